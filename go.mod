@@ -4,6 +4,8 @@ go 1.20
 
 require (
 	github.com/google/go-containerregistry v0.20.0
+	go.etcd.io/bbolt v1.3.8
+	gopkg.in/yaml.v2 v2.4.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
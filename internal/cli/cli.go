@@ -0,0 +1,8 @@
+// Package cli hands the command line of helm-image-scanner from package
+// scanner, which implements it, to the command, without making it part
+// of scanner's API.
+package cli
+
+// Main runs the command line. Package scanner sets it when it is
+// initialized.
+var Main func()
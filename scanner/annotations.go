@@ -0,0 +1,100 @@
+package scanner
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"gopkg.in/yaml.v3"
+)
+
+// artifactHubImages is the Chart.yaml annotation in which chart authors
+// list the images a chart uses, for Artifact Hub to show and scan.
+const artifactHubImages = "artifacthub.io/images"
+
+// DeclaredImage is one entry of an artifacthub.io/images annotation.
+type DeclaredImage struct {
+	// Chart is the chart whose Chart.yaml declares the image.
+	Chart string `json:"chart"`
+	Name  string `json:"name,omitempty"`
+	Image string `json:"image"`
+}
+
+// DeclaredImagesReport cross-checks the images the charts declare in
+// their artifacthub.io/images annotations with those the scan found.
+type DeclaredImagesReport struct {
+	Declared []DeclaredImage `json:"declared"`
+	// Undeclared are images the scan found that no annotation lists.
+	Undeclared []string `json:"undeclared,omitempty"`
+	// Stale are declared images the scan did not find, typically left
+	// behind when a tag in values was bumped.
+	Stale []DeclaredImage `json:"stale,omitempty"`
+	// Errors lists annotations that could not be parsed.
+	Errors     []string `json:"errors,omitempty"`
+	Consistent bool     `json:"consistent"`
+}
+
+// declaredImagesReport compares the annotations of charts with refs, the
+// images found in the chart. References are compared in their canonical
+// form, so nginx:1.25 matches docker.io/library/nginx:1.25. It returns nil
+// when no chart has the annotation.
+func declaredImagesReport(charts []*helmChart, refs []string) *DeclaredImagesReport {
+	report := &DeclaredImagesReport{Declared: []DeclaredImage{}}
+	annotated := false
+	for _, c := range charts {
+		raw, ok := c.meta.Annotations[artifactHubImages]
+		if !ok {
+			continue
+		}
+		annotated = true
+		var entries []struct {
+			Name  string `yaml:"name"`
+			Image string `yaml:"image"`
+		}
+		if err := yaml.Unmarshal([]byte(raw), &entries); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s: %v", c.meta.Name, artifactHubImages, err))
+			continue
+		}
+		for _, e := range entries {
+			if e.Image == "" {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %s: entry %q has no image", c.meta.Name, artifactHubImages, e.Name))
+				continue
+			}
+			report.Declared = append(report.Declared, DeclaredImage{Chart: c.meta.Name, Name: e.Name, Image: e.Image})
+		}
+	}
+	if !annotated {
+		return nil
+	}
+
+	found := make(map[string]bool, len(refs))
+	for _, ref := range refs {
+		found[canonicalRef(ref)] = true
+	}
+	declared := make(map[string]bool, len(report.Declared))
+	for _, d := range report.Declared {
+		key := canonicalRef(d.Image)
+		declared[key] = true
+		if !found[key] {
+			report.Stale = append(report.Stale, d)
+		}
+	}
+	for _, ref := range refs {
+		if !declared[canonicalRef(ref)] {
+			report.Undeclared = append(report.Undeclared, ref)
+		}
+	}
+	sort.Strings(report.Undeclared)
+	report.Consistent = len(report.Undeclared) == 0 && len(report.Stale) == 0 && len(report.Errors) == 0
+	return report
+}
+
+// canonicalRef returns ref with the registry, namespace and tag Docker
+// would assume, or ref itself when it does not parse.
+func canonicalRef(ref string) string {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return ref
+	}
+	return r.Name()
+}
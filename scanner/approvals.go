@@ -0,0 +1,243 @@
+package scanner
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Approval marks a stored scan as approved for a release.
+type Approval struct {
+	ScanID    string    `json:"scan_id"`
+	ChartURL  string    `json:"chart_url"`
+	ScannedAt time.Time `json:"scanned_at"`
+	Release   string    `json:"release"`
+	Reviewer  string    `json:"reviewer"`
+	Comment   string    `json:"comment,omitempty"`
+	// ApprovedAt is when the approval was recorded.
+	ApprovedAt time.Time `json:"approved_at"`
+	// URL is the stored result of the scan.
+	URL string `json:"url,omitempty"`
+}
+
+// approvalLog holds the approvals of stored scans. Like the crawl state it
+// is kept in memory and, when a path is configured, appended to a
+// JSON-lines file that is replayed on startup.
+type approvalLog struct {
+	mu   sync.Mutex
+	list []Approval
+	file *os.File
+}
+
+func openApprovalLog(path string) (*approvalLog, error) {
+	a := &approvalLog{}
+	if path == "" {
+		return a, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening approvals file: %w", err)
+	}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var ap Approval
+		if err := json.Unmarshal(sc.Bytes(), &ap); err != nil || ap.ScanID == "" {
+			continue
+		}
+		a.list = append(a.list, ap)
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading approvals file: %w", err)
+	}
+	a.file = f
+	return a, nil
+}
+
+func (a *approvalLog) record(ap Approval) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		b, _ := json.Marshal(ap)
+		if _, err := a.file.Write(append(b, '\n')); err != nil {
+			return fmt.Errorf("writing approval: %w", err)
+		}
+	}
+	a.list = append(a.list, ap)
+	return nil
+}
+
+// forScan returns the approvals of one scan, oldest first.
+func (a *approvalLog) forScan(id string) []Approval {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := []Approval{}
+	for _, ap := range a.list {
+		if ap.ScanID == id {
+			out = append(out, ap)
+		}
+	}
+	return out
+}
+
+// latest returns, per chart and release, the approval of the most recent
+// scan, optionally restricted to one chart and one release. Two approvals
+// of scans taken at the same time are told apart by when they were given.
+func (a *approvalLog) latest(chartURL, release string) []Approval {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	type key struct{ chart, release string }
+	best := make(map[key]Approval)
+	for _, ap := range a.list {
+		if (chartURL != "" && ap.ChartURL != chartURL) || (release != "" && ap.Release != release) {
+			continue
+		}
+		k := key{ap.ChartURL, ap.Release}
+		cur, ok := best[k]
+		if !ok || ap.ScannedAt.After(cur.ScannedAt) || (ap.ScannedAt.Equal(cur.ScannedAt) && !ap.ApprovedAt.Before(cur.ApprovedAt)) {
+			best[k] = ap
+		}
+	}
+	out := make([]Approval, 0, len(best))
+	for _, ap := range best {
+		out = append(out, ap)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].ChartURL != out[j].ChartURL {
+			return out[i].ChartURL < out[j].ChartURL
+		}
+		return out[i].Release < out[j].Release
+	})
+	return out
+}
+
+// has reports whether ap was recorded already.
+func (a *approvalLog) has(ap Approval) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, x := range a.list {
+		if x.ScanID == ap.ScanID && x.Release == ap.Release && x.Reviewer == ap.Reviewer && x.ApprovedAt.Equal(ap.ApprovedAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// all returns every approval, for backups.
+func (a *approvalLog) all() []Approval {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]Approval(nil), a.list...)
+}
+
+func (a *approvalLog) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+type approvalRequest struct {
+	Release  string `json:"release"`
+	Reviewer string `json:"reviewer"`
+	Comment  string `json:"comment"`
+}
+
+type approvalsResponse struct {
+	Approvals []Approval `json:"approvals"`
+}
+
+// scanApprovalsHandler serves /results/<id>/approvals: GET lists the
+// approvals of the stored scan, POST approves it for a release.
+func (s *server) scanApprovalsHandler(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case http.MethodGet, http.MethodPost:
+	default:
+		http.Error(w, "only GET and POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Method == http.MethodPost && !s.adminAuthorized(w, r) {
+		return
+	}
+	result, err := s.store.Get(r.Context(), id)
+	if errors.Is(err, ErrNotStored) {
+		jsonError(w, http.StatusNotFound, fmt.Sprintf("no stored result %q", id))
+		return
+	}
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if r.Method == http.MethodGet {
+		resp := approvalsResponse{Approvals: s.approvals.forScan(id)}
+		for i := range resp.Approvals {
+			resp.Approvals[i].URL = s.externalURL(r, "/results/"+id)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	var req approvalRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	req.Release, req.Reviewer = strings.TrimSpace(req.Release), strings.TrimSpace(req.Reviewer)
+	if req.Release == "" || req.Reviewer == "" {
+		jsonError(w, http.StatusBadRequest, "release and reviewer are required")
+		return
+	}
+	ap := Approval{
+		ScanID:     id,
+		ChartURL:   result.ChartURL,
+		ScannedAt:  result.ScannedAt,
+		Release:    req.Release,
+		Reviewer:   req.Reviewer,
+		Comment:    req.Comment,
+		ApprovedAt: time.Now().UTC(),
+	}
+	if err := s.approvals.record(ap); err != nil {
+		log.Printf("error: %v", err)
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	details := map[string]string{"chart_url": ap.ChartURL, "release": ap.Release}
+	if ap.Comment != "" {
+		details["comment"] = ap.Comment
+	}
+	if err := s.audit.record(auditApproval, ap.Reviewer, id, details); err != nil {
+		log.Printf("error: %v", err)
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("scan %s of %s approved for %s by %s", id, ap.ChartURL, ap.Release, ap.Reviewer)
+	ap.URL = s.externalURL(r, "/results/"+id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ap)
+}
+
+// approvalsHandler serves GET /approvals, the approval of the most recent
+// scan of every chart and release, filtered by ?chart_url= and ?release=.
+func (s *server) approvalsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	resp := approvalsResponse{Approvals: s.approvals.latest(q.Get("chart_url"), q.Get("release"))}
+	for i := range resp.Approvals {
+		resp.Approvals[i].URL = s.externalURL(r, "/results/"+resp.Approvals[i].ScanID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
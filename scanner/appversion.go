@@ -0,0 +1,89 @@
+package scanner
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// AppVersionReport compares the tag of a chart's main image with the
+// appVersion of its Chart.yaml, which packaging often forgets to bump.
+type AppVersionReport struct {
+	Chart      string `json:"chart"`
+	AppVersion string `json:"app_version"`
+	// Image is the main image: the one set by the chart's top-level image
+	// value or, without one, the image named after the chart.
+	Image   string `json:"image"`
+	Tag     string `json:"tag"`
+	Matches bool   `json:"matches"`
+}
+
+// appVersionReport checks the root chart, the first of charts. It returns
+// nil when the chart has no appVersion or no main image with a tag.
+func appVersionReport(charts []*helmChart, refs []string, prov map[string]*ImageProvenance) *AppVersionReport {
+	if len(charts) == 0 || charts[0].meta.AppVersion == "" {
+		return nil
+	}
+	root := charts[0]
+	values := path.Join(root.dir, "values.yaml")
+	var byValue, byName []string
+	for _, ref := range refs {
+		if p := prov[ref]; p != nil {
+			for _, o := range p.Origins {
+				if o.Source == originValues && o.File == values && o.Path == "image" {
+					byValue = append(byValue, ref)
+					break
+				}
+			}
+		}
+		if repo, _, ok := refRepoTag(ref); ok && path.Base(repo) == root.meta.Name {
+			byName = append(byName, ref)
+		}
+	}
+	main := byValue
+	if len(main) == 0 {
+		main = byName
+	}
+	sort.Strings(main)
+	for _, ref := range main {
+		_, tag, ok := refRepoTag(ref)
+		if !ok || tag == "" {
+			continue
+		}
+		return &AppVersionReport{
+			Chart:      root.meta.Name,
+			AppVersion: root.meta.AppVersion,
+			Image:      ref,
+			Tag:        tag,
+			Matches:    tagMatchesVersion(tag, root.meta.AppVersion),
+		}
+	}
+	return nil
+}
+
+// refRepoTag splits an image reference into its repository and the tag it
+// names, which is empty for a reference by digest only.
+func refRepoTag(ref string) (repo, tag string, ok bool) {
+	ref, _, _ = strings.Cut(ref, "@")
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		ref, tag = ref[:i], ref[i+1:]
+	}
+	if _, err := name.NewRepository(ref); err != nil {
+		return "", "", false
+	}
+	return ref, tag, true
+}
+
+// tagMatchesVersion reports whether tag is version, ignoring a leading v,
+// or version followed by a build or variant suffix, as 1.25.3-alpine is for
+// 1.25.3.
+func tagMatchesVersion(tag, version string) bool {
+	tag, version = strings.TrimPrefix(tag, "v"), strings.TrimPrefix(version, "v")
+	if tag == version {
+		return true
+	}
+	rest, ok := strings.CutPrefix(tag, version)
+	return ok && rest != "" && strings.ContainsRune("-+_", rune(rest[0]))
+}
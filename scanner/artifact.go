@@ -0,0 +1,119 @@
+package scanner
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Kinds of registry content an image reference can point at. Only
+// kindImage is runnable; the others are reported with their blob sizes
+// but without image-specific details. kindImage is empty, so that image
+// entries carry no kind and keep the shape they had before artifacts
+// were reported.
+const (
+	kindImage       = ""
+	kindHelmChart   = "helm_chart"
+	kindWasm        = "wasm"
+	kindSignature   = "signature"
+	kindAttestation = "attestation"
+	kindSBOM        = "sbom"
+	kindArtifact    = "artifact"
+)
+
+// artifactManifest is the subset of an OCI manifest needed to classify it.
+// v1.Manifest does not carry artifactType.
+type artifactManifest struct {
+	MediaType    types.MediaType `json:"mediaType"`
+	ArtifactType string          `json:"artifactType"`
+	Config       v1.Descriptor   `json:"config"`
+	Layers       []v1.Descriptor `json:"layers"`
+}
+
+// classifyManifest decides what a manifest describes. Indexes are treated
+// as images, since their platform manifests are inspected instead. For
+// others it returns the artifact type: the manifest's artifactType, or
+// the config media type when that is not an image config.
+func classifyManifest(mt types.MediaType, raw []byte) (kind, artifactType string) {
+	if mt.IsIndex() {
+		return kindImage, ""
+	}
+	var m artifactManifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return kindImage, ""
+	}
+	artifactType = m.ArtifactType
+	if artifactType == "" && !m.Config.MediaType.IsConfig() {
+		artifactType = string(m.Config.MediaType)
+	}
+	if artifactType == "" && hasFilesystemLayer(m.Layers) {
+		return kindImage, ""
+	}
+	// What is left is either a declared artifact or an image-shaped
+	// manifest whose layers are not filesystems, as used for signatures
+	// and attestations.
+	probe := strings.ToLower(artifactType)
+	for _, l := range m.Layers {
+		probe += " " + strings.ToLower(string(l.MediaType))
+	}
+	switch {
+	case strings.Contains(probe, "helm"):
+		return kindHelmChart, artifactType
+	case strings.Contains(probe, "wasm"):
+		return kindWasm, artifactType
+	case strings.Contains(probe, "in-toto"), strings.Contains(probe, "dsse"), strings.Contains(probe, "attestation"):
+		return kindAttestation, artifactType
+	case strings.Contains(probe, "spdx"), strings.Contains(probe, "cyclonedx"), strings.Contains(probe, "sbom"):
+		return kindSBOM, artifactType
+	case strings.Contains(probe, "cosign"), strings.Contains(probe, "signature"), strings.Contains(probe, "notary"):
+		return kindSignature, artifactType
+	case artifactType == "" && len(m.Layers) == 0:
+		return kindImage, ""
+	}
+	return kindArtifact, artifactType
+}
+
+// hasFilesystemLayer reports whether any layer is a tar archive, i.e. a
+// container filesystem layer.
+func hasFilesystemLayer(layers []v1.Descriptor) bool {
+	for _, l := range layers {
+		if strings.Contains(string(l.MediaType), "tar") {
+			return true
+		}
+	}
+	return false
+}
+
+// artifactInfo reports a non-image manifest: the blobs it references and
+// their media types. Its layers have no uncompressed size, which is left
+// zero.
+func artifactInfo(ref, digest string, mt types.MediaType, raw []byte, kind, artifactType string) (ImageInfo, error) {
+	var m artifactManifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return ImageInfo{Image: ref}, fmt.Errorf("parsing the manifest of %s: %w", ref, err)
+	}
+	info := ImageInfo{
+		Image:        ref,
+		Digest:       digest,
+		Pinned:       isDigestPinned(ref),
+		Kind:         kind,
+		ArtifactType: artifactType,
+		MediaType:    string(mt),
+		NumLayers:    len(m.Layers),
+		SizeBytes:    m.Config.Size,
+		Layers:       make([]LayerInfo, 0, len(m.Layers)),
+	}
+	for _, l := range m.Layers {
+		info.Layers = append(info.Layers, LayerInfo{
+			Digest:      l.Digest.String(),
+			MediaType:   string(l.MediaType),
+			SizeBytes:   l.Size,
+			Compression: layerCompression(l.MediaType),
+		})
+		info.SizeBytes += l.Size
+	}
+	return info, nil
+}
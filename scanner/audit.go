@@ -0,0 +1,367 @@
+package scanner
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions of the audit log.
+const (
+	auditApproval    = "approval"
+	auditPolicy      = "policy"
+	auditCredentials = "credentials"
+	auditRestore     = "restore"
+	// auditChartDefaults records the options stored for a chart, which
+	// may enable policies.
+	auditChartDefaults = "chart_defaults"
+)
+
+// AuditEvent is one entry of the audit log. Hash covers every other field
+// but the signature, PrevHash included, so that changing or dropping an
+// entry breaks the chain of every entry after it.
+type AuditEvent struct {
+	Seq    int       `json:"seq"`
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Actor  string    `json:"actor"`
+	// Subject is what the event is about, such as the id of an approved
+	// scan.
+	Subject string            `json:"subject,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+	// Changed names the details of a policy or credentials event that
+	// differ from the previous one.
+	Changed  []string `json:"changed,omitempty"`
+	PrevHash string   `json:"prev_hash"`
+	Hash     string   `json:"hash"`
+	// Signature is an HMAC-SHA256 of Hash with the key KeyID of the
+	// -secrets-key-file, empty without one.
+	KeyID     string `json:"key_id,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// hashEvent returns the hash of e, leaving out its hash and signature.
+func hashEvent(e AuditEvent) string {
+	e.Hash, e.KeyID, e.Signature = "", "", ""
+	b, _ := json.Marshal(e)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditKey derives the signing key of the audit log from a key of the key
+// file, so that the key that encrypts credentials signs nothing.
+func auditKey(key []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("helm-image-scanner audit log"))
+	return m.Sum(nil)
+}
+
+func signHash(key []byte, hash string) string {
+	m := hmac.New(sha256.New, auditKey(key))
+	m.Write([]byte(hash))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// auditLog is an append-only, hash-chained log of approvals, policy and
+// credential changes. It is kept in memory and, when a path is configured,
+// appended to a JSON-lines file that is verified and replayed on startup.
+type auditLog struct {
+	mu     sync.Mutex
+	events []AuditEvent
+	keys   *keyRing
+	file   *os.File
+	// torn is the size of a partial last entry dropped on opening.
+	torn int
+}
+
+// openAuditLog reads, verifies and opens the log at path for appending. A
+// final line without its newline is what a crash during a write leaves:
+// it is kept when it parses and otherwise cut off, with a warning, and
+// counted in the verification.
+func openAuditLog(path string, keys *keyRing) (*auditLog, error) {
+	a := &auditLog{keys: keys}
+	if path == "" {
+		return a, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit file: %w", err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading audit file: %w", err)
+	}
+	for n, rest := 1, data; len(rest) > 0; n++ {
+		line, next, complete := bytes.Cut(rest, []byte("\n"))
+		var e AuditEvent
+		err := json.Unmarshal(line, &e)
+		if !complete {
+			err = a.repairTail(f, int64(len(data)-len(rest)), line, err)
+			if err == nil && a.torn > 0 {
+				log.Printf("warning: audit file %s, line %d: dropped %d bytes of an entry cut short", path, n, a.torn)
+				break
+			}
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("audit file %s, line %d: %v", path, n, err)
+		}
+		a.events = append(a.events, e)
+		rest = next
+	}
+	if v := a.verify(); !v.Valid {
+		f.Close()
+		return nil, fmt.Errorf("audit file %s fails verification: %s", path, v.Error)
+	}
+	a.file = f
+	return a, nil
+}
+
+// repairTail mends the final line of the audit file, starting at offset
+// and lacking its newline, that failed to parse with parseErr: one that
+// parses gets its newline, and one that does not is truncated away.
+func (a *auditLog) repairTail(f *os.File, offset int64, line []byte, parseErr error) error {
+	if parseErr == nil {
+		if _, err := f.Write([]byte("\n")); err != nil {
+			return fmt.Errorf("ending the last audit entry: %w", err)
+		}
+		return nil
+	}
+	if err := f.Truncate(offset); err != nil {
+		return fmt.Errorf("truncating a partial audit entry: %w", err)
+	}
+	a.torn = len(line)
+	return nil
+}
+
+func (a *auditLog) record(action, actor, subject string, details map[string]string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.appendEvent(AuditEvent{Action: action, Actor: actor, Subject: subject, Details: details})
+}
+
+// recordIfChanged records an event only when details differ from those of
+// the last event of the action, for state that is compared on startup.
+func (a *auditLog) recordIfChanged(action, actor string, details map[string]string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e := AuditEvent{Action: action, Actor: actor, Details: details}
+	if prev := a.lastOf(action); prev != nil {
+		if e.Changed = changedDetails(prev.Details, details); len(e.Changed) == 0 {
+			return nil
+		}
+	}
+	return a.appendEvent(e)
+}
+
+// appendEvent chains and signs e and appends it, with a.mu held. The entry
+// is written before it is kept, so that the chain in memory never runs
+// ahead of the file.
+func (a *auditLog) appendEvent(e AuditEvent) error {
+	e.Seq, e.Time = len(a.events)+1, time.Now().UTC()
+	if n := len(a.events); n > 0 {
+		e.PrevHash = a.events[n-1].Hash
+	}
+	e.Hash = hashEvent(e)
+	if a.keys != nil {
+		e.KeyID = a.keys.ids[0]
+		e.Signature = signHash(a.keys.keys[e.KeyID], e.Hash)
+	}
+	if a.file != nil {
+		b, _ := json.Marshal(e)
+		if _, err := a.file.Write(append(b, '\n')); err != nil {
+			return fmt.Errorf("writing audit event: %w", err)
+		}
+	}
+	a.events = append(a.events, e)
+	return nil
+}
+
+func (a *auditLog) lastOf(action string) *AuditEvent {
+	for i := len(a.events) - 1; i >= 0; i-- {
+		if a.events[i].Action == action {
+			return &a.events[i]
+		}
+	}
+	return nil
+}
+
+func changedDetails(before, after map[string]string) []string {
+	var changed []string
+	for k, v := range after {
+		if old, ok := before[k]; !ok || old != v {
+			changed = append(changed, k)
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// AuditVerification is the outcome of checking the chain and signatures of
+// the audit log.
+type AuditVerification struct {
+	Valid bool `json:"valid"`
+	// Error describes the first entry that fails.
+	Error string `json:"error,omitempty"`
+	// Unsigned and UnknownKeys count the entries whose signature could not
+	// be checked: unsigned ones when there is no key file, or signed with
+	// a key no longer in it. With a key file an unsigned entry fails, as
+	// its signature may have been stripped.
+	Unsigned    int `json:"unsigned,omitempty"`
+	UnknownKeys int `json:"unknown_keys,omitempty"`
+	// TornBytes is the size of a partial last entry, left by a crash
+	// while it was written, that was dropped when the file was opened.
+	TornBytes int `json:"torn_bytes,omitempty"`
+}
+
+func (a *auditLog) verify() AuditVerification {
+	v := AuditVerification{Valid: true, TornBytes: a.torn}
+	prev := ""
+	for i, e := range a.events {
+		fail := ""
+		switch {
+		case e.Seq != i+1:
+			fail = fmt.Sprintf("entry %d has seq %d", i+1, e.Seq)
+		case e.PrevHash != prev:
+			fail = fmt.Sprintf("entry %d does not follow entry %d", e.Seq, e.Seq-1)
+		case hashEvent(e) != e.Hash:
+			fail = fmt.Sprintf("entry %d does not match its hash", e.Seq)
+		}
+		if fail == "" {
+			switch key, ok := a.keys.lookup(e.KeyID); {
+			case e.Signature == "" && a.keys != nil:
+				fail = fmt.Sprintf("entry %d is not signed", e.Seq)
+			case e.Signature == "":
+				v.Unsigned++
+			case !ok:
+				v.UnknownKeys++
+			case !hmac.Equal([]byte(signHash(key, e.Hash)), []byte(e.Signature)):
+				fail = fmt.Sprintf("entry %d has a bad signature", e.Seq)
+			}
+		}
+		if fail != "" {
+			v.Valid, v.Error = false, fail
+			return v
+		}
+		prev = e.Hash
+	}
+	return v
+}
+
+func (a *auditLog) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// lookup returns the key named id of a key ring, which may be nil.
+func (kr *keyRing) lookup(id string) ([]byte, bool) {
+	if kr == nil {
+		return nil, false
+	}
+	key, ok := kr.keys[id]
+	return key, ok
+}
+
+// fileDigest identifies the content of a file, empty when it is missing.
+func fileDigest(path string) string {
+	if path == "" {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// auditStartup records the policy settings and credentials the server
+// starts with when they differ from those it last started with. Files are
+// recorded by digest, never by content.
+func (s *server) auditStartup(keys *keyRing) error {
+	policy := map[string]string{
+		"require_digest":        strconv.FormatBool(s.cfg.RequireDigest),
+		"no_hardcoded_images":   strconv.FormatBool(s.cfg.NoHardcodedImages),
+		"trusted_docker_hub":    strconv.FormatBool(s.cfg.TrustedDockerHub),
+		"docker_hub_badges":     strings.Join(s.cfg.DockerHubTrustedBadges, ","),
+		"docker_hub_namespaces": strings.Join(s.cfg.DockerHubTrustedNamespaces, ","),
+		"platforms":             strings.Join(s.cfg.Platforms, ","),
+		"profiles":              fileDigest(s.cfg.ProfilesFile),
+	}
+	if err := s.audit.recordIfChanged(auditPolicy, "startup", policy); err != nil {
+		return err
+	}
+	creds := map[string]string{
+		"helm_registry_config": fileDigest(s.cfg.HelmRegistryConfig),
+		"helm_repositories":    fileDigest(s.cfg.HelmRepositories),
+		"kubeconfig":           fileDigest(s.cfg.Kubeconfig),
+		"admin_token":          strconv.FormatBool(s.cfg.AdminToken != ""),
+		"api_keys":             fileDigest(s.cfg.APIKeysFile),
+		"oidc_issuer":          s.cfg.OIDCIssuer,
+	}
+	if keys != nil {
+		creds["secrets_keys"] = strings.Join(keys.ids, ",")
+	}
+	return s.audit.recordIfChanged(auditCredentials, "startup", creds)
+}
+
+type auditResponse struct {
+	Events       []AuditEvent      `json:"events"`
+	Verification AuditVerification `json:"verification"`
+	// Head is the hash of the last entry, to be kept elsewhere and
+	// compared on the next read.
+	Head string `json:"head,omitempty"`
+}
+
+// auditHandler serves GET /admin/audit, the audit log after ?since=<seq>
+// with the verification of the whole chain.
+func (s *server) auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	since := 0
+	if v := r.URL.Query().Get("since"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			jsonError(w, http.StatusBadRequest, "since must be a non-negative integer")
+			return
+		}
+		since = n
+	}
+	a := s.audit
+	a.mu.Lock()
+	resp := auditResponse{Events: []AuditEvent{}, Verification: a.verify()}
+	if n := len(a.events); n > 0 {
+		resp.Head = a.events[n-1].Hash
+		if since < n {
+			resp.Events = append(resp.Events, a.events[since:]...)
+		}
+	}
+	a.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,171 @@
+package scanner
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKeyRing() *keyRing {
+	return &keyRing{ids: []string{"k2", "k1"}, keys: map[string][]byte{
+		"k2": bytes.Repeat([]byte{2}, 32),
+		"k1": bytes.Repeat([]byte{1}, 32),
+	}}
+}
+
+// writeAuditLog records three approvals in a new audit file and returns
+// its lines.
+func writeAuditLog(t *testing.T, path string, keys *keyRing) [][]byte {
+	t.Helper()
+	a, err := openAuditLog(path, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"scan-1", "scan-2", "scan-3"} {
+		if err := a.record(auditApproval, "jane", id, map[string]string{"release": "2024.06"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Close()
+	data, _ := os.ReadFile(path)
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	return lines[:len(lines)-1]
+}
+
+// editEntry rewrites one JSON line of the audit file with change.
+func editEntry(t *testing.T, line []byte, change func(*AuditEvent)) []byte {
+	t.Helper()
+	var e AuditEvent
+	if err := json.Unmarshal(line, &e); err != nil {
+		t.Fatal(err)
+	}
+	change(&e)
+	b, _ := json.Marshal(e)
+	return append(b, '\n')
+}
+
+func TestAuditLogVerification(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// keys sign the log and verify it, unless a key file is added
+		// before it is read again.
+		keys    *keyRing
+		addKeys bool
+		edit    func(lines [][]byte) [][]byte
+		wantErr string
+	}{
+		{"untouched", testKeyRing(), false, nil, ""},
+		{"untouched without keys", nil, false, nil, ""},
+		{"details changed", testKeyRing(), false, func(l [][]byte) [][]byte {
+			l[1] = editEntry(t, l[1], func(e *AuditEvent) { e.Details["release"] = "2025.01" })
+			return l
+		}, "entry 2 does not match its hash"},
+		{"details changed and rehashed", testKeyRing(), false, func(l [][]byte) [][]byte {
+			l[1] = editEntry(t, l[1], func(e *AuditEvent) { e.Subject = "scan-9"; e.Hash = hashEvent(*e) })
+			return l
+		}, "entry 2 has a bad signature"},
+		{"signature stripped", testKeyRing(), false, func(l [][]byte) [][]byte {
+			l[2] = editEntry(t, l[2], func(e *AuditEvent) { e.KeyID, e.Signature = "", "" })
+			return l
+		}, "entry 3 is not signed"},
+		{"signature replaced", testKeyRing(), false, func(l [][]byte) [][]byte {
+			l[0] = editEntry(t, l[0], func(e *AuditEvent) { e.Signature = strings.Repeat("0", 64) })
+			return l
+		}, "entry 1 has a bad signature"},
+		{"entry removed", testKeyRing(), false, func(l [][]byte) [][]byte {
+			return append(l[:1], l[2:]...)
+		}, "entry 2 has seq 3"},
+		{"entries swapped", testKeyRing(), false, func(l [][]byte) [][]byte {
+			l[1], l[2] = l[2], l[1]
+			return l
+		}, "entry 2 has seq 3"},
+		{"entry removed and renumbered", nil, false, func(l [][]byte) [][]byte {
+			l[2] = editEntry(t, l[2], func(e *AuditEvent) { e.Seq = 2; e.Hash = hashEvent(*e) })
+			return append(l[:1], l[2])
+		}, "entry 2 does not follow entry 1"},
+		{"key file added to an unsigned log", nil, true, nil, "entry 1 is not signed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.jsonl")
+			lines := writeAuditLog(t, path, tc.keys)
+			if tc.edit != nil {
+				lines = tc.edit(lines)
+			}
+			if err := os.WriteFile(path, bytes.Join(lines, nil), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			keys := tc.keys
+			if tc.addKeys {
+				keys = testKeyRing()
+			}
+			a, err := openAuditLog(path, keys)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer a.Close()
+				if v := a.verify(); !v.Valid || len(a.events) != 3 {
+					t.Errorf("verification %+v of %d entries", v, len(a.events))
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("error %v, want one containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuditLogTornTail(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		tail      func(last []byte) []byte
+		wantTorn  bool
+		wantLines int
+	}{
+		{"cut inside the entry", func(last []byte) []byte { return last[:len(last)/2] }, true, 2},
+		{"only the newline missing", func(last []byte) []byte { return bytes.TrimSuffix(last, []byte("\n")) }, false, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.jsonl")
+			lines := writeAuditLog(t, path, testKeyRing())
+			lines[2] = tc.tail(lines[2])
+			os.WriteFile(path, bytes.Join(lines, nil), 0o600)
+
+			a, err := openAuditLog(path, testKeyRing())
+			if err != nil {
+				t.Fatal(err)
+			}
+			v := a.verify()
+			if !v.Valid || len(a.events) != tc.wantLines || (v.TornBytes > 0) != tc.wantTorn {
+				t.Errorf("verification %+v of %d entries", v, len(a.events))
+			}
+			// The next entry starts a line of its own and chains on.
+			if err := a.record(auditApproval, "jane", "scan-4", nil); err != nil {
+				t.Fatal(err)
+			}
+			a.Close()
+			a, err = openAuditLog(path, testKeyRing())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer a.Close()
+			if v := a.verify(); !v.Valid || v.TornBytes != 0 || len(a.events) != tc.wantLines+1 {
+				t.Errorf("after appending: verification %+v of %d entries", v, len(a.events))
+			}
+		})
+	}
+}
+
+func TestAuditLogRejectsACorruptLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	lines := writeAuditLog(t, path, nil)
+	lines[1] = []byte("{not json\n")
+	os.WriteFile(path, bytes.Join(lines, nil), 0o600)
+	if _, err := openAuditLog(path, nil); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("error %v, want one for line 2", err)
+	}
+}
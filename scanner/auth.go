@@ -0,0 +1,173 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Principal is the authenticated caller of an API request.
+type Principal struct {
+	Subject string `json:"subject"`
+	// Method names the authenticator that vouched for the caller, such
+	// as api-key or oidc.
+	Method string `json:"method"`
+}
+
+// Authenticator identifies the caller of an API request. It returns no
+// principal and no error for a request without its kind of credentials,
+// leaving it to the next authenticator, and an error for credentials it
+// rejects. Implementations must be safe for concurrent use.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// authenticators are tried in order; the first principal wins. An empty
+// list leaves the API open.
+type authenticators []Authenticator
+
+var errNoCredentials = errors.New("missing or unknown credentials")
+
+func (a authenticators) authenticate(r *http.Request) (*Principal, error) {
+	for _, auth := range a {
+		p, err := auth.Authenticate(r)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			return p, nil
+		}
+	}
+	return nil, errNoCredentials
+}
+
+// openAuthenticators builds the authenticators of the configuration: the
+// admin token, API keys, OIDC tokens and then cfg.Authenticators, in that
+// order. The API is only closed when any but the admin token are
+// configured; the admin token alone guards just the /admin endpoints.
+func openAuthenticators(cfg Config) (authenticators, error) {
+	var auth authenticators
+	if cfg.APIKeysFile != "" {
+		keys, err := loadAPIKeys(cfg.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, keys)
+	}
+	if cfg.OIDCIssuer != "" {
+		auth = append(auth, newOIDCAuth(cfg.OIDCIssuer, cfg.OIDCAudience))
+	}
+	auth = append(auth, cfg.Authenticators...)
+	if len(auth) > 0 && cfg.AdminToken != "" {
+		auth = append(authenticators{adminTokenAuth(cfg.AdminToken)}, auth...)
+	}
+	return auth, nil
+}
+
+type principalKey struct{}
+
+// withAuth rejects requests none of auth vouches for with 401, and hands
+// the principal of the others to the handlers.
+func withAuth(auth authenticators, h http.Handler) http.Handler {
+	if len(auth) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := auth.authenticate(r)
+		if err != nil {
+			log.Printf("warning: rejected %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			jsonError(w, http.StatusUnauthorized, "unauthenticated: "+err.Error())
+			return
+		}
+		log.Printf("debug: %s %s by %s (%s)", r.Method, r.URL.Path, p.Subject, p.Method)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// principalFrom returns the caller of a request, nil when the API is open.
+func principalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+func bearerToken(r *http.Request) string {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return strings.TrimSpace(token)
+}
+
+// adminTokenAuth accepts the -admin-token as a bearer token.
+type adminTokenAuth string
+
+func (a adminTokenAuth) Authenticate(r *http.Request) (*Principal, error) {
+	token := bearerToken(r)
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a)) != 1 {
+		return nil, nil
+	}
+	return &Principal{Subject: "admin", Method: "admin-token"}, nil
+}
+
+// apiKeys accepts the keys of the -api-keys-file, given in an X-API-Key
+// header or as a bearer token. They map keys to the names of their
+// holders.
+type apiKeys map[string]string
+
+// loadAPIKeys reads a file of "<name> <key>" lines; blank lines and lines
+// starting with # are skipped.
+func loadAPIKeys(file string) (apiKeys, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("opening API keys: %w", err)
+	}
+	defer f.Close()
+	keys := make(apiKeys)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want <name> <key>", file, n)
+		}
+		if _, dup := keys[fields[1]]; dup {
+			return nil, fmt.Errorf("%s:%d: key of %s is used twice", file, n, fields[0])
+		}
+		keys[fields[1]] = fields[0]
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading API keys: %w", err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s holds no API keys", file)
+	}
+	return keys, nil
+}
+
+func (keys apiKeys) Authenticate(r *http.Request) (*Principal, error) {
+	key := strings.TrimSpace(r.Header.Get("X-API-Key"))
+	header := key != ""
+	if !header {
+		key = bearerToken(r)
+	}
+	if key == "" {
+		return nil, nil
+	}
+	for k, name := range keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			return &Principal{Subject: name, Method: "api-key"}, nil
+		}
+	}
+	if header {
+		return nil, errors.New("unknown API key")
+	}
+	// A bearer token may be meant for another authenticator.
+	return nil, nil
+}
@@ -0,0 +1,109 @@
+package scanner
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// headerAuth vouches for the user an authenticating proxy names in a
+// header, and rejects the blocked one.
+type headerAuth struct{}
+
+func (headerAuth) Authenticate(r *http.Request) (*Principal, error) {
+	switch user := r.Header.Get("X-Forwarded-User"); user {
+	case "":
+		return nil, nil
+	case "mallory":
+		return nil, errors.New("blocked user")
+	default:
+		return &Principal{Subject: user, Method: "proxy"}, nil
+	}
+}
+
+func TestAuthenticators(t *testing.T) {
+	keys := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(keys, []byte("# CI\nci ci-key\n\nops ops-key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{APIKeysFile: keys, AdminToken: "admin-secret", Authenticators: []Authenticator{headerAuth{}}}
+	auth, err := openAuthenticators(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := withAuth(auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := principalFrom(r.Context())
+		w.Write([]byte(p.Method + ":" + p.Subject))
+	}))
+	for _, tc := range []struct {
+		name     string
+		header   string
+		value    string
+		wantCode int
+		wantBody string
+	}{
+		{"no credentials", "", "", http.StatusUnauthorized, ""},
+		{"API key header", "X-API-Key", "ci-key", http.StatusOK, "api-key:ci"},
+		{"API key as bearer", "Authorization", "Bearer ops-key", http.StatusOK, "api-key:ops"},
+		{"unknown API key header", "X-API-Key", "nope", http.StatusUnauthorized, ""},
+		{"unknown bearer", "Authorization", "Bearer nope", http.StatusUnauthorized, ""},
+		{"admin token", "Authorization", "Bearer admin-secret", http.StatusOK, "admin-token:admin"},
+		{"custom authenticator", "X-Forwarded-User", "alice", http.StatusOK, "proxy:alice"},
+		{"custom rejection", "X-Forwarded-User", "mallory", http.StatusUnauthorized, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/status", nil)
+			if tc.header != "" {
+				r.Header.Set(tc.header, tc.value)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.wantCode {
+				t.Fatalf("status %d, want %d", w.Code, tc.wantCode)
+			}
+			if tc.wantBody != "" && w.Body.String() != tc.wantBody {
+				t.Errorf("caller %q, want %q", w.Body.String(), tc.wantBody)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("no WWW-Authenticate challenge")
+			}
+		})
+	}
+}
+
+func TestAuthenticatorsCloseTheAPI(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+		open bool
+	}{
+		{"nothing configured", Config{}, true},
+		{"admin token alone", Config{AdminToken: "x"}, true},
+		{"custom authenticator", Config{Authenticators: []Authenticator{headerAuth{}}}, false},
+	} {
+		auth, err := openAuthenticators(tc.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if open := len(auth) == 0; open != tc.open {
+			t.Errorf("%s: API open is %t, want %t", tc.name, open, tc.open)
+		}
+	}
+}
+
+func TestLoadAPIKeysRejects(t *testing.T) {
+	for name, content := range map[string]string{
+		"three fields":  "ci key extra\n",
+		"duplicate key": "ci key\nops key\n",
+		"no keys":       "# nothing\n",
+	} {
+		file := filepath.Join(t.TempDir(), "keys")
+		os.WriteFile(file, []byte(content), 0o600)
+		if _, err := loadAPIKeys(file); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+}
@@ -0,0 +1,520 @@
+package scanner
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	backupFormat  = "helm-image-scanner-backup"
+	backupVersion = 1
+	// maxBackupEntry bounds one file of an archive being restored.
+	maxBackupEntry = 64 << 20
+)
+
+// backupManifest is the first entry of a backup archive, backup.json. The
+// other entries are results/<id>.json, one stored scan each,
+// crawl-state.jsonl, approvals.jsonl, chart-defaults.jsonl and
+// profiles.json.
+type backupManifest struct {
+	Format       string    `json:"format"`
+	Version      int       `json:"version"`
+	CreatedAt    time.Time `json:"created_at"`
+	Results      int       `json:"results"`
+	CrawlRecords int       `json:"crawl_records"`
+	Approvals    int       `json:"approvals"`
+	Profiles     int       `json:"profiles"`
+	// ChartDefaults counts the charts with stored options.
+	ChartDefaults int `json:"chart_defaults"`
+	// CrawlRepos and CrawlInterval are the instance's crawl schedule.
+	// They are configuration, so a restore reports them rather than
+	// applying them.
+	CrawlRepos    []string `json:"crawl_repos,omitempty"`
+	CrawlInterval string   `json:"crawl_interval,omitempty"`
+}
+
+// RestoreReport is what a restore brought back.
+type RestoreReport struct {
+	Results      int `json:"results"`
+	CrawlRecords int `json:"crawl_records"`
+	Approvals    int `json:"approvals"`
+	Profiles     int `json:"profiles"`
+	// ChartDefaults counts the charts whose stored options were
+	// restored.
+	ChartDefaults int `json:"chart_defaults"`
+	// ProfilesFile is where the profiles were written; they apply from
+	// the next start.
+	ProfilesFile  string   `json:"profiles_file,omitempty"`
+	CrawlRepos    []string `json:"crawl_repos,omitempty"`
+	CrawlInterval string   `json:"crawl_interval,omitempty"`
+	Warnings      []string `json:"warnings,omitempty"`
+}
+
+// writeBackup writes a gzipped tar archive of the stored scans, the crawl
+// state, the approvals and the profiles to w.
+func (s *server) writeBackup(ctx context.Context, w io.Writer) (backupManifest, error) {
+	var list []StoredScan
+	if s.store != nil {
+		var err error
+		if list, err = s.store.List(ctx, "", 0); err != nil {
+			return backupManifest{}, fmt.Errorf("listing stored results: %w", err)
+		}
+	}
+	records := s.crawls.records()
+	approvals := s.approvals.all()
+	defaults := s.chartDefaults.all()
+	m := backupManifest{
+		Format:       backupFormat,
+		Version:      backupVersion,
+		CreatedAt:    time.Now().UTC(),
+		Results:      len(list),
+		CrawlRecords: len(records),
+		Approvals:    len(approvals),
+		Profiles:     len(s.profiles),
+		CrawlRepos:   s.cfg.CrawlRepos,
+	}
+	m.ChartDefaults = len(defaults)
+	if len(m.CrawlRepos) > 0 {
+		m.CrawlInterval = s.cfg.CrawlInterval.String()
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	add := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), ModTime: m.CreatedAt}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	b, _ := json.MarshalIndent(m, "", "  ")
+	if err := add("backup.json", b); err != nil {
+		return m, err
+	}
+	for _, sc := range list {
+		result, err := s.store.Get(ctx, sc.ID)
+		if errors.Is(err, ErrNotStored) {
+			continue // dropped from the store since it was listed
+		}
+		if err != nil {
+			return m, fmt.Errorf("reading stored result %s: %w", sc.ID, err)
+		}
+		b, err := json.Marshal(result)
+		if err != nil {
+			return m, err
+		}
+		if err := add("results/"+sc.ID+".json", b); err != nil {
+			return m, err
+		}
+	}
+	var lines []byte
+	for _, rec := range records {
+		b, _ := json.Marshal(rec)
+		lines = append(append(lines, b...), '\n')
+	}
+	if err := add("crawl-state.jsonl", lines); err != nil {
+		return m, err
+	}
+	lines = nil
+	for _, ap := range approvals {
+		b, _ := json.Marshal(ap)
+		lines = append(append(lines, b...), '\n')
+	}
+	if err := add("approvals.jsonl", lines); err != nil {
+		return m, err
+	}
+	lines = nil
+	for _, d := range defaults {
+		b, _ := json.Marshal(d)
+		lines = append(append(lines, b...), '\n')
+	}
+	if err := add("chart-defaults.jsonl", lines); err != nil {
+		return m, err
+	}
+	b, _ = json.MarshalIndent(s.profiles, "", "  ")
+	if err := add("profiles.json", b); err != nil {
+		return m, err
+	}
+	if err := tw.Close(); err != nil {
+		return m, err
+	}
+	return m, gz.Close()
+}
+
+// restoreBackup reads an archive written by writeBackup. Stored scans keep
+// their ids, so restoring an archive twice stores each scan once; crawl
+// records and approvals already known are skipped, and chart defaults
+// replace those of a chart unless they are older. Profiles are written to the profiles
+// file, which must be configured and, unless overwriteProfiles is set,
+// must not exist yet.
+func (s *server) restoreBackup(ctx context.Context, r io.Reader, overwriteProfiles bool) (RestoreReport, error) {
+	var report RestoreReport
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return report, fmt.Errorf("not a backup archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	var manifest *backupManifest
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, fmt.Errorf("reading backup archive: %w", err)
+		}
+		if hdr.Size > maxBackupEntry {
+			return report, fmt.Errorf("backup entry %s is larger than %d bytes", hdr.Name, maxBackupEntry)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return report, fmt.Errorf("reading backup entry %s: %w", hdr.Name, err)
+		}
+		if manifest == nil {
+			if hdr.Name != "backup.json" {
+				return report, errors.New("not a backup archive: backup.json is missing")
+			}
+			manifest = &backupManifest{}
+			if err := json.Unmarshal(data, manifest); err != nil || manifest.Format != backupFormat {
+				return report, errors.New("not a backup archive: backup.json is not a backup manifest")
+			}
+			if manifest.Version > backupVersion {
+				return report, fmt.Errorf("backup format version %d is newer than this scanner's %d", manifest.Version, backupVersion)
+			}
+			report.CrawlRepos, report.CrawlInterval = manifest.CrawlRepos, manifest.CrawlInterval
+			continue
+		}
+		switch name := hdr.Name; {
+		case strings.HasPrefix(name, "results/") && strings.HasSuffix(name, ".json"):
+			if s.store == nil {
+				return report, errors.New("the backup holds stored results but no result store is configured, see -store")
+			}
+			var result ScanResult
+			if err := json.Unmarshal(data, &result); err != nil {
+				return report, fmt.Errorf("backup entry %s: %w", name, err)
+			}
+			if err := s.store.Put(ctx, strings.TrimSuffix(path.Base(name), ".json"), result); err != nil {
+				return report, fmt.Errorf("storing %s: %w", name, err)
+			}
+			report.Results++
+		case name == "crawl-state.jsonl":
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				var rec crawlRecord
+				if line == "" || json.Unmarshal([]byte(line), &rec) != nil {
+					continue
+				}
+				if !s.crawls.isSeen(rec.Repo, rec.Chart, rec.Version) {
+					s.crawls.record(rec)
+					report.CrawlRecords++
+				}
+			}
+		case name == "approvals.jsonl":
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				var ap Approval
+				if line == "" || json.Unmarshal([]byte(line), &ap) != nil || ap.ScanID == "" || s.approvals.has(ap) {
+					continue
+				}
+				if err := s.approvals.record(ap); err != nil {
+					return report, err
+				}
+				report.Approvals++
+			}
+		case name == "chart-defaults.jsonl":
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				var d ChartDefaults
+				if line == "" || json.Unmarshal([]byte(line), &d) != nil || d.Chart == "" || d.Deleted {
+					continue
+				}
+				if cur, ok := s.chartDefaults.get(d.Chart); ok && !cur.UpdatedAt.Before(d.UpdatedAt) {
+					continue
+				}
+				if err := s.chartDefaults.put(d); err != nil {
+					return report, err
+				}
+				report.ChartDefaults++
+			}
+		case name == "profiles.json":
+			if err := s.restoreProfiles(data, overwriteProfiles, &report); err != nil {
+				return report, err
+			}
+		default:
+			report.Warnings = append(report.Warnings, "ignored unknown entry "+name)
+		}
+	}
+	if manifest == nil {
+		return report, errors.New("not a backup archive: it is empty")
+	}
+	details := map[string]string{
+		"created_at":     manifest.CreatedAt.Format(time.RFC3339),
+		"results":        strconv.Itoa(report.Results),
+		"crawl_records":  strconv.Itoa(report.CrawlRecords),
+		"approvals":      strconv.Itoa(report.Approvals),
+		"profiles":       strconv.Itoa(report.Profiles),
+		"chart_defaults": strconv.Itoa(report.ChartDefaults),
+	}
+	if err := s.audit.record(auditRestore, "admin", "", details); err != nil {
+		return report, err
+	}
+	if len(report.CrawlRepos) > 0 {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("the backed-up instance crawled %s every %s; set -crawl-repos to resume that schedule",
+			strings.Join(report.CrawlRepos, ","), report.CrawlInterval))
+	}
+	return report, nil
+}
+
+func (s *server) restoreProfiles(data []byte, overwrite bool, report *RestoreReport) error {
+	var profiles map[string]interface{}
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return fmt.Errorf("backup entry profiles.json: %w", err)
+	}
+	if len(profiles) == 0 {
+		return nil
+	}
+	file := s.cfg.ProfilesFile
+	if file == "" {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("%d profiles not restored: no profiles file is configured, see -profiles", len(profiles)))
+		return nil
+	}
+	if _, err := os.Stat(file); err == nil && !overwrite {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("%d profiles not restored: %s exists", len(profiles), file))
+		return nil
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	b, err := yaml.Marshal(profiles)
+	if err != nil {
+		return err
+	}
+	if _, err := parseProfiles(b, "profiles.json of the backup"); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(file, b); err != nil {
+		return fmt.Errorf("writing profiles: %w", err)
+	}
+	report.Profiles = len(profiles)
+	report.ProfilesFile = file
+	return nil
+}
+
+// adminAuthorized checks the bearer token of the admin endpoints, which
+// are only served when -admin-token is set.
+func (s *server) adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if s.cfg.AdminToken == "" {
+		jsonError(w, http.StatusNotFound, "admin endpoints are disabled, see -admin-token")
+		return false
+	}
+	if p, _ := adminTokenAuth(s.cfg.AdminToken).Authenticate(r); p == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		jsonError(w, http.StatusUnauthorized, "admin token required")
+		return false
+	}
+	return true
+}
+
+// backupHandler serves GET /admin/backup, the instance's backup archive.
+func (s *server) backupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="scanner-backup-%s.tar.gz"`, time.Now().UTC().Format("20060102-150405")))
+	if _, err := s.writeBackup(r.Context(), w); err != nil {
+		// The archive has started, so the client sees a truncated one.
+		log.Printf("warning: writing backup: %v", err)
+	}
+}
+
+// restoreHandler serves POST /admin/restore, which takes an archive of
+// /admin/backup as its body.
+func (s *server) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	report, err := s.restoreBackup(r.Context(), r.Body, r.URL.Query().Get("overwrite_profiles") == "true")
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, fmt.Sprintf("restore stopped after %d results: %v", report.Results, err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// openBackupServer opens the stores named by the SCANNER_* environment,
+// for the backup and restore subcommands. Profiles are only read for a
+// backup, since a restore may be what creates the profiles file.
+func openBackupServer(withProfiles bool) (*server, func(), error) {
+	cfg, err := LoadConfig(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	crawls, err := openCrawlState(cfg.CrawlStateFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	approvals, err := openApprovalLog(cfg.ApprovalsFile)
+	if err != nil {
+		crawls.Close()
+		return nil, nil, err
+	}
+	defaults, err := openChartDefaults(cfg.ChartDefaultsFile)
+	if err != nil {
+		crawls.Close()
+		approvals.Close()
+		return nil, nil, err
+	}
+	profiles := make(scanProfiles)
+	if withProfiles {
+		if profiles, err = loadProfiles(cfg.ProfilesFile); err != nil {
+			crawls.Close()
+			approvals.Close()
+			defaults.Close()
+			return nil, nil, err
+		}
+	}
+	store, err := openResultStore(cfg)
+	if err != nil {
+		crawls.Close()
+		approvals.Close()
+		defaults.Close()
+		return nil, nil, err
+	}
+	history, _ := openHistoryStore("")
+	keys, err := loadKeyRing(cfg.SecretsKeyFile)
+	var audit *auditLog
+	if err == nil {
+		audit, err = openAuditLog(cfg.AuditFile, keys)
+	}
+	if err != nil {
+		crawls.Close()
+		approvals.Close()
+		defaults.Close()
+		if store != nil {
+			store.Close()
+		}
+		return nil, nil, err
+	}
+	s := newServer(cfg, history, crawls, nil, nil, profiles, nil, nil)
+	s.store = store
+	s.approvals = approvals
+	s.chartDefaults = defaults
+	s.audit = audit
+	return s, func() {
+		crawls.Close()
+		approvals.Close()
+		defaults.Close()
+		audit.Close()
+		if store != nil {
+			store.Close()
+		}
+	}, nil
+}
+
+// runBackup is the backup subcommand. It returns the exit code.
+func runBackup(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: helm-image-scanner backup <archive.tar.gz|->")
+		fmt.Fprintln(stderr, "\nThe stores are those of the SCANNER_* environment variables.")
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	s, closeStores, err := openBackupServer(true)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	defer closeStores()
+	out := stdout
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Create(name)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+	m, err := s.writeBackup(context.Background(), out)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	fmt.Fprintf(stderr, "backed up %d results, %d crawl records, %d approvals and %d profiles\n", m.Results, m.CrawlRecords, m.Approvals, m.Profiles)
+	return 0
+}
+
+// runRestore is the restore subcommand. It returns the exit code.
+func runRestore(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: helm-image-scanner restore [flags] <archive.tar.gz|->")
+		fmt.Fprintln(stderr, "\nThe stores are those of the SCANNER_* environment variables.")
+		fs.PrintDefaults()
+	}
+	overwrite := fs.Bool("overwrite-profiles", false, "replace an existing profiles file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	s, closeStores, err := openBackupServer(false)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	defer closeStores()
+	var in io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+	report, err := s.restoreBackup(context.Background(), in, *overwrite)
+	for _, w := range report.Warnings {
+		fmt.Fprintln(stderr, "warning:", w)
+	}
+	fmt.Fprintf(stdout, "restored %d results, %d crawl records, %d approvals, %d chart defaults and %d profiles\n", report.Results, report.CrawlRecords, report.Approvals, report.ChartDefaults, report.Profiles)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
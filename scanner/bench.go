@@ -0,0 +1,273 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// BenchResult summarises the runs of one chart of a bench corpus.
+type BenchResult struct {
+	Chart  string `json:"chart"`
+	Runs   int    `json:"runs"`
+	Errors int    `json:"errors"`
+	// FirstError is the error of the first failed run.
+	FirstError    string         `json:"first_error,omitempty"`
+	Images        int            `json:"images"`
+	Latency       latencySummary `json:"latency"`
+	ScansPerSec   float64        `json:"scans_per_second"`
+	AllocsPerScan uint64         `json:"allocs_per_scan"`
+	BytesPerScan  uint64         `json:"bytes_per_scan"`
+}
+
+// latencySummary holds run latencies in milliseconds.
+type latencySummary struct {
+	Mean float64 `json:"mean_ms"`
+	P50  float64 `json:"p50_ms"`
+	P95  float64 `json:"p95_ms"`
+	Max  float64 `json:"max_ms"`
+}
+
+// benchChart is one chart of the corpus, read once so that every run
+// measures the pipeline rather than the disk.
+type benchChart struct {
+	name    string
+	archive []byte      // a packaged chart, unpacked on every run
+	files   []chartFile // an unpacked chart directory
+}
+
+// runBench is the bench subcommand: it runs every chart of a local corpus
+// through the scan pipeline a number of times and reports latency,
+// throughput and allocations per chart. Server settings are taken from
+// the SCANNER_* environment variables, as for scan. It returns the exit
+// code.
+func runBench(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: helm-image-scanner bench [flags] <chart.tgz|chart dir>...")
+		fs.PrintDefaults()
+	}
+	runs := fs.Int("n", 10, "runs per chart")
+	parallel := fs.Int("c", 1, "runs in parallel")
+	extractOnly := fs.Bool("extract-only", false, "stop after extracting the images, without contacting registries")
+	keepCache := fs.Bool("cache", false, "keep the image cache between runs instead of inspecting every image on every run")
+	render := fs.Bool("render", envBool("SCANNER_RENDER", false), "render the chart templates")
+	asJSON := fs.Bool("json", false, "write the results as JSON")
+	verbose := fs.Bool("v", false, "log scan warnings, which are discarded otherwise")
+	var valueFiles stringList
+	fs.Var(&valueFiles, "f", "values file merged over the chart's values, in order (repeatable)")
+	var paths []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		paths = append(paths, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(paths) == 0 || *runs < 1 || *parallel < 1 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := LoadConfig(nil)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+	if !*keepCache {
+		cfg.CacheTTL = 0
+	}
+	if cfg.MaxScans < *parallel {
+		cfg.MaxScans = *parallel
+	}
+	req := scanRequest{Options: Options{Render: render}}
+	for _, f := range valueFiles {
+		vals, err := readValuesFile(f)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		req.Values = mergeValues(req.Values, vals)
+	}
+	history, _ := openHistoryStore("")
+	crawls, _ := openCrawlState("")
+	s := newServer(cfg, history, crawls, nil, nil, nil, nil, nil)
+	opts, err := s.scanOptionsFor(req, cacheControl{})
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	corpus := make([]benchChart, 0, len(paths))
+	for _, p := range paths {
+		c, err := readBenchChart(p, opts.Archive)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		corpus = append(corpus, c)
+	}
+
+	results := make([]BenchResult, 0, len(corpus))
+	code := 0
+	for _, c := range corpus {
+		r := s.benchChart(context.Background(), c, opts, *runs, *parallel, *extractOnly)
+		if r.Errors > 0 {
+			code = 1
+		}
+		results = append(results, r)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+		return code
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "chart\truns\terrors\timages\tmean ms\tp50 ms\tp95 ms\tmax ms\tscans/s\tallocs/scan\tbytes/scan\t")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.1f\t%.1f\t%.1f\t%.1f\t%.2f\t%d\t%d\t\n", r.Chart, r.Runs, r.Errors, r.Images,
+			r.Latency.Mean, r.Latency.P50, r.Latency.P95, r.Latency.Max, r.ScansPerSec, r.AllocsPerScan, r.BytesPerScan)
+	}
+	tw.Flush()
+	for _, r := range results {
+		if r.FirstError != "" {
+			fmt.Fprintf(stderr, "%s: %d of %d runs failed, first: %s\n", r.Chart, r.Errors, r.Runs, r.FirstError)
+		}
+	}
+	return code
+}
+
+// readBenchChart loads a packaged chart or a chart directory.
+func readBenchChart(p string, limits archiveLimits) (benchChart, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return benchChart{}, err
+	}
+	c := benchChart{name: p}
+	if !info.IsDir() {
+		c.archive, err = os.ReadFile(p)
+		return c, err
+	}
+	files, err := readRepositoryDir(p, limits)
+	if err != nil {
+		return benchChart{}, fmt.Errorf("reading %s: %w", p, err)
+	}
+	// Charts are laid out below their directory, as in an archive.
+	base := filepath.Base(filepath.Clean(p))
+	for i := range files {
+		files[i].Name = base + "/" + files[i].Name
+	}
+	c.files = files
+	return c, nil
+}
+
+// benchChart runs one chart n times, parallel runs at a time.
+func (s *server) benchChart(ctx context.Context, c benchChart, opts scanOptions, n, parallel int, extractOnly bool) BenchResult {
+	latencies := make([]time.Duration, n)
+	images := make([]int, n)
+	errs := make([]error, n)
+
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallel)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			t := time.Now()
+			images[i], errs[i] = s.benchRun(ctx, c, opts, extractOnly)
+			latencies[i] = time.Since(t)
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	r := BenchResult{Chart: c.name, Runs: n}
+	for i, err := range errs {
+		if err != nil {
+			if r.Errors++; r.FirstError == "" {
+				r.FirstError = err.Error()
+			}
+			continue
+		}
+		r.Images = images[i]
+	}
+	r.Latency = summarizeLatencies(latencies)
+	r.ScansPerSec = math.Round(float64(n)/elapsed.Seconds()*100) / 100
+	r.AllocsPerScan = (after.Mallocs - before.Mallocs) / uint64(n)
+	r.BytesPerScan = (after.TotalAlloc - before.TotalAlloc) / uint64(n)
+	return r
+}
+
+// benchRun scans the chart once and returns the number of images found.
+func (s *server) benchRun(ctx context.Context, c benchChart, opts scanOptions, extractOnly bool) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.ScanTimeout)
+	defer cancel()
+	files := c.files
+	if c.archive != nil {
+		var err error
+		if files, err = readChartArchive(bytes.NewReader(c.archive), opts.Archive); err != nil {
+			return 0, err
+		}
+	}
+	if extractOnly {
+		job, ctx, err := s.tracker.start(ctx, c.name)
+		if err != nil {
+			return 0, err
+		}
+		defer s.tracker.finish(job)
+		refs, _, _, _, err := chartImages(ctx, job, files, opts)
+		return len(refs), err
+	}
+	result, err := s.scanLocalChart(ctx, c.name, files, opts)
+	if err != nil {
+		return 0, err
+	}
+	found := len(result.Pinning.Pinned) + len(result.Pinning.Tagged)
+	if failed := found - len(result.Images); failed > 0 {
+		return found, fmt.Errorf("%d of %d images failed to inspect", failed, found)
+	}
+	return found, nil
+}
+
+func summarizeLatencies(d []time.Duration) latencySummary {
+	sorted := append([]time.Duration(nil), d...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var total time.Duration
+	for _, l := range sorted {
+		total += l
+	}
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	at := func(q float64) time.Duration { return sorted[int(q*float64(len(sorted)-1)+0.5)] }
+	return latencySummary{
+		Mean: ms(total / time.Duration(len(sorted))),
+		P50:  ms(at(0.5)),
+		P95:  ms(at(0.95)),
+		Max:  ms(sorted[len(sorted)-1]),
+	}
+}
@@ -0,0 +1,219 @@
+package scanner
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// imageCache keeps inspection results so repeated scans of the same chart,
+// or charts sharing images, do not hit the registry again. It is split in
+// two: tag resolutions (reference -> manifest digest), which go stale when
+// a tag is re-pushed, and inspection results keyed by digest, which never
+// go stale because the content behind a digest is immutable. Tag
+// resolutions expire once they are older than the TTL and digest results
+// once they have gone unused for it; a lookup drops the expired entry it
+// finds, and sweepEvery drops the others, so that entries no scan asks
+// for again do not pile up.
+type imageCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	tags    map[string]tagEntry
+	digests map[string]digestEntry
+
+	tagHits, tagMisses       int64
+	digestHits, digestMisses int64
+}
+
+// CacheStats reports the cache's size and hit counts since startup.
+type CacheStats struct {
+	Tags         int   `json:"tags"`
+	Digests      int   `json:"digests"`
+	TagHits      int64 `json:"tag_hits"`
+	TagMisses    int64 `json:"tag_misses"`
+	DigestHits   int64 `json:"digest_hits"`
+	DigestMisses int64 `json:"digest_misses"`
+}
+
+type tagEntry struct {
+	digest   string
+	resolved time.Time
+}
+
+type digestEntry struct {
+	info     ImageInfo
+	deep     bool
+	lastUsed time.Time
+}
+
+// newImageCache returns a cache whose entries live for ttl. A zero ttl
+// disables caching; the methods are still safe to call.
+func newImageCache(ttl time.Duration) *imageCache {
+	return &imageCache{
+		ttl:     ttl,
+		tags:    make(map[string]tagEntry),
+		digests: make(map[string]digestEntry),
+	}
+}
+
+// resolved returns the digest ref was last resolved to, provided the
+// resolution is younger than both the cache TTL and maxAge (when set).
+func (c *imageCache) resolved(ref string, maxAge time.Duration) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.tags[ref]
+	if !ok {
+		c.tagMisses++
+		return "", false
+	}
+	age := time.Since(e.resolved)
+	if age > c.ttl {
+		delete(c.tags, ref)
+		c.tagMisses++
+		return "", false
+	}
+	if maxAge > 0 && age > maxAge {
+		c.tagMisses++
+		return "", false
+	}
+	c.tagHits++
+	return e.digest, true
+}
+
+func (c *imageCache) putResolved(ref, digest string) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tags[ref] = tagEntry{digest: digest, resolved: time.Now()}
+}
+
+// inspected returns the cached result for a manifest digest. A result from
+// a metadata-only inspection does not satisfy a deep request.
+func (c *imageCache) inspected(digest string, deep bool) (ImageInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.digests[digest]
+	if !ok {
+		c.digestMisses++
+		return ImageInfo{}, false
+	}
+	if time.Since(e.lastUsed) > c.ttl {
+		delete(c.digests, digest)
+		c.digestMisses++
+		return ImageInfo{}, false
+	}
+	if deep && !e.deep {
+		c.digestMisses++
+		return ImageInfo{}, false
+	}
+	c.digestHits++
+	e.lastUsed = time.Now()
+	c.digests[digest] = e
+	return e.info, true
+}
+
+func (c *imageCache) putInspected(digest string, info ImageInfo, deep bool) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.digests[digest]; ok && e.deep && !deep {
+		return
+	}
+	c.digests[digest] = digestEntry{info: info, deep: deep, lastUsed: time.Now()}
+}
+
+// sweep removes every expired entry and returns how many it removed.
+func (c *imageCache) sweep() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for ref, e := range c.tags {
+		if time.Since(e.resolved) > c.ttl {
+			delete(c.tags, ref)
+			n++
+		}
+	}
+	for digest, e := range c.digests {
+		if time.Since(e.lastUsed) > c.ttl {
+			delete(c.digests, digest)
+			n++
+		}
+	}
+	return n
+}
+
+// sweepEvery sweeps the cache once per TTL until ctx is done, so that no
+// entry is held much longer than twice the TTL.
+func (c *imageCache) sweepEvery(ctx context.Context) {
+	if c.ttl <= 0 {
+		return
+	}
+	t := time.NewTicker(c.ttl)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if n := c.sweep(); n > 0 {
+				log.Printf("debug: cache: %d expired entries removed", n)
+			}
+		}
+	}
+}
+
+func (c *imageCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Tags:         len(c.tags),
+		Digests:      len(c.digests),
+		TagHits:      c.tagHits,
+		TagMisses:    c.tagMisses,
+		DigestHits:   c.digestHits,
+		DigestMisses: c.digestMisses,
+	}
+}
+
+// indexCache keeps parsed repository indexes for resolving chart versions,
+// so resolving several charts of one repository downloads its index once.
+// Crawls always fetch a fresh index.
+type indexCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]indexCacheEntry
+}
+
+type indexCacheEntry struct {
+	idx     *repoIndex
+	fetched time.Time
+}
+
+func newIndexCache(ttl time.Duration) *indexCache {
+	return &indexCache{ttl: ttl, entries: make(map[string]indexCacheEntry)}
+}
+
+func (c *indexCache) get(repo string) (*repoIndex, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[repo]
+	if !ok || time.Since(e.fetched) >= c.ttl {
+		delete(c.entries, repo)
+		return nil, false
+	}
+	return e.idx, true
+}
+
+func (c *indexCache) put(repo string, idx *repoIndex) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[repo] = indexCacheEntry{idx: idx, fetched: time.Now()}
+}
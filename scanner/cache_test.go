@@ -0,0 +1,36 @@
+package scanner
+
+import (
+	"testing"
+	"time"
+)
+
+func TestImageCacheSweep(t *testing.T) {
+	c := newImageCache(time.Hour)
+	c.putResolved("nginx:1.25", "sha256:old")
+	c.putInspected("sha256:old", ImageInfo{Image: "nginx:1.25"}, false)
+	c.putResolved("redis:7.2", "sha256:new")
+	c.putInspected("sha256:new", ImageInfo{Image: "redis:7.2"}, false)
+	// Age the nginx entries past the TTL without looking them up.
+	c.mu.Lock()
+	e := c.tags["nginx:1.25"]
+	e.resolved = e.resolved.Add(-2 * time.Hour)
+	c.tags["nginx:1.25"] = e
+	d := c.digests["sha256:old"]
+	d.lastUsed = d.lastUsed.Add(-2 * time.Hour)
+	c.digests["sha256:old"] = d
+	c.mu.Unlock()
+
+	if n := c.sweep(); n != 2 {
+		t.Errorf("sweep removed %d entries, want 2", n)
+	}
+	if st := c.stats(); st.Tags != 1 || st.Digests != 1 {
+		t.Errorf("%d tags and %d digests left, want 1 each", st.Tags, st.Digests)
+	}
+	if _, ok := c.resolved("redis:7.2", 0); !ok {
+		t.Error("the fresh tag resolution was swept")
+	}
+	if _, ok := c.inspected("sha256:new", false); !ok {
+		t.Error("the fresh digest result was swept")
+	}
+}
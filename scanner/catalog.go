@@ -0,0 +1,187 @@
+package scanner
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// catalogTimeout bounds one lookup in a catalog service.
+const catalogTimeout = 5 * time.Second
+
+// imageCatalog maps image repositories to metadata such as the owning
+// team, merged into every image so reports say whom to contact. It is
+// read from a JSON or CSV file at startup, or asked per repository from
+// an HTTP service.
+type imageCatalog struct {
+	// entries map a repository, or a prefix ending in /*, to metadata.
+	entries map[string]map[string]string
+
+	service string
+	client  *http.Client
+	ttl     time.Duration
+	mu      sync.Mutex
+	cached  map[string]catalogEntry
+}
+
+type catalogEntry struct {
+	meta    map[string]string
+	fetched time.Time
+}
+
+// openCatalog loads the catalog at src: an http(s) URL of a service, or a
+// .json or .csv file. An empty src means no catalog.
+func openCatalog(src string, ttl time.Duration) (*imageCatalog, error) {
+	if src == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		return &imageCatalog{
+			service: src,
+			client:  &http.Client{Timeout: catalogTimeout},
+			ttl:     ttl,
+			cached:  make(map[string]catalogEntry),
+		}, nil
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, fmt.Errorf("opening catalog: %w", err)
+	}
+	defer f.Close()
+	var entries map[string]map[string]string
+	switch {
+	case strings.HasSuffix(src, ".json"):
+		err = json.NewDecoder(f).Decode(&entries)
+	case strings.HasSuffix(src, ".csv"):
+		entries, err = readCatalogCSV(f)
+	default:
+		return nil, fmt.Errorf("catalog %s must be a .json or .csv file or an http(s) URL", src)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing catalog %s: %w", src, err)
+	}
+	c := &imageCatalog{entries: make(map[string]map[string]string, len(entries))}
+	for repo, meta := range entries {
+		c.entries[canonicalRegistry(repo)] = meta
+	}
+	return c, nil
+}
+
+// readCatalogCSV reads a catalog whose header names the columns: a
+// repository column, then one column per metadata field.
+func readCatalogCSV(r io.Reader) (map[string]map[string]string, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 || len(rows[0]) < 2 || rows[0][0] != "repository" {
+		return nil, errors.New("want a header row starting with repository")
+	}
+	header := rows[0]
+	entries := make(map[string]map[string]string, len(rows)-1)
+	for _, row := range rows[1:] {
+		meta := make(map[string]string, len(header)-1)
+		for i := 1; i < len(header) && i < len(row); i++ {
+			if row[i] != "" {
+				meta[header[i]] = row[i]
+			}
+		}
+		entries[row[0]] = meta
+	}
+	return entries, nil
+}
+
+// lookup returns the metadata of ref's repository. The most specific
+// entry wins: the repository itself, then the longest matching prefix.
+// A failing service is logged and yields no metadata.
+func (c *imageCatalog) lookup(ctx context.Context, ref string) map[string]string {
+	if c == nil {
+		return nil
+	}
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return nil
+	}
+	repo := canonicalRegistry(r.Context().RegistryStr() + "/" + r.Context().RepositoryStr())
+	if c.service != "" {
+		return c.ask(ctx, repo)
+	}
+	if meta, ok := c.entries[repo]; ok {
+		return meta
+	}
+	for p := repo; strings.Contains(p, "/"); {
+		p = p[:strings.LastIndex(p, "/")]
+		if meta, ok := c.entries[p+"/*"]; ok {
+			return meta
+		}
+	}
+	return nil
+}
+
+// ask queries the catalog service with GET ?repository=<repo>. It answers
+// with a JSON object of strings, or 404 for repositories it does not
+// know. Answers are cached for the TTL.
+func (c *imageCatalog) ask(ctx context.Context, repo string) map[string]string {
+	c.mu.Lock()
+	e, ok := c.cached[repo]
+	c.mu.Unlock()
+	if ok && time.Since(e.fetched) < c.ttl {
+		return e.meta
+	}
+	meta, err := c.fetch(ctx, repo)
+	if err != nil {
+		log.Printf("warning: catalog lookup of %s: %v", repo, err)
+		return nil
+	}
+	if c.ttl > 0 {
+		c.mu.Lock()
+		c.cached[repo] = catalogEntry{meta: meta, fetched: time.Now()}
+		c.mu.Unlock()
+	}
+	return meta
+}
+
+func (c *imageCatalog) fetch(ctx context.Context, repo string) (map[string]string, error) {
+	u, err := url.Parse(c.service)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("repository", repo)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("catalog returned %s", resp.Status)
+	}
+	var meta map[string]string
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&meta); err != nil {
+		return nil, fmt.Errorf("decoding catalog answer: %w", err)
+	}
+	return meta, nil
+}
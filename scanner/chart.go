@@ -0,0 +1,478 @@
+package scanner
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// chartFile is one regular file from a chart archive. Name is the path as
+// stored in the archive, e.g. "mychart/templates/deployment.yaml".
+// Subcharts packaged as nested archives under charts/ are unpacked in
+// place, so their files appear as "mychart/charts/redis/values.yaml".
+type chartFile struct {
+	Name string
+	Data []byte
+}
+
+// archiveLimits bounds what a chart archive may expand to.
+type archiveLimits struct {
+	MaxDownload int64 // compressed size of the archive as downloaded
+	MaxBytes    int64 // total uncompressed bytes across all files
+	MaxFiles    int
+	MaxDepth    int // nesting of subchart archives
+}
+
+var defaultArchiveLimits = archiveLimits{
+	MaxDownload: 100 << 20,
+	MaxBytes:    200 << 20,
+	MaxFiles:    20000,
+	MaxDepth:    5,
+}
+
+// strictArchiveLimits apply to untrusted charts. Real-world charts, even
+// large umbrella charts, stay well below them.
+var strictArchiveLimits = archiveLimits{
+	MaxDownload: 10 << 20,
+	MaxBytes:    25 << 20,
+	MaxFiles:    2000,
+	MaxDepth:    2,
+}
+
+var errArchiveTooLarge = errors.New("chart archive exceeds the download size limit")
+
+// readChartArchive reads a chart archive in any of the formats charts are
+// found in: a gzipped tarball as Helm packages it, a plain tar or a zip, as
+// source hosts offer for download. The format is told by the content, not
+// the name.
+func readChartArchive(r io.Reader, limits archiveLimits) ([]chartFile, error) {
+	budget := limits
+	var files []chartFile
+	lr := &limitedReader{r: r, n: limits.MaxDownload}
+	if err := readArchive(lr, "", 0, &budget, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// limitedReader fails, rather than silently truncating, once more than n
+// bytes are read.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errArchiveTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errArchiveTooLarge
+	}
+	return n, err
+}
+
+// Archive formats told apart by their first bytes.
+const (
+	formatGzip = "gzip"
+	formatTar  = "tar"
+	formatZip  = "zip"
+)
+
+// sniffArchive returns the format of an archive starting with head, which
+// should be at least 262 bytes long to recognise a tar.
+func sniffArchive(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return formatGzip
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return formatZip
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return formatTar
+	}
+	return ""
+}
+
+// readArchive unpacks the archive r into files under prefix, whatever its
+// format.
+func readArchive(r io.Reader, prefix string, depth int, budget *archiveLimits, files *[]chartFile) error {
+	br := bufio.NewReaderSize(r, 512)
+	head, _ := br.Peek(262)
+	switch sniffArchive(head) {
+	case formatGzip:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("creating gzip reader: %w", err)
+		}
+		defer gz.Close()
+		return readTar(tar.NewReader(gz), prefix, depth, budget, files)
+	case formatTar:
+		return readTar(tar.NewReader(br), prefix, depth, budget, files)
+	case formatZip:
+		return readZip(br, prefix, depth, budget, files)
+	}
+	if len(bytes.TrimSpace(head)) == 0 {
+		return errors.New("chart archive is empty")
+	}
+	return errors.New("chart is not a gzipped tarball, tar or zip archive")
+}
+
+func readTar(tr *tar.Reader, prefix string, depth int, budget *archiveLimits, files *[]chartFile) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		if hdr.Size > budget.MaxBytes {
+			return fmt.Errorf("chart expands to more than the allowed size")
+		}
+		buf := make([]byte, hdr.Size)
+		if _, err := io.ReadFull(tr, buf); err != nil {
+			return fmt.Errorf("reading %s: %w", hdr.Name, err)
+		}
+		if err := addArchiveFile(hdr.Name, buf, prefix, depth, budget, files); err != nil {
+			return err
+		}
+	}
+}
+
+// readZip reads a zip archive, which lists its files at its end and so is
+// read whole first, within the download limit.
+func readZip(r io.Reader, prefix string, depth int, budget *archiveLimits, files *[]chartFile) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("reading zip: %w", err)
+	}
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", f.Name, err)
+		}
+		// The sizes in the zip's directory are not trusted.
+		buf, err := io.ReadAll(io.LimitReader(rc, budget.MaxBytes+1))
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", f.Name, err)
+		}
+		if int64(len(buf)) > budget.MaxBytes {
+			return fmt.Errorf("chart expands to more than the allowed size")
+		}
+		if err := addArchiveFile(f.Name, buf, prefix, depth, budget, files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addArchiveFile adds one file of an archive to files, unpacking it in
+// place if it is a packaged subchart, and charges it to the budget.
+func addArchiveFile(stored string, data []byte, prefix string, depth int, budget *archiveLimits, files *[]chartFile) error {
+	name := path.Clean(strings.TrimPrefix(stored, "/"))
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return nil
+	}
+	if budget.MaxFiles--; budget.MaxFiles < 0 {
+		return fmt.Errorf("chart has too many files")
+	}
+	if int64(len(data)) > budget.MaxBytes {
+		return fmt.Errorf("chart expands to more than the allowed size")
+	}
+	budget.MaxBytes -= int64(len(data))
+	full := prefix + name
+	if isSubchartArchive(name) {
+		if depth+1 > budget.MaxDepth {
+			return fmt.Errorf("subcharts nested too deeply at %s", full)
+		}
+		dir := path.Dir(full) + "/"
+		if err := readArchive(bytes.NewReader(data), dir, depth+1, budget, files); err != nil {
+			return fmt.Errorf("subchart %s: %w", full, err)
+		}
+		return nil
+	}
+	*files = append(*files, chartFile{Name: full, Data: data})
+	return nil
+}
+
+// isSubchartArchive reports whether name is a packaged dependency, i.e. a
+// .tgz directly inside a chart's charts/ directory.
+func isSubchartArchive(name string) bool {
+	return (strings.HasSuffix(name, ".tgz") || strings.HasSuffix(name, ".tar.gz")) &&
+		path.Base(path.Dir(name)) == "charts"
+}
+
+func isYAMLFile(name string) bool {
+	return strings.HasSuffix(name, ".yaml") || strings.HasSuffix(name, ".yml")
+}
+
+// chartMetadata is the part of Chart.yaml the scanner uses.
+type chartMetadata struct {
+	APIVersion   string            `yaml:"apiVersion" json:"api_version,omitempty"`
+	Name         string            `yaml:"name" json:"name"`
+	Version      string            `yaml:"version" json:"version"`
+	AppVersion   string            `yaml:"appVersion" json:"app_version,omitempty"`
+	Description  string            `yaml:"description" json:"-"`
+	Type         string            `yaml:"type" json:"type,omitempty"`
+	KubeVersion  string            `yaml:"kubeVersion" json:"kube_version,omitempty"`
+	Home         string            `yaml:"home" json:"-"`
+	Icon         string            `yaml:"icon" json:"-"`
+	Sources      []string          `yaml:"sources" json:"-"`
+	Keywords     []string          `yaml:"keywords" json:"-"`
+	Annotations  map[string]string `yaml:"annotations" json:"-"`
+	Dependencies []chartDependency `yaml:"dependencies" json:"-"`
+}
+
+type chartDependency struct {
+	Name       string   `yaml:"name"`
+	Version    string   `yaml:"version"`
+	Repository string   `yaml:"repository"`
+	Condition  string   `yaml:"condition"`
+	Tags       []string `yaml:"tags"`
+	Alias      string   `yaml:"alias"`
+}
+
+// helmChart is a chart and its subcharts as laid out in an archive.
+type helmChart struct {
+	dir       string // e.g. "mychart" or "mychart/charts/redis"
+	meta      chartMetadata
+	defaults  map[string]interface{} // the chart's own values.yaml
+	files     map[string][]byte      // keyed relative to dir, subcharts excluded
+	subcharts []*helmChart
+}
+
+// buildChartTree arranges archive files into charts. The root chart is the
+// shallowest directory holding a Chart.yaml.
+func buildChartTree(files []chartFile) (*helmChart, error) {
+	root := ""
+	for _, f := range files {
+		if path.Base(f.Name) != "Chart.yaml" {
+			continue
+		}
+		dir := path.Dir(f.Name)
+		if root == "" || strings.Count(dir, "/") < strings.Count(root, "/") {
+			root = dir
+		}
+	}
+	if root == "" {
+		return nil, fmt.Errorf("no Chart.yaml found in archive")
+	}
+	return loadChartDir(root, files)
+}
+
+func loadChartDir(dir string, files []chartFile) (*helmChart, error) {
+	c := &helmChart{dir: dir, files: make(map[string][]byte), defaults: map[string]interface{}{}}
+	subdirs := make(map[string]bool)
+	for _, f := range files {
+		rel, ok := strings.CutPrefix(f.Name, dir+"/")
+		if !ok {
+			continue
+		}
+		if sub, ok := strings.CutPrefix(rel, "charts/"); ok && strings.HasSuffix(sub, "/Chart.yaml") &&
+			strings.Count(sub, "/") == 1 {
+			subdirs[dir+"/charts/"+path.Dir(sub)] = true
+		}
+	}
+	for _, f := range files {
+		rel, ok := strings.CutPrefix(f.Name, dir+"/")
+		if !ok || inSubchart(f.Name, subdirs) {
+			continue
+		}
+		c.files[rel] = f.Data
+	}
+	data, ok := c.files["Chart.yaml"]
+	if !ok {
+		return nil, fmt.Errorf("%s: missing Chart.yaml", dir)
+	}
+	if err := yaml.Unmarshal(data, &c.meta); err != nil {
+		return nil, fmt.Errorf("%s/Chart.yaml: %w", dir, err)
+	}
+	if data, ok := c.files["values.yaml"]; ok {
+		if err := yaml.Unmarshal(data, &c.defaults); err != nil {
+			return nil, fmt.Errorf("%s/values.yaml: %w", dir, err)
+		}
+		if c.defaults == nil {
+			c.defaults = map[string]interface{}{}
+		}
+	}
+	for sub := range subdirs {
+		sc, err := loadChartDir(sub, files)
+		if err != nil {
+			return nil, err
+		}
+		c.subcharts = append(c.subcharts, sc)
+	}
+	sort.Slice(c.subcharts, func(i, j int) bool { return c.subcharts[i].dir < c.subcharts[j].dir })
+	return c, nil
+}
+
+func inSubchart(name string, subdirs map[string]bool) bool {
+	for d := range subdirs {
+		if strings.HasPrefix(name, d+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// valuesTree pairs a chart with the values it is rendered with.
+type valuesTree struct {
+	chart     *helmChart
+	name      string // the dependency alias, or the chart name
+	values    map[string]interface{}
+	subcharts []*valuesTree
+}
+
+// coalesceValues computes effective values the way Helm does: user values
+// over chart defaults, each subchart getting its parent's values under its
+// name, "global" flowing down with the parent winning, and subcharts whose
+// dependency condition or tags evaluate to false left out.
+func coalesceValues(c *helmChart, user map[string]interface{}) *valuesTree {
+	return coalesceChart(c, c.meta.Name, mergeValues(deepCopyValues(c.defaults), user))
+}
+
+func coalesceChart(c *helmChart, name string, vals map[string]interface{}) *valuesTree {
+	t := &valuesTree{chart: c, name: name, values: vals}
+	global, _ := vals["global"].(map[string]interface{})
+	for _, sc := range c.subcharts {
+		subName := sc.meta.Name
+		dep, listed := c.dependency(sc.meta.Name)
+		if listed && dep.Alias != "" {
+			subName = dep.Alias
+		}
+		if listed && !dependencyEnabled(dep, vals) {
+			continue
+		}
+		sub := deepCopyValues(sc.defaults)
+		if parent, ok := vals[subName].(map[string]interface{}); ok {
+			sub = mergeValues(sub, parent)
+		}
+		subGlobal, _ := sub["global"].(map[string]interface{})
+		sub["global"] = mergeValues(deepCopyValues(subGlobal), global)
+		t.subcharts = append(t.subcharts, coalesceChart(sc, subName, sub))
+	}
+	return t
+}
+
+func (c *helmChart) dependency(name string) (chartDependency, bool) {
+	for _, d := range c.meta.Dependencies {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return chartDependency{}, false
+}
+
+// dependencyEnabled evaluates a dependency's condition (the first path
+// that resolves to a boolean wins) and then its tags.
+func dependencyEnabled(dep chartDependency, vals map[string]interface{}) bool {
+	for _, cond := range strings.Split(dep.Condition, ",") {
+		cond = strings.TrimSpace(cond)
+		if cond == "" {
+			continue
+		}
+		if b, ok := lookupValue(vals, cond).(bool); ok {
+			return b
+		}
+	}
+	if len(dep.Tags) == 0 {
+		return true
+	}
+	tags, _ := vals["tags"].(map[string]interface{})
+	for _, tag := range dep.Tags {
+		if b, ok := tags[tag].(bool); ok && b {
+			return true
+		}
+	}
+	for _, tag := range dep.Tags {
+		if _, ok := tags[tag].(bool); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupValue resolves a dotted path such as "redis.enabled".
+func lookupValue(vals map[string]interface{}, p string) interface{} {
+	var cur interface{} = vals
+	for _, k := range strings.Split(p, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cur = m[k]
+	}
+	return cur
+}
+
+// mergeValues merges src into dst recursively, src winning, and returns
+// dst. A nil in src deletes the key, as in Helm.
+func mergeValues(dst, src map[string]interface{}) map[string]interface{} {
+	if dst == nil {
+		dst = map[string]interface{}{}
+	}
+	for k, v := range src {
+		if v == nil {
+			delete(dst, k)
+			continue
+		}
+		if sm, ok := v.(map[string]interface{}); ok {
+			if dm, ok := dst[k].(map[string]interface{}); ok {
+				dst[k] = mergeValues(dm, sm)
+				continue
+			}
+			dst[k] = mergeValues(map[string]interface{}{}, sm)
+			continue
+		}
+		dst[k] = v
+	}
+	return dst
+}
+
+func deepCopyValues(m map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		out[k] = deepCopyValue(v)
+	}
+	return out
+}
+
+func deepCopyValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		return deepCopyValues(x)
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, e := range x {
+			out[i] = deepCopyValue(e)
+		}
+		return out
+	}
+	return v
+}
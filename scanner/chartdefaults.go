@@ -0,0 +1,306 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxChartDefaults bounds the body of a PUT /chart-defaults.
+const maxChartDefaults = 1 << 20
+
+// ChartDefaults are the /scan options stored for one chart. They apply to
+// every scan of the chart, under the profile and the fields the request
+// names itself.
+type ChartDefaults struct {
+	// Chart is the chart's identity: its repository URL and name, such
+	// as https://charts.bitnami.com/bitnami/redis, or an OCI repository.
+	Chart     string          `json:"chart"`
+	Options   json.RawMessage `json:"options,omitempty"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	// Deleted marks, in the file, defaults that were removed.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+type chartDefaultsResponse struct {
+	Charts []ChartDefaults `json:"charts"`
+}
+
+// chartDefaultsStore holds the defaults of every chart. Like the approvals
+// it is kept in memory and, when a path is configured, appended to a
+// JSON-lines file that is replayed on startup, the last line of a chart
+// winning.
+type chartDefaultsStore struct {
+	mu      sync.Mutex
+	byChart map[string]ChartDefaults
+	file    *os.File
+}
+
+func openChartDefaults(path string) (*chartDefaultsStore, error) {
+	c := &chartDefaultsStore{byChart: make(map[string]ChartDefaults)}
+	if path == "" {
+		return c, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening chart defaults file: %w", err)
+	}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, maxChartDefaults+4096)
+	for sc.Scan() {
+		var d ChartDefaults
+		if err := json.Unmarshal(sc.Bytes(), &d); err != nil || d.Chart == "" {
+			continue
+		}
+		c.apply(d)
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading chart defaults file: %w", err)
+	}
+	c.file = f
+	return c, nil
+}
+
+func (c *chartDefaultsStore) apply(d ChartDefaults) {
+	if d.Deleted {
+		delete(c.byChart, d.Chart)
+		return
+	}
+	c.byChart[d.Chart] = d
+}
+
+func (c *chartDefaultsStore) get(chart string) (ChartDefaults, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.byChart[chart]
+	return d, ok
+}
+
+// put records d, which replaces the chart's defaults or, when Deleted,
+// removes them.
+func (c *chartDefaultsStore) put(d ChartDefaults) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file != nil {
+		b, _ := json.Marshal(d)
+		if _, err := c.file.Write(append(b, '\n')); err != nil {
+			return fmt.Errorf("writing chart defaults: %w", err)
+		}
+	}
+	c.apply(d)
+	return nil
+}
+
+// all returns the defaults of every chart, ordered by chart.
+func (c *chartDefaultsStore) all() []ChartDefaults {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]ChartDefaults, 0, len(c.byChart))
+	for _, d := range c.byChart {
+		out = append(out, d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Chart < out[j].Chart })
+	return out
+}
+
+func (c *chartDefaultsStore) Close() error {
+	if c.file == nil {
+		return nil
+	}
+	return c.file.Close()
+}
+
+// archiveVersionRe splits a chart archive named the way helm package names
+// it, <name>-<version>.tgz, into name and version.
+var archiveVersionRe = regexp.MustCompile(`^(.+?)-v?[0-9]+\.[0-9]+\.[0-9]+(?:[-+][0-9A-Za-z.+-]*)?\.(?:tgz|tar\.gz|tar|zip)$`)
+
+// chartIdentity names a chart across its versions: a repo/chart reference
+// becomes the repository's URL and the chart's name, which is also what
+// a versioned archive URL next to the repository's index comes down to,
+// and an OCI reference loses its tag or digest. Other URLs identify
+// themselves, less any query.
+func (s *server) chartIdentity(chart string) (string, error) {
+	if isChartRef(chart) {
+		repo, name, err := s.splitChartRef(chart)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(repo.URL, "/") + "/" + name, nil
+	}
+	if rest, ok := strings.CutPrefix(chart, "oci://"); ok {
+		if i := strings.Index(rest, "@"); i >= 0 {
+			rest = rest[:i]
+		}
+		if i := strings.LastIndex(rest, ":"); i > strings.LastIndex(rest, "/") {
+			rest = rest[:i]
+		}
+		return "oci://" + strings.ToLower(rest), nil
+	}
+	u, err := url.Parse(chart)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("chart %q is neither a URL nor repo/chart", chart)
+	}
+	u.RawQuery, u.Fragment, u.User = "", "", nil
+	u.Host = strings.ToLower(u.Host)
+	if m := archiveVersionRe.FindStringSubmatch(path.Base(u.Path)); m != nil {
+		u.Path = path.Join(path.Dir(u.Path), m[1])
+		u.RawPath = ""
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// parseChartOptions checks the options of a chart's defaults, which are
+// the option fields of a /scan request.
+func (s *server) parseChartOptions(data []byte) (json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var req scanRequest
+	if err := dec.Decode(&req); err != nil {
+		return nil, fmt.Errorf("invalid options: %v", err)
+	}
+	if req.ChartURL != "" || req.Version != "" || req.Manifest != "" || req.Terraform != "" || req.Profile != "" || req.NoChartDefaults {
+		return nil, errors.New("chart defaults hold options, not chart_url, version, manifest, terraform, profile or no_chart_defaults")
+	}
+	if _, err := s.scanOptionsFor(req, cacheControl{}); err != nil {
+		return nil, err
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, data); err != nil {
+		return nil, fmt.Errorf("invalid options: %v", err)
+	}
+	return compact.Bytes(), nil
+}
+
+// chartDefaultsFor returns the stored defaults of chart, if it has any.
+func (s *server) chartDefaultsFor(chart string) (ChartDefaults, bool) {
+	id, err := s.chartIdentity(chart)
+	if err != nil {
+		return ChartDefaults{}, false
+	}
+	return s.chartDefaults.get(id)
+}
+
+// chartScanOptions returns the options of a scan the server starts on its
+// own, such as a crawl's, of chart: base, or the chart's stored defaults
+// when it has some, and the chart they were stored for.
+func (s *server) chartScanOptions(chart string, base scanOptions) (scanOptions, string, error) {
+	d, ok := s.chartDefaultsFor(chart)
+	if !ok {
+		return base, "", nil
+	}
+	var req scanRequest
+	json.Unmarshal(d.Options, &req)
+	opts, err := s.scanOptionsFor(req, cacheControl{})
+	if err != nil {
+		return base, "", fmt.Errorf("defaults of %s: %w", d.Chart, err)
+	}
+	opts.Share = base.Share
+	return opts, d.Chart, nil
+}
+
+// chartDefaultsHandler serves /chart-defaults: GET lists the defaults of
+// every chart, or with ?chart= those of one; PUT ?chart= replaces them
+// with the options in the body and DELETE ?chart= removes them. chart
+// may be an identity, a repo/chart reference or the URL of any version.
+func (s *server) chartDefaultsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodPut, http.MethodDelete:
+	default:
+		http.Error(w, "only GET, PUT and DELETE allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	chart := r.URL.Query().Get("chart")
+	if chart == "" {
+		if r.Method != http.MethodGet {
+			jsonError(w, http.StatusBadRequest, "chart is required")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(chartDefaultsResponse{Charts: s.chartDefaults.all()})
+		return
+	}
+	id, err := s.chartIdentity(chart)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	cur, found := s.chartDefaults.get(id)
+	switch r.Method {
+	case http.MethodGet:
+		if !found {
+			jsonError(w, http.StatusNotFound, fmt.Sprintf("no defaults for %s", id))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cur)
+		return
+	case http.MethodDelete:
+		if !s.adminAuthorized(w, r) {
+			return
+		}
+		if !found {
+			jsonError(w, http.StatusNotFound, fmt.Sprintf("no defaults for %s", id))
+			return
+		}
+		if err := s.recordChartDefaults(ChartDefaults{Chart: id, UpdatedAt: time.Now().UTC(), Deleted: true}); err != nil {
+			log.Printf("error: %v", err)
+			jsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Printf("defaults of %s removed", id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxChartDefaults+1))
+	if err != nil || len(data) > maxChartDefaults {
+		jsonError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	opts, err := s.parseChartOptions(data)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	d := ChartDefaults{Chart: id, Options: opts, UpdatedAt: time.Now().UTC()}
+	if err := s.recordChartDefaults(d); err != nil {
+		log.Printf("error: %v", err)
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("defaults of %s set", id)
+	w.Header().Set("Content-Type", "application/json")
+	if !found {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(d)
+}
+
+// recordChartDefaults stores d and audits the change, as the defaults may
+// set policies.
+func (s *server) recordChartDefaults(d ChartDefaults) error {
+	if err := s.chartDefaults.put(d); err != nil {
+		return err
+	}
+	details := map[string]string{"options": string(d.Options)}
+	if d.Deleted {
+		details = map[string]string{"deleted": "true"}
+	}
+	return s.audit.record(auditChartDefaults, "admin", d.Chart, details)
+}
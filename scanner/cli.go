@@ -0,0 +1,190 @@
+package scanner
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// stringList is a flag that may be given several times.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// runScan is the scan subcommand: it scans the charts named on the command
+// line and writes one JSON result per chart to stdout. Server settings
+// such as the concurrency are taken from the SCANNER_* environment
+// variables. It returns the exit code.
+func runScan(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: helm-image-scanner scan [flags] <chart>...")
+		fmt.Fprintln(stderr, "\nA chart is a chart archive URL, an oci:// reference or repo/chart.")
+		fs.PrintDefaults()
+	}
+	version := fs.String("version", "", "version constraint for repo/chart references, the latest stable version if empty")
+	var repos, valueFiles stringList
+	fs.Var(&repos, "repo", "chart repository as name=url, on top of Helm's repositories.yaml (repeatable)")
+	fs.Var(&valueFiles, "f", "values file merged over the chart's values, in order (repeatable)")
+	render := fs.Bool("render", envBool("SCANNER_RENDER", false), "render the chart templates")
+	releaseName := fs.String("release-name", "", "release name when rendering")
+	namespace := fs.String("namespace", "", "release namespace when rendering")
+	platforms := fs.String("platforms", "", "comma-separated platforms every image must support")
+	registriesOnly := fs.Bool("registries-only", false, "only list the registries and repositories of each chart, without inspecting images")
+	// Flags may follow the charts, as in `scan repo/chart --version 1.2.3`.
+	var charts []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		charts = append(charts, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(charts) == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := LoadConfig(nil)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	keys, err := loadKeyRing(cfg.SecretsKeyFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	helm, err := loadHelmConfig(cfg.HelmRepositories, cfg.HelmRegistryConfig, keys)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	for _, r := range repos {
+		name, u, ok := strings.Cut(r, "=")
+		if !ok || name == "" || !strings.Contains(u, "://") {
+			fmt.Fprintf(stderr, "invalid -repo %q, want name=url\n", r)
+			return 2
+		}
+		helm.addRepo(helmRepository{Name: name, URL: strings.TrimSuffix(u, "/")})
+	}
+	req := scanRequest{Options: Options{Render: render, ReleaseName: *releaseName, Namespace: *namespace, Platforms: splitList(*platforms)}}
+	for _, f := range valueFiles {
+		vals, err := readValuesFile(f)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		req.Values = mergeValues(req.Values, vals)
+	}
+
+	catalog, err := openCatalog(cfg.Catalog, cfg.CacheTTL)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	history, _ := openHistoryStore("")
+	crawls, _ := openCrawlState("")
+	s := newServer(cfg, history, crawls, nil, nil, nil, helm, catalog)
+	opts, err := s.scanOptionsFor(req, cacheControl{})
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	ctx := context.Background()
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	code := 0
+	for _, chart := range charts {
+		if *registriesOnly {
+			summary, err := s.registriesChartArg(ctx, chart, *version, opts)
+			if err != nil {
+				fmt.Fprintf(stderr, "scanning %s: %v\n", chart, err)
+				code = 1
+				continue
+			}
+			enc.Encode(summary)
+			continue
+		}
+		result, err := s.scanChartArg(ctx, chart, *version, opts)
+		if err != nil {
+			fmt.Fprintf(stderr, "scanning %s: %v\n", chart, err)
+			code = 1
+			continue
+		}
+		enc.Encode(result)
+		if result.Policy != nil && !result.Policy.Passed {
+			code = 1
+		}
+	}
+	return code
+}
+
+// scanChartArg scans a chart named on the command line, looking up
+// repo/chart references in the configured repositories.
+func (s *server) scanChartArg(ctx context.Context, chart, version string, opts scanOptions) (*ScanResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.ScanTimeout)
+	defer cancel()
+	chartURL, err := s.chartArgURL(ctx, chart, version)
+	if err != nil {
+		return nil, err
+	}
+	return s.scanChartForImages(ctx, chartURL, opts)
+}
+
+// registriesChartArg is scanChartArg for -registries-only.
+func (s *server) registriesChartArg(ctx context.Context, chart, version string, opts scanOptions) (*RegistrySummary, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.ScanTimeout)
+	defer cancel()
+	chartURL, err := s.chartArgURL(ctx, chart, version)
+	if err != nil {
+		return nil, err
+	}
+	return s.registrySummary(ctx, chartURL, opts)
+}
+
+func (s *server) chartArgURL(ctx context.Context, chart, version string) (string, error) {
+	if !isChartRef(chart) {
+		if version != "" {
+			return "", fmt.Errorf("-version applies to repo/chart references only")
+		}
+		return chart, nil
+	}
+	repo, name, err := s.splitChartRef(chart)
+	if err != nil {
+		return "", err
+	}
+	chartURL, _, err := s.locateChart(ctx, repo.URL, name, version)
+	if err != nil {
+		return "", fmt.Errorf("resolving chart: %w", err)
+	}
+	return chartURL, nil
+}
+
+func readValuesFile(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading values: %w", err)
+	}
+	var vals map[string]interface{}
+	if err := yaml.Unmarshal(data, &vals); err != nil {
+		return nil, fmt.Errorf("parsing values %s: %w", path, err)
+	}
+	return vals, nil
+}
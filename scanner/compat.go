@@ -0,0 +1,327 @@
+package scanner
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// CompatibilityReport checks a chart against a target Kubernetes version:
+// the kubeVersion constraints of the chart and its enabled subcharts, and
+// the API versions of the rendered manifests.
+type CompatibilityReport struct {
+	KubeVersion string `json:"kube_version"`
+	// Compatible is false when any issue other than a deprecation was
+	// found.
+	Compatible bool `json:"compatible"`
+	// APIsChecked is false when the chart was not rendered, so only the
+	// kubeVersion constraints could be checked.
+	APIsChecked bool                 `json:"apis_checked"`
+	Issues      []CompatibilityIssue `json:"issues,omitempty"`
+}
+
+// CompatibilityIssue types.
+const (
+	issueKubeVersion    = "kube_version"
+	issueRemovedAPI     = "removed_api"
+	issueUnavailableAPI = "unavailable_api"
+	issueDeprecatedAPI  = "deprecated_api"
+)
+
+type CompatibilityIssue struct {
+	Type        string `json:"type"`
+	Chart       string `json:"chart"`
+	Template    string `json:"template,omitempty"`
+	APIVersion  string `json:"api_version,omitempty"`
+	Kind        string `json:"kind,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+	Message     string `json:"message"`
+}
+
+// apiDeprecation is a group version, or some kinds of it, that Kubernetes
+// deprecated and removed. Versions are minor releases of Kubernetes 1.x.
+type apiDeprecation struct {
+	APIVersion  string
+	Kinds       []string // empty for every kind
+	Deprecated  int
+	Removed     int
+	Replacement string
+}
+
+var apiDeprecations = []apiDeprecation{
+	{"extensions/v1beta1", []string{"Deployment", "DaemonSet", "ReplicaSet"}, 9, 16, "apps/v1"},
+	{"extensions/v1beta1", []string{"NetworkPolicy"}, 9, 16, "networking.k8s.io/v1"},
+	{"extensions/v1beta1", []string{"PodSecurityPolicy"}, 10, 16, "policy/v1beta1"},
+	{"extensions/v1beta1", []string{"Ingress"}, 14, 22, "networking.k8s.io/v1"},
+	{"apps/v1beta1", nil, 9, 16, "apps/v1"},
+	{"apps/v1beta2", nil, 9, 16, "apps/v1"},
+	{"admissionregistration.k8s.io/v1beta1", nil, 16, 22, "admissionregistration.k8s.io/v1"},
+	{"apiextensions.k8s.io/v1beta1", nil, 16, 22, "apiextensions.k8s.io/v1"},
+	{"apiregistration.k8s.io/v1beta1", nil, 19, 22, "apiregistration.k8s.io/v1"},
+	{"authentication.k8s.io/v1beta1", nil, 19, 22, "authentication.k8s.io/v1"},
+	{"authorization.k8s.io/v1beta1", nil, 19, 22, "authorization.k8s.io/v1"},
+	{"certificates.k8s.io/v1beta1", nil, 19, 22, "certificates.k8s.io/v1"},
+	{"coordination.k8s.io/v1beta1", nil, 19, 22, "coordination.k8s.io/v1"},
+	{"networking.k8s.io/v1beta1", []string{"Ingress", "IngressClass"}, 19, 22, "networking.k8s.io/v1"},
+	{"rbac.authorization.k8s.io/v1beta1", nil, 17, 22, "rbac.authorization.k8s.io/v1"},
+	{"scheduling.k8s.io/v1beta1", nil, 14, 22, "scheduling.k8s.io/v1"},
+	{"storage.k8s.io/v1beta1", []string{"CSIDriver", "CSINode", "StorageClass", "VolumeAttachment"}, 19, 22, "storage.k8s.io/v1"},
+	{"batch/v1beta1", []string{"CronJob"}, 21, 25, "batch/v1"},
+	{"discovery.k8s.io/v1beta1", nil, 21, 25, "discovery.k8s.io/v1"},
+	{"events.k8s.io/v1beta1", nil, 19, 25, "events.k8s.io/v1"},
+	{"autoscaling/v2beta1", nil, 22, 25, "autoscaling/v2"},
+	{"policy/v1beta1", []string{"PodDisruptionBudget"}, 21, 25, "policy/v1"},
+	{"policy/v1beta1", []string{"PodSecurityPolicy"}, 21, 25, ""},
+	{"node.k8s.io/v1beta1", nil, 20, 25, "node.k8s.io/v1"},
+	{"autoscaling/v2beta2", nil, 23, 26, "autoscaling/v2"},
+	{"flowcontrol.apiserver.k8s.io/v1beta1", nil, 23, 26, "flowcontrol.apiserver.k8s.io/v1"},
+	{"storage.k8s.io/v1beta1", []string{"CSIStorageCapacity"}, 24, 27, "storage.k8s.io/v1"},
+	{"flowcontrol.apiserver.k8s.io/v1beta2", nil, 26, 29, "flowcontrol.apiserver.k8s.io/v1"},
+	{"flowcontrol.apiserver.k8s.io/v1beta3", nil, 29, 32, "flowcontrol.apiserver.k8s.io/v1"},
+}
+
+// apiIntroduction is a group version, or some kinds of it, that only
+// recent Kubernetes releases serve.
+type apiIntroduction struct {
+	APIVersion string
+	Kinds      []string
+	Introduced int
+}
+
+var apiIntroductions = []apiIntroduction{
+	{"certificates.k8s.io/v1", nil, 19},
+	{"events.k8s.io/v1", nil, 19},
+	{"networking.k8s.io/v1", []string{"Ingress", "IngressClass"}, 19},
+	{"node.k8s.io/v1", nil, 20},
+	{"batch/v1", []string{"CronJob"}, 21},
+	{"discovery.k8s.io/v1", nil, 21},
+	{"policy/v1", nil, 21},
+	{"autoscaling/v2", nil, 23},
+	{"flowcontrol.apiserver.k8s.io/v1beta3", nil, 26},
+	{"flowcontrol.apiserver.k8s.io/v1", nil, 29},
+}
+
+func matchesKind(kinds []string, kind string) bool {
+	if len(kinds) == 0 {
+		return true
+	}
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func findDeprecation(apiVersion, kind string) (apiDeprecation, bool) {
+	for _, d := range apiDeprecations {
+		if d.APIVersion == apiVersion && matchesKind(d.Kinds, kind) {
+			return d, true
+		}
+	}
+	return apiDeprecation{}, false
+}
+
+// normalizeKubeVersion accepts "1.29", "v1.29.3" and the like and returns
+// the "v1.29.3" form along with the minor version.
+func normalizeKubeVersion(s string) (string, int, error) {
+	v, err := parseSemver(s)
+	if err != nil || v.wild > 1 || v.major != 1 {
+		return "", 0, fmt.Errorf("invalid Kubernetes version %q, want e.g. 1.29 or v1.29.3", s)
+	}
+	out := fmt.Sprintf("v%d.%d.%d", v.major, v.minor, v.patch)
+	if v.pre != "" {
+		out += "-" + v.pre
+	}
+	return out, int(v.minor), nil
+}
+
+// apiVersionsFor returns .Capabilities.APIVersions as a cluster of the
+// given version serves them, so that charts choosing an API version by
+// capability render what they would install there.
+func apiVersionsFor(kubeVersion string) apiVersionSet {
+	_, minor, err := normalizeKubeVersion(kubeVersion)
+	if err != nil {
+		return defaultAPIVersions
+	}
+	set := make(map[string]bool)
+	for _, gv := range defaultAPIVersions {
+		set[gv] = true
+	}
+	for _, in := range apiIntroductions {
+		if len(in.Kinds) == 0 && minor < in.Introduced {
+			delete(set, in.APIVersion)
+		}
+	}
+	for _, d := range apiDeprecations {
+		if minor < d.Removed {
+			set[d.APIVersion] = true
+		}
+	}
+	out := make(apiVersionSet, 0, len(set))
+	for gv := range set {
+		out = append(out, gv)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// checkCompatibility builds the compatibility report of a chart for the
+// target version. manifests are the rendered templates; rendered is false
+// when the chart was not rendered.
+func checkCompatibility(target string, files []chartFile, user map[string]interface{}, manifests []renderedManifest, rendered bool) *CompatibilityReport {
+	version, minor, err := normalizeKubeVersion(target)
+	if err != nil {
+		return nil
+	}
+	rep := &CompatibilityReport{KubeVersion: version, APIsChecked: rendered}
+	charts, err := enabledCharts(files, user)
+	if err != nil {
+		return nil
+	}
+
+	for _, c := range charts {
+		constraint := c.meta.KubeVersion
+		if constraint == "" {
+			continue
+		}
+		ok, err := semverCompare(constraint, version)
+		if err != nil {
+			rep.Issues = append(rep.Issues, CompatibilityIssue{
+				Type:    issueKubeVersion,
+				Chart:   c.meta.Name,
+				Message: fmt.Sprintf("kubeVersion %q cannot be checked: %v", constraint, err),
+			})
+		} else if !ok {
+			rep.Issues = append(rep.Issues, CompatibilityIssue{
+				Type:    issueKubeVersion,
+				Chart:   c.meta.Name,
+				Message: fmt.Sprintf("chart requires kubeVersion %s, which Kubernetes %s does not satisfy", constraint, version),
+			})
+		}
+	}
+
+	for _, m := range manifests {
+		chart := chartOfTemplate(charts, m.Template)
+		docs, _ := decodeDocuments(m.Data)
+		for _, d := range docs {
+			apiVersion, kind := valueString(d["apiVersion"]), manifestKind(d)
+			if issue, ok := apiIssue(apiVersion, kind, minor); ok {
+				issue.Chart, issue.Template = chart, m.Template
+				rep.Issues = append(rep.Issues, issue)
+			}
+		}
+	}
+
+	rep.Compatible = true
+	for _, i := range rep.Issues {
+		if i.Type != issueDeprecatedAPI {
+			rep.Compatible = false
+		}
+	}
+	return rep
+}
+
+// apiIssue reports an object's API version that Kubernetes 1.minor no
+// longer serves, does not serve yet or has deprecated.
+func apiIssue(apiVersion, kind string, minor int) (CompatibilityIssue, bool) {
+	issue := CompatibilityIssue{APIVersion: apiVersion, Kind: kind}
+	if d, ok := findDeprecation(apiVersion, kind); ok && minor >= d.Deprecated {
+		issue.Replacement = d.Replacement
+		if minor >= d.Removed {
+			issue.Type = issueRemovedAPI
+			issue.Message = fmt.Sprintf("%s %s was removed in Kubernetes 1.%d", apiVersion, kind, d.Removed)
+		} else {
+			issue.Type = issueDeprecatedAPI
+			issue.Message = fmt.Sprintf("%s %s is deprecated since Kubernetes 1.%d and removed in 1.%d", apiVersion, kind, d.Deprecated, d.Removed)
+		}
+		if d.Replacement != "" {
+			issue.Message += "; use " + d.Replacement
+		}
+		return issue, true
+	}
+	for _, in := range apiIntroductions {
+		if in.APIVersion == apiVersion && matchesKind(in.Kinds, kind) && minor < in.Introduced {
+			issue.Type = issueUnavailableAPI
+			issue.Message = fmt.Sprintf("%s %s requires Kubernetes 1.%d", apiVersion, kind, in.Introduced)
+			return issue, true
+		}
+	}
+	return issue, false
+}
+
+// enabledCharts lists the chart in files and the subcharts enabled with
+// the given values.
+func enabledCharts(files []chartFile, user map[string]interface{}) ([]*helmChart, error) {
+	root, err := buildChartTree(files)
+	if err != nil {
+		return nil, err
+	}
+	var charts []*helmChart
+	var walk func(t *valuesTree)
+	walk = func(t *valuesTree) {
+		charts = append(charts, t.chart)
+		for _, sub := range t.subcharts {
+			walk(sub)
+		}
+	}
+	walk(coalesceValues(root, user))
+	return charts, nil
+}
+
+// DeprecatedAPI is a rendered object using an API version Kubernetes has
+// deprecated, whether or not it has been removed yet.
+type DeprecatedAPI struct {
+	Chart        string `json:"chart"`
+	Template     string `json:"template"`
+	APIVersion   string `json:"api_version"`
+	Kind         string `json:"kind"`
+	Name         string `json:"name,omitempty"`
+	DeprecatedIn string `json:"deprecated_in"`
+	RemovedIn    string `json:"removed_in"`
+	Replacement  string `json:"replacement,omitempty"`
+}
+
+// findDeprecatedAPIs looks up every rendered object in the deprecation
+// table.
+func findDeprecatedAPIs(charts []*helmChart, manifests []renderedManifest) []DeprecatedAPI {
+	var out []DeprecatedAPI
+	for _, m := range manifests {
+		docs, _ := decodeDocuments(m.Data)
+		for _, doc := range docs {
+			apiVersion, kind := valueString(doc["apiVersion"]), manifestKind(doc)
+			d, ok := findDeprecation(apiVersion, kind)
+			if !ok {
+				continue
+			}
+			out = append(out, DeprecatedAPI{
+				Chart:        chartOfTemplate(charts, m.Template),
+				Template:     m.Template,
+				APIVersion:   apiVersion,
+				Kind:         kind,
+				Name:         valueString(lookupValue(doc, "metadata.name")),
+				DeprecatedIn: fmt.Sprintf("1.%d", d.Deprecated),
+				RemovedIn:    fmt.Sprintf("1.%d", d.Removed),
+				Replacement:  d.Replacement,
+			})
+		}
+	}
+	return out
+}
+
+// chartOfTemplate names the chart a rendered template belongs to: the one
+// with the deepest directory containing it.
+func chartOfTemplate(charts []*helmChart, template string) string {
+	best := ""
+	var name string
+	for _, c := range charts {
+		if strings.HasPrefix(template, c.dir+"/") && len(c.dir) > len(best) {
+			best, name = c.dir, c.meta.Name
+		}
+	}
+	if name == "" {
+		return path.Dir(template)
+	}
+	return name
+}
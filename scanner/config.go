@@ -0,0 +1,543 @@
+package scanner
+
+import (
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// Config holds the server-wide settings. Every field but the hooks at the
+// end can be set with a command-line flag, and the flag defaults can be
+// overridden through the environment variable named in its usage string.
+// The hooks are for programs embedding the scanner.
+type Config struct {
+	Addr           string
+	BasePath       string
+	TrustForwarded bool
+	// TrustedProxies are the peers whose X-Forwarded-* headers are read
+	// when TrustForwarded is set.
+	TrustedProxies []netip.Prefix
+	MaxScans       int
+	Concurrency    int
+	ImageTimeout   time.Duration
+	ScanTimeout    time.Duration
+	Inspection     string
+	CacheTTL       time.Duration
+	HistoryFile    string
+	Sinks          string
+	// Store names where finished scans are kept for /results.
+	Store string
+	// AdminToken enables the /admin endpoints for bearers of it.
+	AdminToken string
+	// APIKeysFile and OIDCIssuer, when set, close the API to callers
+	// without an API key or a token of the issuer for OIDCAudience.
+	APIKeysFile  string
+	OIDCIssuer   string
+	OIDCAudience string
+	// Failed sink deliveries are tried again SinkRetries times, waiting
+	// SinkBackoff, then twice as long each time.
+	SinkRetries int
+	SinkBackoff time.Duration
+	// Record writes every outbound response to a directory; Replay
+	// answers outbound requests from such a directory instead of the
+	// network.
+	Record string
+	Replay string
+	// Catalog is the source of image owner metadata.
+	Catalog string
+	// SuppressWarnings are left out of every scan's warnings.
+	SuppressWarnings []string
+	// LargeImageBytes is the compressed size above which an image is
+	// LARGE_IMAGE.
+	LargeImageBytes int64
+	// BaseImages are the images that layers are attributed to.
+	BaseImages []string
+	// EOLFeed is the source of release cycle support dates; EOLProducts
+	// map repositories to its products.
+	EOLFeed     string
+	EOLProducts []string
+	// CheckLinks checks the links of every chart's metadata.
+	CheckLinks bool
+
+	// Template rendering and its sandbox limits.
+	Render          bool
+	RenderTimeout   time.Duration
+	RenderMaxOutput int64
+	RenderMaxDepth  int
+
+	// Workspaces on disk for Git clones: WorkDir holds at most
+	// MaxWorkspaces of them, each of at most WorkspaceQuota bytes.
+	WorkDir        string
+	WorkspaceQuota int64
+	MaxWorkspaces  int
+
+	// Outbound politeness: the User-Agent sent everywhere and the pacing
+	// of requests, in total and per host.
+	UserAgent         string
+	MaxRequestsPerSec int
+	HostInterval      time.Duration
+
+	// Connection reuse: HTTP/2 where the host offers it, and how many
+	// idle connections to each host are kept, for how long.
+	HTTP2               bool
+	KeepAlive           time.Duration
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+
+	// Untrusted switches on the hardened mode for public-facing
+	// deployments; AllowedHosts is then the complete list of hosts the
+	// service may contact.
+	Untrusted    bool
+	AllowedHosts []string
+	// Pins map hosts to the addresses dialed instead of resolving them;
+	// DNSCacheTTL keeps the answers for other hosts.
+	Pins        map[string][]string
+	DNSCacheTTL time.Duration
+
+	// Scheduled differential crawls of chart repositories.
+	CrawlRepos     []string
+	CrawlInterval  time.Duration
+	CrawlStateFile string
+	// BulkWindows are the times crawls may scan in, in BulkTimezone; none
+	// leaves them unrestricted.
+	BulkWindows  []scanWindow
+	BulkTimezone *time.Location
+
+	// ApprovalsFile records the approvals of stored scans for releases.
+	ApprovalsFile string
+	// ChartDefaultsFile records the scan options stored per chart.
+	ChartDefaultsFile string
+	// AuditFile is the hash-chained log of approvals, policy and
+	// credential changes.
+	AuditFile string
+
+	// Policies applied to every scan.
+	RequireDigest     bool
+	NoHardcodedImages bool
+	// TrustedDockerHub fails charts with Docker Hub images whose publisher
+	// has none of DockerHubTrustedBadges and is not one of
+	// DockerHubTrustedNamespaces. Badges are looked up at DockerHubAPI.
+	TrustedDockerHub           bool
+	DockerHubAPI               string
+	DockerHubTrustedBadges     []string
+	DockerHubTrustedNamespaces []string
+	// Issues is the tracker crawls open issues about policy violations
+	// in, assigned to the owners in the catalog's IssuesAssigneeField.
+	Issues              string
+	IssuesAssigneeField string
+	// Platforms every image is checked for, unless a request names its
+	// own.
+	Platforms []string
+	// Prices turn on the cost estimate of every scan.
+	Prices CostPrices
+	// Rewrites map image prefixes to the mirrors every scan checks the
+	// images in.
+	Rewrites map[string]string
+	// Mirrors are the mirrors images are inspected at when faster than
+	// their registry, probed again after MirrorHealthTTL.
+	Mirrors         []rewriteRule
+	MirrorHealthTTL time.Duration
+	// ProfilesFile holds the named option presets requests can select.
+	ProfilesFile string
+
+	// Helm's repositories.yaml and registry config, for repo/chart
+	// references and repository credentials.
+	HelmRepositories   string
+	HelmRegistryConfig string
+
+	// Cluster access for comparing charts with deployed releases.
+	Kubeconfig string
+	InCluster  bool
+
+	// LogLevel is the lowest level logged at startup.
+	LogLevel string
+	// SizeUnits adds human-readable sizes to responses unless a request
+	// asks otherwise.
+	SizeUnits sizeUnits
+	// StartupChecks checks repositories, registries, clusters and the
+	// result store before serving.
+	StartupChecks bool
+
+	// SecretsKeyFile holds the keys that decrypt encrypted credential
+	// files.
+	SecretsKeyFile string
+
+	// Bounds for per-request overrides; MaxImages also caps the images
+	// one scan inspects, 0 leaving it open.
+	MaxConcurrency   int
+	AllowDeep        bool
+	AllowCacheBypass bool
+	MaxImages        int
+
+	// Authenticators are tried after the built-in ones. Like API keys,
+	// they close the API to requests none of the authenticators vouches
+	// for.
+	Authenticators []Authenticator
+	// ExtraSinks receive every finished scan after the sinks of Sinks,
+	// reported in /deliveries under their Go type.
+	ExtraSinks []Sink
+	// ResultStore, when set, keeps finished scans in place of the store
+	// Store names. Serve closes it when it returns.
+	ResultStore ResultStore
+}
+
+const (
+	inspectionMetadata = "metadata"
+	inspectionDeep     = "deep"
+)
+
+// LoadConfig parses the server's flags in args over the defaults the
+// SCANNER_* environment variables set.
+func LoadConfig(args []string) (Config, error) {
+	var cfg Config
+	fs := flag.NewFlagSet("helm-image-scanner", flag.ContinueOnError)
+	fs.StringVar(&cfg.Addr, "addr", envString("SCANNER_ADDR", ":8080"),
+		"listen address (SCANNER_ADDR)")
+	fs.StringVar(&cfg.BasePath, "base-path", envString("SCANNER_BASE_PATH", ""),
+		"path prefix to serve under, e.g. /image-scanner (SCANNER_BASE_PATH)")
+	fs.BoolVar(&cfg.TrustForwarded, "trust-forwarded-headers", envBool("SCANNER_TRUST_FORWARDED_HEADERS", false),
+		"build links from X-Forwarded-Proto/Host/Prefix set by a reverse proxy (SCANNER_TRUST_FORWARDED_HEADERS)")
+	trustedProxies := fs.String("trusted-proxies", envString("SCANNER_TRUSTED_PROXIES", defaultTrustedProxies),
+		"comma-separated addresses or CIDR ranges of the proxies whose X-Forwarded-* headers are trusted (SCANNER_TRUSTED_PROXIES)")
+	fs.IntVar(&cfg.MaxScans, "max-scans", envInt("SCANNER_MAX_SCANS", 4),
+		"scans run at the same time, further scans queue (SCANNER_MAX_SCANS)")
+	fs.IntVar(&cfg.Concurrency, "concurrency", envInt("SCANNER_CONCURRENCY", 5),
+		"images inspected concurrently per scan (SCANNER_CONCURRENCY)")
+	fs.DurationVar(&cfg.ImageTimeout, "image-timeout", envDuration("SCANNER_IMAGE_TIMEOUT", 2*time.Minute),
+		"upper bound for inspecting a single image (SCANNER_IMAGE_TIMEOUT)")
+	fs.DurationVar(&cfg.ScanTimeout, "scan-timeout", envDuration("SCANNER_SCAN_TIMEOUT", 10*time.Minute),
+		"deadline for a whole scan, including the chart download (SCANNER_SCAN_TIMEOUT)")
+	fs.StringVar(&cfg.Inspection, "inspection", envString("SCANNER_INSPECTION", inspectionMetadata),
+		"default inspection depth, metadata or deep (SCANNER_INSPECTION)")
+	fs.DurationVar(&cfg.CacheTTL, "cache-ttl", envDuration("SCANNER_CACHE_TTL", time.Hour),
+		"how long inspection results are cached, 0 disables (SCANNER_CACHE_TTL)")
+	fs.StringVar(&cfg.HistoryFile, "history-file", envString("SCANNER_HISTORY_FILE", ""),
+		"file to persist per-image size history in, empty keeps it in memory (SCANNER_HISTORY_FILE)")
+	fs.StringVar(&cfg.Sinks, "sinks", envString("SCANNER_SINKS", ""),
+		"comma-separated destinations every scan result is written to (SCANNER_SINKS)")
+	fs.StringVar(&cfg.Store, "store", envString("SCANNER_STORE", ""),
+		"where finished scans are kept for /results: memory or a file for the embedded store (SCANNER_STORE)")
+	fs.StringVar(&cfg.AdminToken, "admin-token", envString("SCANNER_ADMIN_TOKEN", ""),
+		"bearer token for the /admin backup and restore endpoints, empty disables them (SCANNER_ADMIN_TOKEN)")
+	fs.StringVar(&cfg.APIKeysFile, "api-keys-file", envString("SCANNER_API_KEYS_FILE", ""),
+		"file of \"<name> <key>\" lines; when set, API requests need one of the keys (SCANNER_API_KEYS_FILE)")
+	fs.StringVar(&cfg.OIDCIssuer, "oidc-issuer", envString("SCANNER_OIDC_ISSUER", ""),
+		"OpenID Connect issuer URL; when set, API requests may authenticate with its tokens (SCANNER_OIDC_ISSUER)")
+	fs.StringVar(&cfg.OIDCAudience, "oidc-audience", envString("SCANNER_OIDC_AUDIENCE", ""),
+		"audience OIDC tokens must be issued for (SCANNER_OIDC_AUDIENCE)")
+	fs.IntVar(&cfg.SinkRetries, "sink-retries", envInt("SCANNER_SINK_RETRIES", 5),
+		"times a failed sink delivery is tried again before it becomes a dead letter (SCANNER_SINK_RETRIES)")
+	fs.DurationVar(&cfg.SinkBackoff, "sink-backoff", envDuration("SCANNER_SINK_BACKOFF", 2*time.Second),
+		"wait before the first retry of a sink delivery, doubling with each retry (SCANNER_SINK_BACKOFF)")
+	fs.StringVar(&cfg.Catalog, "catalog", envString("SCANNER_CATALOG", ""),
+		"image catalog adding owner metadata: a .json or .csv file or an http(s) service (SCANNER_CATALOG)")
+	suppress := fs.String("suppress-warnings", envString("SCANNER_SUPPRESS_WARNINGS", ""),
+		"comma-separated warning codes, or CODE:prefix, left out of every scan (SCANNER_SUPPRESS_WARNINGS)")
+	fs.Int64Var(&cfg.LargeImageBytes, "large-image-bytes", int64(envInt("SCANNER_LARGE_IMAGE_BYTES", defaultLargeImageBytes)),
+		"compressed size above which an image is LARGE_IMAGE, 0 disables the warning (SCANNER_LARGE_IMAGE_BYTES)")
+	baseImages := fs.String("base-images", envString("SCANNER_BASE_IMAGES", ""),
+		"comma-separated base images, e.g. docker.io/library/debian:12, that image layers are attributed to (SCANNER_BASE_IMAGES)")
+	fs.StringVar(&cfg.EOLFeed, "eol-feed", envString("SCANNER_EOL_FEED", ""),
+		"end-of-life feed flagging images past end of support: an endoflife.date-style API URL such as https://endoflife.date/api, or a .json file (SCANNER_EOL_FEED)")
+	eolProducts := fs.String("eol-products", envString("SCANNER_EOL_PRODUCTS", ""),
+		"comma-separated repository=product mappings to the EOL feed's products, a repository may end in /* (SCANNER_EOL_PRODUCTS)")
+	fs.BoolVar(&cfg.CheckLinks, "check-links", envBool("SCANNER_CHECK_LINKS", false),
+		"check that the icon, home and sources links of every chart are reachable (SCANNER_CHECK_LINKS)")
+	fs.BoolVar(&cfg.Render, "render", envBool("SCANNER_RENDER", false),
+		"render chart templates by default (SCANNER_RENDER)")
+	fs.DurationVar(&cfg.RenderTimeout, "render-timeout", envDuration("SCANNER_RENDER_TIMEOUT", 15*time.Second),
+		"wall-clock limit for rendering one chart (SCANNER_RENDER_TIMEOUT)")
+	fs.Int64Var(&cfg.RenderMaxOutput, "render-max-output", int64(envInt("SCANNER_RENDER_MAX_OUTPUT", 32<<20)),
+		"bytes templates may produce while rendering one chart (SCANNER_RENDER_MAX_OUTPUT)")
+	fs.IntVar(&cfg.RenderMaxDepth, "render-max-depth", envInt("SCANNER_RENDER_MAX_DEPTH", 64),
+		"maximum nesting of include and tpl calls (SCANNER_RENDER_MAX_DEPTH)")
+	fs.StringVar(&cfg.WorkDir, "work-dir", envString("SCANNER_WORK_DIR", filepath.Join(os.TempDir(), "helm-image-scanner")),
+		"directory of the per-scan workspaces Git repositories are cloned into, swept at startup (SCANNER_WORK_DIR)")
+	fs.Int64Var(&cfg.WorkspaceQuota, "workspace-quota", int64(envInt("SCANNER_WORKSPACE_QUOTA", 512<<20)),
+		"bytes one workspace may hold before its clone is aborted (SCANNER_WORKSPACE_QUOTA)")
+	fs.IntVar(&cfg.MaxWorkspaces, "max-workspaces", envInt("SCANNER_MAX_WORKSPACES", 4),
+		"workspaces in use at a time; further clones wait (SCANNER_MAX_WORKSPACES)")
+	fs.StringVar(&cfg.UserAgent, "user-agent", envString("SCANNER_USER_AGENT", "helm-image-scanner"),
+		"User-Agent of chart downloads and registry requests (SCANNER_USER_AGENT)")
+	fs.IntVar(&cfg.MaxRequestsPerSec, "max-requests-per-second", envInt("SCANNER_MAX_REQUESTS_PER_SECOND", 0),
+		"outbound requests per second across all hosts, 0 is unlimited (SCANNER_MAX_REQUESTS_PER_SECOND)")
+	fs.DurationVar(&cfg.HostInterval, "host-interval", envDuration("SCANNER_HOST_INTERVAL", 0),
+		"least time between two requests to the same host (SCANNER_HOST_INTERVAL)")
+	fs.BoolVar(&cfg.HTTP2, "http2", envBool("SCANNER_HTTP2", true),
+		"use HTTP/2 with registries and other hosts that offer it over TLS (SCANNER_HTTP2)")
+	fs.DurationVar(&cfg.KeepAlive, "keep-alive", envDuration("SCANNER_KEEP_ALIVE", 90*time.Second),
+		"how long an idle connection is kept for reuse, 0 closes connections after each request (SCANNER_KEEP_ALIVE)")
+	fs.IntVar(&cfg.MaxIdleConnsPerHost, "max-idle-conns-per-host", envInt("SCANNER_MAX_IDLE_CONNS_PER_HOST", 16),
+		"idle connections kept per host (SCANNER_MAX_IDLE_CONNS_PER_HOST)")
+	fs.IntVar(&cfg.MaxConnsPerHost, "max-conns-per-host", envInt("SCANNER_MAX_CONNS_PER_HOST", 0),
+		"connections open to one host at a time, 0 is unlimited (SCANNER_MAX_CONNS_PER_HOST)")
+	fs.BoolVar(&cfg.Untrusted, "untrusted", envBool("SCANNER_UNTRUSTED", false),
+		"hardened mode for charts from unknown sources (SCANNER_UNTRUSTED)")
+	allowedHosts := fs.String("allowed-hosts", envString("SCANNER_ALLOWED_HOSTS", ""),
+		"comma-separated hosts reachable in untrusted mode, *.example.com allowed (SCANNER_ALLOWED_HOSTS)")
+	pins := fs.String("resolve", envString("SCANNER_RESOLVE", ""),
+		"comma-separated host=ip pins dialed instead of resolving the hosts, *.example.com allowed (SCANNER_RESOLVE)")
+	fs.DurationVar(&cfg.DNSCacheTTL, "dns-cache-ttl", envDuration("SCANNER_DNS_CACHE_TTL", 0),
+		"how long to keep DNS answers for outbound hosts, 0 to resolve every connection (SCANNER_DNS_CACHE_TTL)")
+	crawlRepos := fs.String("crawl-repos", envString("SCANNER_CRAWL_REPOS", ""),
+		"comma-separated chart repository URLs crawled on a schedule (SCANNER_CRAWL_REPOS)")
+	fs.DurationVar(&cfg.CrawlInterval, "crawl-interval", envDuration("SCANNER_CRAWL_INTERVAL", 24*time.Hour),
+		"time between scheduled crawls (SCANNER_CRAWL_INTERVAL)")
+	fs.StringVar(&cfg.CrawlStateFile, "crawl-state-file", envString("SCANNER_CRAWL_STATE_FILE", ""),
+		"file recording crawled chart versions, empty keeps it in memory (SCANNER_CRAWL_STATE_FILE)")
+	bulkWindows := fs.String("bulk-windows", envString("SCANNER_BULK_WINDOWS", ""),
+		"comma-separated windows crawls may scan in, e.g. \"Mon-Fri 22:00-06:00=2\", with optional concurrency after = (SCANNER_BULK_WINDOWS)")
+	bulkTimezone := fs.String("bulk-windows-timezone", envString("SCANNER_BULK_WINDOWS_TIMEZONE", "Local"),
+		"time zone of -bulk-windows, e.g. Europe/Berlin (SCANNER_BULK_WINDOWS_TIMEZONE)")
+	fs.StringVar(&cfg.ApprovalsFile, "approvals-file", envString("SCANNER_APPROVALS_FILE", ""),
+		"file recording the release approvals of stored scans, empty keeps them in memory (SCANNER_APPROVALS_FILE)")
+	fs.StringVar(&cfg.ChartDefaultsFile, "chart-defaults-file", envString("SCANNER_CHART_DEFAULTS_FILE", ""),
+		"file recording the scan options stored per chart, empty keeps them in memory (SCANNER_CHART_DEFAULTS_FILE)")
+	fs.StringVar(&cfg.AuditFile, "audit-file", envString("SCANNER_AUDIT_FILE", ""),
+		"append-only file of approvals, policy and credential changes, empty keeps it in memory (SCANNER_AUDIT_FILE)")
+	fs.BoolVar(&cfg.RequireDigest, "require-digest", envBool("SCANNER_REQUIRE_DIGEST", false),
+		"fail charts that reference images by tag instead of digest (SCANNER_REQUIRE_DIGEST)")
+	fs.BoolVar(&cfg.NoHardcodedImages, "no-hardcoded-images", envBool("SCANNER_NO_HARDCODED_IMAGES", false),
+		"fail charts with images written in templates instead of set through values (SCANNER_NO_HARDCODED_IMAGES)")
+	fs.BoolVar(&cfg.TrustedDockerHub, "trusted-docker-hub", envBool("SCANNER_TRUSTED_DOCKER_HUB", false),
+		"fail charts with Docker Hub images from untrusted publishers (SCANNER_TRUSTED_DOCKER_HUB)")
+	fs.StringVar(&cfg.DockerHubAPI, "docker-hub-api", envString("SCANNER_DOCKER_HUB_API", "https://hub.docker.com"),
+		"Docker Hub API publisher badges are looked up at (SCANNER_DOCKER_HUB_API)")
+	hubBadgeList := fs.String("docker-hub-trusted-badges", envString("SCANNER_DOCKER_HUB_TRUSTED_BADGES", hubOfficial+","+hubVerified),
+		"comma-separated publisher badges trusted_docker_hub accepts: official, verified_publisher, open_source (SCANNER_DOCKER_HUB_TRUSTED_BADGES)")
+	hubNamespaces := fs.String("docker-hub-trusted-namespaces", envString("SCANNER_DOCKER_HUB_TRUSTED_NAMESPACES", ""),
+		"comma-separated Docker Hub namespaces trusted_docker_hub accepts whatever their badge (SCANNER_DOCKER_HUB_TRUSTED_NAMESPACES)")
+	fs.StringVar(&cfg.Issues, "issues", envString("SCANNER_ISSUES", ""),
+		"tracker crawls open issues about policy violations in: github:owner/repo or jira:https://jira.example.com?project=KEY (SCANNER_ISSUES)")
+	fs.StringVar(&cfg.IssuesAssigneeField, "issues-assignee-field", envString("SCANNER_ISSUES_ASSIGNEE_FIELD", "owner"),
+		"catalog field naming the tracker user an issue is assigned to (SCANNER_ISSUES_ASSIGNEE_FIELD)")
+	platforms := fs.String("platforms", envString("SCANNER_PLATFORMS", ""),
+		"comma-separated platforms every image must support, e.g. linux/amd64,linux/arm64 (SCANNER_PLATFORMS)")
+	fs.Float64Var(&cfg.Prices.StoragePerGiBMonth, "storage-price", envFloat("SCANNER_STORAGE_PRICE", 0),
+		"registry storage price per GiB and month for cost estimates (SCANNER_STORAGE_PRICE)")
+	fs.Float64Var(&cfg.Prices.EgressPerGiB, "egress-price", envFloat("SCANNER_EGRESS_PRICE", 0),
+		"registry egress price per GiB for cost estimates (SCANNER_EGRESS_PRICE)")
+	fs.Float64Var(&cfg.Prices.PullsPerMonth, "pulls-per-month", envFloat("SCANNER_PULLS_PER_MONTH", 0),
+		"full pulls of a chart's images per month in cost estimates (SCANNER_PULLS_PER_MONTH)")
+	mirrors := fs.String("mirrors", envString("SCANNER_MIRRORS", ""),
+		"comma-separated from=to mirrors images are inspected at when faster than their registry or when it rate limits, a registry may have several (SCANNER_MIRRORS)")
+	fs.DurationVar(&cfg.MirrorHealthTTL, "mirror-health-ttl", envDuration("SCANNER_MIRROR_HEALTH_TTL", time.Minute),
+		"how long a probe or failure of a mirror is remembered (SCANNER_MIRROR_HEALTH_TTL)")
+	rewrites := fs.String("rewrites", envString("SCANNER_REWRITES", ""),
+		"comma-separated from=to image prefixes to check in mirrors, e.g. docker.io=harbor.example.com/dockerhub (SCANNER_REWRITES)")
+	fs.StringVar(&cfg.ProfilesFile, "profiles", envString("SCANNER_PROFILES", ""),
+		"YAML file of named scan option presets (SCANNER_PROFILES)")
+	fs.StringVar(&cfg.HelmRepositories, "helm-repositories", envString("SCANNER_HELM_REPOSITORIES", defaultHelmPath("HELM_REPOSITORY_CONFIG", "repositories.yaml")),
+		"Helm repositories.yaml to resolve repo/chart references with, ignored if missing (SCANNER_HELM_REPOSITORIES)")
+	fs.StringVar(&cfg.HelmRegistryConfig, "helm-registry-config", envString("SCANNER_HELM_REGISTRY_CONFIG", defaultHelmPath("HELM_REGISTRY_CONFIG", "registry", "config.json")),
+		"Helm registry logins used for OCI registries, ignored if missing (SCANNER_HELM_REGISTRY_CONFIG)")
+	fs.StringVar(&cfg.Record, "record", envString("SCANNER_RECORD", ""),
+		"directory to record chart and registry responses in, for -replay (SCANNER_RECORD)")
+	fs.StringVar(&cfg.Replay, "replay", envString("SCANNER_REPLAY", ""),
+		"directory of recorded responses to answer chart and registry requests from, without network access (SCANNER_REPLAY)")
+	fs.StringVar(&cfg.Kubeconfig, "kubeconfig", envString("SCANNER_KUBECONFIG", ""),
+		"kubeconfig for reading deployed releases, empty disables cluster access (SCANNER_KUBECONFIG)")
+	fs.StringVar(&cfg.LogLevel, "log-level", envString("SCANNER_LOG_LEVEL", "info"),
+		"lowest level logged: debug, info, warning or error; changeable through /admin/log-level (SCANNER_LOG_LEVEL)")
+	units := fs.String("size-units", envString("SCANNER_SIZE_UNITS", ""),
+		"add human-readable sizes next to byte counts in responses: binary or decimal, empty for none (SCANNER_SIZE_UNITS)")
+	fs.BoolVar(&cfg.StartupChecks, "startup-checks", envBool("SCANNER_STARTUP_CHECKS", false),
+		"refuse to start unless every Helm repository, registry login, cluster context and the result store answer (SCANNER_STARTUP_CHECKS)")
+	fs.StringVar(&cfg.SecretsKeyFile, "secrets-key-file", envString("SCANNER_SECRETS_KEY_FILE", ""),
+		"key file decrypting credential files encrypted with the secrets subcommand (SCANNER_SECRETS_KEY_FILE)")
+	fs.BoolVar(&cfg.InCluster, "in-cluster", envBool("SCANNER_IN_CLUSTER", false),
+		"read deployed releases with the pod's service account (SCANNER_IN_CLUSTER)")
+	fs.IntVar(&cfg.MaxConcurrency, "max-concurrency", envInt("SCANNER_MAX_CONCURRENCY", 20),
+		"highest concurrency a request may ask for (SCANNER_MAX_CONCURRENCY)")
+	fs.IntVar(&cfg.MaxImages, "max-images", envInt("SCANNER_MAX_IMAGES", 500),
+		"most images one scan inspects, the rest are listed as not inspected; 0 is unlimited (SCANNER_MAX_IMAGES)")
+	fs.BoolVar(&cfg.AllowDeep, "allow-deep", envBool("SCANNER_ALLOW_DEEP", false),
+		"let requests ask for deep inspection (SCANNER_ALLOW_DEEP)")
+	fs.BoolVar(&cfg.AllowCacheBypass, "allow-cache-bypass", envBool("SCANNER_ALLOW_CACHE_BYPASS", true),
+		"let requests bypass the inspection cache (SCANNER_ALLOW_CACHE_BYPASS)")
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	var err error
+	if cfg.TrustedProxies, err = parseTrustedProxies(splitList(*trustedProxies)); err != nil {
+		return Config{}, err
+	}
+	cfg.AllowedHosts = splitList(*allowedHosts)
+	cfg.CrawlRepos = splitList(*crawlRepos)
+	cfg.Platforms = splitList(*platforms)
+	if _, err := parsePlatforms(cfg.Platforms); err != nil {
+		return Config{}, err
+	}
+	cfg.DockerHubTrustedBadges = splitList(*hubBadgeList)
+	cfg.DockerHubTrustedNamespaces = splitList(*hubNamespaces)
+	if err := validHubBadges(cfg.DockerHubTrustedBadges); err != nil {
+		return Config{}, err
+	}
+	if err := cfg.Prices.validate(); err != nil {
+		return Config{}, err
+	}
+	if cfg.Rewrites, err = rewriteList(splitList(*rewrites)); err != nil {
+		return Config{}, err
+	}
+	if _, err := parseRewrites(cfg.Rewrites); err != nil {
+		return Config{}, err
+	}
+	if cfg.Mirrors, err = parseMirrors(splitList(*mirrors)); err != nil {
+		return Config{}, err
+	}
+	if cfg.Pins, err = parsePins(splitList(*pins)); err != nil {
+		return Config{}, err
+	}
+	cfg.SuppressWarnings = splitList(*suppress)
+	if _, err := parseWarningFilters(cfg.SuppressWarnings); err != nil {
+		return Config{}, err
+	}
+	cfg.BaseImages = splitList(*baseImages)
+	cfg.EOLProducts = splitList(*eolProducts)
+	for _, ref := range cfg.BaseImages {
+		if _, err := name.ParseReference(ref); err != nil {
+			return Config{}, fmt.Errorf("base image %q: %w", ref, err)
+		}
+	}
+	cfg.BasePath = normalizeBasePath(cfg.BasePath)
+	if cfg.Untrusted && len(cfg.AllowedHosts) == 0 {
+		return Config{}, fmt.Errorf("untrusted mode requires -allowed-hosts")
+	}
+	if cfg.Untrusted {
+		// Untrusted mode never uses local credentials.
+		cfg.HelmRepositories, cfg.HelmRegistryConfig = "", ""
+	}
+	if cfg.Untrusted && (cfg.Kubeconfig != "" || cfg.InCluster) {
+		return Config{}, fmt.Errorf("cluster access cannot be combined with untrusted mode")
+	}
+	if cfg.OIDCIssuer != "" && cfg.OIDCAudience == "" {
+		return Config{}, fmt.Errorf("-oidc-issuer requires -oidc-audience")
+	}
+	if cfg.Kubeconfig != "" && cfg.InCluster {
+		return Config{}, fmt.Errorf("-kubeconfig and -in-cluster are mutually exclusive")
+	}
+	if cfg.Record != "" && cfg.Replay != "" {
+		return Config{}, fmt.Errorf("-record and -replay are mutually exclusive")
+	}
+	if cfg.Record != "" {
+		if err := os.MkdirAll(cfg.Record, 0o755); err != nil {
+			return Config{}, fmt.Errorf("creating record directory: %w", err)
+		}
+	}
+	if cfg.Replay != "" {
+		if info, err := os.Stat(cfg.Replay); err != nil || !info.IsDir() {
+			return Config{}, fmt.Errorf("replay directory %s does not exist", cfg.Replay)
+		}
+	}
+	if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+		return Config{}, err
+	}
+	if cfg.SizeUnits, err = parseSizeUnits(*units); err != nil {
+		return Config{}, fmt.Errorf("size-units: %w", err)
+	}
+	if cfg.SinkRetries < 0 || cfg.SinkBackoff <= 0 {
+		return Config{}, fmt.Errorf("sink-retries must not be negative and sink-backoff must be positive")
+	}
+	if cfg.KeepAlive < 0 || cfg.MaxIdleConnsPerHost < 0 || cfg.MaxConnsPerHost < 0 {
+		return Config{}, fmt.Errorf("connection settings must not be negative")
+	}
+	if cfg.MaxRequestsPerSec < 0 || cfg.HostInterval < 0 {
+		return Config{}, fmt.Errorf("max-requests-per-second and host-interval must not be negative")
+	}
+	if cfg.MaxScans < 1 {
+		return Config{}, fmt.Errorf("max-scans must be at least 1, got %d", cfg.MaxScans)
+	}
+	if cfg.BulkTimezone, err = time.LoadLocation(*bulkTimezone); err != nil {
+		return Config{}, fmt.Errorf("bulk-windows-timezone: %w", err)
+	}
+	if cfg.BulkWindows, err = parseScanWindows(splitList(*bulkWindows), cfg.MaxScans); err != nil {
+		return Config{}, fmt.Errorf("bulk-windows: %w", err)
+	}
+	if cfg.Concurrency < 1 {
+		return Config{}, fmt.Errorf("concurrency must be at least 1, got %d", cfg.Concurrency)
+	}
+	if cfg.MaxImages < 0 {
+		return Config{}, fmt.Errorf("max-images must not be negative")
+	}
+	if cfg.MaxConcurrency < cfg.Concurrency {
+		return Config{}, fmt.Errorf("max-concurrency (%d) must not be below concurrency (%d)", cfg.MaxConcurrency, cfg.Concurrency)
+	}
+	if cfg.RenderMaxOutput <= 0 || cfg.RenderMaxDepth <= 0 {
+		return Config{}, fmt.Errorf("render limits must be positive")
+	}
+	if cfg.WorkspaceQuota <= 0 || cfg.MaxWorkspaces <= 0 {
+		return Config{}, fmt.Errorf("workspace limits must be positive")
+	}
+	if cfg.Inspection != inspectionMetadata && cfg.Inspection != inspectionDeep {
+		return Config{}, fmt.Errorf("inspection must be %q or %q, got %q", inspectionMetadata, inspectionDeep, cfg.Inspection)
+	}
+	if cfg.ImageTimeout <= 0 || cfg.ScanTimeout <= 0 || cfg.RenderTimeout <= 0 || cfg.CrawlInterval <= 0 {
+		return Config{}, fmt.Errorf("timeouts and intervals must be positive")
+	}
+	return cfg, nil
+}
+
+func (cfg Config) connSettings() connSettings {
+	return connSettings{HTTP2: cfg.HTTP2, KeepAlive: cfg.KeepAlive, MaxIdlePerHost: cfg.MaxIdleConnsPerHost, MaxPerHost: cfg.MaxConnsPerHost}
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func envString(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	if v, ok := os.LookupEnv(key); ok {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+func envBool(key string, def bool) bool {
+	if v, ok := os.LookupEnv(key); ok {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
+func envFloat(key string, def float64) float64 {
+	if v, ok := os.LookupEnv(key); ok {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	}
+	return def
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	if v, ok := os.LookupEnv(key); ok {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return def
+}
@@ -0,0 +1,134 @@
+package scanner
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ImageConstruction is how a reference was assembled from the parts of a
+// values map, by the image-map, repository-tag and image-helper rules.
+type ImageConstruction struct {
+	// Map is the values path of the map the parts were read from.
+	Map string `json:"map"`
+	// Registry is the registry put in front of the repository, and
+	// RegistryFrom the values path it came from, such as image.registry
+	// or global.imageRegistry. Both are empty when no registry was
+	// applied.
+	Registry     string `json:"registry,omitempty"`
+	RegistryFrom string `json:"registry_from,omitempty"`
+	// Replaced is the map's own registry that global.imageRegistry
+	// replaced.
+	Replaced string `json:"replaced,omitempty"`
+	// Steps describe each part taken or left out, ending with the result.
+	Steps []string `json:"steps"`
+}
+
+// imageParts reads the parts of an image map the way one of the rules
+// assembles it: image maps take string fields only, while the
+// common.images.image helper renders any scalar and falls back to the
+// chart's appVersion for a missing tag.
+type imageParts struct {
+	m      map[string]interface{}
+	at     string
+	helper bool
+	steps  []string
+}
+
+func newImageParts(m map[string]interface{}, mapPath string, helper bool) *imageParts {
+	return &imageParts{m: m, at: mapPath, helper: helper}
+}
+
+func (p *imageParts) path(key string) string {
+	if p.at == "" {
+		return key
+	}
+	return p.at + "." + key
+}
+
+func (p *imageParts) step(format string, args ...interface{}) {
+	p.steps = append(p.steps, fmt.Sprintf(format, args...))
+}
+
+// get returns a part, noting a field the rule cannot use.
+func (p *imageParts) get(key string) string {
+	v, ok := p.m[key]
+	if !ok || v == nil {
+		return ""
+	}
+	if p.helper {
+		return valueString(v)
+	}
+	s, isString := v.(string)
+	if !isString {
+		p.step("%s: %v is a %T, not a string, and is left out", p.path(key), v, v)
+	}
+	return s
+}
+
+// describeImageMap explains an image map assembled into img, with
+// globalRegistry the global.imageRegistry that replaces the map's
+// registry, if set, and appVersion the helper's fallback tag.
+func describeImageMap(m map[string]interface{}, mapPath, globalRegistry, appVersion string, helper bool, img string) *ImageConstruction {
+	p := newImageParts(m, mapPath, helper)
+	c := &ImageConstruction{Map: mapPath}
+	repoKey := "repository"
+	repo := p.get(repoKey)
+	if repo == "" && !helper {
+		repoKey = "name"
+		repo = p.get(repoKey)
+	}
+	p.step("repository %q from %s", repo, p.path(repoKey))
+
+	own := p.get("registry")
+	switch {
+	case globalRegistry != "" && own != "":
+		c.Registry, c.RegistryFrom, c.Replaced = globalRegistry, "global.imageRegistry", own
+		p.step("registry %q from global.imageRegistry, replacing %q of %s", globalRegistry, own, p.path("registry"))
+	case globalRegistry != "":
+		c.Registry, c.RegistryFrom = globalRegistry, "global.imageRegistry"
+		p.step("registry %q from global.imageRegistry", globalRegistry)
+	case own != "":
+		c.Registry, c.RegistryFrom = own, p.path("registry")
+		p.step("registry %q from %s", own, c.RegistryFrom)
+	default:
+		p.step("no registry, so the repository is used as written")
+	}
+
+	tag, digest := p.get("tag"), p.get("digest")
+	switch {
+	case digest != "":
+		p.step("digest %q from %s", digest, p.path("digest"))
+		if tag != "" {
+			p.step("tag %q of %s dropped for the digest", tag, p.path("tag"))
+		}
+	case tag != "":
+		p.step("tag %q from %s", tag, p.path("tag"))
+	case helper && appVersion != "":
+		p.step("tag %q from the chart's appVersion, as %s is empty", appVersion, p.path("tag"))
+	default:
+		p.step("no tag or digest")
+	}
+	p.step("assembled %s", img)
+	c.Steps = p.steps
+	return c
+}
+
+// describeRepositoryTag explains a repository and tag side by side, which
+// are joined as written: neither a registry next to them nor
+// global.imageRegistry is applied.
+func describeRepositoryTag(m map[string]interface{}, mapPath, globalRegistry, img string) *ImageConstruction {
+	p := newImageParts(m, mapPath, false)
+	p.step("repository %q from %s", p.get("repository"), p.path("repository"))
+	p.step("tag %q from %s", p.get("tag"), p.path("tag"))
+	if own, _ := m["registry"].(string); own != "" {
+		p.step("registry %q of %s not applied: a repository and tag are joined as written", own, p.path("registry"))
+	}
+	if globalRegistry != "" {
+		p.step("global.imageRegistry %q not applied: it only replaces the registry of image maps", globalRegistry)
+	}
+	if mapPath == "image" || strings.HasSuffix(mapPath, ".image") {
+		p.step("the map is read as an image map as well, which may yield a second reference")
+	}
+	p.step("assembled %s", img)
+	return &ImageConstruction{Map: mapPath, Steps: p.steps}
+}
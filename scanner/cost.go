@@ -0,0 +1,99 @@
+package scanner
+
+import (
+	"fmt"
+	"math"
+)
+
+// CostPrices are the prices a cost estimate uses, in any one currency.
+type CostPrices struct {
+	// StoragePerGiBMonth is the price of keeping one GiB in a registry
+	// for a month.
+	StoragePerGiBMonth float64 `json:"storage_per_gib_month,omitempty"`
+	// EgressPerGiB is the price of transferring one GiB out of the
+	// registry.
+	EgressPerGiB float64 `json:"egress_per_gib,omitempty"`
+	// PullsPerMonth is how often a node without any of the chart's
+	// images pulls all of them, e.g. new nodes coming up.
+	PullsPerMonth float64 `json:"pulls_per_month,omitempty"`
+}
+
+// over returns p with the prices set in o taking precedence.
+func (p CostPrices) over(o CostPrices) CostPrices {
+	if o.StoragePerGiBMonth != 0 {
+		p.StoragePerGiBMonth = o.StoragePerGiBMonth
+	}
+	if o.EgressPerGiB != 0 {
+		p.EgressPerGiB = o.EgressPerGiB
+	}
+	if o.PullsPerMonth != 0 {
+		p.PullsPerMonth = o.PullsPerMonth
+	}
+	return p
+}
+
+// set reports whether there is anything to estimate.
+func (p CostPrices) set() bool {
+	return p.StoragePerGiBMonth > 0 || p.EgressPerGiB > 0
+}
+
+func (p CostPrices) validate() error {
+	if p.StoragePerGiBMonth < 0 || p.EgressPerGiB < 0 || p.PullsPerMonth < 0 {
+		return fmt.Errorf("prices and pulls_per_month must not be negative")
+	}
+	return nil
+}
+
+// CostReport estimates what hosting or mirroring the chart's images
+// costs. Layers shared between images are stored and pulled once, so the
+// estimate rests on UniqueBytes rather than the sum of image sizes.
+type CostReport struct {
+	Prices      CostPrices `json:"prices"`
+	UniqueBytes int64      `json:"unique_bytes"`
+	// SharedBytes is what layer sharing saves over the sum of the image
+	// sizes.
+	SharedBytes int64 `json:"shared_bytes"`
+	// Mirror is the one-time egress of copying every layer into a mirror.
+	Mirror float64 `json:"mirror"`
+	// Storage and Pulls are monthly; Monthly is their sum.
+	Storage float64 `json:"storage"`
+	Pulls   float64 `json:"pulls"`
+	Monthly float64 `json:"monthly"`
+}
+
+// costReport adds up the distinct layers of the inspected images. Images
+// without layer details, such as other artifacts, count with their whole
+// size once per digest.
+func costReport(infos []ImageInfo, prices CostPrices) *CostReport {
+	rep := &CostReport{Prices: prices}
+	blobs := make(map[string]int64)
+	var total int64
+	for _, info := range infos {
+		total += info.SizeBytes
+		if len(info.Layers) == 0 {
+			blobs[info.Digest] = info.SizeBytes
+			continue
+		}
+		for _, l := range info.Layers {
+			blobs[l.Digest] = l.SizeBytes
+		}
+	}
+	for _, n := range blobs {
+		rep.UniqueBytes += n
+	}
+	if rep.SharedBytes = total - rep.UniqueBytes; rep.SharedBytes < 0 {
+		rep.SharedBytes = 0
+	}
+	gib := float64(rep.UniqueBytes) / (1 << 30)
+	rep.Mirror = roundPrice(gib * prices.EgressPerGiB)
+	rep.Storage = roundPrice(gib * prices.StoragePerGiBMonth)
+	rep.Pulls = roundPrice(gib * prices.EgressPerGiB * prices.PullsPerMonth)
+	rep.Monthly = roundPrice(rep.Storage + rep.Pulls)
+	return rep
+}
+
+// roundPrice keeps four decimals, enough for charts that cost fractions
+// of a cent.
+func roundPrice(v float64) float64 {
+	return math.Round(v*10000) / 10000
+}
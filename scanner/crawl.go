@@ -0,0 +1,413 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxIndexSize bounds the repository index.yaml; large public
+// repositories are in the tens of megabytes.
+const maxIndexSize = 128 << 20
+
+// repoIndex is the part of a chart repository's index.yaml the crawler
+// needs.
+type repoIndex struct {
+	Entries map[string][]indexEntry `yaml:"entries"`
+}
+
+type indexEntry struct {
+	Name    string   `yaml:"name"`
+	Version string   `yaml:"version"`
+	URLs    []string `yaml:"urls"`
+	Digest  string   `yaml:"digest"`
+}
+
+// crawlRecord is one line of the crawl state file: a chart version that
+// was scanned successfully.
+type crawlRecord struct {
+	Repo      string    `json:"repo"`
+	Chart     string    `json:"chart"`
+	Version   string    `json:"version"`
+	Digest    string    `json:"digest,omitempty"`
+	Images    int       `json:"images"`
+	ScannedAt time.Time `json:"scanned_at"`
+	// Baseline marks versions passed over by the first crawl of a
+	// repository rather than scanned.
+	Baseline bool `json:"baseline,omitempty"`
+}
+
+// crawlState remembers which chart versions of each repository have been
+// scanned, so that a crawl only scans what was published since the last
+// one. Like the history store it is kept in memory and, when a path is
+// configured, appended to a JSON-lines file that is replayed on startup.
+type crawlState struct {
+	mu      sync.Mutex
+	seen    map[string]map[string]crawlRecord // repo -> "chart@version"
+	running map[string]bool
+	file    *os.File
+}
+
+func openCrawlState(path string) (*crawlState, error) {
+	c := &crawlState{seen: make(map[string]map[string]crawlRecord), running: make(map[string]bool)}
+	if path == "" {
+		return c, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening crawl state file: %w", err)
+	}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec crawlRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			continue
+		}
+		c.mark(rec)
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading crawl state file: %w", err)
+	}
+	c.file = f
+	return c, nil
+}
+
+func (c *crawlState) mark(rec crawlRecord) {
+	if c.seen[rec.Repo] == nil {
+		c.seen[rec.Repo] = make(map[string]crawlRecord)
+	}
+	c.seen[rec.Repo][rec.Chart+"@"+rec.Version] = rec
+}
+
+func (c *crawlState) isSeen(repo, chart, version string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.seen[repo][chart+"@"+version]
+	return ok
+}
+
+// known reports whether repo has been crawled before.
+func (c *crawlState) known(repo string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.seen[repo]) > 0
+}
+
+func (c *crawlState) record(rec crawlRecord) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mark(rec)
+	if c.file == nil {
+		return
+	}
+	b, _ := json.Marshal(rec)
+	if _, err := c.file.Write(append(b, '\n')); err != nil {
+		log.Printf("warning: writing crawl state: %v", err)
+	}
+}
+
+// records returns every version recorded, for backups.
+func (c *crawlState) records() []crawlRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var recs []crawlRecord
+	for _, versions := range c.seen {
+		for _, rec := range versions {
+			recs = append(recs, rec)
+		}
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		a, b := recs[i], recs[j]
+		if a.Repo != b.Repo {
+			return a.Repo < b.Repo
+		}
+		return a.Chart+"@"+a.Version < b.Chart+"@"+b.Version
+	})
+	return recs
+}
+
+// begin claims repo for a crawl; it fails if one is already running.
+func (c *crawlState) begin(repo string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.running[repo] {
+		return false
+	}
+	c.running[repo] = true
+	return true
+}
+
+func (c *crawlState) end(repo string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.running, repo)
+}
+
+func (c *crawlState) Close() error {
+	if c.file == nil {
+		return nil
+	}
+	return c.file.Close()
+}
+
+// crawlRequest is the body of POST /crawl.
+type crawlRequest struct {
+	RepoURL string `json:"repo_url"`
+	// Charts restricts the crawl to these chart names.
+	Charts []string `json:"charts,omitempty"`
+	// Backfill scans every unseen version on the first crawl of a
+	// repository instead of only the latest version of each chart.
+	Backfill bool `json:"backfill,omitempty"`
+}
+
+type crawlResponse struct {
+	RepoURL string         `json:"repo_url"`
+	Queued  []crawlVersion `json:"queued"`
+	// Baseline counts older versions recorded as seen without a scan.
+	Baseline int `json:"baseline,omitempty"`
+}
+
+type crawlVersion struct {
+	Chart    string `json:"chart"`
+	Version  string `json:"version"`
+	ChartURL string `json:"chart_url"`
+	digest   string
+}
+
+func (s *server) crawlHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req crawlRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if req.RepoURL == "" {
+		jsonError(w, http.StatusBadRequest, "repo_url is required")
+		return
+	}
+	resp, err := s.startCrawl(r.Context(), req)
+	if err == errCrawlRunning {
+		jsonError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		jsonError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(resp)
+}
+
+var errCrawlRunning = errors.New("a crawl of this repository is already running")
+
+// startCrawl reads the repository index, works out which chart versions
+// have not been scanned yet and scans them in the background. Results go
+// to the configured sinks; only successful scans are recorded as seen, so
+// failed versions are tried again on the next crawl.
+func (s *server) startCrawl(ctx context.Context, req crawlRequest) (*crawlResponse, error) {
+	repo := strings.TrimSuffix(req.RepoURL, "/")
+	if !s.crawls.begin(repo) {
+		return nil, errCrawlRunning
+	}
+	idx, err := s.fetchIndex(ctx, repo)
+	if err != nil {
+		s.crawls.end(repo)
+		return nil, err
+	}
+	latestOnly := !req.Backfill && !s.crawls.known(repo)
+	queued, passed := newVersions(idx, repo, req.Charts, latestOnly, s.crawls.isSeen)
+	now := time.Now().UTC()
+	for _, v := range passed {
+		s.crawls.record(crawlRecord{Repo: repo, Chart: v.Chart, Version: v.Version, Digest: v.digest, ScannedAt: now, Baseline: true})
+	}
+	resp := &crawlResponse{RepoURL: repo, Queued: queued, Baseline: len(passed)}
+
+	go func(versions []crawlVersion) {
+		defer s.crawls.end(repo)
+		s.crawlVersions(repo, versions)
+	}(resp.Queued)
+	return resp, nil
+}
+
+func (s *server) crawlVersions(repo string, versions []crawlVersion) {
+	opts, err := s.scanOptionsFor(scanRequest{}, cacheControl{})
+	if err != nil {
+		log.Printf("warning: crawl of %s: %v", repo, err)
+		return
+	}
+	opts.Share = newDigestShare()
+	// Only as many scans are started as can run; the rest would just sit
+	// in the queue eating into their deadline.
+	sem := make(chan struct{}, s.cfg.MaxScans)
+	var wg sync.WaitGroup
+	for _, v := range versions {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(v crawlVersion) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// Waiting for a bulk window does not count against the scan
+			// timeout.
+			release, _ := s.windows.acquire(context.Background())
+			defer release()
+			ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ScanTimeout)
+			defer cancel()
+			opts, defaults, err := s.chartScanOptions(repo+"/"+v.Chart, opts)
+			if err != nil {
+				log.Printf("warning: crawl of %s: %s %s: %v", repo, v.Chart, v.Version, err)
+				return
+			}
+			result, err := s.scanChartForImages(ctx, v.ChartURL, opts)
+			if err != nil {
+				log.Printf("warning: crawl of %s: %s %s: %v", repo, v.Chart, v.Version, err)
+				return
+			}
+			result.ChartDefaults = defaults
+			s.publish(result)
+			s.issues.fileIssues(ctx, v.Chart, v.Version, result)
+			s.crawls.record(crawlRecord{
+				Repo:      repo,
+				Chart:     v.Chart,
+				Version:   v.Version,
+				Digest:    v.digest,
+				Images:    len(result.Images),
+				ScannedAt: result.ScannedAt,
+			})
+		}(v)
+	}
+	wg.Wait()
+	st := opts.Share.result()
+	log.Printf("crawl of %s finished, %d versions, %d digests inspected, %d inspections shared", repo, len(versions), st.Inspected, st.Shared)
+}
+
+// cachedIndex returns the index of repo, fetching it when the cached copy
+// is missing or older than the cache TTL.
+func (s *server) cachedIndex(ctx context.Context, repo string) (*repoIndex, error) {
+	if idx, ok := s.indexes.get(repo); ok {
+		return idx, nil
+	}
+	idx, err := s.fetchIndex(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	s.indexes.put(repo, idx)
+	return idx, nil
+}
+
+func (s *server) fetchIndex(ctx context.Context, repo string) (*repoIndex, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, repo+"/index.yaml", nil)
+	if err != nil {
+		return nil, fmt.Errorf("fetching index: %w", err)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching index: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status fetching index: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxIndexSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("fetching index: %w", err)
+	}
+	if len(data) > maxIndexSize {
+		return nil, fmt.Errorf("index is larger than %d bytes", maxIndexSize)
+	}
+	var idx repoIndex
+	if err := yaml.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("parsing index: %w", err)
+	}
+	return &idx, nil
+}
+
+// newVersions lists the chart versions in idx that have not been seen,
+// restricted to charts when given. With latestOnly, only the highest
+// version of each chart is returned and the other unseen versions are
+// returned as passed.
+func newVersions(idx *repoIndex, repo string, charts []string, latestOnly bool, seen func(repo, chart, version string) bool) (queued, passed []crawlVersion) {
+	want := make(map[string]bool, len(charts))
+	for _, c := range charts {
+		want[c] = true
+	}
+	queued = []crawlVersion{}
+	for name, entries := range idx.Entries {
+		if len(want) > 0 && !want[name] {
+			continue
+		}
+		entries = append([]indexEntry(nil), entries...)
+		sort.Slice(entries, func(i, j int) bool {
+			return compareVersions(entries[i].Version, entries[j].Version) > 0
+		})
+		for i, e := range entries {
+			if len(e.URLs) == 0 || seen(repo, name, e.Version) {
+				continue
+			}
+			v := crawlVersion{
+				Chart:    name,
+				Version:  e.Version,
+				ChartURL: resolveChartURL(repo, e.URLs[0]),
+				digest:   e.Digest,
+			}
+			if latestOnly && i > 0 {
+				passed = append(passed, v)
+			} else {
+				queued = append(queued, v)
+			}
+		}
+	}
+	sort.Slice(queued, func(i, j int) bool {
+		if queued[i].Chart != queued[j].Chart {
+			return queued[i].Chart < queued[j].Chart
+		}
+		return compareVersions(queued[i].Version, queued[j].Version) > 0
+	})
+	return queued, passed
+}
+
+// resolveChartURL makes a chart URL from index.yaml absolute; repositories
+// commonly list archives relative to the index.
+func resolveChartURL(repo, u string) string {
+	base, err := url.Parse(repo + "/")
+	if err != nil {
+		return u
+	}
+	ref, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	return base.ResolveReference(ref).String()
+}
+
+// crawlPeriodically crawls repos every interval, starting immediately.
+func (s *server) crawlPeriodically(repos []string, interval time.Duration) {
+	for {
+		for _, repo := range repos {
+			resp, err := s.startCrawl(context.Background(), crawlRequest{RepoURL: repo})
+			if err != nil {
+				log.Printf("warning: crawl of %s: %v", repo, err)
+				continue
+			}
+			log.Printf("crawl of %s: %d new versions", resp.RepoURL, len(resp.Queued))
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,213 @@
+package scanner
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ruleCRDField is an image read from a field of a custom resource that the
+// CRD table names, rather than from an image field.
+const ruleCRDField = "crd-field"
+
+// crdFields is what the scanner knows about the images of a custom
+// resource kind. Paths are YAML paths where * stands for any key and [*]
+// for any list element.
+type crdFields struct {
+	// PodSpecs are the pod specs the resource embeds, read by the workload
+	// reports.
+	PodSpecs []string
+	// Images are fields holding an image reference under another name than
+	// image.
+	Images []string
+	// Ignore are subtrees whose image fields are patterns to match images
+	// against, not images.
+	Ignore []string
+	// Variables marks kinds whose {{ }} expressions are filled in by their
+	// controller; images holding one are left out.
+	Variables bool
+	// when, if set, restricts Images to the resources it accepts.
+	when func(d map[string]interface{}) bool
+	// replicas, if set, returns the least number of pods the resource
+	// runs, for pull estimates.
+	replicas func(d map[string]interface{}) interface{}
+}
+
+var kyvernoPolicy = crdFields{
+	Ignore: []string{
+		"spec.rules[*].match", "spec.rules[*].exclude", "spec.rules[*].preconditions",
+		"spec.rules[*].validate", "spec.rules[*].verifyImages",
+	},
+	Variables: true,
+}
+
+var kyvernoCleanupPolicy = crdFields{
+	Ignore:    []string{"spec.match", "spec.exclude", "spec.conditions"},
+	Variables: true,
+}
+
+// crdImageFields maps "<API group>/<kind>" to what the scanner knows of the
+// images of custom resources; "<API group>/*" covers every kind of a group.
+// Kinds missing here are read by the generic extraction, which finds
+// images in any image field and suffices for most CRDs.
+var crdImageFields = map[string]crdFields{
+	// Kyverno policies match images with patterns and fill in variables;
+	// the resources of generate rules and patches of mutate rules are read.
+	"kyverno.io/ClusterPolicy":        kyvernoPolicy,
+	"kyverno.io/Policy":               kyvernoPolicy,
+	"kyverno.io/ClusterCleanupPolicy": kyvernoCleanupPolicy,
+	"kyverno.io/CleanupPolicy":        kyvernoCleanupPolicy,
+	// Gatekeeper constraints list allowed or exempt images as parameters.
+	"constraints.gatekeeper.sh/*": {Ignore: []string{"spec.match", "spec.parameters"}},
+	"mutations.gatekeeper.sh/Assign": {
+		Images: []string{"spec.parameters.assign.value"},
+		when: func(d map[string]interface{}) bool {
+			return strings.HasSuffix(valueString(lookupValue(d, "spec.location")), ".image")
+		},
+	},
+	"keda.sh/ScaledJob":                   {PodSpecs: []string{"spec.jobTargetRef.template.spec"}},
+	"argoproj.io/Rollout":                 {PodSpecs: []string{"spec.template.spec"}},
+	"apps.kruise.io/CloneSet":             {PodSpecs: []string{"spec.template.spec"}},
+	"apps.kruise.io/StatefulSet":          {PodSpecs: []string{"spec.template.spec"}},
+	"apps.kruise.io/DaemonSet":            {PodSpecs: []string{"spec.template.spec"}},
+	"batch.volcano.sh/Job":                {PodSpecs: []string{"spec.tasks[*].template.spec"}},
+	"kubeflow.org/PyTorchJob":             {PodSpecs: []string{"spec.pytorchReplicaSpecs.*.template.spec"}},
+	"kubeflow.org/TFJob":                  {PodSpecs: []string{"spec.tfReplicaSpecs.*.template.spec"}},
+	"kubeflow.org/MPIJob":                 {PodSpecs: []string{"spec.mpiReplicaSpecs.*.template.spec"}},
+	"ray.io/RayCluster":                   {PodSpecs: []string{"spec.headGroupSpec.template.spec", "spec.workerGroupSpecs[*].template.spec"}},
+	"ray.io/RayJob":                       {PodSpecs: []string{"spec.rayClusterSpec.headGroupSpec.template.spec", "spec.rayClusterSpec.workerGroupSpecs[*].template.spec"}},
+	"ray.io/RayService":                   {PodSpecs: []string{"spec.rayClusterConfig.headGroupSpec.template.spec", "spec.rayClusterConfig.workerGroupSpecs[*].template.spec"}},
+	"sources.knative.dev/ContainerSource": {PodSpecs: []string{"spec.template.spec"}},
+	// Knative revisions are templated by services and configurations, and
+	// scale between the bounds of their autoscaling annotations.
+	"serving.knative.dev/Service":       {PodSpecs: []string{"spec.template.spec"}, replicas: knativeMinScale("spec.template.metadata")},
+	"serving.knative.dev/Configuration": {PodSpecs: []string{"spec.template.spec"}, replicas: knativeMinScale("spec.template.metadata")},
+	"serving.knative.dev/Revision":      {PodSpecs: []string{"spec"}, replicas: knativeMinScale("metadata")},
+}
+
+// knativeMinScale reads the min-scale annotation of the revision metadata
+// at path. Without one, a revision may scale to zero and runs a pod when
+// it is called.
+func knativeMinScale(path string) func(d map[string]interface{}) interface{} {
+	return func(d map[string]interface{}) interface{} {
+		annotations, _ := lookupValue(d, path+".annotations").(map[string]interface{})
+		for _, key := range []string{"autoscaling.knative.dev/min-scale", "autoscaling.knative.dev/minScale", "autoscaling.knative.dev/initial-scale"} {
+			if v, ok := annotations[key]; ok {
+				return v
+			}
+		}
+		return nil
+	}
+}
+
+// crdFieldsOf returns the table entry of a manifest's kind.
+func crdFieldsOf(d map[string]interface{}) (crdFields, bool) {
+	group, _, ok := strings.Cut(valueString(d["apiVersion"]), "/")
+	if !ok {
+		return crdFields{}, false
+	}
+	if f, ok := crdImageFields[group+"/"+manifestKind(d)]; ok {
+		return f, true
+	}
+	f, ok := crdImageFields[group+"/*"]
+	return f, ok
+}
+
+// extract reports the images of a custom resource of the kind.
+func (f crdFields) extract(d map[string]interface{}, found func(img, path, rule string)) {
+	walkImages(d, "", "", func(img, path, rule string) {
+		if f.ignored(path) || (f.Variables && strings.Contains(img, "{{")) {
+			return
+		}
+		found(img, path, rule)
+	})
+	if f.when != nil && !f.when(d) {
+		return
+	}
+	for _, p := range f.Images {
+		lookupAll(d, p, func(v interface{}, path string) {
+			if img := valueString(v); img != "" {
+				found(img, path, ruleCRDField)
+			}
+		})
+	}
+}
+
+func (f crdFields) ignored(path string) bool {
+	for _, p := range f.Ignore {
+		if matchPathPrefix(p, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// podSpecs returns the pod specs of a workload manifest, none for a
+// manifest that is no workload.
+func podSpecs(d map[string]interface{}) []map[string]interface{} {
+	var paths []string
+	if f, ok := crdFieldsOf(d); ok {
+		paths = f.PodSpecs
+	} else if p, ok := podSpecPaths[manifestKind(d)]; ok {
+		paths = []string{p}
+	}
+	var specs []map[string]interface{}
+	for _, p := range paths {
+		lookupAll(d, p, func(v interface{}, _ string) {
+			if spec, ok := v.(map[string]interface{}); ok {
+				specs = append(specs, spec)
+			}
+		})
+	}
+	return specs
+}
+
+var listIndexRe = regexp.MustCompile(`\[\d+\]`)
+
+func pathSegments(p string) []string {
+	return strings.Split(strings.ReplaceAll(p, "[", ".["), ".")
+}
+
+// matchPathPrefix reports whether path lies in the subtree pattern names.
+func matchPathPrefix(pattern, path string) bool {
+	pat := pathSegments(pattern)
+	segs := pathSegments(listIndexRe.ReplaceAllString(path, "[*]"))
+	if len(segs) < len(pat) {
+		return false
+	}
+	for i, s := range pat {
+		if s != segs[i] && !(s == "*" && !strings.HasPrefix(segs[i], "[")) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupAll calls fn for every value at pattern below node, with its path.
+func lookupAll(node interface{}, pattern string, fn func(v interface{}, path string)) {
+	var walk func(node interface{}, segs []string, path string)
+	walk = func(node interface{}, segs []string, path string) {
+		if len(segs) == 0 {
+			fn(node, path)
+			return
+		}
+		switch seg := segs[0]; seg {
+		case "[*]":
+			list, _ := node.([]interface{})
+			for i, e := range list {
+				walk(e, segs[1:], path+"["+strconv.Itoa(i)+"]")
+			}
+		case "*":
+			m, _ := node.(map[string]interface{})
+			for k, v := range m {
+				walk(v, segs[1:], joinPath(path, k))
+			}
+		default:
+			m, _ := node.(map[string]interface{})
+			if v, ok := m[seg]; ok {
+				walk(v, segs[1:], joinPath(path, seg))
+			}
+		}
+	}
+	walk(node, pathSegments(pattern), "")
+}
@@ -0,0 +1,91 @@
+package scanner
+
+import (
+	"sync"
+)
+
+// DedupStats counts the inspections of a batch of scans, such as a crawl,
+// a train or an inventory, in which each digest is inspected once.
+type DedupStats struct {
+	// Inspected are the digests inspected at a registry.
+	Inspected int `json:"inspected"`
+	// Shared are the inspections answered by one of another scan of the
+	// batch, typically of a digest referenced by several charts or tags.
+	Shared int `json:"shared"`
+}
+
+// digestShare lets the scans of a batch share their inspections by
+// digest. Unlike the image cache it works with caching disabled or
+// bypassed, and an inspection still running is waited for instead of
+// repeated. Failed inspections are not kept, so the next scan retries.
+type digestShare struct {
+	mu      sync.Mutex
+	entries map[string]*sharedInspection
+	stats   DedupStats
+}
+
+type sharedInspection struct {
+	done chan struct{}
+	info ImageInfo
+	err  error
+}
+
+func newDigestShare() *digestShare {
+	return &digestShare{entries: make(map[string]*sharedInspection)}
+}
+
+// inspect returns the inspection of digest, calling fetch unless the batch
+// already has one, and whether it was shared. A nil share always fetches.
+func (d *digestShare) inspect(digest string, deep bool, fetch func() (ImageInfo, error)) (ImageInfo, bool, error) {
+	if d == nil {
+		info, err := fetch()
+		return info, false, err
+	}
+	key := digest
+	if deep {
+		key += "+deep"
+	}
+	d.mu.Lock()
+	e, ok := d.entries[key]
+	if !ok && !deep {
+		// A deep inspection answers a shallow one too.
+		e, ok = d.entries[digest+"+deep"]
+	}
+	if ok {
+		d.mu.Unlock()
+		<-e.done
+		if e.err == nil {
+			d.mu.Lock()
+			d.stats.Shared++
+			d.mu.Unlock()
+			return e.info, true, nil
+		}
+		// The inspection failed; try again, as a scan of its own would.
+		return d.inspect(digest, deep, fetch)
+	}
+	e = &sharedInspection{done: make(chan struct{})}
+	d.entries[key] = e
+	d.mu.Unlock()
+
+	e.info, e.err = fetch()
+	d.mu.Lock()
+	if e.err != nil {
+		delete(d.entries, key)
+	} else {
+		d.stats.Inspected++
+	}
+	d.mu.Unlock()
+	close(e.done)
+	return e.info, false, e.err
+}
+
+// result returns the stats of the batch, nil for a nil share.
+func (d *digestShare) result() *DedupStats {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st := d.stats
+	return &st
+}
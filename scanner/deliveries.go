@@ -0,0 +1,235 @@
+package scanner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDeadLetters bounds the dead-letter list; the oldest entries go
+// first.
+const maxDeadLetters = 200
+
+// maxSinkBackoff caps the wait between two delivery attempts.
+const maxSinkBackoff = 5 * time.Minute
+
+// namedSink is a sink with the destination it was configured as, with
+// credentials removed, for delivery reports.
+type namedSink struct {
+	Sink
+	name string
+}
+
+// sinkName returns the configured destination, without the password of a
+// URL.
+func sinkName(spec string) string {
+	if u, err := url.Parse(spec); err == nil && u.User != nil {
+		u.User = url.User(u.User.Username())
+		return u.String()
+	}
+	return spec
+}
+
+// permanentError marks a delivery failure that retrying cannot fix, such
+// as a webhook rejecting the payload.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// deliveryTracker delivers results to the sinks, retrying failures with
+// exponential backoff, and keeps per-sink statistics and the deliveries
+// that failed for good. Both live in memory only.
+type deliveryTracker struct {
+	sinks   fanOut
+	retries int
+	backoff time.Duration
+
+	mu     sync.Mutex
+	stats  map[string]*SinkStats
+	dead   []DeadLetter
+	nextID int
+}
+
+// SinkStats reports the deliveries to one sink since startup.
+type SinkStats struct {
+	Sink      string `json:"sink"`
+	Delivered int64  `json:"delivered"`
+	// Retried counts failed attempts that were tried again.
+	Retried   int64      `json:"retried"`
+	Failed    int64      `json:"failed"`
+	Pending   int        `json:"pending"`
+	LastError string     `json:"last_error,omitempty"`
+	LastOK    *time.Time `json:"last_delivered_at,omitempty"`
+}
+
+// DeadLetter is a result a sink did not take after every attempt. It can
+// be retried through the API.
+type DeadLetter struct {
+	ID        string    `json:"id"`
+	Sink      string    `json:"sink"`
+	ChartURL  string    `json:"chart_url"`
+	ScannedAt time.Time `json:"scanned_at"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error"`
+	FailedAt  time.Time `json:"failed_at"`
+
+	sink   Sink
+	result ScanResult
+}
+
+func newDeliveryTracker(sinks fanOut, retries int, backoff time.Duration) *deliveryTracker {
+	t := &deliveryTracker{sinks: sinks, retries: retries, backoff: backoff, stats: make(map[string]*SinkStats)}
+	for _, sink := range sinks {
+		name := t.name(sink)
+		t.stats[name] = &SinkStats{Sink: name}
+	}
+	return t
+}
+
+func (t *deliveryTracker) name(sink Sink) string {
+	if n, ok := sink.(*namedSink); ok {
+		return n.name
+	}
+	return fmt.Sprintf("%T", sink)
+}
+
+// deliver writes result to every sink in the background.
+func (t *deliveryTracker) deliver(result ScanResult) {
+	for _, sink := range t.sinks {
+		go t.attempt(sink, result)
+	}
+}
+
+// attempt delivers result to one sink, trying again after 1, 2, 4...
+// times the backoff until the retries are used up.
+func (t *deliveryTracker) attempt(sink Sink, result ScanResult) {
+	name := t.name(sink)
+	t.update(name, func(st *SinkStats) { st.Pending++ })
+	wait := t.backoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), sinkTimeout)
+		err := sink.Write(ctx, result)
+		cancel()
+		if err == nil {
+			now := time.Now().UTC()
+			t.update(name, func(st *SinkStats) {
+				st.Pending--
+				st.Delivered++
+				st.LastOK = &now
+			})
+			return
+		}
+		var perm permanentError
+		if errors.As(err, &perm) || attempt > t.retries {
+			log.Printf("warning: publishing scan of %s to %s failed after %d attempts: %v", result.ChartURL, name, attempt, err)
+			t.update(name, func(st *SinkStats) {
+				st.Pending--
+				st.Failed++
+				st.LastError = err.Error()
+			})
+			t.bury(DeadLetter{Sink: name, ChartURL: result.ChartURL, ScannedAt: result.ScannedAt,
+				Attempts: attempt, Error: err.Error(), FailedAt: time.Now().UTC(), sink: sink, result: result})
+			return
+		}
+		t.update(name, func(st *SinkStats) {
+			st.Retried++
+			st.LastError = err.Error()
+		})
+		time.Sleep(wait)
+		if wait *= 2; wait > maxSinkBackoff {
+			wait = maxSinkBackoff
+		}
+	}
+}
+
+func (t *deliveryTracker) update(name string, f func(*SinkStats)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f(t.stats[name])
+}
+
+func (t *deliveryTracker) bury(d DeadLetter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextID++
+	d.ID = strconv.Itoa(t.nextID)
+	t.dead = append(t.dead, d)
+	if len(t.dead) > maxDeadLetters {
+		t.dead = t.dead[len(t.dead)-maxDeadLetters:]
+	}
+}
+
+// take removes a dead letter, for retrying or discarding it.
+func (t *deliveryTracker) take(id string) (DeadLetter, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, d := range t.dead {
+		if d.ID == id {
+			t.dead = append(t.dead[:i], t.dead[i+1:]...)
+			return d, true
+		}
+	}
+	return DeadLetter{}, false
+}
+
+// DeliveryReport is the response of GET /deliveries.
+type DeliveryReport struct {
+	Sinks       []SinkStats  `json:"sinks"`
+	DeadLetters []DeadLetter `json:"dead_letters"`
+}
+
+func (t *deliveryTracker) report() DeliveryReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rep := DeliveryReport{Sinks: make([]SinkStats, 0, len(t.sinks)), DeadLetters: append([]DeadLetter{}, t.dead...)}
+	for _, sink := range t.sinks {
+		rep.Sinks = append(rep.Sinks, *t.stats[t.name(sink)])
+	}
+	return rep
+}
+
+// deliveriesHandler serves GET /deliveries, the sink statistics and dead
+// letters; POST /deliveries/{id}/retry, which delivers a dead letter
+// again; and DELETE /deliveries/{id}, which discards it.
+func (s *server) deliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/deliveries"), "/")
+	if rest == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "only GET allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.deliveries.report())
+		return
+	}
+	id, action, _ := strings.Cut(rest, "/")
+	switch {
+	case action == "retry" && r.Method == http.MethodPost:
+		d, ok := s.deliveries.take(id)
+		if !ok {
+			jsonError(w, http.StatusNotFound, fmt.Sprintf("no dead letter %q", id))
+			return
+		}
+		go s.deliveries.attempt(d.sink, d.result)
+		w.WriteHeader(http.StatusAccepted)
+	case action == "" && r.Method == http.MethodDelete:
+		if _, ok := s.deliveries.take(id); !ok {
+			jsonError(w, http.StatusNotFound, fmt.Sprintf("no dead letter %q", id))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case action == "retry" || action == "":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		jsonError(w, http.StatusNotFound, "not found")
+	}
+}
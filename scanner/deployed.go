@@ -0,0 +1,194 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// DeployedDiff compares the images of a chart with the images running
+// for a release, as a preview of what an upgrade changes.
+type DeployedDiff struct {
+	Context   string `json:"context"`
+	Namespace string `json:"namespace"`
+	Release   string `json:"release"`
+	Pods      int    `json:"pods"`
+	// Running is every image in the pod specs of the release.
+	Running []string `json:"running"`
+	// Added images are not running yet, Removed ones are no longer used by
+	// the chart; an image moving to another tag or digest of the same
+	// repository is Changed instead.
+	Added     []string      `json:"added"`
+	Removed   []string      `json:"removed"`
+	Changed   []ImageChange `json:"changed"`
+	Unchanged []string      `json:"unchanged"`
+	Warnings  []string      `json:"warnings,omitempty"`
+}
+
+type ImageChange struct {
+	Repository string `json:"repository"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	// FromDigests and ToDigest are set when the reference itself stays
+	// the same but the tag now points at another image than the pods run.
+	FromDigests []string `json:"from_digests,omitempty"`
+	ToDigest    string   `json:"to_digest,omitempty"`
+}
+
+// compareDeployed reads the pods of the release and diffs their images
+// against the scanned chart's.
+func (s *server) compareDeployed(ctx context.Context, kubeContext, namespace, release string, result *ScanResult) (*DeployedDiff, error) {
+	c, err := s.kube.client(kubeContext)
+	if err != nil {
+		return nil, err
+	}
+	if namespace == "" {
+		namespace = c.namespace
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+	pods, err := c.releasePods(ctx, namespace, release)
+	if err != nil {
+		return nil, err
+	}
+	chart := append(append([]string(nil), result.Pinning.Pinned...), result.Pinning.Tagged...)
+	diff := diffDeployed(chart, result.Images, pods)
+	diff.Context, diff.Namespace, diff.Release = c.context, namespace, release
+	if len(pods) == 0 {
+		sels := make([]string, len(releaseSelectors))
+		for i, sel := range releaseSelectors {
+			sels[i] = fmt.Sprintf(sel, release)
+		}
+		diff.Warnings = append(diff.Warnings, fmt.Sprintf("no pods match %s; the release is not deployed or its chart does not label its pods", strings.Join(sels, " or ")))
+	}
+	return diff, nil
+}
+
+type runningImage struct {
+	ref     string
+	digests map[string]struct{}
+}
+
+// diffDeployed matches references after normalising them, so that
+// "nginx:1.25" in the chart and "docker.io/library/nginx:1.25" in a pod
+// are the same image.
+func diffDeployed(chart []string, infos []ImageInfo, pods []kubePod) *DeployedDiff {
+	digests := make(map[string]string, len(infos))
+	for _, info := range infos {
+		digests[historyKey(info.Image)] = info.Digest
+	}
+
+	running := make(map[string]*runningImage)
+	for _, p := range pods {
+		// The kubelet reports the digest it pulled as the imageID of
+		// each container; containers that have not started have none.
+		pulled := make(map[string]string)
+		for _, st := range append(p.Status.InitContainerStatuses, p.Status.ContainerStatuses...) {
+			if _, d, ok := strings.Cut(st.ImageID, "@"); ok {
+				pulled[historyKey(st.Image)] = d
+			}
+		}
+		var images []string
+		for _, c := range p.Spec.InitContainers {
+			images = append(images, c.Image)
+		}
+		for _, c := range p.Spec.Containers {
+			images = append(images, c.Image)
+		}
+		for _, img := range images {
+			key := historyKey(img)
+			ri, ok := running[key]
+			if !ok {
+				ri = &runningImage{ref: img, digests: make(map[string]struct{})}
+				running[key] = ri
+			}
+			if d := pulled[key]; d != "" {
+				ri.digests[d] = struct{}{}
+			}
+		}
+	}
+
+	diff := &DeployedDiff{
+		Pods:      len(pods),
+		Running:   []string{},
+		Added:     []string{},
+		Removed:   []string{},
+		Changed:   []ImageChange{},
+		Unchanged: []string{},
+	}
+	for _, ri := range running {
+		diff.Running = append(diff.Running, ri.ref)
+	}
+
+	// Exact matches first, then what is left is paired by repository.
+	added := make(map[string][]string)
+	for _, ref := range chart {
+		key := historyKey(ref)
+		ri, ok := running[key]
+		if !ok {
+			repo := repositoryOf(ref)
+			added[repo] = append(added[repo], ref)
+			continue
+		}
+		delete(running, key)
+		d := digests[key]
+		if _, same := ri.digests[d]; d == "" || len(ri.digests) == 0 || same {
+			diff.Unchanged = append(diff.Unchanged, ref)
+			continue
+		}
+		from := make([]string, 0, len(ri.digests))
+		for rd := range ri.digests {
+			from = append(from, rd)
+		}
+		sort.Strings(from)
+		diff.Changed = append(diff.Changed, ImageChange{
+			Repository: repositoryOf(ref), From: ri.ref, To: ref, FromDigests: from, ToDigest: d,
+		})
+	}
+	removed := make(map[string][]string)
+	for _, ri := range running {
+		repo := repositoryOf(ri.ref)
+		removed[repo] = append(removed[repo], ri.ref)
+	}
+	for repo, to := range added {
+		from := removed[repo]
+		sort.Strings(to)
+		sort.Strings(from)
+		for len(to) > 0 && len(from) > 0 {
+			diff.Changed = append(diff.Changed, ImageChange{Repository: repo, From: from[0], To: to[0]})
+			to, from = to[1:], from[1:]
+		}
+		diff.Added = append(diff.Added, to...)
+		removed[repo] = from
+	}
+	for _, from := range removed {
+		diff.Removed = append(diff.Removed, from...)
+	}
+
+	sort.Strings(diff.Running)
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Unchanged)
+	sort.Slice(diff.Changed, func(i, j int) bool {
+		a, b := diff.Changed[i], diff.Changed[j]
+		if a.Repository != b.Repository {
+			return a.Repository < b.Repository
+		}
+		return a.To < b.To
+	})
+	return diff
+}
+
+// repositoryOf is the normalised repository of ref, or ref itself when it
+// does not parse.
+func repositoryOf(ref string) string {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return ref
+	}
+	return r.Context().Name()
+}
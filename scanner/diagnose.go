@@ -0,0 +1,377 @@
+package scanner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template/parse"
+)
+
+// RenderDiagnostics is the response of POST /diagnose: every template
+// error of a chart, and the required values it is still missing.
+type RenderDiagnostics struct {
+	ChartURL string         `json:"chart_url"`
+	Source   *ReleaseSource `json:"source,omitempty"`
+	// Rendered is true when every template rendered.
+	Rendered  bool               `json:"rendered"`
+	Manifests int                `json:"manifests"`
+	Errors    []RenderDiagnostic `json:"errors"`
+	// RequiredValues is filled with ?required=true.
+	RequiredValues []RequiredValue `json:"required_values,omitempty"`
+}
+
+// RenderDiagnostic is one template error. Errors inside included
+// templates are reported where they happened, in the helper.
+type RenderDiagnostic struct {
+	// Kind is parse, required_value, missing_value, fail, sandbox or
+	// execution.
+	Kind     string `json:"kind"`
+	Template string `json:"template,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	// ValuePath is the value the failing action read, as set from the
+	// top-level chart, e.g. redis.auth.password for a subchart.
+	ValuePath string `json:"value_path,omitempty"`
+	Message   string `json:"message"`
+}
+
+// RequiredValue is a value a template passes to required that has no
+// default and is not set by the request.
+type RequiredValue struct {
+	Path     string `json:"path"`
+	Message  string `json:"message,omitempty"`
+	Template string `json:"template"`
+	Line     int    `json:"line,omitempty"`
+
+	missing bool
+}
+
+var (
+	execErrRe  = regexp.MustCompile(`(?s)^template: ([^:]+):(\d+):(\d+): executing "[^"]*" at <(.*?)>: (.*)$`)
+	parseErrRe = regexp.MustCompile(`(?s)^template: ([^:]+):(\d+):(?:(\d+):)? (.*)$`)
+	valuesRe   = regexp.MustCompile(`\.Values((?:\.\w+)+)`)
+)
+
+// diagnoseHandler serves POST /diagnose. It takes the body of /scan and
+// renders the chart without inspecting any image.
+func (s *server) diagnoseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req, err := s.decodeScanRequest(r.Body)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	render := true
+	req.Render = &render
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.ScanTimeout)
+	defer cancel()
+	source, code, err := s.resolveScanTarget(ctx, &req)
+	if err != nil {
+		msg := err.Error()
+		if code == http.StatusInternalServerError {
+			msg = "diagnosis failed: " + msg
+		}
+		jsonError(w, code, msg)
+		return
+	}
+	opts, err := s.scanOptionsFor(req, cacheControl{})
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	report, err := s.diagnose(ctx, req.ChartURL, opts, r.URL.Query().Get("required") == "true")
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, fmt.Sprintf("diagnosis failed: %v", err))
+		return
+	}
+	report.Source = source
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// diagnose renders every template of the chart, carrying on past
+// failures, and describes each failure.
+func (s *server) diagnose(ctx context.Context, chartURL string, opts scanOptions, listRequired bool) (*RenderDiagnostics, error) {
+	job, ctx, err := s.tracker.start(ctx, "diagnosis of "+chartURL)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for a scan slot: %w", err)
+	}
+	defer s.tracker.finish(job)
+	files, err := s.fetchChart(ctx, chartURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	root, err := buildChartTree(files)
+	if err != nil {
+		return nil, err
+	}
+	tree := coalesceValues(root, opts.RenderOpts.Values)
+
+	job.setStage(stageRendering)
+	ro := opts.RenderOpts
+	ro.KeepGoing = true
+	manifests, renderErr := renderChart(ctx, files, ro)
+	if renderErr != nil && ctx.Err() != nil {
+		return nil, renderErr
+	}
+	report := &RenderDiagnostics{ChartURL: chartURL, Rendered: renderErr == nil, Manifests: len(manifests), Errors: []RenderDiagnostic{}}
+	prefixes := valuePrefixes(tree)
+	calls := requiredValues(tree, prefixes)
+	errs := []error{renderErr}
+	if joined, ok := renderErr.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		d := diagnoseRenderError(err, prefixes)
+		if d.Kind == "required_value" && d.ValuePath == "" {
+			// .Values.x | required "msg" shows no path in the error.
+			for _, c := range calls {
+				if c.Template == d.Template && c.Line == d.Line {
+					d.ValuePath = c.Path
+				}
+			}
+		}
+		report.Errors = append(report.Errors, d)
+	}
+	if listRequired {
+		for _, c := range calls {
+			if c.missing {
+				report.RequiredValues = append(report.RequiredValues, c)
+			}
+		}
+	}
+	return report, nil
+}
+
+// valuePrefixes maps each chart directory to the path its values have
+// in the top-level chart's values.
+func valuePrefixes(tree *valuesTree) map[string]string {
+	prefixes := make(map[string]string)
+	var walk func(t *valuesTree, prefix string)
+	walk = func(t *valuesTree, prefix string) {
+		prefixes[t.chart.dir] = prefix
+		for _, sub := range t.subcharts {
+			walk(sub, prefix+sub.name+".")
+		}
+	}
+	walk(tree, "")
+	return prefixes
+}
+
+// valuePrefix returns the prefix of the chart the template belongs to.
+func valuePrefix(prefixes map[string]string, tmpl string) string {
+	best, prefix := "", ""
+	for dir, p := range prefixes {
+		if strings.HasPrefix(tmpl, dir+"/templates/") && len(dir) > len(best) {
+			best, prefix = dir, p
+		}
+	}
+	return prefix
+}
+
+// diagnoseRenderError takes apart the error text/template returns,
+// following errors raised in include and tpl to the innermost template.
+func diagnoseRenderError(err error, prefixes map[string]string) RenderDiagnostic {
+	msg := err.Error()
+	d := RenderDiagnostic{Kind: "execution", Message: msg}
+	if errors.Is(err, errRenderTimeout) || errors.Is(err, errRenderOutputLimit) || errors.Is(err, errRenderDepth) {
+		d.Kind = "sandbox"
+		return d
+	}
+	for {
+		m := execErrRe.FindStringSubmatch(msg)
+		if m == nil {
+			break
+		}
+		d.Template = m[1]
+		d.Line, _ = strconv.Atoi(m[2])
+		d.Column, _ = strconv.Atoi(m[3])
+		action, rest := m[4], m[5]
+		if inner, ok := cutCallError(rest, "include", "tpl"); ok && strings.HasPrefix(inner, "template: ") {
+			msg = inner
+			continue
+		}
+		d.Message = rest
+		if v := valuesRe.FindStringSubmatch(action); v != nil {
+			d.ValuePath = valuePrefix(prefixes, d.Template) + v[1][1:]
+		}
+		if cause, ok := cutCallError(rest, "required"); ok {
+			d.Kind, d.Message = "required_value", cause
+		} else if cause, ok := cutCallError(rest, "fail"); ok {
+			d.Kind, d.Message = "fail", cause
+		} else if strings.Contains(rest, "nil pointer evaluating") {
+			d.Kind = "missing_value"
+		}
+		return d
+	}
+	if m := parseErrRe.FindStringSubmatch(msg); m != nil {
+		d.Kind, d.Template, d.Message = "parse", m[1], m[4]
+		d.Line, _ = strconv.Atoi(m[2])
+		d.Column, _ = strconv.Atoi(m[3])
+	}
+	return d
+}
+
+// cutCallError strips the "error calling <fn>: " text/template puts
+// before the error of a template function.
+func cutCallError(msg string, fns ...string) (string, bool) {
+	for _, fn := range fns {
+		if rest, ok := strings.CutPrefix(msg, "error calling "+fn+": "); ok {
+			return rest, true
+		}
+	}
+	return "", false
+}
+
+// requiredValues finds the .Values paths templates pass to required,
+// marking those the effective values leave nil or empty. Templates are
+// read, not executed, so values only required behind a condition are
+// found too.
+func requiredValues(tree *valuesTree, prefixes map[string]string) []RequiredValue {
+	var found []RequiredValue
+	seen := make(map[string]bool)
+	var walk func(t *valuesTree)
+	walk = func(t *valuesTree) {
+		names := make([]string, 0, len(t.chart.files))
+		for rel := range t.chart.files {
+			if strings.HasPrefix(rel, "templates/") {
+				names = append(names, rel)
+			}
+		}
+		sort.Strings(names)
+		for _, rel := range names {
+			full := t.chart.dir + "/" + rel
+			trees := make(map[string]*parse.Tree)
+			pt := parse.New(full)
+			pt.Mode = parse.SkipFuncCheck
+			if _, err := pt.Parse(string(t.chart.files[rel]), "", "", trees); err != nil {
+				continue
+			}
+			for _, tr := range trees {
+				for _, c := range requiredCalls(tr, tr.Root) {
+					_, err := required("", lookupValue(t.values, c.Path))
+					c.missing = err != nil
+					c.Path = prefixes[t.chart.dir] + c.Path
+					c.Template = full
+					if key := c.Template + "\x00" + c.Path; !seen[key] {
+						seen[key] = true
+						found = append(found, c)
+					}
+				}
+			}
+		}
+		for _, sub := range t.subcharts {
+			walk(sub)
+		}
+	}
+	walk(tree)
+	sort.Slice(found, func(i, j int) bool { return found[i].Path < found[j].Path })
+	return found
+}
+
+// requiredCalls finds calls of required on a .Values path, both as
+// required "msg" .Values.x and as .Values.x | required "msg".
+func requiredCalls(tr *parse.Tree, n parse.Node) []RequiredValue {
+	var calls []RequiredValue
+	var visit func(n parse.Node)
+	visitPipe := func(p *parse.PipeNode) {
+		if p == nil {
+			return
+		}
+		for i, cmd := range p.Cmds {
+			if len(cmd.Args) > 0 {
+				if id, ok := cmd.Args[0].(*parse.IdentifierNode); ok && id.Ident == "required" {
+					var msg string
+					var value parse.Node
+					if len(cmd.Args) > 1 {
+						if s, ok := cmd.Args[1].(*parse.StringNode); ok {
+							msg = s.Text
+						}
+					}
+					if len(cmd.Args) > 2 {
+						value = cmd.Args[2]
+					} else if i > 0 && len(p.Cmds[i-1].Args) == 1 {
+						value = p.Cmds[i-1].Args[0]
+					}
+					if path := valuesPath(value); path != "" {
+						loc, _ := tr.ErrorContext(cmd)
+						calls = append(calls, RequiredValue{Path: path, Message: msg, Line: contextLine(loc)})
+					}
+				}
+			}
+			for _, arg := range cmd.Args {
+				visit(arg)
+			}
+		}
+	}
+	visit = func(n parse.Node) {
+		switch n := n.(type) {
+		case *parse.ListNode:
+			if n != nil {
+				for _, c := range n.Nodes {
+					visit(c)
+				}
+			}
+		case *parse.ActionNode:
+			visitPipe(n.Pipe)
+		case *parse.PipeNode:
+			visitPipe(n)
+		case *parse.IfNode:
+			visitPipe(n.Pipe)
+			visit(n.List)
+			visit(n.ElseList)
+		case *parse.RangeNode:
+			visitPipe(n.Pipe)
+			visit(n.List)
+			visit(n.ElseList)
+		case *parse.WithNode:
+			visitPipe(n.Pipe)
+			visit(n.List)
+			visit(n.ElseList)
+		case *parse.TemplateNode:
+			visitPipe(n.Pipe)
+		}
+	}
+	visit(n)
+	return calls
+}
+
+// valuesPath returns the dotted path of a .Values or $.Values field
+// reference, or "".
+func valuesPath(n parse.Node) string {
+	var ident []string
+	switch n := n.(type) {
+	case *parse.FieldNode:
+		ident = n.Ident
+	case *parse.VariableNode:
+		if len(n.Ident) > 0 && n.Ident[0] == "$" {
+			ident = n.Ident[1:]
+		}
+	}
+	if len(ident) < 2 || ident[0] != "Values" {
+		return ""
+	}
+	return strings.Join(ident[1:], ".")
+}
+
+// contextLine reads the line from a "name:line:col" location.
+func contextLine(loc string) int {
+	parts := strings.Split(loc, ":")
+	if len(parts) < 3 {
+		return 0
+	}
+	line, _ := strconv.Atoi(parts[len(parts)-2])
+	return line
+}
@@ -0,0 +1,147 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// maxIndexDepth bounds the directories followed below a directory index.
+const maxIndexDepth = 10
+
+// fetchChart downloads the chart at chartURL and unpacks it. Besides an
+// archive in any format readChartArchive reads, an http(s) URL may serve
+// the directory index of an unpacked chart, such as a web server's
+// autoindex page, whose files are downloaded one by one. An oci:// chart
+// is held to the scan's allowed registries like its images are.
+func (s *server) fetchChart(ctx context.Context, chartURL string, opts scanOptions) ([]chartFile, error) {
+	if ref, ok := strings.CutPrefix(chartURL, "oci://"); ok {
+		if err := opts.egressAllowed(ref); err != nil {
+			return nil, fmt.Errorf("pulling chart: %w", err)
+		}
+	}
+	limits := opts.Archive
+	body, err := s.openChart(ctx, chartURL)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	br := bufio.NewReaderSize(body, 512)
+	head, _ := br.Peek(262)
+	if sniffArchive(head) != "" || !isIndexPage(head) || strings.HasPrefix(chartURL, "oci://") {
+		return readChartArchive(br, limits)
+	}
+	root := chartURL
+	if !strings.HasSuffix(root, "/") {
+		root += "/"
+	}
+	u, err := url.Parse(root)
+	if err != nil {
+		return nil, err
+	}
+	w := &indexWalk{
+		s:       s,
+		root:    root,
+		name:    path.Base(u.Path),
+		budget:  limits,
+		left:    limits.MaxDownload,
+		visited: map[string]bool{root: true},
+	}
+	if w.name == "/" || w.name == "." {
+		w.name = "chart"
+	}
+	page, err := w.read(br)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.walk(ctx, u, page, 0); err != nil {
+		return nil, fmt.Errorf("reading directory index %s: %w", chartURL, err)
+	}
+	if len(w.files) == 0 {
+		return nil, errors.New("directory index lists no chart files")
+	}
+	return w.files, nil
+}
+
+// isIndexPage reports whether a download starting with head is an HTML
+// page rather than an archive.
+func isIndexPage(head []byte) bool {
+	head = bytes.ToLower(bytes.TrimSpace(head))
+	return bytes.HasPrefix(head, []byte("<!doctype html")) || bytes.HasPrefix(head, []byte("<html")) ||
+		bytes.HasPrefix(head, []byte("<pre>")) || bytes.HasPrefix(head, []byte("<head"))
+}
+
+var hrefRe = regexp.MustCompile(`(?i)href\s*=\s*["']([^"'#?]+)["']`)
+
+// indexWalk downloads the files a directory index and its subdirectories
+// link to, within the archive limits of the scan. Only links below the
+// chart's URL are followed, which leaves out parent directories and
+// sorting links.
+type indexWalk struct {
+	s       *server
+	root    string
+	name    string
+	budget  archiveLimits
+	left    int64 // bytes left to download
+	visited map[string]bool
+	files   []chartFile
+}
+
+func (w *indexWalk) walk(ctx context.Context, dir *url.URL, page []byte, depth int) error {
+	for _, m := range hrefRe.FindAllSubmatch(page, -1) {
+		link, err := dir.Parse(string(m[1]))
+		if err != nil {
+			continue
+		}
+		target := link.String()
+		if !strings.HasPrefix(target, w.root) || w.visited[target] {
+			continue
+		}
+		w.visited[target] = true
+		rel, err := url.PathUnescape(strings.TrimPrefix(target, w.root))
+		if err != nil {
+			continue
+		}
+		data, err := w.download(ctx, target)
+		if err != nil {
+			return fmt.Errorf("downloading %s: %w", rel, err)
+		}
+		if strings.HasSuffix(target, "/") {
+			if depth+1 > maxIndexDepth {
+				return fmt.Errorf("directories nested too deeply at %s", rel)
+			}
+			if err := w.walk(ctx, link, data, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := addArchiveFile(rel, data, w.name+"/", 0, &w.budget, &w.files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *indexWalk) download(ctx context.Context, target string) ([]byte, error) {
+	body, err := w.s.openChart(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return w.read(body)
+}
+
+// read reads r against the download limit shared by all files.
+func (w *indexWalk) read(r io.Reader) ([]byte, error) {
+	lr := &limitedReader{r: r, n: w.left}
+	data, err := io.ReadAll(lr)
+	w.left = lr.n
+	return data, err
+}
@@ -0,0 +1,131 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostResolver picks the addresses outbound connections dial. Hosts of
+// -resolve are pinned to their addresses and never looked up; other hosts
+// are looked up in DNS, and the answers kept for -dns-cache-ttl.
+type hostResolver struct {
+	pins   map[string][]string // host or *.domain -> addresses
+	ttl    time.Duration
+	lookup func(ctx context.Context, host string) ([]string, error)
+	dialer *net.Dialer
+
+	mu    sync.Mutex
+	cache map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// newHostResolver returns nil when nothing is pinned or cached, leaving
+// dialing to the transport's defaults.
+func newHostResolver(pins map[string][]string, ttl time.Duration) *hostResolver {
+	if len(pins) == 0 && ttl <= 0 {
+		return nil
+	}
+	return &hostResolver{
+		pins:   pins,
+		ttl:    ttl,
+		lookup: net.DefaultResolver.LookupHost,
+		dialer: &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		cache:  make(map[string]dnsEntry),
+	}
+}
+
+// parsePins parses the -resolve flag, a comma-separated list of host=ip
+// mappings, where *.example.com pins every subdomain without a pin of its
+// own. A host given several times is pinned to all its addresses, tried
+// in order.
+func parsePins(list []string) (map[string][]string, error) {
+	pins := make(map[string][]string)
+	for _, p := range list {
+		host, ip, ok := strings.Cut(p, "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		ip = strings.TrimSpace(ip)
+		if !ok || host == "" || strings.ContainsAny(host, ":/") {
+			return nil, fmt.Errorf("invalid pin %q, want host=ip", p)
+		}
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid pin %q: %q is not an IP address", p, ip)
+		}
+		pins[host] = append(pins[host], ip)
+	}
+	return pins, nil
+}
+
+// addrs returns the addresses to dial for host.
+func (r *hostResolver) addrs(ctx context.Context, host string) ([]string, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ips, ok := r.pins[host]; ok {
+		return ips, nil
+	}
+	best := ""
+	for pattern := range r.pins {
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok && strings.HasSuffix(host, "."+suffix) && len(pattern) > len(best) {
+			best = pattern
+		}
+	}
+	if best != "" {
+		return r.pins[best], nil
+	}
+	if r.ttl <= 0 {
+		return r.lookup(ctx, host)
+	}
+	r.mu.Lock()
+	e, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.addrs, nil
+	}
+	addrs, err := r.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.cache[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(r.ttl)}
+	r.mu.Unlock()
+	return addrs, nil
+}
+
+// DialContext dials the addresses of the host of addr in turn. TLS is
+// still verified against the host name, which the transport takes from
+// the request.
+func (r *hostResolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return r.dialer.DialContext(ctx, network, addr)
+	}
+	addrs, err := r.addrs(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, a := range addrs {
+		conn, err := r.dialer.DialContext(ctx, network, net.JoinHostPort(a, port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	return nil, fmt.Errorf("dialing %s: %w", host, errors.Join(errs...))
+}
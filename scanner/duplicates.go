@@ -0,0 +1,111 @@
+package scanner
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// DuplicateGroup lists references in one chart that are variants of the
+// same repository: different tags, different registries (mirrors), or
+// both. ExtraBytes is how much more a node pulls for the whole group than
+// for the suggested image alone, counting shared layers once.
+type DuplicateGroup struct {
+	Repository string   `json:"repository"`
+	Kind       string   `json:"kind"`
+	Images     []string `json:"images"`
+	Suggested  string   `json:"suggested"`
+	ExtraBytes int64    `json:"extra_bytes"`
+	Suggestion string   `json:"suggestion"`
+}
+
+const (
+	duplicateTags       = "tags"
+	duplicateRegistries = "registries"
+	duplicateBoth       = "tags_and_registries"
+)
+
+// findDuplicates groups refs by repository path, ignoring the registry and
+// Docker Hub's implicit "library/" namespace, and reports every group with
+// more than one member. infos supplies sizes for the images that were
+// inspected; others still count towards the group but not its bytes.
+func findDuplicates(refs []string, infos []ImageInfo) []DuplicateGroup {
+	byRef := make(map[string]ImageInfo, len(infos))
+	for _, info := range infos {
+		byRef[info.Image] = info
+	}
+	groups := make(map[string][]name.Reference)
+	for _, ref := range refs {
+		r, err := name.ParseReference(ref)
+		if err != nil {
+			continue
+		}
+		key := strings.TrimPrefix(r.Context().RepositoryStr(), "library/")
+		groups[key] = append(groups[key], r)
+	}
+
+	var out []DuplicateGroup
+	for repo, members := range groups {
+		if len(members) < 2 {
+			continue
+		}
+		registries := make(map[string]struct{})
+		ids := make(map[string]struct{})
+		images := make([]string, 0, len(members))
+		for _, r := range members {
+			registries[r.Context().RegistryStr()] = struct{}{}
+			ids[r.Identifier()] = struct{}{}
+			images = append(images, r.String())
+		}
+		sort.Strings(images)
+		kind := duplicateTags
+		switch {
+		case len(registries) > 1 && len(ids) > 1:
+			kind = duplicateBoth
+		case len(registries) > 1:
+			kind = duplicateRegistries
+		}
+
+		suggested := members[0]
+		for _, r := range members[1:] {
+			if compareVersions(r.Identifier(), suggested.Identifier()) > 0 {
+				suggested = r
+			}
+		}
+		g := DuplicateGroup{
+			Repository: repo,
+			Kind:       kind,
+			Images:     images,
+			Suggested:  suggested.String(),
+		}
+		g.ExtraBytes = groupBytes(members, byRef) - byRef[suggested.String()].SizeBytes
+		if g.ExtraBytes < 0 {
+			g.ExtraBytes = 0
+		}
+		g.Suggestion = fmt.Sprintf("consolidate the %d references on %s", len(members), g.Suggested)
+		if g.ExtraBytes > 0 {
+			g.Suggestion += fmt.Sprintf(" to save about %d bytes per node", g.ExtraBytes)
+		}
+		out = append(out, g)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Repository < out[j].Repository })
+	return out
+}
+
+// groupBytes sums the distinct layers of the inspected members.
+func groupBytes(members []name.Reference, byRef map[string]ImageInfo) int64 {
+	seen := make(map[string]struct{})
+	var total int64
+	for _, r := range members {
+		for _, l := range byRef[r.String()].Layers {
+			if _, ok := seen[l.Digest]; ok {
+				continue
+			}
+			seen[l.Digest] = struct{}{}
+			total += l.SizeBytes
+		}
+	}
+	return total
+}
@@ -0,0 +1,572 @@
+package scanner
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	v1empty "github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// The end-to-end tests run the scan pipeline against an in-process
+// registry and chart server seeded with synthetic images and charts, so
+// extraction, inspection, caching and policies are checked without
+// network access.
+
+// newE2E starts a harness and a server with the built-in defaults: the
+// SCANNER_* variables are cleared for the test, so that it does not
+// depend on the environment. Every test gets a server of its own, so no
+// cache carries over.
+func newE2E(t *testing.T) (*harness, *server) {
+	t.Helper()
+	for _, kv := range os.Environ() {
+		if k, _, _ := strings.Cut(kv, "="); strings.HasPrefix(k, "SCANNER_") {
+			t.Setenv(k, "")
+			os.Unsetenv(k)
+		}
+	}
+	cfg, err := LoadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := newHarness()
+	if err != nil {
+		t.Fatalf("seeding the harness: %v", err)
+	}
+	t.Cleanup(h.Close)
+	history, _ := openHistoryStore("")
+	crawls, _ := openCrawlState("")
+	return h, newServer(cfg, history, crawls, nil, nil, nil, nil, nil)
+}
+
+// harness is an in-process OCI registry, with charts served next to it at
+// /charts/<name>.tgz. Charts write REGISTRY where the registry's host
+// goes.
+type harness struct {
+	srv  *httptest.Server
+	host string
+	// digests are the digests of the pushed images by repo:tag, before
+	// any tag was moved.
+	digests map[string]string
+	charts  map[string][]byte
+	// manifests and blobs count the registry requests for each.
+	manifests, blobs atomic.Int64
+}
+
+func newHarness() (*harness, error) {
+	h := &harness{digests: make(map[string]string), charts: make(map[string][]byte)}
+	reg := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/charts/", h.serveChart)
+	mux.Handle("/v2/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/manifests/"):
+			h.manifests.Add(1)
+		case strings.Contains(r.URL.Path, "/blobs/"):
+			h.blobs.Add(1)
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	h.srv = httptest.NewServer(mux)
+	h.host = strings.TrimPrefix(h.srv.URL, "http://")
+	if err := h.seed(); err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *harness) Close() { h.srv.Close() }
+
+// seed pushes the synthetic images and packages the charts.
+func (h *harness) seed() error {
+	for _, img := range []struct {
+		ref    string
+		layers int64
+	}{{"app:1.0", 3}, {"sidecar:1.0", 1}, {"db:15", 2}, {"moved:1", 1}, {"moved:1", 2}} {
+		if err := h.pushImage(img.ref, img.layers); err != nil {
+			return err
+		}
+	}
+	if err := h.pushIndex("multi:1", "linux/amd64", "linux/arm64"); err != nil {
+		return err
+	}
+	charts := map[string]map[string]string{
+		"web": {
+			"Chart.yaml":  "apiVersion: v2\nname: web\nversion: 1.0.0\n",
+			"values.yaml": "image:\n  repository: REGISTRY/app\n  tag: \"1.0\"\n",
+			"templates/deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+        - name: web
+          image: {{ .Values.image.repository }}:{{ .Values.image.tag }}
+        - name: sidecar
+          image: REGISTRY/sidecar:1.0
+`,
+		},
+		"pinned": {
+			"Chart.yaml":  "apiVersion: v2\nname: pinned\nversion: 1.0.0\n",
+			"values.yaml": "image: REGISTRY/app@" + h.digests["app:1.0"] + "\n",
+		},
+		"multi": {
+			"Chart.yaml":  "apiVersion: v2\nname: multi\nversion: 1.0.0\n",
+			"values.yaml": "image: REGISTRY/multi:1\n",
+		},
+		"stale": {
+			"Chart.yaml":  "apiVersion: v2\nname: stale\nversion: 1.0.0\n",
+			"values.yaml": "image: REGISTRY/moved:1@" + h.digests["moved:1"] + "\n",
+		},
+		"missing": {
+			"Chart.yaml":  "apiVersion: v2\nname: missing\nversion: 1.0.0\n",
+			"values.yaml": "app:\n  image: REGISTRY/app:1.0\nworker:\n  image: REGISTRY/gone:1\n",
+		},
+	}
+	for chart, files := range charts {
+		data, err := packageChart(chart, files, h.host)
+		if err != nil {
+			return err
+		}
+		h.charts[chart] = data
+	}
+	return nil
+}
+
+func (h *harness) ref(s string) string { return h.host + "/" + s }
+
+func (h *harness) chartURL(chart string) string { return h.srv.URL + "/charts/" + chart + ".tgz" }
+
+func (h *harness) serveChart(w http.ResponseWriter, r *http.Request) {
+	data, ok := h.charts[strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/charts/"), ".tgz")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Write(data)
+}
+
+// pushImage pushes a random image, recording the digest of its first push.
+func (h *harness) pushImage(ref string, layers int64) error {
+	img, err := random.Image(1024, layers)
+	if err != nil {
+		return err
+	}
+	if err := h.write(ref, img); err != nil {
+		return err
+	}
+	if _, seen := h.digests[ref]; !seen {
+		d, err := img.Digest()
+		if err != nil {
+			return err
+		}
+		h.digests[ref] = d.String()
+	}
+	return nil
+}
+
+// pushIndex pushes an image index with a random image per platform.
+func (h *harness) pushIndex(ref string, platforms ...string) error {
+	var idx v1.ImageIndex = v1empty.Index
+	for _, p := range platforms {
+		plat, err := v1.ParsePlatform(p)
+		if err != nil {
+			return err
+		}
+		img, err := random.Image(512, 1)
+		if err != nil {
+			return err
+		}
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: plat}})
+	}
+	r, err := name.ParseReference(h.ref(ref))
+	if err != nil {
+		return err
+	}
+	if err := remote.WriteIndex(r, idx); err != nil {
+		return fmt.Errorf("pushing %s: %w", ref, err)
+	}
+	d, err := idx.Digest()
+	if err != nil {
+		return err
+	}
+	h.digests[ref] = d.String()
+	return nil
+}
+
+func (h *harness) write(ref string, img v1.Image) error {
+	r, err := name.ParseReference(h.ref(ref))
+	if err != nil {
+		return err
+	}
+	if err := remote.Write(r, img); err != nil {
+		return fmt.Errorf("pushing %s: %w", ref, err)
+	}
+	return nil
+}
+
+// packageChart packs files below a directory named after the chart, the
+// layout of helm package, with REGISTRY replaced by host.
+func packageChart(chart string, files map[string]string, host string) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	names := make([]string, 0, len(files))
+	for n := range files {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		data := strings.ReplaceAll(files[n], "REGISTRY", host)
+		if err := tw.WriteHeader(&tar.Header{Name: chart + "/" + n, Mode: 0o644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(tw, data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// scan runs a /scan request for one of the harness's charts, rendered
+// unless the request says otherwise.
+func (h *harness) scan(t *testing.T, s *server, chart string, req scanRequest) *ScanResult {
+	t.Helper()
+	if req.Render == nil {
+		render := true
+		req.Render = &render
+	}
+	opts, err := s.scanOptionsFor(req, cacheControl{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ScanTimeout)
+	defer cancel()
+	result, err := s.scanChartForImages(ctx, h.chartURL(chart), opts)
+	if err != nil {
+		t.Fatalf("scanning %s: %v", chart, err)
+	}
+	return result
+}
+
+// wantRefs checks that the scan discovered exactly want.
+func wantRefs(t *testing.T, result *ScanResult, want ...string) {
+	t.Helper()
+	got := append(append([]string{}, result.Pinning.Pinned...), result.Pinning.Tagged...)
+	sort.Strings(got)
+	sort.Strings(want)
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("found images %v, want %v", got, want)
+	}
+}
+
+func findImage(t *testing.T, result *ScanResult, ref string) ImageInfo {
+	t.Helper()
+	for _, info := range result.Images {
+		if info.Image == ref {
+			return info
+		}
+	}
+	t.Fatalf("%s was not inspected", ref)
+	return ImageInfo{}
+}
+
+func TestE2EExtraction(t *testing.T) {
+	h, s := newE2E(t)
+	wantRefs(t, h.scan(t, s, "web", scanRequest{}), h.ref("app:1.0"), h.ref("sidecar:1.0"))
+	result := h.scan(t, s, "web", scanRequest{Options: Options{Values: map[string]interface{}{"image": map[string]interface{}{"tag": "2.0"}}}})
+	if result.RenderError != "" {
+		t.Fatalf("rendering: %s", result.RenderError)
+	}
+	wantRefs(t, result, h.ref("app:2.0"), h.ref("sidecar:1.0"))
+}
+
+func TestE2EInspection(t *testing.T) {
+	h, s := newE2E(t)
+	info := findImage(t, h.scan(t, s, "web", scanRequest{}), h.ref("app:1.0"))
+	r, err := name.ParseReference(h.ref("app:1.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := remote.Image(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for _, l := range m.Layers {
+		size += l.Size
+	}
+	if info.Digest != h.digests["app:1.0"] {
+		t.Errorf("digest %s, want %s", info.Digest, h.digests["app:1.0"])
+	}
+	if info.NumLayers != len(m.Layers) {
+		t.Errorf("%d layers, want %d", info.NumLayers, len(m.Layers))
+	}
+	if info.SizeBytes != size {
+		t.Errorf("size %d bytes, want %d", info.SizeBytes, size)
+	}
+}
+
+func TestE2EPlatforms(t *testing.T) {
+	h, s := newE2E(t)
+	result := h.scan(t, s, "multi", scanRequest{Options: Options{Platforms: []string{"linux/amd64", "linux/s390x"}}})
+	info := findImage(t, result, h.ref("multi:1"))
+	if got := strings.Join(info.Platforms, ","); got != "linux/amd64,linux/arm64" {
+		t.Errorf("platforms %s, want linux/amd64,linux/arm64", got)
+	}
+	if result.Platforms == nil || len(result.Platforms.Missing) != 1 || strings.Join(result.Platforms.Missing[0].Missing, ",") != "linux/s390x" {
+		t.Errorf("platform gaps %+v, want linux/s390x missing", result.Platforms)
+	}
+}
+
+func TestE2ECache(t *testing.T) {
+	h, s := newE2E(t)
+	h.scan(t, s, "web", scanRequest{})
+	before := s.cache.stats()
+	manifests, blobs := h.manifests.Load(), h.blobs.Load()
+	result := h.scan(t, s, "web", scanRequest{})
+	if len(result.Images) != 2 {
+		t.Fatalf("%d images inspected from the cache, want 2", len(result.Images))
+	}
+	if n := h.blobs.Load() - blobs; n != 0 {
+		t.Errorf("%d blob requests on a cached scan, want none", n)
+	}
+	if n := h.manifests.Load() - manifests; n != 0 {
+		t.Errorf("%d manifest requests on a cached scan, want none", n)
+	}
+	after := s.cache.stats()
+	if after.TagHits-before.TagHits != 2 || after.DigestHits-before.DigestHits != 2 {
+		t.Errorf("%d tag and %d digest cache hits, want 2 each", after.TagHits-before.TagHits, after.DigestHits-before.DigestHits)
+	}
+	// no_cache resolves the tags again but reuses what was inspected.
+	manifests, blobs = h.manifests.Load(), h.blobs.Load()
+	h.scan(t, s, "web", scanRequest{Options: Options{NoCache: true}})
+	if h.manifests.Load() == manifests {
+		t.Error("no_cache made no manifest request")
+	}
+	if n := h.blobs.Load() - blobs; n != 0 {
+		t.Errorf("%d blob requests with no_cache, want none", n)
+	}
+}
+
+func TestE2ERequireDigest(t *testing.T) {
+	h, s := newE2E(t)
+	result := h.scan(t, s, "web", scanRequest{Options: Options{RequireDigest: true}})
+	if result.Policy == nil || result.Policy.Passed || len(result.Policy.Violations) != 2 {
+		t.Errorf("policy %+v, want two require_digest violations", result.Policy)
+	}
+	result = h.scan(t, s, "pinned", scanRequest{Options: Options{RequireDigest: true}})
+	if result.Policy == nil || !result.Policy.Passed {
+		t.Errorf("policy %+v for a pinned chart, want passed", result.Policy)
+	}
+}
+
+func TestE2ENoHardcodedImages(t *testing.T) {
+	h, s := newE2E(t)
+	result := h.scan(t, s, "web", scanRequest{Options: Options{NoHardcodedImages: true}})
+	if result.Policy == nil || len(result.Policy.Violations) != 1 || result.Policy.Violations[0].Image != h.ref("sidecar:1.0") {
+		t.Errorf("policy %+v, want sidecar:1.0 hard-coded", result.Policy)
+	}
+}
+
+func TestE2EStalePin(t *testing.T) {
+	h, s := newE2E(t)
+	result := h.scan(t, s, "stale", scanRequest{})
+	want := h.ref("moved:1@" + h.digests["moved:1"])
+	if len(result.Pinning.Stale) != 1 || result.Pinning.Stale[0] != want {
+		t.Errorf("stale pins %v, want %s", result.Pinning.Stale, want)
+	}
+}
+
+func TestE2EAllowedRegistries(t *testing.T) {
+	h, s := newE2E(t)
+	manifests := h.manifests.Load()
+	result := h.scan(t, s, "web", scanRequest{Options: Options{AllowedRegistries: []string{"registry.example.com"}}})
+	if len(result.Images) != 0 || len(result.EgressBlocked) != 2 {
+		t.Errorf("%d images inspected and %d blocked, want 0 and 2", len(result.Images), len(result.EgressBlocked))
+	}
+	if n := h.manifests.Load() - manifests; n != 0 {
+		t.Errorf("%d registry requests for blocked images, want none", n)
+	}
+}
+
+func TestE2EAllowedRegistriesHoldOCICharts(t *testing.T) {
+	h, s := newE2E(t)
+	opts, err := s.scanOptionsFor(scanRequest{Options: Options{AllowedRegistries: []string{"registry.example.com"}}}, cacheControl{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifests := h.manifests.Load()
+	if _, err := s.scanChartForImages(context.Background(), "oci://"+h.host+"/charts/web:1.0.0", opts); !errors.Is(err, errEgressBlocked) {
+		t.Errorf("error %v, want %v", err, errEgressBlocked)
+	}
+	if n := h.manifests.Load() - manifests; n != 0 {
+		t.Errorf("%d registry requests for a blocked chart, want none", n)
+	}
+	for _, tc := range []struct {
+		repo    string
+		allowed []string
+		blocked bool
+	}{
+		{"oci://" + h.host + "/charts", []string{"registry.example.com"}, true},
+		{"oci://" + h.host + "/charts", []string{h.host}, false},
+		{"oci://" + h.host + "/charts", nil, false},
+		{h.srv.URL + "/charts", []string{"registry.example.com"}, false},
+	} {
+		if err := chartRepoAllowed(tc.repo, tc.allowed); errors.Is(err, errEgressBlocked) != tc.blocked {
+			t.Errorf("%s with %v: error %v, want blocked %v", tc.repo, tc.allowed, err, tc.blocked)
+		}
+	}
+}
+
+func TestE2EMaxImages(t *testing.T) {
+	h, s := newE2E(t)
+	result := h.scan(t, s, "web", scanRequest{Options: Options{MaxImages: 1}})
+	if tr := result.Truncation; tr == nil || tr.Discovered != 2 || len(tr.NotInspected) != 1 || len(result.Images) != 1 {
+		t.Errorf("truncation %+v with %d images inspected, want 1 of 2", result.Truncation, len(result.Images))
+	}
+}
+
+func TestE2EMissingImage(t *testing.T) {
+	h, s := newE2E(t)
+	result := h.scan(t, s, "missing", scanRequest{})
+	findImage(t, result, h.ref("app:1.0"))
+	for _, w := range result.Warnings {
+		if w.Code == warnImageFailed && w.Image == h.ref("gone:1") {
+			return
+		}
+	}
+	t.Errorf("no %s warning for gone:1 in %+v", warnImageFailed, result.Warnings)
+}
+
+// TestE2EScanResponse checks the shapes of the /scan response: the list
+// of images by default and the whole result with ?report=full.
+func TestE2EScanResponse(t *testing.T) {
+	h, s := newE2E(t)
+	body := `{"chart_url": "` + h.chartURL("web") + `", "render": true}`
+	w := httptest.NewRecorder()
+	s.scanHandler(w, httptest.NewRequest(http.MethodPost, "/scan?fields=image,digest", strings.NewReader(body)))
+	var images []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &images); err != nil {
+		t.Fatalf("default response %s: %v", w.Body, err)
+	}
+	if len(images) != 2 || len(images[0]) != 2 || images[0]["digest"] == nil {
+		t.Errorf("default response %s, want two images with image and digest", w.Body)
+	}
+	w = httptest.NewRecorder()
+	s.scanHandler(w, httptest.NewRequest(http.MethodPost, "/scan?report=full", strings.NewReader(body)))
+	var result ScanResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("full report %s: %v", w.Body, err)
+	}
+	if len(result.Images) != 2 || result.Pinning == nil {
+		t.Errorf("full report %s, want the images and pinning", w.Body)
+	}
+}
+
+func TestE2ERunProgress(t *testing.T) {
+	h, s := newE2E(t)
+	sc, err := New(s.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	render := true
+	var steps []Progress
+	result, err := sc.Run(context.Background(), Request{Chart: h.chartURL("web"), Options: Options{Render: &render}}, func(p Progress) {
+		steps = append(steps, p)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRefs(t, result, h.ref("app:1.0"), h.ref("sidecar:1.0"))
+	var stages, images []string
+	for _, p := range steps {
+		if p.Image != "" {
+			images = append(images, p.Image)
+			if p.Err != nil {
+				t.Errorf("%s failed: %v", p.Image, p.Err)
+			}
+			continue
+		}
+		stages = append(stages, p.Stage)
+	}
+	want := []string{StageQueued, StageDownloading, StageRendering, StageInspecting, StageReporting}
+	if strings.Join(stages, " ") != strings.Join(want, " ") {
+		t.Errorf("stages %v, want %v", stages, want)
+	}
+	sort.Strings(images)
+	if want := []string{h.ref("app:1.0"), h.ref("sidecar:1.0")}; strings.Join(images, " ") != strings.Join(want, " ") {
+		t.Errorf("inspected %v, want %v", images, want)
+	}
+	if last := steps[len(steps)-1]; last.ImagesDone != 2 || last.ImagesTotal != 2 {
+		t.Errorf("finished with %d of %d images inspected, want 2 of 2", last.ImagesDone, last.ImagesTotal)
+	}
+
+	if _, err := sc.Run(context.Background(), Request{Chart: h.chartURL("web"), Version: "1.x"}, nil); err == nil {
+		t.Error("a version was accepted for a chart URL")
+	}
+}
+
+func TestE2EScannersKeepTheirConfig(t *testing.T) {
+	h, s := newE2E(t)
+	capped := s.cfg
+	capped.MaxImages = 1
+	one, err := New(capped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer one.Close()
+	all, err := New(s.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer all.Close()
+	render := true
+	req := Request{Chart: h.chartURL("web"), Options: Options{Render: &render}}
+	for _, tc := range []struct {
+		sc   *Scanner
+		want int
+	}{{one, 1}, {all, 2}} {
+		result, err := tc.sc.Run(context.Background(), req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Images) != tc.want {
+			t.Errorf("%d images inspected, want %d", len(result.Images), tc.want)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package scanner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// eolTimeout bounds one request to the EOL feed.
+const eolTimeout = 5 * time.Second
+
+// EOLStatus is the support status of the release cycle an image's version
+// belongs to, as the EOL feed lists it.
+type EOLStatus struct {
+	Product string `json:"product"`
+	Cycle   string `json:"cycle"`
+	// Version is the version the cycle was matched by, from the tag or
+	// the image's org.opencontainers.image.version label.
+	Version string `json:"version"`
+	// EOL is the end-of-support date, or "true" for a cycle the feed
+	// marks unsupported without a date.
+	EOL     string `json:"eol,omitempty"`
+	Expired bool   `json:"expired"`
+	// Latest is the newest release of the cycle.
+	Latest string `json:"latest,omitempty"`
+}
+
+// eolCycle is one release cycle in the endoflife.date format. EOL is a
+// date or a boolean.
+type eolCycle struct {
+	Cycle  json.RawMessage `json:"cycle"`
+	EOL    json.RawMessage `json:"eol"`
+	Latest json.RawMessage `json:"latest"`
+}
+
+// eolProducts maps the last path segment of well-known image repositories
+// to their endoflife.date product. -eol-products adds to and overrides it.
+var eolProducts = map[string]string{
+	"postgres": "postgresql", "postgresql": "postgresql",
+	"mysql": "mysql", "mariadb": "mariadb", "mongo": "mongodb", "mongodb": "mongodb",
+	"redis": "redis", "memcached": "memcached", "elasticsearch": "elasticsearch",
+	"kibana": "kibana", "logstash": "logstash", "opensearch": "opensearch",
+	"rabbitmq": "rabbitmq", "kafka": "apache-kafka", "zookeeper": "zookeeper",
+	"cassandra": "apache-cassandra", "couchdb": "couchdb", "etcd": "etcd",
+	"nginx": "nginx", "httpd": "apache", "haproxy": "haproxy", "traefik": "traefik",
+	"tomcat": "tomcat", "node": "nodejs", "python": "python", "ruby": "ruby",
+	"php": "php", "golang": "go", "eclipse-temurin": "eclipse-temurin",
+	"alpine": "alpine", "debian": "debian", "ubuntu": "ubuntu", "centos": "centos",
+	"grafana": "grafana", "prometheus": "prometheus", "consul": "consul",
+	"vault": "hashicorp-vault", "keycloak": "keycloak", "jenkins": "jenkins",
+	"gitlab-ce": "gitlab", "sonarqube": "sonar", "wordpress": "wordpress",
+}
+
+// eolFeed looks up the support status of image versions in a feed in the
+// format of the endoflife.date API: an http(s) base URL serving
+// <product>.json, or a JSON file mapping products to their cycles.
+type eolFeed struct {
+	// products map a repository, or a prefix ending in /*, to a product.
+	products map[string]string
+
+	file    map[string][]eolCycle
+	service string
+	client  *http.Client
+	ttl     time.Duration
+	mu      sync.Mutex
+	cached  map[string]eolEntry
+}
+
+type eolEntry struct {
+	cycles  []eolCycle
+	fetched time.Time
+}
+
+// openEOLFeed opens the feed at src with the -eol-products mappings,
+// repository=product entries. An empty src means no feed.
+func openEOLFeed(src string, mappings []string, ttl time.Duration) (*eolFeed, error) {
+	if src == "" {
+		return nil, nil
+	}
+	f := &eolFeed{products: make(map[string]string)}
+	for _, m := range mappings {
+		repo, product, ok := strings.Cut(m, "=")
+		repo, product = strings.TrimSpace(repo), strings.TrimSpace(product)
+		if !ok || repo == "" || product == "" {
+			return nil, fmt.Errorf("invalid EOL product mapping %q, want repository=product", m)
+		}
+		f.products[canonicalRegistry(repo)] = product
+	}
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		f.service = strings.TrimSuffix(src, "/")
+		f.client = &http.Client{Timeout: eolTimeout}
+		f.ttl = ttl
+		f.cached = make(map[string]eolEntry)
+		return f, nil
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return nil, fmt.Errorf("opening EOL feed: %w", err)
+	}
+	if err := json.Unmarshal(data, &f.file); err != nil {
+		return nil, fmt.Errorf("parsing EOL feed %s: %w", src, err)
+	}
+	return f, nil
+}
+
+// product returns the feed product of ref's repository: a -eol-products
+// mapping of the repository or its longest prefix, then the built-in
+// table by the repository's last segment.
+func (f *eolFeed) product(ref string) string {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return ""
+	}
+	repo := canonicalRegistry(r.Context().RegistryStr() + "/" + r.Context().RepositoryStr())
+	if p, ok := f.products[repo]; ok {
+		return p
+	}
+	for p := repo; strings.Contains(p, "/"); {
+		p = p[:strings.LastIndex(p, "/")]
+		if product, ok := f.products[p+"/*"]; ok {
+			return product
+		}
+	}
+	return eolProducts[path.Base(repo)]
+}
+
+var versionRe = regexp.MustCompile(`^v?(\d+(?:\.\d+)*)`)
+
+// check returns the support status of info's version, nil when its
+// product is unknown to the feed or no cycle matches. A failing feed is
+// logged and yields no status.
+func (f *eolFeed) check(ctx context.Context, info ImageInfo) *EOLStatus {
+	if f == nil || info.Kind != kindImage {
+		return nil
+	}
+	product := f.product(info.Image)
+	if product == "" {
+		return nil
+	}
+	_, tag, _ := refRepoTag(info.Image)
+	version := versionRe.FindStringSubmatch(tag)
+	if version == nil {
+		version = versionRe.FindStringSubmatch(info.Version)
+	}
+	if version == nil {
+		return nil
+	}
+	cycles, err := f.cycles(ctx, product)
+	if err != nil {
+		log.Printf("warning: EOL feed lookup of %s: %v", product, err)
+		return nil
+	}
+	return matchCycle(product, version[1], cycles, time.Now())
+}
+
+// matchCycle finds the cycle of version, the longest one it starts with,
+// and whether it has reached its end of support by now.
+func matchCycle(product, version string, cycles []eolCycle, now time.Time) *EOLStatus {
+	var best *EOLStatus
+	for _, c := range cycles {
+		cycle := jsonScalar(c.Cycle)
+		if cycle == "" || (version != cycle && !strings.HasPrefix(version, cycle+".")) {
+			continue
+		}
+		if best != nil && len(cycle) <= len(best.Cycle) {
+			continue
+		}
+		st := &EOLStatus{Product: product, Cycle: cycle, Version: version, Latest: jsonScalar(c.Latest)}
+		switch eol := jsonScalar(c.EOL); eol {
+		case "", "false":
+		case "true":
+			st.EOL, st.Expired = eol, true
+		default:
+			st.EOL = eol
+			if t, err := time.Parse("2006-01-02", eol); err == nil {
+				st.Expired = !now.Before(t)
+			}
+		}
+		best = st
+	}
+	return best
+}
+
+// jsonScalar returns a JSON string, number or boolean as text.
+func jsonScalar(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	return strings.TrimSpace(string(raw))
+}
+
+// cycles returns the cycles of product, from the file or asked from the
+// service with GET <feed>/<product>.json. Answers, including 404 for
+// unknown products, are cached for the TTL.
+func (f *eolFeed) cycles(ctx context.Context, product string) ([]eolCycle, error) {
+	if f.service == "" {
+		return f.file[product], nil
+	}
+	f.mu.Lock()
+	e, ok := f.cached[product]
+	f.mu.Unlock()
+	if ok && time.Since(e.fetched) < f.ttl {
+		return e.cycles, nil
+	}
+	cycles, err := f.fetch(ctx, product)
+	if err != nil {
+		return nil, err
+	}
+	if f.ttl > 0 {
+		f.mu.Lock()
+		f.cached[product] = eolEntry{cycles: cycles, fetched: time.Now()}
+		f.mu.Unlock()
+	}
+	return cycles, nil
+}
+
+func (f *eolFeed) fetch(ctx context.Context, product string) ([]eolCycle, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.service+"/"+product+".json", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("EOL feed returned %s", resp.Status)
+	}
+	var cycles []eolCycle
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&cycles); err != nil {
+		return nil, fmt.Errorf("decoding EOL feed answer: %w", err)
+	}
+	return cycles, nil
+}
@@ -0,0 +1,187 @@
+package scanner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sources of an image origin.
+const (
+	originValues   = "values"
+	originFile     = "file"
+	originManifest = "manifest"
+)
+
+// maxOrigins bounds the origins kept for one image; an image repeated in
+// many manifests is explained well enough by the first of them.
+const maxOrigins = 20
+
+// ImageOrigin is one place a scan found an image reference.
+type ImageOrigin struct {
+	// Source is "values" for the chart's effective values, "file" for a
+	// YAML file of the chart and "manifest" for a rendered manifest.
+	Source string `json:"source"`
+	// File is the archive path of the file, the values.yaml of the chart
+	// the values belong to, or the template a manifest was rendered from.
+	File string `json:"file"`
+	// Document is the index of the YAML document within the file.
+	Document int `json:"document"`
+	// Path is the YAML path of the field, as in spec.containers[0].image.
+	Path string `json:"path"`
+	// Rule is the extraction rule that matched: image-string, image-map,
+	// repository-tag or image-helper.
+	Rule string `json:"rule"`
+	// Helper is the library chart helper that wrote the image into a
+	// rendered manifest, as <library chart>/<template name>.
+	Helper string `json:"helper,omitempty"`
+	// Construction explains how an image of the values assembled from
+	// the parts of a map was put together.
+	Construction *ImageConstruction `json:"construction,omitempty"`
+}
+
+// InspectionStep is one step taken to inspect an image.
+type InspectionStep struct {
+	Stage   string `json:"stage"`
+	Message string `json:"message"`
+}
+
+// ImageProvenance is how a scan came by one image.
+type ImageProvenance struct {
+	Origins []ImageOrigin `json:"origins"`
+	// OriginsDropped counts the origins beyond the first 20.
+	OriginsDropped int              `json:"origins_dropped,omitempty"`
+	Steps          []InspectionStep `json:"steps,omitempty"`
+}
+
+// provenance collects the provenance of the images of one scan.
+type provenance struct {
+	mu     sync.Mutex
+	images map[string]*ImageProvenance
+	// valuesRead is set when the chart's effective values were read, so
+	// that an image missing from them is meaningful.
+	valuesRead bool
+}
+
+func (p *provenance) origin(img string, o ImageOrigin) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.images == nil {
+		p.images = make(map[string]*ImageProvenance)
+	}
+	e := p.images[img]
+	if e == nil {
+		e = &ImageProvenance{}
+		p.images[img] = e
+	}
+	if len(e.Origins) >= maxOrigins {
+		e.OriginsDropped++
+		return
+	}
+	e.Origins = append(e.Origins, o)
+}
+
+// step records an inspection step of img. Steps of references the scan
+// found no origin for, such as the tag of a tag@digest reference, are
+// dropped.
+func (p *provenance) step(img, stage, msg string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e := p.images[img]; e != nil {
+		e.Steps = append(e.Steps, InspectionStep{Stage: stage, Message: msg})
+	}
+}
+
+// result returns the provenance of every image, with origins in a stable
+// order.
+func (p *provenance) result() map[string]*ImageProvenance {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, e := range p.images {
+		sort.SliceStable(e.Origins, func(i, j int) bool {
+			a, b := e.Origins[i], e.Origins[j]
+			if a.File != b.File {
+				return a.File < b.File
+			}
+			if a.Document != b.Document {
+				return a.Document < b.Document
+			}
+			return a.Path < b.Path
+		})
+	}
+	return p.images
+}
+
+// imageStep records an inspection step of ref in the scan's provenance and
+// its trace.
+func imageStep(ctx context.Context, stage, ref, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	tracef(ctx, stage, "%s: %s", ref, msg)
+	if j := jobFrom(ctx); j != nil {
+		j.prov.step(ref, stage, msg)
+	}
+}
+
+// ImageExplanation is how a stored scan came by one image.
+type ImageExplanation struct {
+	ScanID    string    `json:"scan_id"`
+	ChartURL  string    `json:"chart_url"`
+	ScannedAt time.Time `json:"scanned_at"`
+	Image     string    `json:"image"`
+	ImageProvenance
+	// Inspected is the image as the scan reported it; it is missing when
+	// the inspection failed, which the last step explains.
+	Inspected *ImageInfo `json:"inspected,omitempty"`
+}
+
+// explainHandler serves GET /scans/{id}/images/{ref}/explain, where id is
+// a stored result's id.
+func (s *server) explainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, rest, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/scans/"), "/images/")
+	ref, ok2 := strings.CutSuffix(rest, "/explain")
+	if !ok || !ok2 || id == "" || ref == "" {
+		jsonError(w, http.StatusNotFound, "want /scans/{id}/images/{ref}/explain")
+		return
+	}
+	if s.store == nil {
+		jsonError(w, http.StatusNotFound, "no result store configured, see -store")
+		return
+	}
+	result, err := s.store.Get(r.Context(), id)
+	if errors.Is(err, ErrNotStored) {
+		jsonError(w, http.StatusNotFound, fmt.Sprintf("no stored result %q", id))
+		return
+	}
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	prov := result.Provenance[ref]
+	if prov == nil {
+		msg := fmt.Sprintf("scan %s found no image %q", id, ref)
+		if result.Provenance == nil {
+			msg = fmt.Sprintf("scan %s recorded no provenance", id)
+		}
+		jsonError(w, http.StatusNotFound, msg)
+		return
+	}
+	exp := ImageExplanation{ScanID: id, ChartURL: result.ChartURL, ScannedAt: result.ScannedAt, Image: ref, ImageProvenance: *prov}
+	for i := range result.Images {
+		if result.Images[i].Image == ref {
+			exp.Inspected = &result.Images[i]
+			break
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(exp)
+}
@@ -0,0 +1,219 @@
+package scanner
+
+import (
+	"io"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+func extractImagesFromYAML(data []byte) ([]string, error) {
+	imgs := make(map[string]struct{})
+	err := walkYAMLImages(data, func(_ int, img, _, _ string) {
+		imgs[img] = struct{}{}
+	})
+	if err != nil {
+		return nil, err
+	}
+	list := make([]string, 0, len(imgs))
+	for img := range imgs {
+		list = append(list, img)
+	}
+	return list, nil
+}
+
+// walkYAMLImages calls found for every image in the documents of data,
+// with the document's index, the YAML path of the field and the rule that
+// matched it. Documents of the kinds documentExtractor knows are read by
+// their extractor.
+func walkYAMLImages(data []byte, found func(doc int, img, path, rule string)) error {
+	dec := yaml.NewDecoder(strings.NewReader(string(data)))
+	for doc := 0; ; doc++ {
+		var node interface{}
+		if err := dec.Decode(&node); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		report := func(img, path, rule string) { found(doc, img, path, rule) }
+		if d, ok := node.(map[string]interface{}); ok {
+			if extract := documentExtractor(d); extract != nil {
+				extract(d, report)
+				continue
+			}
+		}
+		walkImages(node, "", "", report)
+	}
+}
+
+func scanNode(node interface{}, imgs map[string]struct{}) {
+	scanNodeRegistry(node, "", imgs)
+}
+
+// scanNodeRegistry is scanNode with the registry of every image map
+// replaced by registry when it is set, as global.imageRegistry does.
+func scanNodeRegistry(node interface{}, registry string, imgs map[string]struct{}) {
+	walkImages(node, registry, "", func(img, _, _ string) { imgs[img] = struct{}{} })
+}
+
+// Extraction rules, as reported by the explain endpoint.
+const (
+	// ruleImageString is `image: "<ref>"`.
+	ruleImageString = "image-string"
+	// ruleImageMap is an image map with a repository or name and an
+	// optional registry, tag or digest.
+	ruleImageMap = "image-map"
+	// ruleRepositoryTag is a repository and a tag side by side.
+	ruleRepositoryTag = "repository-tag"
+	// ruleImageHelper is an image map read the way common.images.image
+	// assembles it.
+	ruleImageHelper = "image-helper"
+)
+
+// imageWalker keeps the path to the node being visited as a stack, so
+// that paths are only joined for the fields that yield an image.
+type imageWalker struct {
+	registry string
+	path     []string
+	found    func(img, path, rule string)
+	// construct, when set, is called instead of found, with how images
+	// assembled from parts were put together.
+	construct func(img, path, rule string, c *ImageConstruction)
+}
+
+// walkImages calls found for every image below node. prefix is prepended
+// to the reported paths.
+func walkImages(node interface{}, registry, prefix string, found func(img, path, rule string)) {
+	w := &imageWalker{registry: registry, found: found}
+	if prefix != "" {
+		w.path = append(w.path, prefix)
+	}
+	w.walk(node)
+}
+
+// walkValuesImages is walkImages for values, which also explains how
+// every image assembled from the parts of a map was put together.
+func walkValuesImages(node interface{}, registry, prefix string, found func(img, path, rule string, c *ImageConstruction)) {
+	w := &imageWalker{registry: registry, construct: found}
+	if prefix != "" {
+		w.path = append(w.path, prefix)
+	}
+	w.walk(node)
+}
+
+// report passes an image on; describe is only called for construct.
+func (w *imageWalker) report(img, path, rule string, describe func() *ImageConstruction) {
+	if w.construct == nil {
+		w.found(img, path, rule)
+		return
+	}
+	var c *ImageConstruction
+	if describe != nil {
+		c = describe()
+	}
+	w.construct(img, path, rule, c)
+}
+
+func (w *imageWalker) walk(node interface{}) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		// 1) image: "<string>"
+		if iv, ok := v["image"]; ok {
+			switch x := iv.(type) {
+			case string:
+				w.report(x, w.join("image"), ruleImageString, nil)
+			case map[string]interface{}:
+				m := x
+				if w.registry != "" {
+					m = withRegistry(x, w.registry)
+				}
+				if built := buildFromMap(m); built != "" {
+					at := w.join("image")
+					w.report(built, at, ruleImageMap, func() *ImageConstruction {
+						return describeImageMap(x, at, w.registry, "", false, built)
+					})
+				}
+			}
+		}
+		// 2) repository + tag at same level
+		if rv, ok1 := v["repository"]; ok1 {
+			if tv, ok2 := v["tag"]; ok2 {
+				if repo, ok := rv.(string); ok {
+					if tag, ok := tv.(string); ok {
+						at, img := w.join(""), repo+":"+tag
+						w.report(img, at, ruleRepositoryTag, func() *ImageConstruction {
+							return describeRepositoryTag(v, at, w.registry, img)
+						})
+					}
+				}
+			}
+		}
+		for k, child := range v {
+			w.path = append(w.path, k)
+			w.walk(child)
+			w.path = w.path[:len(w.path)-1]
+		}
+	case []interface{}:
+		for i, e := range v {
+			w.path = append(w.path, "["+strconv.Itoa(i)+"]")
+			w.walk(e)
+			w.path = w.path[:len(w.path)-1]
+		}
+	}
+}
+
+// join returns the current path with field appended, as in
+// spec.containers[0].image.
+func (w *imageWalker) join(field string) string {
+	var b strings.Builder
+	for _, seg := range w.path {
+		if b.Len() > 0 && !strings.HasPrefix(seg, "[") {
+			b.WriteByte('.')
+		}
+		b.WriteString(seg)
+	}
+	if field != "" {
+		if b.Len() > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(field)
+	}
+	return b.String()
+}
+
+func buildFromMap(m map[string]interface{}) string {
+	reg, _ := m["registry"].(string)
+	repo, _ := m["repository"].(string)
+	if repo == "" {
+		repo, _ = m["name"].(string)
+	}
+	if repo == "" {
+		return ""
+	}
+	tag, _ := m["tag"].(string)
+	digest, _ := m["digest"].(string)
+
+	img := strings.TrimRight(reg, "/")
+	if img != "" {
+		img += "/" + repo
+	} else {
+		img = repo
+	}
+	if digest != "" {
+		img += "@" + digest
+	} else if tag != "" {
+		img += ":" + tag
+	}
+	return img
+}
+
+func withRegistry(m map[string]interface{}, registry string) map[string]interface{} {
+	c := make(map[string]interface{}, len(m)+1)
+	for k, v := range m {
+		c[k] = v
+	}
+	c["registry"] = registry
+	return c
+}
@@ -0,0 +1,118 @@
+package scanner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// fieldSelection is the ?fields= list of a request: the image fields
+// the caller wants, in the order they are written. A nil selection
+// writes whole images.
+type fieldSelection []string
+
+// parseFields reads the fields query parameter and checks every name
+// against the JSON fields of image, the element type of the response's
+// images list.
+func parseFields(r *http.Request, image interface{}) (fieldSelection, error) {
+	fields := splitList(r.URL.Query().Get("fields"))
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	known := jsonFieldNames(reflect.TypeOf(image))
+	for _, f := range fields {
+		if !containsString(known, f) {
+			return nil, fmt.Errorf("unknown field %q, want one of %s", f, strings.Join(known, ", "))
+		}
+	}
+	return fields, nil
+}
+
+// jsonFieldNames lists the JSON names of a struct's fields, including
+// those promoted from embedded structs.
+func jsonFieldNames(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			names = append(names, jsonFieldNames(f.Type)...)
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// writeSelected writes v as the JSON response, with every object of its
+// top-level images list, or of v itself when it is a list of images, cut
+// down to the selected fields and sizes in units added. Fields an image
+// omits stay omitted.
+func writeSelected(w http.ResponseWriter, v interface{}, fields fieldSelection, units sizeUnits) {
+	w.Header().Set("Content-Type", "application/json")
+	if fields == nil {
+		if units == "" {
+			json.NewEncoder(w).Encode(v)
+			return
+		}
+		data, _ := json.Marshal(v)
+		w.Write(append(units.humanize(data), '\n'))
+		return
+	}
+	data, _ := json.Marshal(v)
+	if bytes.HasPrefix(data, []byte("[")) {
+		data = fields.applyAll(data)
+		w.Write(append(units.humanize(data), '\n'))
+		return
+	}
+	var top map[string]json.RawMessage
+	json.Unmarshal(data, &top)
+	if raw, ok := top["images"]; ok {
+		top["images"] = fields.applyAll(raw)
+	}
+	data, _ = json.Marshal(top)
+	w.Write(append(units.humanize(data), '\n'))
+}
+
+// applyAll cuts every object of an encoded list down to the selection.
+func (fs fieldSelection) applyAll(list json.RawMessage) json.RawMessage {
+	var images []map[string]json.RawMessage
+	json.Unmarshal(list, &images)
+	out := make([]json.RawMessage, len(images))
+	for i, img := range images {
+		out[i] = fs.apply(img)
+	}
+	data, _ := json.Marshal(out)
+	return data
+}
+
+// apply encodes the selected fields of a decoded object, in selection
+// order.
+func (fs fieldSelection) apply(obj map[string]json.RawMessage) json.RawMessage {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for _, f := range fs {
+		v, ok := obj[f]
+		if !ok {
+			continue
+		}
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(f)
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes()
+}
@@ -0,0 +1,251 @@
+package scanner
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// fleetRequest is the body of POST /fleet. An empty Contexts queries
+// every context of the kubeconfig.
+type fleetRequest struct {
+	Contexts   []string `json:"contexts,omitempty"`
+	Namespace  string   `json:"namespace,omitempty"`
+	Inspection string   `json:"inspection,omitempty"`
+}
+
+// FleetReport is the image inventory of the Helm releases deployed across
+// clusters.
+type FleetReport struct {
+	ScannedAt time.Time      `json:"scanned_at"`
+	Clusters  []FleetCluster `json:"clusters"`
+	Images    []FleetImage   `json:"images"`
+	Dedup     *DedupStats    `json:"dedup"`
+}
+
+type FleetCluster struct {
+	Context  string            `json:"context"`
+	Releases []DeployedRelease `json:"releases"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// DeployedRelease is the deployed revision of a Helm release.
+type DeployedRelease struct {
+	Namespace  string   `json:"namespace"`
+	Name       string   `json:"name"`
+	Chart      string   `json:"chart"`
+	Version    string   `json:"version"`
+	AppVersion string   `json:"app_version,omitempty"`
+	Revision   int      `json:"revision"`
+	Images     []string `json:"images"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// FleetImage is an image with the clusters and releases running it.
+// Images that could not be inspected keep only their reference.
+type FleetImage struct {
+	ImageInfo
+	Error    string   `json:"error,omitempty"`
+	Clusters []string `json:"clusters"`
+	// UsedBy are the releases as context/namespace/name.
+	UsedBy []string `json:"used_by"`
+}
+
+func (s *server) fleetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.kube == nil {
+		jsonError(w, http.StatusBadRequest, "cluster access is not configured, see -kubeconfig and -in-cluster")
+		return
+	}
+	fields, err := parseFields(r, FleetImage{})
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	units, err := s.unitsFor(r)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var req fleetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	opts, err := s.scanOptionsFor(scanRequest{Options: Options{Inspection: req.Inspection}}, cacheControl{})
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Contexts) == 0 {
+		req.Contexts = s.kube.contexts()
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.ScanTimeout)
+	defer cancel()
+	report := &FleetReport{ScannedAt: time.Now().UTC(), Clusters: make([]FleetCluster, len(req.Contexts))}
+	var wg sync.WaitGroup
+	for i, name := range req.Contexts {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			report.Clusters[i] = s.clusterReleases(ctx, name, req.Namespace)
+		}(i, name)
+	}
+	wg.Wait()
+
+	byRef := make(map[string]*FleetImage)
+	var refs []string
+	for _, c := range report.Clusters {
+		for _, rel := range c.Releases {
+			label := c.Context + "/" + rel.Namespace + "/" + rel.Name
+			for _, ref := range rel.Images {
+				img, ok := byRef[ref]
+				if !ok {
+					img = &FleetImage{ImageInfo: ImageInfo{Image: ref}}
+					byRef[ref] = img
+					refs = append(refs, ref)
+				}
+				if !containsString(img.Clusters, c.Context) {
+					img.Clusters = append(img.Clusters, c.Context)
+				}
+				img.UsedBy = append(img.UsedBy, label)
+			}
+		}
+	}
+	if len(refs) > 0 {
+		job, ctx, err := s.tracker.start(ctx, fmt.Sprintf("fleet inventory of %d clusters", len(req.Contexts)))
+		if err != nil {
+			jsonError(w, http.StatusServiceUnavailable, fmt.Sprintf("waiting for a scan slot: %v", err))
+			return
+		}
+		opts.Share = newDigestShare()
+		results := s.inspectAll(ctx, refs, opts, job, stageInspecting)
+		s.retryTransient(ctx, results, opts, job)
+		s.tracker.finish(job)
+		report.Dedup = opts.Share.result()
+		for _, res := range results {
+			img := byRef[res.info.Image]
+			if res.err != nil {
+				img.Error = res.err.Error()
+				continue
+			}
+			s.history.record(res.info)
+			img.ImageInfo = res.info
+		}
+	}
+
+	report.Images = make([]FleetImage, 0, len(byRef))
+	for _, img := range byRef {
+		sort.Strings(img.Clusters)
+		sort.Strings(img.UsedBy)
+		report.Images = append(report.Images, *img)
+	}
+	sort.Slice(report.Images, func(a, b int) bool { return report.Images[a].Image < report.Images[b].Image })
+	writeSelected(w, report, fields, units)
+}
+
+// clusterReleases reads the deployed Helm releases of one context. A
+// cluster that cannot be read is reported with its error, so one
+// unreachable cluster does not hide the rest of the fleet.
+func (s *server) clusterReleases(ctx context.Context, name, namespace string) FleetCluster {
+	fc := FleetCluster{Context: name, Releases: []DeployedRelease{}}
+	c, err := s.kube.client(name)
+	if err != nil {
+		fc.Error = err.Error()
+		return fc
+	}
+	fc.Context = c.context
+	secrets, err := c.deployedReleaseSecrets(ctx, namespace)
+	if err != nil {
+		fc.Error = err.Error()
+		return fc
+	}
+	for _, sec := range secrets {
+		fc.Releases = append(fc.Releases, decodeHelmRelease(sec))
+	}
+	sort.Slice(fc.Releases, func(i, j int) bool {
+		a, b := fc.Releases[i], fc.Releases[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	return fc
+}
+
+// helmRelease is the part of Helm's release record the inventory uses.
+type helmRelease struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Version   int    `json:"version"`
+	Chart     struct {
+		Metadata struct {
+			Name       string `json:"name"`
+			Version    string `json:"version"`
+			AppVersion string `json:"appVersion"`
+		} `json:"metadata"`
+	} `json:"chart"`
+	Manifest string `json:"manifest"`
+	Hooks    []struct {
+		Manifest string `json:"manifest"`
+	} `json:"hooks"`
+}
+
+// decodeHelmRelease unpacks a release record, which Helm stores as
+// base64 of the gzipped JSON, and extracts the images of its manifest and
+// hooks.
+func decodeHelmRelease(sec helmReleaseSecret) DeployedRelease {
+	out := DeployedRelease{Name: sec.Metadata.Name, Images: []string{}}
+	data, err := base64.StdEncoding.DecodeString(string(sec.Data.Release))
+	if err != nil {
+		out.Error = fmt.Sprintf("decoding release record: %v", err)
+		return out
+	}
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			out.Error = fmt.Sprintf("decompressing release record: %v", err)
+			return out
+		}
+		if data, err = io.ReadAll(io.LimitReader(zr, 64<<20)); err != nil {
+			out.Error = fmt.Sprintf("decompressing release record: %v", err)
+			return out
+		}
+	}
+	var rel helmRelease
+	if err := json.Unmarshal(data, &rel); err != nil {
+		out.Error = fmt.Sprintf("parsing release record: %v", err)
+		return out
+	}
+	out.Name, out.Namespace, out.Revision = rel.Name, rel.Namespace, rel.Version
+	out.Chart, out.Version, out.AppVersion = rel.Chart.Metadata.Name, rel.Chart.Metadata.Version, rel.Chart.Metadata.AppVersion
+
+	found := make(map[string]struct{})
+	manifests := []string{rel.Manifest}
+	for _, h := range rel.Hooks {
+		manifests = append(manifests, h.Manifest)
+	}
+	for _, m := range manifests {
+		imgs, _ := extractImagesFromYAML([]byte(m))
+		for _, img := range imgs {
+			found[img] = struct{}{}
+		}
+	}
+	for img := range found {
+		out.Images = append(out.Images, img)
+	}
+	sort.Strings(out.Images)
+	return out
+}
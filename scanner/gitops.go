@@ -0,0 +1,332 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ReleaseSource describes the GitOps object a scan was resolved from.
+type ReleaseSource struct {
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Namespace  string `json:"namespace,omitempty"`
+	Chart      string `json:"chart"`
+	Version    string `json:"version"`
+	Repository string `json:"repository"`
+	// Warnings lists parts of the spec that could not be taken into
+	// account, such as values held in ConfigMaps.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// releaseSpec is a Flux HelmRelease or Argo CD Application reduced to
+// what a scan needs.
+type releaseSpec struct {
+	source      ReleaseSource
+	constraint  string
+	values      map[string]interface{}
+	releaseName string
+	namespace   string
+	// localPath is set for charts kept in a Git repository, with the
+	// chart's directory in it.
+	localPath string
+	// chartURL is set for releases that name a chart archive directly.
+	chartURL string
+}
+
+// parseReleaseManifest reads the first HelmRelease or Application in a
+// multi-document manifest. The HelmRepository or OCIRepository a Flux
+// release refers to must be in the same manifest.
+func parseReleaseManifest(data []byte) (*releaseSpec, error) {
+	docs, err := decodeDocuments(data)
+	if err != nil {
+		return nil, err
+	}
+	sources := releaseSources(docs)
+	for _, d := range docs {
+		if isRelease(d) {
+			return parseRelease(d, sources)
+		}
+	}
+	return nil, errors.New("manifest contains no HelmRelease or Argo CD Application")
+}
+
+// releaseSources indexes the Flux source objects among docs by kind and
+// name.
+func releaseSources(docs []map[string]interface{}) map[string]map[string]interface{} {
+	sources := make(map[string]map[string]interface{})
+	for _, d := range docs {
+		switch manifestKind(d) {
+		case "HelmRepository", "OCIRepository", "GitRepository":
+			sources[manifestKind(d)+"/"+valueString(lookupValue(d, "metadata.name"))] = d
+		}
+	}
+	return sources
+}
+
+func isRelease(d map[string]interface{}) bool {
+	switch manifestKind(d) {
+	case "HelmRelease":
+		return strings.HasPrefix(valueString(d["apiVersion"]), "helm.toolkit.fluxcd.io/")
+	case "Application":
+		return strings.HasPrefix(valueString(d["apiVersion"]), "argoproj.io/")
+	}
+	return false
+}
+
+func parseRelease(d map[string]interface{}, sources map[string]map[string]interface{}) (*releaseSpec, error) {
+	if manifestKind(d) == "HelmRelease" {
+		return parseHelmRelease(d, sources)
+	}
+	return parseApplication(d)
+}
+
+func decodeDocuments(data []byte) ([]map[string]interface{}, error) {
+	dec := yaml.NewDecoder(strings.NewReader(string(data)))
+	var docs []map[string]interface{}
+	for {
+		var d map[string]interface{}
+		if err := dec.Decode(&d); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("parsing manifest: %w", err)
+		}
+		if d != nil {
+			docs = append(docs, d)
+		}
+	}
+	return docs, nil
+}
+
+func manifestKind(d map[string]interface{}) string {
+	return valueString(d["kind"])
+}
+
+func parseHelmRelease(d map[string]interface{}, sources map[string]map[string]interface{}) (*releaseSpec, error) {
+	name := valueString(lookupValue(d, "metadata.name"))
+	spec := &releaseSpec{
+		source:    ReleaseSource{Kind: "HelmRelease", Name: name, Namespace: valueString(lookupValue(d, "metadata.namespace"))},
+		namespace: valueString(lookupValue(d, "spec.targetNamespace")),
+	}
+	if spec.namespace == "" {
+		spec.namespace = spec.source.Namespace
+	}
+	spec.releaseName = valueString(lookupValue(d, "spec.releaseName"))
+	if spec.releaseName == "" {
+		spec.releaseName = name
+		if t := valueString(lookupValue(d, "spec.targetNamespace")); t != "" {
+			spec.releaseName = t + "-" + name
+		}
+	}
+	spec.values, _ = lookupValue(d, "spec.values").(map[string]interface{})
+	if lookupValue(d, "spec.valuesFrom") != nil {
+		spec.source.Warnings = append(spec.source.Warnings, "spec.valuesFrom is not resolved; only inline spec.values are applied")
+	}
+
+	if ref, ok := lookupValue(d, "spec.chartRef").(map[string]interface{}); ok {
+		kind, refName := valueString(ref["kind"]), valueString(ref["name"])
+		src, ok := sources[kind+"/"+refName]
+		if kind != "OCIRepository" || !ok {
+			return nil, fmt.Errorf("chartRef %s/%s must be an OCIRepository included in the manifest", kind, refName)
+		}
+		// The OCIRepository URL names the chart itself.
+		u := strings.TrimRight(valueString(lookupValue(src, "spec.url")), "/")
+		spec.source.Repository = u[:strings.LastIndex(u, "/")+1]
+		spec.source.Chart = u[len(spec.source.Repository):]
+		spec.source.Repository = strings.TrimRight(spec.source.Repository, "/")
+		spec.constraint = valueString(lookupValue(src, "spec.ref.tag"))
+		if s := valueString(lookupValue(src, "spec.ref.semver")); s != "" {
+			spec.constraint = s
+		}
+		return spec, nil
+	}
+
+	spec.source.Chart = valueString(lookupValue(d, "spec.chart.spec.chart"))
+	spec.constraint = valueString(lookupValue(d, "spec.chart.spec.version"))
+	kind := valueString(lookupValue(d, "spec.chart.spec.sourceRef.kind"))
+	refName := valueString(lookupValue(d, "spec.chart.spec.sourceRef.name"))
+	if spec.source.Chart == "" {
+		return nil, errors.New("HelmRelease has no spec.chart.spec.chart")
+	}
+	if kind == "GitRepository" {
+		src, ok := sources["GitRepository/"+refName]
+		if !ok {
+			return nil, fmt.Errorf("GitRepository %q is not in the manifest", refName)
+		}
+		spec.source.Repository = valueString(lookupValue(src, "spec.url"))
+		spec.localPath = spec.source.Chart
+		return spec, nil
+	}
+	if kind != "HelmRepository" {
+		return nil, fmt.Errorf("charts from a %s source are not supported", kind)
+	}
+	src, ok := sources["HelmRepository/"+refName]
+	if !ok {
+		return nil, fmt.Errorf("HelmRepository %q is not in the manifest", refName)
+	}
+	spec.source.Repository = strings.TrimRight(valueString(lookupValue(src, "spec.url")), "/")
+	if valueString(lookupValue(src, "spec.type")) == "oci" && !strings.HasPrefix(spec.source.Repository, "oci://") {
+		spec.source.Repository = "oci://" + spec.source.Repository
+	}
+	return spec, nil
+}
+
+func parseApplication(d map[string]interface{}) (*releaseSpec, error) {
+	name := valueString(lookupValue(d, "metadata.name"))
+	spec := &releaseSpec{
+		source:    ReleaseSource{Kind: "Application", Name: name, Namespace: valueString(lookupValue(d, "metadata.namespace"))},
+		namespace: valueString(lookupValue(d, "spec.destination.namespace")),
+	}
+	// Multi-source applications list their sources under spec.sources;
+	// the first one naming a chart is the one scanned.
+	src, _ := lookupValue(d, "spec.source").(map[string]interface{})
+	if list, ok := lookupValue(d, "spec.sources").([]interface{}); ok {
+		for _, e := range list {
+			if m, ok := e.(map[string]interface{}); ok && valueString(m["chart"]) != "" {
+				src = m
+				break
+			}
+		}
+	}
+	if src == nil {
+		return nil, errors.New("Application has no spec.source")
+	}
+	spec.source.Chart = valueString(src["chart"])
+	spec.source.Repository = strings.TrimRight(valueString(src["repoURL"]), "/")
+	if spec.source.Chart == "" {
+		spec.localPath = valueString(src["path"])
+		if spec.localPath == "" {
+			return nil, errors.New("Application source has neither chart nor path")
+		}
+		spec.source.Chart = spec.localPath
+	} else if !strings.Contains(spec.source.Repository, "://") {
+		// Argo CD writes OCI Helm repositories without a scheme.
+		spec.source.Repository = "oci://" + spec.source.Repository
+	}
+	spec.constraint = valueString(src["targetRevision"])
+
+	helm, _ := src["helm"].(map[string]interface{})
+	spec.releaseName = valueString(helm["releaseName"])
+	if spec.releaseName == "" {
+		spec.releaseName = name
+	}
+	// Argo CD layers values, then valuesObject, then parameters.
+	spec.values = map[string]interface{}{}
+	if s := valueString(helm["values"]); s != "" {
+		var vals map[string]interface{}
+		if err := yaml.Unmarshal([]byte(s), &vals); err != nil {
+			return nil, fmt.Errorf("parsing spec.source.helm.values: %w", err)
+		}
+		spec.values = mergeValues(spec.values, vals)
+	}
+	if obj, ok := helm["valuesObject"].(map[string]interface{}); ok {
+		spec.values = mergeValues(spec.values, obj)
+	}
+	// Argo CD passes parameters to helm as --set, or --set-string with
+	// forceString.
+	if params, ok := helm["parameters"].([]interface{}); ok {
+		for _, p := range params {
+			m, ok := p.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			force, _ := m["forceString"].(bool)
+			if err := setHelmValue(spec.values, valueString(m["name"]), valueString(m["value"]), force); err != nil {
+				spec.source.Warnings = append(spec.source.Warnings, fmt.Sprintf("helm.parameters: %v; it is not applied", err))
+			}
+		}
+	}
+	if helm["valueFiles"] != nil {
+		spec.source.Warnings = append(spec.source.Warnings, "helm.valueFiles are not applied")
+	}
+	return spec, nil
+}
+
+// resolveRelease returns the archive URL and version of the chart a
+// release deploys.
+func (s *server) resolveRelease(ctx context.Context, rel *releaseSpec) (chartURL, version string, err error) {
+	if rel.chartURL != "" {
+		return rel.chartURL, "", nil
+	}
+	return s.locateChart(ctx, rel.source.Repository, rel.source.Chart, rel.constraint)
+}
+
+// locateChart finds the archive URL of chart in a Helm repository, given
+// as an HTTP(S) repository URL or oci://registry/path, picking the highest
+// version that satisfies constraint.
+func (s *server) locateChart(ctx context.Context, repo, chart, constraint string) (chartURL, version string, err error) {
+	if base, ok := strings.CutPrefix(repo, "oci://"); ok {
+		ref := base + "/" + chart
+		if _, err := parseSemver(constraint); err == nil && strings.Trim(constraint, "0123456789.v") == "" {
+			return "oci://" + ref + ":" + constraint, constraint, nil
+		}
+		tags, err := s.registry.listTags(ctx, ref)
+		if err != nil {
+			return "", "", fmt.Errorf("listing chart versions: %w", err)
+		}
+		// Helm stores "+" in versions as "_" in OCI tags.
+		versions := make([]string, len(tags))
+		for i, t := range tags {
+			versions[i] = strings.ReplaceAll(t, "_", "+")
+		}
+		v, err := pickVersion(chart, constraint, versions)
+		if err != nil {
+			return "", "", err
+		}
+		return "oci://" + ref + ":" + strings.ReplaceAll(v, "+", "_"), v, nil
+	}
+	idx, err := s.cachedIndex(ctx, repo)
+	if err != nil {
+		return "", "", err
+	}
+	entries := idx.Entries[chart]
+	versions := make([]string, len(entries))
+	for i, e := range entries {
+		versions[i] = e.Version
+	}
+	v, err := pickVersion(chart, constraint, versions)
+	if err != nil {
+		return "", "", err
+	}
+	for _, e := range entries {
+		if e.Version == v && len(e.URLs) > 0 {
+			return resolveChartURL(repo, e.URLs[0]), v, nil
+		}
+	}
+	return "", "", fmt.Errorf("chart %s %s has no download URL", chart, v)
+}
+
+// pickVersion returns the highest of versions matching a semver
+// constraint; an exact match wins and an empty constraint means the latest
+// stable version.
+func pickVersion(chart, constraint string, versions []string) (string, error) {
+	for _, v := range versions {
+		if v == constraint {
+			return v, nil
+		}
+	}
+	if constraint == "" {
+		constraint = "*"
+	}
+	var best string
+	var bestV semVersion
+	for _, v := range versions {
+		ok, err := semverCompare(constraint, v)
+		if err != nil || !ok {
+			continue
+		}
+		sv, _ := parseSemver(v)
+		if best == "" || sv.compare(bestV) > 0 {
+			best, bestV = v, sv
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no version of chart %s matches %q", chart, constraint)
+	}
+	return best, nil
+}
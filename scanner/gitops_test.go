@@ -0,0 +1,66 @@
+package scanner
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseArgoApplication(t *testing.T) {
+	rel, err := parseReleaseManifest([]byte(`
+apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: web
+spec:
+  destination:
+    namespace: apps
+  source:
+    repoURL: ghcr.io/acme/charts
+    chart: web
+    targetRevision: 1.2.3
+    helm:
+      values: |
+        image:
+          tag: "1.24"
+        replicas: 1
+      valuesObject:
+        replicas: 2
+      parameters:
+        - name: image.tag
+          value: "1.25"
+        - name: podAnnotations.prometheus\.io/scrape
+          value: "true"
+          forceString: true
+        - name: replicas
+          value: "3"
+        - name: tolerations[0].key
+          value: gpu
+        - name: args
+          value: "{--verbose,--port=8080}"
+        - name: broken[
+          value: x
+      valueFiles:
+        - values-prod.yaml
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel.source.Repository != "oci://ghcr.io/acme/charts" || rel.source.Chart != "web" || rel.constraint != "1.2.3" || rel.releaseName != "web" {
+		t.Errorf("source %+v at %s as %s", rel.source, rel.constraint, rel.releaseName)
+	}
+	want := map[string]interface{}{
+		"image":          map[string]interface{}{"tag": "1.25"},
+		"replicas":       int64(3),
+		"podAnnotations": map[string]interface{}{"prometheus.io/scrape": "true"},
+		"tolerations":    []interface{}{map[string]interface{}{"key": "gpu"}},
+		"args":           []interface{}{"--verbose", "--port=8080"},
+	}
+	if !reflect.DeepEqual(rel.values, want) {
+		t.Errorf("values %#v, want %#v", rel.values, want)
+	}
+	warnings := strings.Join(rel.source.Warnings, "; ")
+	if !strings.Contains(warnings, `helm.parameters: set name "broken[" has an unclosed [`) || !strings.Contains(warnings, "helm.valueFiles are not applied") {
+		t.Errorf("warnings %q", warnings)
+	}
+}
@@ -0,0 +1,997 @@
+package scanner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// This file reads the subset of HCL that Terraform configurations declare
+// helm_release resources with: blocks, attributes, literals, collections,
+// string templates, variable and local references and a few functions.
+// Other expressions, such as conditionals and references to resources,
+// parse fine but evaluate to an error, since only some attributes of a
+// file are of interest.
+
+// hclBlock is a block of an HCL file, or the file's top-level body.
+type hclBlock struct {
+	Type   string
+	Labels []string
+	Attrs  map[string]hclExpr
+	Blocks []*hclBlock
+}
+
+// hclExpr is an unevaluated expression.
+type hclExpr interface{}
+
+type (
+	hclLiteral struct{ v interface{} }
+	// hclTemplate is a quoted string or heredoc; literal text parts are
+	// hclLiterals.
+	hclTemplate struct{ parts []hclExpr }
+	hclTuple    struct{ elems []hclExpr }
+	hclObject   struct{ keys, vals []hclExpr }
+	hclCall     struct {
+		name string
+		args []hclExpr
+	}
+	// hclTraversal is a reference such as var.name or local.images[0];
+	// attribute steps are hclLiteral strings.
+	hclTraversal struct {
+		root  string
+		steps []hclExpr
+	}
+	// hclOpaque is an expression outside the supported subset.
+	hclOpaque struct{ src string }
+)
+
+func parseHCL(src []byte) (*hclBlock, error) {
+	p := &hclParser{src: string(src)}
+	body := &hclBlock{Attrs: make(map[string]hclExpr)}
+	err := p.body(body)
+	if err == nil && p.pos < len(p.src) {
+		err = errors.New("unexpected }")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %w", strings.Count(p.src[:p.pos], "\n")+1, err)
+	}
+	return body, nil
+}
+
+type hclParser struct {
+	src string
+	pos int
+}
+
+func (p *hclParser) peek() byte {
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+func (p *hclParser) rest() string { return p.src[p.pos:] }
+
+// space skips blanks and comments, and line breaks too when nl is set.
+func (p *hclParser) space(nl bool) {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n' && nl:
+			p.pos++
+		case c == '#' || strings.HasPrefix(p.rest(), "//"):
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case strings.HasPrefix(p.rest(), "/*"):
+			end := strings.Index(p.src[p.pos+2:], "*/")
+			if end < 0 {
+				p.pos = len(p.src)
+			} else {
+				p.pos += end + 4
+			}
+		default:
+			return
+		}
+	}
+}
+
+func isIdentByte(c byte, first bool) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= utf8.RuneSelf ||
+		!first && (c == '-' || c >= '0' && c <= '9')
+}
+
+func (p *hclParser) ident() string {
+	start := p.pos
+	for p.pos < len(p.src) && isIdentByte(p.src[p.pos], p.pos == start) {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+// keyword reports whether the input continues with the keyword kw.
+func (p *hclParser) keyword(kw string) bool {
+	r := p.rest()
+	return strings.HasPrefix(r, kw) && (len(r) == len(kw) || !isIdentByte(r[len(kw)], false))
+}
+
+// body reads attributes and blocks up to the end of input or a closing
+// brace, which is left for the caller.
+func (p *hclParser) body(b *hclBlock) error {
+	for {
+		p.space(true)
+		if p.pos >= len(p.src) || p.peek() == '}' {
+			return nil
+		}
+		name := p.ident()
+		if name == "" {
+			return fmt.Errorf("unexpected %q", p.peek())
+		}
+		p.space(false)
+		if p.peek() == '=' {
+			p.pos++
+			x, err := p.expr(true)
+			if err != nil {
+				return err
+			}
+			b.Attrs[name] = x
+			p.space(false)
+			if c := p.peek(); c != '\n' && c != '}' && c != 0 {
+				return fmt.Errorf("unexpected %q after attribute %s", c, name)
+			}
+			continue
+		}
+		blk := &hclBlock{Type: name, Attrs: make(map[string]hclExpr)}
+		for p.peek() != '{' {
+			switch {
+			case p.peek() == '"':
+				t, err := p.quoted()
+				if err != nil {
+					return err
+				}
+				label, ok := literalString(t)
+				if !ok {
+					return fmt.Errorf("block %s has a label with interpolations", name)
+				}
+				blk.Labels = append(blk.Labels, label)
+			case isIdentByte(p.peek(), true):
+				blk.Labels = append(blk.Labels, p.ident())
+			default:
+				return fmt.Errorf("unexpected %q in block %s", p.peek(), name)
+			}
+			p.space(false)
+		}
+		p.pos++
+		if err := p.body(blk); err != nil {
+			return err
+		}
+		if p.peek() != '}' {
+			return fmt.Errorf("block %s is not closed", name)
+		}
+		p.pos++
+		b.Blocks = append(b.Blocks, blk)
+	}
+}
+
+// expr reads an expression. In a body (nl set) it ends with the line;
+// inside brackets line breaks are insignificant.
+func (p *hclParser) expr(nl bool) (hclExpr, error) {
+	p.space(!nl)
+	start := p.pos
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	p.space(!nl)
+	switch c := p.peek(); {
+	case c == 0 || c == '\n' || c == ',' || c == ')' || c == ']' || c == '}' || c == ':':
+		return x, nil
+	case c == '=' && !strings.HasPrefix(p.rest(), "=="):
+		return x, nil
+	case strings.HasPrefix(p.rest(), "~}"):
+		// The strip marker closing an interpolation.
+		return x, nil
+	}
+	// An operator follows: keep the source, but do not evaluate it.
+	if err := p.skipExpr(nl); err != nil {
+		return nil, err
+	}
+	return hclOpaque{src: strings.TrimSpace(p.src[start:p.pos])}, nil
+}
+
+// skipExpr consumes input up to the end of the current expression.
+func (p *hclParser) skipExpr(nl bool) error {
+	depth := 0
+	for {
+		p.space(!nl || depth > 0)
+		switch c := p.peek(); {
+		case c == 0:
+			if depth > 0 {
+				return errors.New("unexpected end of file")
+			}
+			return nil
+		case c == '\n':
+			return nil
+		case c == '(' || c == '[' || c == '{':
+			depth++
+			p.pos++
+		case c == ')' || c == ']' || c == '}':
+			if depth == 0 {
+				return nil
+			}
+			depth--
+			p.pos++
+		case c == ',' && depth == 0:
+			return nil
+		default:
+			if err := p.skipToken(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// group consumes a bracketed expression that is not evaluated, such as a
+// for expression.
+func (p *hclParser) group() (hclExpr, error) {
+	start := p.pos
+	depth := 0
+	for {
+		p.space(true)
+		switch c := p.peek(); {
+		case c == 0:
+			return nil, errors.New("unexpected end of file")
+		case c == '(' || c == '[' || c == '{':
+			depth++
+			p.pos++
+		case c == ')' || c == ']' || c == '}':
+			depth--
+			p.pos++
+			if depth == 0 {
+				return hclOpaque{src: p.src[start:p.pos]}, nil
+			}
+		default:
+			if err := p.skipToken(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func (p *hclParser) skipToken() error {
+	var err error
+	switch {
+	case p.peek() == '"':
+		_, err = p.quoted()
+	case strings.HasPrefix(p.rest(), "<<"):
+		_, err = p.heredoc()
+	default:
+		p.pos++
+	}
+	return err
+}
+
+func (p *hclParser) primary() (hclExpr, error) {
+	switch c := p.peek(); {
+	case c == '"':
+		return p.quoted()
+	case strings.HasPrefix(p.rest(), "<<"):
+		return p.heredoc()
+	case c >= '0' && c <= '9':
+		return p.number()
+	case c == '[':
+		return p.tuple()
+	case c == '{':
+		return p.object()
+	case c == '(':
+		p.pos++
+		x, err := p.expr(false)
+		if err != nil {
+			return nil, err
+		}
+		p.space(true)
+		if p.peek() != ')' {
+			return nil, errors.New("expected )")
+		}
+		p.pos++
+		return x, nil
+	case c == '-' || c == '!':
+		start := p.pos
+		p.pos++
+		p.space(false)
+		if _, err := p.primary(); err != nil {
+			return nil, err
+		}
+		return hclOpaque{src: p.src[start:p.pos]}, nil
+	}
+	name := p.ident()
+	switch name {
+	case "":
+		return nil, fmt.Errorf("unexpected %q", p.peek())
+	case "true", "false":
+		return hclLiteral{name == "true"}, nil
+	case "null":
+		return hclLiteral{nil}, nil
+	}
+	if p.peek() == '(' {
+		return p.call(name)
+	}
+	return p.traversal(name)
+}
+
+func (p *hclParser) number() (hclExpr, error) {
+	start := p.pos
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		exp := c == '+' || c == '-'
+		if exp && p.src[p.pos-1] != 'e' && p.src[p.pos-1] != 'E' {
+			break
+		}
+		if !exp && c != '.' && c != 'e' && c != 'E' && (c < '0' || c > '9') {
+			break
+		}
+		p.pos++
+	}
+	s := p.src[start:p.pos]
+	if i, err := strconv.Atoi(s); err == nil {
+		return hclLiteral{i}, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number %q", s)
+	}
+	return hclLiteral{f}, nil
+}
+
+func (p *hclParser) traversal(root string) (hclExpr, error) {
+	t := hclTraversal{root: root}
+	for {
+		switch p.peek() {
+		case '.':
+			p.pos++
+			switch c := p.peek(); {
+			case c == '*':
+				p.pos++
+				t.steps = append(t.steps, hclOpaque{src: "*"})
+			case c >= '0' && c <= '9':
+				// Legacy index syntax, as in var.list.0.
+				x, err := p.number()
+				if err != nil {
+					return nil, err
+				}
+				t.steps = append(t.steps, x)
+			default:
+				name := p.ident()
+				if name == "" {
+					return nil, fmt.Errorf("expected an attribute name after %s.", root)
+				}
+				t.steps = append(t.steps, hclLiteral{name})
+			}
+		case '[':
+			p.pos++
+			p.space(true)
+			var x hclExpr = hclOpaque{src: "*"}
+			if p.peek() == '*' {
+				p.pos++
+			} else {
+				var err error
+				if x, err = p.expr(false); err != nil {
+					return nil, err
+				}
+			}
+			p.space(true)
+			if p.peek() != ']' {
+				return nil, errors.New("expected ]")
+			}
+			p.pos++
+			t.steps = append(t.steps, x)
+		default:
+			return t, nil
+		}
+	}
+}
+
+func (p *hclParser) call(name string) (hclExpr, error) {
+	p.pos++
+	c := hclCall{name: name}
+	for {
+		p.space(true)
+		if p.peek() == ')' {
+			p.pos++
+			return c, nil
+		}
+		x, err := p.expr(false)
+		if err != nil {
+			return nil, err
+		}
+		c.args = append(c.args, x)
+		p.space(true)
+		if strings.HasPrefix(p.rest(), "...") {
+			// Argument expansion is not evaluated.
+			p.pos += 3
+			c.args[len(c.args)-1] = hclOpaque{src: "..."}
+			p.space(true)
+		}
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ')':
+		default:
+			return nil, fmt.Errorf("expected , or ) in call to %s", name)
+		}
+	}
+}
+
+func (p *hclParser) tuple() (hclExpr, error) {
+	start := p.pos
+	p.pos++
+	p.space(true)
+	if p.keyword("for") {
+		p.pos = start
+		return p.group()
+	}
+	var t hclTuple
+	for {
+		p.space(true)
+		if p.peek() == ']' {
+			p.pos++
+			return t, nil
+		}
+		x, err := p.expr(false)
+		if err != nil {
+			return nil, err
+		}
+		t.elems = append(t.elems, x)
+		p.space(true)
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+		default:
+			return nil, errors.New("expected , or ] in tuple")
+		}
+	}
+}
+
+func (p *hclParser) object() (hclExpr, error) {
+	start := p.pos
+	p.pos++
+	p.space(true)
+	if p.keyword("for") {
+		p.pos = start
+		return p.group()
+	}
+	var o hclObject
+	for {
+		p.space(true)
+		if p.peek() == '}' {
+			p.pos++
+			return o, nil
+		}
+		var key hclExpr
+		if isIdentByte(p.peek(), true) {
+			// A bare name is a key, not a reference.
+			save := p.pos
+			name := p.ident()
+			p.space(false)
+			if c := p.peek(); c == '=' || c == ':' {
+				key = hclLiteral{name}
+			} else {
+				p.pos = save
+			}
+		}
+		if key == nil {
+			var err error
+			if key, err = p.expr(false); err != nil {
+				return nil, err
+			}
+		}
+		p.space(false)
+		if c := p.peek(); c != '=' && c != ':' {
+			return nil, errors.New("expected = or : in object")
+		}
+		p.pos++
+		val, err := p.expr(true)
+		if err != nil {
+			return nil, err
+		}
+		o.keys = append(o.keys, key)
+		o.vals = append(o.vals, val)
+		p.space(false)
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case '\n', '}':
+		default:
+			return nil, errors.New("expected , or a new line in object")
+		}
+	}
+}
+
+// quoted reads a quoted string template.
+func (p *hclParser) quoted() (hclExpr, error) {
+	p.pos++
+	return p.template(true)
+}
+
+// heredoc reads a <<EOT or, stripping the common indentation, <<-EOT
+// template. The line break after the closing marker is left in the input.
+func (p *hclParser) heredoc() (hclExpr, error) {
+	p.pos += 2
+	indent := p.peek() == '-'
+	if indent {
+		p.pos++
+	}
+	marker := p.ident()
+	nl := strings.IndexByte(p.rest(), '\n')
+	if marker == "" || nl < 0 || strings.TrimSpace(p.rest()[:nl]) != "" {
+		return nil, errors.New("invalid heredoc")
+	}
+	p.pos += nl + 1
+	var lines []string
+	for {
+		if p.pos >= len(p.src) {
+			return nil, fmt.Errorf("heredoc %s is not closed", marker)
+		}
+		line := p.rest()
+		if end := strings.IndexByte(line, '\n'); end >= 0 {
+			line = line[:end]
+		}
+		if strings.TrimSpace(line) == marker {
+			p.pos += len(line)
+			break
+		}
+		p.pos += len(line) + 1
+		lines = append(lines, line)
+	}
+	if indent {
+		strip := -1
+		for _, l := range lines {
+			if strings.TrimSpace(l) == "" {
+				continue
+			}
+			if n := len(l) - len(strings.TrimLeft(l, " \t")); strip < 0 || n < strip {
+				strip = n
+			}
+		}
+		for i, l := range lines {
+			if len(l) >= strip && strip > 0 {
+				lines[i] = l[strip:]
+			} else if strings.TrimSpace(l) == "" {
+				lines[i] = ""
+			}
+		}
+	}
+	var content string
+	if len(lines) > 0 {
+		content = strings.Join(lines, "\n") + "\n"
+	}
+	sub := &hclParser{src: content}
+	return sub.template(false)
+}
+
+// template reads template text up to a closing quote, or to the end of
+// input for heredocs, where quotes and backslashes are literal.
+func (p *hclParser) template(quoted bool) (hclExpr, error) {
+	var t hclTemplate
+	var lit strings.Builder
+	flush := func() {
+		if lit.Len() > 0 {
+			t.parts = append(t.parts, hclLiteral{lit.String()})
+			lit.Reset()
+		}
+	}
+	for {
+		if p.pos >= len(p.src) {
+			if quoted {
+				return nil, errors.New("unterminated string")
+			}
+			flush()
+			return t, nil
+		}
+		r := p.rest()
+		switch {
+		case quoted && r[0] == '\n':
+			return nil, errors.New("unterminated string")
+		case quoted && r[0] == '"':
+			p.pos++
+			flush()
+			return t, nil
+		case quoted && r[0] == '\\':
+			s, n, err := hclEscape(r)
+			if err != nil {
+				return nil, err
+			}
+			lit.WriteString(s)
+			p.pos += n
+		case strings.HasPrefix(r, "$${") || strings.HasPrefix(r, "%%{"):
+			lit.WriteString(r[1:3])
+			p.pos += 3
+		case strings.HasPrefix(r, "${") || strings.HasPrefix(r, "%{"):
+			flush()
+			x, err := p.interpolation()
+			if err != nil {
+				return nil, err
+			}
+			t.parts = append(t.parts, x)
+		default:
+			lit.WriteByte(r[0])
+			p.pos++
+		}
+	}
+}
+
+func (p *hclParser) interpolation() (hclExpr, error) {
+	start := p.pos
+	directive := p.peek() == '%'
+	p.pos += 2
+	if p.peek() == '~' {
+		p.pos++
+	}
+	var x hclExpr
+	if directive {
+		// Template directives (%{ if }, %{ for }) are not evaluated.
+		if err := p.skipExpr(false); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if x, err = p.expr(false); err != nil {
+			return nil, err
+		}
+		p.space(true)
+		if p.peek() == '~' {
+			p.pos++
+		}
+	}
+	if p.peek() != '}' {
+		return nil, errors.New("expected } to close the interpolation")
+	}
+	p.pos++
+	if directive {
+		x = hclOpaque{src: p.src[start:p.pos]}
+	}
+	return x, nil
+}
+
+// hclEscape decodes the escape sequence at the start of s, returning the
+// text and the number of bytes consumed.
+func hclEscape(s string) (string, int, error) {
+	if len(s) < 2 {
+		return "", 0, errors.New("unterminated string")
+	}
+	switch s[1] {
+	case 'n':
+		return "\n", 2, nil
+	case 'r':
+		return "\r", 2, nil
+	case 't':
+		return "\t", 2, nil
+	case '"', '\\':
+		return s[1:2], 2, nil
+	case 'u', 'U':
+		n := 4
+		if s[1] == 'U' {
+			n = 8
+		}
+		if len(s) < 2+n {
+			return "", 0, errors.New("invalid unicode escape")
+		}
+		r, err := strconv.ParseUint(s[2:2+n], 16, 32)
+		if err != nil {
+			return "", 0, errors.New("invalid unicode escape")
+		}
+		return string(rune(r)), 2 + n, nil
+	}
+	return "", 0, fmt.Errorf("invalid escape \\%c", s[1])
+}
+
+// literalString returns the text of a template without interpolations.
+func literalString(x hclExpr) (string, bool) {
+	t, ok := x.(hclTemplate)
+	if !ok {
+		return "", false
+	}
+	var b strings.Builder
+	for _, part := range t.parts {
+		l, ok := part.(hclLiteral)
+		if !ok {
+			return "", false
+		}
+		b.WriteString(l.v.(string))
+	}
+	return b.String(), true
+}
+
+func (t hclTraversal) String() string {
+	var b strings.Builder
+	b.WriteString(t.root)
+	for _, s := range t.steps {
+		switch x := s.(type) {
+		case hclLiteral:
+			if name, ok := x.v.(string); ok {
+				b.WriteString("." + name)
+			} else {
+				fmt.Fprintf(&b, "[%v]", x.v)
+			}
+		default:
+			b.WriteString("[…]")
+		}
+	}
+	return b.String()
+}
+
+// hclScope evaluates expressions in one module. Path references evaluate
+// to "."; file reads are relative to the module.
+type hclScope struct {
+	vars     map[string]interface{}
+	locals   map[string]hclExpr
+	values   map[string]interface{}
+	pending  map[string]bool
+	readFile func(name string) ([]byte, error)
+}
+
+func (sc *hclScope) eval(x hclExpr) (interface{}, error) {
+	switch x := x.(type) {
+	case hclLiteral:
+		return x.v, nil
+	case hclTemplate:
+		// A template that is a single interpolation yields its value as is.
+		if len(x.parts) == 1 {
+			if _, ok := x.parts[0].(hclLiteral); !ok {
+				return sc.eval(x.parts[0])
+			}
+		}
+		var b strings.Builder
+		for _, part := range x.parts {
+			v, err := sc.eval(part)
+			if err != nil {
+				return nil, err
+			}
+			s, ok := hclString(v)
+			if !ok {
+				return nil, fmt.Errorf("cannot interpolate %s", hclTypeName(v))
+			}
+			b.WriteString(s)
+		}
+		return b.String(), nil
+	case hclTuple:
+		out := make([]interface{}, len(x.elems))
+		for i, e := range x.elems {
+			v, err := sc.eval(e)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = v
+		}
+		return out, nil
+	case hclObject:
+		out := make(map[string]interface{}, len(x.keys))
+		for i := range x.keys {
+			k, err := sc.eval(x.keys[i])
+			if err != nil {
+				return nil, err
+			}
+			ks, ok := hclString(k)
+			if !ok {
+				return nil, fmt.Errorf("object key cannot be %s", hclTypeName(k))
+			}
+			v, err := sc.eval(x.vals[i])
+			if err != nil {
+				return nil, err
+			}
+			out[ks] = v
+		}
+		return out, nil
+	case hclTraversal:
+		return sc.traverse(x)
+	case hclCall:
+		return sc.call(x)
+	case hclOpaque:
+		return nil, fmt.Errorf("%q cannot be evaluated statically", x.src)
+	}
+	return nil, fmt.Errorf("unsupported expression %T", x)
+}
+
+func (sc *hclScope) traverse(t hclTraversal) (interface{}, error) {
+	var name string
+	if len(t.steps) > 0 {
+		if l, ok := t.steps[0].(hclLiteral); ok {
+			name, _ = l.v.(string)
+		}
+	}
+	var v interface{}
+	switch {
+	case t.root == "var" && name != "":
+		val, ok := sc.vars[name]
+		if !ok {
+			return nil, fmt.Errorf("var.%s has no default value", name)
+		}
+		v = val
+	case t.root == "local" && name != "":
+		val, err := sc.local(name)
+		if err != nil {
+			return nil, err
+		}
+		v = val
+	case t.root == "path" && (name == "module" || name == "root" || name == "cwd"):
+		v = "."
+	default:
+		return nil, fmt.Errorf("%s cannot be evaluated statically", t)
+	}
+	for _, step := range t.steps[1:] {
+		k, err := sc.eval(step)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", t, err)
+		}
+		if v, err = hclIndex(v, k); err != nil {
+			return nil, fmt.Errorf("%s: %w", t, err)
+		}
+	}
+	return v, nil
+}
+
+func (sc *hclScope) local(name string) (interface{}, error) {
+	if v, ok := sc.values[name]; ok {
+		return v, nil
+	}
+	x, ok := sc.locals[name]
+	if !ok {
+		return nil, fmt.Errorf("local.%s is not defined", name)
+	}
+	if sc.pending[name] {
+		return nil, fmt.Errorf("local.%s refers to itself", name)
+	}
+	sc.pending[name] = true
+	defer delete(sc.pending, name)
+	v, err := sc.eval(x)
+	if err != nil {
+		return nil, err
+	}
+	sc.values[name] = v
+	return v, nil
+}
+
+func hclIndex(v, k interface{}) (interface{}, error) {
+	switch c := v.(type) {
+	case map[string]interface{}:
+		ks, ok := hclString(k)
+		if !ok {
+			return nil, fmt.Errorf("cannot index a map with %s", hclTypeName(k))
+		}
+		e, ok := c[ks]
+		if !ok {
+			return nil, fmt.Errorf("no key %q", ks)
+		}
+		return e, nil
+	case []interface{}:
+		i, ok := k.(int)
+		if f, isFloat := k.(float64); isFloat && f == float64(int(f)) {
+			i, ok = int(f), true
+		}
+		if !ok || i < 0 || i >= len(c) {
+			return nil, fmt.Errorf("invalid index %v", k)
+		}
+		return c[i], nil
+	}
+	return nil, fmt.Errorf("cannot index %s", hclTypeName(v))
+}
+
+// hclString converts a primitive value to a string, as interpolation does.
+func hclString(v interface{}) (string, bool) {
+	switch v.(type) {
+	case string, int, float64, bool:
+		return valueString(v), true
+	}
+	return "", false
+}
+
+func hclTypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "a list"
+	}
+	return "a " + fmt.Sprintf("%T", v)
+}
+
+func (sc *hclScope) call(c hclCall) (interface{}, error) {
+	if c.name == "try" {
+		// try returns its first argument that evaluates.
+		err := errors.New("try needs arguments")
+		for _, a := range c.args {
+			var v interface{}
+			if v, err = sc.eval(a); err == nil {
+				return v, nil
+			}
+		}
+		return nil, err
+	}
+	args := make([]interface{}, len(c.args))
+	for i, a := range c.args {
+		v, err := sc.eval(a)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	one := func() (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s takes one argument", c.name)
+		}
+		return args[0], nil
+	}
+	switch c.name {
+	case "tostring", "tonumber", "tobool", "tomap", "tolist", "toset", "sensitive", "nonsensitive":
+		return one()
+	case "file":
+		v, err := one()
+		if err != nil {
+			return nil, err
+		}
+		name, ok := v.(string)
+		if !ok {
+			return nil, errors.New("file takes a path")
+		}
+		data, err := sc.readFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("file(%q): %w", name, err)
+		}
+		return string(data), nil
+	case "yamlencode", "jsonencode":
+		v, err := one()
+		if err != nil {
+			return nil, err
+		}
+		var b []byte
+		if c.name == "yamlencode" {
+			b, err = yaml.Marshal(v)
+		} else {
+			b, err = json.Marshal(v)
+		}
+		return string(b), err
+	case "trimspace":
+		v, err := one()
+		if err != nil {
+			return nil, err
+		}
+		s, _ := hclString(v)
+		return strings.TrimSpace(s), nil
+	case "merge":
+		out := make(map[string]interface{})
+		for _, a := range args {
+			m, ok := a.(map[string]interface{})
+			if !ok && a != nil {
+				return nil, errors.New("merge takes objects")
+			}
+			for k, v := range m {
+				out[k] = v
+			}
+		}
+		return out, nil
+	case "lookup":
+		if len(args) < 2 || len(args) > 3 {
+			return nil, errors.New("lookup takes two or three arguments")
+		}
+		v, err := hclIndex(args[0], args[1])
+		if err != nil && len(args) == 3 {
+			return args[2], nil
+		}
+		return v, err
+	case "coalesce":
+		for _, a := range args {
+			if a != nil && a != "" {
+				return a, nil
+			}
+		}
+		return nil, errors.New("coalesce has no non-empty argument")
+	}
+	return nil, fmt.Errorf("function %s cannot be evaluated statically", c.name)
+}
@@ -0,0 +1,144 @@
+package scanner
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// evalAttr parses src and evaluates its attribute x, with var.name set to
+// "web" and var.port to 8080.
+func evalAttr(t *testing.T, src string) (interface{}, error) {
+	t.Helper()
+	body, err := parseHCL([]byte(src))
+	if err != nil {
+		return nil, err
+	}
+	x, ok := body.Attrs["x"]
+	if !ok {
+		t.Fatalf("no attribute x in %+v", body)
+	}
+	sc := &hclScope{
+		vars:    map[string]interface{}{"name": "web", "port": 8080},
+		locals:  map[string]hclExpr{},
+		values:  map[string]interface{}{},
+		pending: map[string]bool{},
+	}
+	return sc.eval(x)
+}
+
+func TestHCLExpressions(t *testing.T) {
+	for _, tc := range []struct {
+		name, src string
+		want      interface{}
+	}{
+		{"string", `x = "nginx"`, "nginx"},
+		{"number", `x = 3`, 3},
+		{"float", `x = 1.5e3`, 1500.0},
+		{"bool", `x = true`, true},
+		{"escapes", `x = "a\"b\\c\nd\u00e9\t"`, "a\"b\\c\nd\u00e9\t"},
+		{"interpolation", `x = "img-${var.name}:1.0"`, "img-web:1.0"},
+		{"interpolation keeps the type", `x = "${var.port}"`, 8080},
+		{"escaped interpolation", `x = "$${var.name} %%{ if }"`, "${var.name} %{ if }"},
+		{"strip markers", `x = "a-${~ var.name ~}-b"`, "a-web-b"},
+		{"heredoc", "x = <<EOT\nimage: ${var.name}\n  \"tag\": \\n\nEOT\n", "image: web\n  \"tag\": \\n\n"},
+		{"indented heredoc", "x = <<-EOT\n    a:\n      b: 1\n    EOT\n", "a:\n  b: 1\n"},
+		{"empty heredoc", "x = <<EOT\nEOT\n", nil},
+		{"tuple over lines", "x = [\n  \"a\", # first\n  \"b\",\n]", []interface{}{"a", "b"}},
+		{"object", `x = { repository = "nginx", "tag" = var.name }`, map[string]interface{}{"repository": "nginx", "tag": "web"}},
+		{"comments", "# top\n// also\n/* block\ncomment */ x = /* inline */ \"v\" # trailing\n", "v"},
+		{"function", `x = merge({ a = 1 }, { b = var.name })`, map[string]interface{}{"a": 1, "b": "web"}},
+		{"jsonencode", `x = jsonencode({ image = var.name })`, `{"image":"web"}`},
+		{"lookup with default", `x = lookup({ a = 1 }, "b", "none")`, "none"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := evalAttr(t, tc.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.want == nil {
+				if s, _ := got.(string); s != "" {
+					t.Errorf("got %#v, want empty", got)
+				}
+				return
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %#v, want %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHCLExpressionsNotEvaluated(t *testing.T) {
+	for _, tc := range []struct{ name, src, wantErr string }{
+		{"resource reference", `x = aws_s3_bucket.charts.id`, ""},
+		{"conditional", `x = var.port > 0 ? "a" : "b"`, "cannot be evaluated statically"},
+		{"directive", `x = "%{ if var.name != "" }a%{ endif }"`, "cannot be evaluated statically"},
+		{"unknown variable", `x = var.missing`, "missing"},
+	} {
+		if _, err := evalAttr(t, tc.src); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: error %v, want one containing %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestHCLBlocks(t *testing.T) {
+	src := `
+terraform {
+  required_providers {
+    helm = { source = "hashicorp/helm" }
+  }
+}
+
+resource "helm_release" web {
+  name = "web"
+
+  set {
+    name  = "image.tag"
+    value = "1.25"
+  }
+  dynamic "set" {
+    for_each = var.extra
+    content {
+      name = set.key
+    }
+  }
+}
+`
+	body, err := parseHCL([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Blocks) != 2 || body.Blocks[0].Type != "terraform" || body.Blocks[0].Blocks[0].Type != "required_providers" {
+		t.Fatalf("top-level blocks %+v", body.Blocks)
+	}
+	r := body.Blocks[1]
+	if r.Type != "resource" || !reflect.DeepEqual(r.Labels, []string{"helm_release", "web"}) {
+		t.Errorf("resource block %s %v", r.Type, r.Labels)
+	}
+	if len(r.Blocks) != 2 || r.Blocks[0].Type != "set" || r.Blocks[1].Type != "dynamic" || r.Blocks[1].Labels[0] != "set" {
+		t.Fatalf("nested blocks %+v", r.Blocks)
+	}
+	if content := r.Blocks[1].Blocks; len(content) != 1 || content[0].Type != "content" {
+		t.Errorf("dynamic block content %+v", content)
+	}
+	if _, ok := r.Blocks[0].Attrs["value"]; !ok {
+		t.Errorf("set block attributes %v", r.Blocks[0].Attrs)
+	}
+}
+
+func TestParseHCLRejects(t *testing.T) {
+	for _, tc := range []struct{ name, src, wantErr string }{
+		{"unterminated string", "a = 1\nx = \"open\n", "line 2: unterminated string"},
+		{"unclosed block", "resource \"a\" \"b\" {\n  x = 1\n", "not closed"},
+		{"stray brace", "x = 1\n}\n", "unexpected }"},
+		{"unclosed heredoc", "x = <<EOT\nnever closed\n", "heredoc EOT is not closed"},
+		{"bad escape", `x = "\q"`, `invalid escape \q`},
+		{"interpolated label", `resource "${var.kind}" "x" {}`, "label with interpolations"},
+		{"attribute without a name", "= 1\n", `unexpected '='`},
+	} {
+		if _, err := parseHCL([]byte(tc.src)); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: error %v, want one containing %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
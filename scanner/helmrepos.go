@@ -0,0 +1,289 @@
+package scanner
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"gopkg.in/yaml.v3"
+)
+
+// helmRepository is an entry of Helm's repositories.yaml, as written by
+// `helm repo add`.
+type helmRepository struct {
+	Name                  string `yaml:"name"`
+	URL                   string `yaml:"url"`
+	Username              string `yaml:"username"`
+	Password              string `yaml:"password"`
+	CertFile              string `yaml:"certFile"`
+	KeyFile               string `yaml:"keyFile"`
+	CAFile                string `yaml:"caFile"`
+	InsecureSkipTLSVerify bool   `yaml:"insecure_skip_tls_verify"`
+}
+
+// helmConfig is the host's Helm client configuration: the repositories
+// added with `helm repo add` and the logins of `helm registry login`.
+type helmConfig struct {
+	repos    []helmRepository
+	registry configKeychain
+	// routes carry the credentials and TLS settings of the repositories
+	// that have any.
+	routes []repoRoute
+}
+
+// helmConfigDir returns Helm's configuration directory, following the
+// rules of the Helm CLI.
+func helmConfigDir() string {
+	if d := os.Getenv("HELM_CONFIG_HOME"); d != "" {
+		return d
+	}
+	if runtime.GOOS == "darwin" {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, "Library", "Preferences", "helm")
+		}
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "helm")
+}
+
+// defaultHelmPath is where Helm keeps one of its files unless env
+// overrides it.
+func defaultHelmPath(env string, elem ...string) string {
+	if p := os.Getenv(env); p != "" {
+		return p
+	}
+	dir := helmConfigDir()
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(append([]string{dir}, elem...)...)
+}
+
+// loadHelmConfig reads repositories.yaml and the registry config,
+// decrypting them with keys when they are encrypted. Files that do not
+// exist are skipped, as Helm does.
+func loadHelmConfig(reposPath, registryPath string, keys *keyRing) (*helmConfig, error) {
+	hc := &helmConfig{registry: configKeychain{}}
+	if reposPath != "" {
+		data, err := readSecretFile(reposPath, keys)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, fmt.Errorf("reading Helm repositories: %w", err)
+		default:
+			var f struct {
+				Repositories []helmRepository `yaml:"repositories"`
+			}
+			if err := yaml.Unmarshal(data, &f); err != nil {
+				return nil, fmt.Errorf("parsing %s: %w", reposPath, err)
+			}
+			for _, r := range f.Repositories {
+				r.URL = strings.TrimSuffix(r.URL, "/")
+				hc.repos = append(hc.repos, r)
+				route, err := newRepoRoute(r)
+				if err != nil {
+					return nil, fmt.Errorf("Helm repository %s: %w", r.Name, err)
+				}
+				if route.username != "" || route.tls != nil {
+					hc.routes = append(hc.routes, route)
+				}
+			}
+		}
+	}
+	if registryPath != "" {
+		data, err := readSecretFile(registryPath, keys)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, fmt.Errorf("reading Helm registry config: %w", err)
+		default:
+			if hc.registry, err = parseRegistryConfig(data); err != nil {
+				return nil, fmt.Errorf("parsing %s: %w", registryPath, err)
+			}
+		}
+	}
+	return hc, nil
+}
+
+// repo returns the repository added under name.
+func (hc *helmConfig) repo(name string) (helmRepository, bool) {
+	if hc != nil {
+		for _, r := range hc.repos {
+			if r.Name == name {
+				return r, true
+			}
+		}
+	}
+	return helmRepository{}, false
+}
+
+// addRepo adds a repository, replacing one of the same name.
+func (hc *helmConfig) addRepo(r helmRepository) {
+	for i := range hc.repos {
+		if hc.repos[i].Name == r.Name {
+			hc.repos[i] = r
+			return
+		}
+	}
+	hc.repos = append(hc.repos, r)
+}
+
+// transport wraps next so that requests to a repository's URL carry its
+// credentials and TLS settings.
+func (hc *helmConfig) transport(next http.RoundTripper) http.RoundTripper {
+	if hc == nil || len(hc.routes) == 0 {
+		return next
+	}
+	return &helmRepoTransport{next: next, routes: hc.routes}
+}
+
+func newRepoRoute(r helmRepository) (repoRoute, error) {
+	route := repoRoute{prefix: r.URL, username: r.Username, password: r.Password}
+	if r.CAFile != "" || r.CertFile != "" || r.InsecureSkipTLSVerify {
+		tc, err := repoTLSConfig(r)
+		if err != nil {
+			return route, err
+		}
+		route.tls = tc
+	}
+	return route, nil
+}
+
+func repoTLSConfig(r helmRepository) (*tls.Config, error) {
+	tc := &tls.Config{InsecureSkipVerify: r.InsecureSkipTLSVerify}
+	if r.CAFile != "" {
+		pem, err := os.ReadFile(r.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", r.CAFile)
+		}
+	}
+	if r.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// helmRepoTransport applies repository settings to the requests under a
+// repository URL: the index and the chart archives stored next to it.
+// Charts an index points to on other hosts are fetched without
+// credentials. TLS settings travel to the transport of newTransport in
+// the request's context, so the requests still pass the rest of the
+// chain.
+type helmRepoTransport struct {
+	next   http.RoundTripper
+	routes []repoRoute
+}
+
+type repoRoute struct {
+	prefix             string
+	username, password string
+	tls                *tls.Config
+}
+
+func (t *helmRepoTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := req.URL.String()
+	var best *repoRoute
+	for i, r := range t.routes {
+		if (u == r.prefix || strings.HasPrefix(u, r.prefix+"/")) && (best == nil || len(r.prefix) > len(best.prefix)) {
+			best = &t.routes[i]
+		}
+	}
+	if best == nil {
+		return t.next.RoundTrip(req)
+	}
+	if best.username != "" && req.Header.Get("Authorization") == "" {
+		req = req.Clone(req.Context())
+		req.SetBasicAuth(best.username, best.password)
+	}
+	if best.tls != nil {
+		req = req.WithContext(withTLSConfig(req.Context(), best.tls))
+	}
+	return t.next.RoundTrip(req)
+}
+
+// splitChartRef looks up the repository of a repo/chart reference, the
+// form `helm install` accepts, in the Helm repositories.
+func (s *server) splitChartRef(ref string) (repo helmRepository, chart string, err error) {
+	name, chart, ok := strings.Cut(ref, "/")
+	if !ok || name == "" || chart == "" || strings.Contains(chart, "/") {
+		return repo, "", fmt.Errorf("chart reference %q is neither a URL nor repo/chart", ref)
+	}
+	repo, ok = s.helm.repo(name)
+	if !ok {
+		return repo, "", fmt.Errorf("unknown chart repository %q", name)
+	}
+	return repo, chart, nil
+}
+
+// isChartRef reports whether chart_url is a repo/chart reference rather
+// than a URL.
+func isChartRef(s string) bool {
+	return !strings.Contains(s, "://")
+}
+
+// configKeychain holds the logins of a config.json in Docker's format,
+// such as Helm's registry config or the content of an image pull secret.
+type configKeychain map[string]authn.AuthConfig
+
+func parseRegistryConfig(data []byte) (configKeychain, error) {
+	var f struct {
+		Auths map[string]struct {
+			Auth          string `json:"auth"`
+			Username      string `json:"username"`
+			Password      string `json:"password"`
+			IdentityToken string `json:"identitytoken"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	kc := make(configKeychain, len(f.Auths))
+	for host, a := range f.Auths {
+		cfg := authn.AuthConfig{Username: a.Username, Password: a.Password, IdentityToken: a.IdentityToken}
+		if a.Auth != "" {
+			dec, err := base64.StdEncoding.DecodeString(a.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("auth of %s: %w", host, err)
+			}
+			cfg.Username, cfg.Password, _ = strings.Cut(string(dec), ":")
+		}
+		// Keys may be URLs such as https://index.docker.io/v1/.
+		host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+		host, _, _ = strings.Cut(host, "/")
+		kc[host] = cfg
+	}
+	return kc, nil
+}
+
+func (kc configKeychain) Resolve(res authn.Resource) (authn.Authenticator, error) {
+	if cfg, ok := kc[res.RegistryStr()]; ok {
+		return authn.FromConfig(cfg), nil
+	}
+	if res.RegistryStr() == name.DefaultRegistry {
+		if cfg, ok := kc["registry-1.docker.io"]; ok {
+			return authn.FromConfig(cfg), nil
+		}
+	}
+	return authn.Anonymous, nil
+}
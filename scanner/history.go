@@ -0,0 +1,181 @@
+package scanner
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// historyPersistInterval limits how often a repeated observation of an
+// unchanged digest is written to the history file.
+const historyPersistInterval = time.Hour
+
+// HistoryEntry is a span of time during which a reference pointed at one
+// digest.
+type HistoryEntry struct {
+	Digest                string    `json:"digest"`
+	SizeBytes             int64     `json:"size_bytes"`
+	UncompressedSizeBytes int64     `json:"uncompressed_size_bytes,omitempty"`
+	NumLayers             int       `json:"layers"`
+	FirstSeen             time.Time `json:"first_seen"`
+	LastSeen              time.Time `json:"last_seen"`
+}
+
+type historyResponse struct {
+	Image   string         `json:"image"`
+	History []HistoryEntry `json:"history"`
+}
+
+// historyRecord is one line of the history file.
+type historyRecord struct {
+	Ref                   string    `json:"ref"`
+	Digest                string    `json:"digest"`
+	SizeBytes             int64     `json:"size_bytes"`
+	UncompressedSizeBytes int64     `json:"uncompressed_size_bytes,omitempty"`
+	NumLayers             int       `json:"layers"`
+	Seen                  time.Time `json:"seen"`
+}
+
+// historyStore tracks which digest and size every image reference had each
+// time it was scanned. Entries are kept in memory and, when a path is
+// configured, appended to a JSON-lines file that is replayed on startup.
+type historyStore struct {
+	mu        sync.Mutex
+	entries   map[string][]HistoryEntry
+	persisted map[string]time.Time
+	file      *os.File
+}
+
+func openHistoryStore(path string) (*historyStore, error) {
+	h := &historyStore{
+		entries:   make(map[string][]HistoryEntry),
+		persisted: make(map[string]time.Time),
+	}
+	if path == "" {
+		return h, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening history file: %w", err)
+	}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var rec historyRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			continue
+		}
+		h.apply(rec)
+		h.persisted[rec.Ref] = rec.Seen
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading history file: %w", err)
+	}
+	h.file = f
+	return h, nil
+}
+
+// record notes that info was observed now.
+func (h *historyStore) record(info ImageInfo) {
+	if info.Digest == "" {
+		return
+	}
+	rec := historyRecord{
+		Ref:                   historyKey(info.Image),
+		Digest:                info.Digest,
+		SizeBytes:             info.SizeBytes,
+		UncompressedSizeBytes: info.UncompressedSizeBytes,
+		NumLayers:             info.NumLayers,
+		Seen:                  time.Now().UTC(),
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	changed := h.apply(rec)
+	if h.file == nil || (!changed && rec.Seen.Sub(h.persisted[rec.Ref]) < historyPersistInterval) {
+		return
+	}
+	b, _ := json.Marshal(rec)
+	if _, err := h.file.Write(append(b, '\n')); err != nil {
+		return
+	}
+	h.persisted[rec.Ref] = rec.Seen
+}
+
+// apply folds rec into the in-memory history and reports whether it
+// started a new entry.
+func (h *historyStore) apply(rec historyRecord) bool {
+	list := h.entries[rec.Ref]
+	if n := len(list); n > 0 && list[n-1].Digest == rec.Digest {
+		if rec.Seen.After(list[n-1].LastSeen) {
+			list[n-1].LastSeen = rec.Seen
+		}
+		return false
+	}
+	h.entries[rec.Ref] = append(list, HistoryEntry{
+		Digest:                rec.Digest,
+		SizeBytes:             rec.SizeBytes,
+		UncompressedSizeBytes: rec.UncompressedSizeBytes,
+		NumLayers:             rec.NumLayers,
+		FirstSeen:             rec.Seen,
+		LastSeen:              rec.Seen,
+	})
+	return true
+}
+
+func (h *historyStore) history(ref string) []HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]HistoryEntry(nil), h.entries[historyKey(ref)]...)
+}
+
+func (h *historyStore) Close() error {
+	if h.file == nil {
+		return nil
+	}
+	return h.file.Close()
+}
+
+// historyKey normalises ref so that "nginx:1.25" and
+// "docker.io/library/nginx:1.25" share a history.
+func historyKey(ref string) string {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return ref
+	}
+	return r.Name()
+}
+
+// imageHistoryHandler serves GET /images/{ref}/history. The reference may
+// contain slashes and may also be URL-encoded as a single path segment.
+func (s *server) imageHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := strings.TrimPrefix(r.URL.EscapedPath(), "/images/")
+	if !strings.HasSuffix(p, "/history") {
+		jsonError(w, http.StatusNotFound, "not found")
+		return
+	}
+	ref, err := url.PathUnescape(strings.TrimSuffix(p, "/history"))
+	if err != nil || ref == "" {
+		jsonError(w, http.StatusBadRequest, "invalid image reference")
+		return
+	}
+	entries := s.history.history(ref)
+	if len(entries) == 0 {
+		jsonError(w, http.StatusNotFound, fmt.Sprintf("no history for %q", ref))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(historyResponse{Image: historyKey(ref), History: entries})
+}
@@ -0,0 +1,201 @@
+package scanner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// hubTimeout bounds one request to the Docker Hub API.
+const hubTimeout = 10 * time.Second
+
+// Docker Hub publisher badges. Official images live in the library
+// namespace; the others are read from the Hub's catalog.
+const (
+	hubOfficial   = "official"
+	hubVerified   = "verified_publisher"
+	hubOpenSource = "open_source"
+	hubCommunity  = "community"
+)
+
+var hubBadges = []string{hubOfficial, hubVerified, hubOpenSource}
+
+// DockerHubReport classifies the Docker Hub images of a chart by who
+// publishes them, for the trusted_docker_hub policy.
+type DockerHubReport struct {
+	Images []DockerHubImage `json:"images"`
+}
+
+type DockerHubImage struct {
+	Image      string `json:"image"`
+	Repository string `json:"repository"`
+	// Badge is official, verified_publisher, open_source or community;
+	// it is not looked up for a trusted namespace.
+	Badge   string `json:"badge,omitempty"`
+	Trusted bool   `json:"trusted"`
+	// Reason says why the image is trusted or not.
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+// dockerHub looks up the publisher badges of Docker Hub repositories and
+// decides which are trusted: those with a trusted badge and those of a
+// trusted namespace.
+type dockerHub struct {
+	api        string
+	badges     map[string]bool
+	namespaces map[string]bool
+	ttl        time.Duration
+
+	mu     sync.Mutex
+	cached map[string]hubEntry
+}
+
+type hubEntry struct {
+	badge   string
+	fetched time.Time
+}
+
+func newDockerHub(api string, badges, namespaces []string, ttl time.Duration) *dockerHub {
+	h := &dockerHub{
+		api:        strings.TrimSuffix(api, "/"),
+		badges:     make(map[string]bool),
+		namespaces: make(map[string]bool),
+		ttl:        ttl,
+		cached:     make(map[string]hubEntry),
+	}
+	for _, b := range badges {
+		h.badges[b] = true
+	}
+	for _, ns := range namespaces {
+		h.namespaces[strings.ToLower(ns)] = true
+	}
+	return h
+}
+
+// validHubBadges checks the -docker-hub-trusted-badges.
+func validHubBadges(badges []string) error {
+	for _, b := range badges {
+		ok := false
+		for _, known := range hubBadges {
+			ok = ok || b == known
+		}
+		if !ok {
+			return fmt.Errorf("unknown Docker Hub badge %q, want one of %s", b, strings.Join(hubBadges, ", "))
+		}
+	}
+	return nil
+}
+
+// dockerHubReport classifies the Docker Hub images among refs; images of
+// other registries are left out.
+func (s *server) dockerHubReport(ctx context.Context, refs []string, concurrency int) *DockerHubReport {
+	rep := &DockerHubReport{Images: []DockerHubImage{}}
+	for _, ref := range refs {
+		r, err := name.ParseReference(ref)
+		if err != nil || r.Context().RegistryStr() != name.DefaultRegistry {
+			continue
+		}
+		rep.Images = append(rep.Images, DockerHubImage{Image: ref, Repository: r.Context().RepositoryStr()})
+	}
+	sort.Slice(rep.Images, func(i, j int) bool { return rep.Images[i].Image < rep.Images[j].Image })
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for i := range rep.Images {
+		wg.Add(1)
+		go func(img *DockerHubImage) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			s.hub.classify(ctx, s.client, img)
+		}(&rep.Images[i])
+	}
+	wg.Wait()
+	return rep
+}
+
+func (h *dockerHub) classify(ctx context.Context, client *http.Client, img *DockerHubImage) {
+	ns, _, _ := strings.Cut(img.Repository, "/")
+	if h.namespaces[ns] {
+		img.Trusted = true
+		img.Reason = fmt.Sprintf("namespace %s is trusted", ns)
+		return
+	}
+	if ns == "library" {
+		img.Badge = hubOfficial
+	} else {
+		badge, err := h.badge(ctx, client, img.Repository)
+		if err != nil {
+			img.Error = err.Error()
+			img.Reason = "the publisher could not be looked up on Docker Hub"
+			return
+		}
+		img.Badge = badge
+	}
+	img.Trusted = h.badges[img.Badge]
+	switch {
+	case img.Trusted:
+		img.Reason = fmt.Sprintf("the %s badge is trusted", img.Badge)
+	case img.Badge == hubCommunity:
+		img.Reason = fmt.Sprintf("namespace %s has no publisher badge and is not trusted", ns)
+	default:
+		img.Reason = fmt.Sprintf("namespace %s has the %s badge, which is not trusted, and is not trusted itself", ns, img.Badge)
+	}
+}
+
+// badge returns the publisher badge of a repository, asked from the Hub's
+// catalog search and cached for the TTL. A repository without a badge is
+// community.
+func (h *dockerHub) badge(ctx context.Context, client *http.Client, repo string) (string, error) {
+	h.mu.Lock()
+	e, ok := h.cached[repo]
+	h.mu.Unlock()
+	if ok && time.Since(e.fetched) < h.ttl {
+		return e.badge, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, hubTimeout)
+	defer cancel()
+	q := url.Values{"query": {repo}, "type": {"image"}, "page_size": {"25"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.api+"/api/search/v3/catalog/search?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Docker Hub answered %s", resp.Status)
+	}
+	var page struct {
+		Results []struct {
+			Name  string `json:"name"`
+			Slug  string `json:"slug"`
+			Badge string `json:"badge"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&page); err != nil {
+		return "", fmt.Errorf("parsing the Docker Hub catalog: %w", err)
+	}
+	badge := hubCommunity
+	for _, r := range page.Results {
+		if (r.Name == repo || r.Slug == repo) && r.Badge != "" {
+			badge = r.Badge
+			break
+		}
+	}
+	h.mu.Lock()
+	h.cached[repo] = hubEntry{badge: badge, fetched: time.Now()}
+	h.mu.Unlock()
+	return badge, nil
+}
@@ -0,0 +1,331 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+type ImageInfo struct {
+	Image                 string           `json:"image"`
+	Digest                string           `json:"digest,omitempty"`
+	Pinned                bool             `json:"pinned"`
+	TagVerification       *TagVerification `json:"tag_verification,omitempty"`
+	Kind                  string           `json:"kind,omitempty"`
+	ArtifactType          string           `json:"artifact_type,omitempty"`
+	SizeBytes             int64            `json:"size_bytes"`
+	UncompressedSizeBytes int64            `json:"uncompressed_size_bytes,omitempty"`
+	UncompressedEstimated bool             `json:"uncompressed_estimated,omitempty"`
+	NumLayers             int              `json:"layers"`
+	MediaType             string           `json:"media_type,omitempty"`
+	Compression           string           `json:"compression,omitempty"`
+	Platforms             []string         `json:"platforms,omitempty"`
+	// User is the user the image's config runs as, empty for root.
+	User           string          `json:"user,omitempty"`
+	Layers         []LayerInfo     `json:"layer_details,omitempty"`
+	LayerBreakdown *LayerBreakdown `json:"layer_breakdown,omitempty"`
+	PullSecrets    []string        `json:"pull_secrets,omitempty"`
+	// Metadata is what the image catalog records for the repository,
+	// such as its owner.
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	HistoryURL string            `json:"history_url,omitempty"`
+	// Mirror is the reference the scan pulled the image by, when its
+	// registry has a faster mirror or rate limited the scan.
+	Mirror string `json:"mirror,omitempty"`
+	// EOL is the support status of the image's release cycle, when the
+	// EOL feed knows it.
+	EOL *EOLStatus `json:"eol,omitempty"`
+	// RateLimited marks an image inspected at Mirror because its registry
+	// rate limited the scan.
+	RateLimited bool `json:"rate_limited,omitempty"`
+	// Version is the image's org.opencontainers.image.version label.
+	Version string `json:"version,omitempty"`
+}
+
+// TagVerification records whether the tag of a "repo:tag@digest"
+// reference still resolves to the pinned digest. A mismatch usually means
+// the image was rebuilt and the pin is stale.
+type TagVerification struct {
+	Tag       string `json:"tag"`
+	TagDigest string `json:"tag_digest,omitempty"`
+	Matches   bool   `json:"matches"`
+	Error     string `json:"error,omitempty"`
+}
+
+// LayerInfo describes a single layer as listed in the image manifest.
+// SizeBytes is the size of the blob in the registry, i.e. compressed
+// unless Compression is "none".
+//
+// UncompressedSizeBytes is exact when the blob is uncompressed or the
+// producer recorded it in an annotation; otherwise it is derived from a
+// typical compression ratio and UncompressedEstimated is set.
+type LayerInfo struct {
+	Digest                string `json:"digest"`
+	MediaType             string `json:"media_type"`
+	SizeBytes             int64  `json:"size_bytes"`
+	UncompressedSizeBytes int64  `json:"uncompressed_size_bytes"`
+	UncompressedEstimated bool   `json:"uncompressed_estimated,omitempty"`
+	Compression           string `json:"compression"`
+	// Kind is standard, foreign or squashed; URLs are where a foreign
+	// layer is fetched from.
+	Kind string   `json:"kind"`
+	URLs []string `json:"urls,omitempty"`
+	// Origin is the base image of -base-images the layer belongs to, the
+	// host serving a foreign layer, or "own".
+	Origin string `json:"origin,omitempty"`
+}
+
+const (
+	compressionGzip    = "gzip"
+	compressionZstd    = "zstd"
+	compressionNone    = "none"
+	compressionMixed   = "mixed"
+	compressionUnknown = "unknown"
+)
+
+// uncompressedSizeAnnotations are layer descriptor annotations that some
+// image builders use to record the size of the uncompressed tar.
+var uncompressedSizeAnnotations = []string{
+	"io.containers.estargz.uncompressed-size",
+	"io.github.containers.zstd-chunked.uncompressed-size",
+	"containerd.io/uncompressed-size",
+}
+
+// compressionRatios are rough uncompressed/compressed ratios observed for
+// container image layers, used only when no exact figure is available.
+var compressionRatios = map[string]float64{
+	compressionGzip:    2.6,
+	compressionZstd:    2.9,
+	compressionUnknown: 2.6,
+}
+
+// resolveDigest returns the manifest digest ref points at. Digest
+// references are returned as-is; tags cost a single HEAD request.
+func (c registryClient) resolveDigest(ctx context.Context, ref string) (string, error) {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return "", err
+	}
+	if d, ok := r.(name.Digest); ok {
+		return d.DigestStr(), nil
+	}
+	return crane.Digest(ref, c.options(ctx)...)
+}
+
+// isDigestPinned reports whether ref names its content by digest, with or
+// without an accompanying tag.
+func isDigestPinned(ref string) bool {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return false
+	}
+	_, ok := r.(name.Digest)
+	return ok
+}
+
+// dualReferenceTag returns the tag reference of a "repo:tag@digest"
+// reference. Plain digest and tag references report false.
+func dualReferenceTag(ref string) (string, bool) {
+	base, _, ok := strings.Cut(ref, "@")
+	if !ok {
+		return "", false
+	}
+	// A colon after the last slash is a tag; earlier ones are ports.
+	if !strings.Contains(base[strings.LastIndex(base, "/")+1:], ":") {
+		return "", false
+	}
+	if _, err := name.NewTag(base); err != nil {
+		return "", false
+	}
+	return base, true
+}
+
+// inspectImage reads the manifest and config of ref at the given manifest
+// digest, pulling by digest so a tag moved in the meantime cannot mix two
+// images. With deep set, layers whose uncompressed size would otherwise be
+// estimated are streamed and measured.
+func (c registryClient) inspectImage(ctx context.Context, ref, digest string, deep bool) (ImageInfo, error) {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return ImageInfo{Image: ref}, err
+	}
+	desc, err := remote.Get(r.Context().Digest(digest), crane.GetOptions(c.options(ctx)...).Remote...)
+	if err != nil {
+		return ImageInfo{Image: ref}, err
+	}
+	kind, artifactType := classifyManifest(desc.MediaType, desc.Manifest)
+	if kind != kindImage {
+		return artifactInfo(ref, digest, desc.MediaType, desc.Manifest, kind, artifactType)
+	}
+	// For an index this selects the default platform's image.
+	img, err := desc.Image()
+	if err != nil {
+		return ImageInfo{Image: ref}, err
+	}
+	// Sizes and media types come straight from the manifest descriptors,
+	// which avoids touching the layer blobs and works for any layer media
+	// type, including zstd and vendor-specific ones.
+	m, err := img.Manifest()
+	if err != nil {
+		return ImageInfo{Image: ref}, err
+	}
+	info := ImageInfo{
+		Image:     ref,
+		Digest:    digest,
+		Pinned:    isDigestPinned(ref),
+		NumLayers: len(m.Layers),
+		MediaType: string(m.MediaType),
+		Layers:    make([]LayerInfo, 0, len(m.Layers)),
+	}
+	// The config blob is small and lists the uncompressed diff IDs; a
+	// layer whose digest equals its diff ID is stored uncompressed. A
+	// config that cannot be read only costs us that shortcut.
+	var diffIDs []v1.Hash
+	cf, err := img.ConfigFile()
+	if err == nil {
+		diffIDs = cf.RootFS.DiffIDs
+	}
+	info.Platforms = imagePlatforms(desc, cf)
+	if cf != nil {
+		info.User = cf.Config.User
+		info.Version = cf.Config.Labels["org.opencontainers.image.version"]
+	}
+	history := layerHistory(cf, len(m.Layers))
+	for i, l := range m.Layers {
+		c := layerCompression(l.MediaType)
+		if i < len(diffIDs) && diffIDs[i] == l.Digest {
+			c = compressionNone
+		}
+		li := LayerInfo{
+			Digest:      l.Digest.String(),
+			MediaType:   string(l.MediaType),
+			SizeBytes:   l.Size,
+			Compression: c,
+			URLs:        l.URLs,
+		}
+		var h *v1.History
+		if history != nil {
+			h = history[i]
+		}
+		li.Kind = layerKind(l, h)
+		li.UncompressedSizeBytes, li.UncompressedEstimated = uncompressedSize(l, c)
+		if deep && li.UncompressedEstimated {
+			n, err := measureUncompressed(img, l.Digest)
+			if err != nil {
+				return ImageInfo{Image: ref}, fmt.Errorf("measuring layer %s: %w", l.Digest, err)
+			}
+			li.UncompressedSizeBytes, li.UncompressedEstimated = n, false
+		}
+		info.Layers = append(info.Layers, li)
+		info.SizeBytes += l.Size
+		info.UncompressedSizeBytes += li.UncompressedSizeBytes
+		info.UncompressedEstimated = info.UncompressedEstimated || li.UncompressedEstimated
+		switch info.Compression {
+		case "":
+			info.Compression = c
+		case c:
+		default:
+			info.Compression = compressionMixed
+		}
+	}
+	return info, nil
+}
+
+// imagePlatforms lists the platforms an image runs on: the entries of an
+// index, leaving out attestations, or the platform in a single image's
+// config.
+func imagePlatforms(desc *remote.Descriptor, cf *v1.ConfigFile) []string {
+	var out []string
+	if desc.MediaType.IsIndex() {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return nil
+		}
+		im, err := idx.IndexManifest()
+		if err != nil {
+			return nil
+		}
+		for _, m := range im.Manifests {
+			if m.Platform == nil || m.Platform.OS == "unknown" {
+				continue
+			}
+			if p := m.Platform.String(); !containsString(out, p) {
+				out = append(out, p)
+			}
+		}
+		return out
+	}
+	if cf != nil {
+		if p := cf.Platform(); p != nil {
+			out = append(out, p.String())
+		}
+	}
+	return out
+}
+
+// uncompressedSize returns the uncompressed size of a layer and whether the
+// figure is an estimate. It never downloads the layer.
+func uncompressedSize(l v1.Descriptor, compression string) (int64, bool) {
+	if compression == compressionNone {
+		return l.Size, false
+	}
+	for _, key := range uncompressedSizeAnnotations {
+		if v, ok := l.Annotations[key]; ok {
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+				return n, false
+			}
+		}
+	}
+	ratio, ok := compressionRatios[compression]
+	if !ok {
+		ratio = compressionRatios[compressionUnknown]
+	}
+	return int64(float64(l.Size) * ratio), true
+}
+
+// measureUncompressed downloads a layer and counts its decompressed bytes.
+func measureUncompressed(img v1.Image, h v1.Hash) (int64, error) {
+	l, err := img.LayerByDigest(h)
+	if err != nil {
+		return 0, err
+	}
+	rc, err := l.Uncompressed()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	return io.Copy(io.Discard, rc)
+}
+
+// layerCompression maps a layer media type to the compression of its blob.
+// Known Docker and OCI types are matched exactly; anything else falls back
+// to looking for the conventional "+gzip"/"+zstd"/".tar" suffixes so that
+// vendor media types are still classified where possible.
+func layerCompression(mt types.MediaType) string {
+	switch mt {
+	case types.DockerLayer, types.DockerForeignLayer, types.OCILayer, types.OCIRestrictedLayer:
+		return compressionGzip
+	case types.OCILayerZStd:
+		return compressionZstd
+	case types.DockerUncompressedLayer, types.OCIUncompressedLayer, types.OCIUncompressedRestrictedLayer:
+		return compressionNone
+	}
+	s := strings.ToLower(string(mt))
+	switch {
+	case strings.Contains(s, "zstd"):
+		return compressionZstd
+	case strings.Contains(s, "gzip"), strings.HasSuffix(s, ".gz"), strings.HasSuffix(s, "+gz"):
+		return compressionGzip
+	case strings.HasSuffix(s, ".tar"), strings.HasSuffix(s, "+tar"):
+		return compressionNone
+	}
+	return compressionUnknown
+}
@@ -0,0 +1,474 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// inventoryRequest is the JSON body of POST /inventory. An archive of the
+// repository may be uploaded instead, as a gzipped tar body.
+type inventoryRequest struct {
+	GitURL     string `json:"git_url"`
+	Ref        string `json:"ref,omitempty"`
+	Inspection string `json:"inspection,omitempty"`
+	Render     *bool  `json:"render,omitempty"`
+}
+
+// InventoryReport is the consolidated image inventory of a GitOps
+// repository.
+type InventoryReport struct {
+	Repository string            `json:"repository"`
+	ScannedAt  time.Time         `json:"scanned_at"`
+	Sources    []InventorySource `json:"sources"`
+	Images     []InventoryImage  `json:"images"`
+	Dedup      *DedupStats       `json:"dedup"`
+}
+
+// InventorySource is one release or chart found in the repository.
+type InventorySource struct {
+	File string `json:"file"`
+	ReleaseSource
+	ChartURL string   `json:"chart_url,omitempty"`
+	Images   []string `json:"images"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// InventoryImage is an image with the sources that deploy it.
+type InventoryImage struct {
+	ImageInfo
+	UsedBy []string `json:"used_by"`
+}
+
+func (src InventorySource) label() string {
+	if src.Namespace != "" {
+		return src.Kind + " " + src.Namespace + "/" + src.Name
+	}
+	return src.Kind + " " + src.Name
+}
+
+func (s *server) inventoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fields, err := parseFields(r, InventoryImage{})
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	units, err := s.unitsFor(r)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var req inventoryRequest
+	var files []chartFile
+	repo := "upload"
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch ct {
+	case "application/gzip", "application/x-gzip", "application/x-tar+gzip":
+		var err error
+		if files, err = readChartArchive(r.Body, s.archiveLimits()); err != nil {
+			jsonError(w, http.StatusBadRequest, fmt.Sprintf("reading archive: %v", err))
+			return
+		}
+		files = stripCommonDir(files)
+		req.Inspection = r.URL.Query().Get("inspection")
+	default:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if req.GitURL == "" {
+			jsonError(w, http.StatusBadRequest, "git_url is required, or upload a .tar.gz of the repository")
+			return
+		}
+		if s.cfg.Untrusted {
+			// git runs outside the egress guard.
+			jsonError(w, http.StatusBadRequest, "cloning Git repositories is disabled in untrusted mode")
+			return
+		}
+		repo = req.GitURL
+	}
+	// Validate the overrides once, before any slow work.
+	if _, err := s.scanOptionsFor(scanRequest{Options: Options{Inspection: req.Inspection, Render: req.Render}}, cacheControl{}); err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if files == nil {
+		ctx, cancel := context.WithTimeout(r.Context(), s.cfg.ScanTimeout)
+		var err error
+		files, err = s.cloneRepository(ctx, req.GitURL, req.Ref, s.archiveLimits())
+		cancel()
+		if err != nil {
+			jsonError(w, http.StatusInternalServerError, fmt.Sprintf("cloning repository: %v", err))
+			return
+		}
+	}
+
+	report := s.inventory(r.Context(), repo, files, req)
+	writeSelected(w, report, fields, units)
+}
+
+func (s *server) archiveLimits() archiveLimits {
+	if s.cfg.Untrusted {
+		return strictArchiveLimits
+	}
+	return defaultArchiveLimits
+}
+
+// inventory finds every HelmRelease, Application, Terraform helm_release
+// and chart in files, scans each one and merges the results. Charts
+// deployed by a release in the repository are scanned with that release's
+// values only.
+func (s *server) inventory(ctx context.Context, repo string, files []chartFile, req inventoryRequest) *InventoryReport {
+	charts := make(map[string]bool)
+	for _, f := range files {
+		if path.Base(f.Name) == "Chart.yaml" {
+			charts[path.Dir(f.Name)] = true
+		}
+	}
+	var docs []map[string]interface{}
+	docFile := make(map[int]string)
+	for _, f := range files {
+		if !isYAMLFile(f.Name) || inChart(path.Dir(f.Name), charts) {
+			continue
+		}
+		ds, err := decodeDocuments(f.Data)
+		if err != nil {
+			continue
+		}
+		for _, d := range ds {
+			docFile[len(docs)] = f.Name
+			docs = append(docs, d)
+		}
+	}
+	sources := releaseSources(docs)
+
+	type job struct {
+		src   InventorySource
+		rel   *releaseSpec
+		files []chartFile
+	}
+	var jobs []job
+	deployed := make(map[string]bool)
+	addRelease := func(file string, rel *releaseSpec) {
+		j := job{src: InventorySource{File: file, ReleaseSource: rel.source}, rel: rel}
+		if rel.localPath != "" {
+			dir := path.Clean(strings.TrimPrefix(rel.localPath, "./"))
+			if j.files = filesUnder(files, dir); len(j.files) == 0 {
+				j.src.Error = fmt.Sprintf("chart path %s is not in this repository", dir)
+			}
+			deployed[dir] = true
+		}
+		jobs = append(jobs, j)
+	}
+	for i, d := range docs {
+		if !isRelease(d) {
+			continue
+		}
+		rel, err := parseRelease(d, sources)
+		if err != nil {
+			src := InventorySource{File: docFile[i], Error: err.Error()}
+			src.Kind = manifestKind(d)
+			src.Name = valueString(lookupValue(d, "metadata.name"))
+			src.Namespace = valueString(lookupValue(d, "metadata.namespace"))
+			jobs = append(jobs, job{src: src})
+			continue
+		}
+		addRelease(docFile[i], rel)
+	}
+	for _, dir := range terraformModules(files, charts) {
+		releases, err := parseTerraformReleases(filterFiles(files, func(name string) bool {
+			return path.Dir(name) == dir && isTerraformFile(name)
+		}), readRepoFile(files))
+		if err != nil {
+			jobs = append(jobs, job{src: InventorySource{File: dir, ReleaseSource: ReleaseSource{Kind: "helm_release"}, Error: err.Error()}})
+			continue
+		}
+		for _, r := range releases {
+			if r.err != nil {
+				jobs = append(jobs, job{src: InventorySource{File: r.file, ReleaseSource: r.rel.source, Error: r.err.Error()}})
+				continue
+			}
+			addRelease(r.file, r.rel)
+		}
+	}
+	for _, dir := range topLevelCharts(charts) {
+		if deployed[dir] {
+			continue
+		}
+		src := InventorySource{File: path.Join(dir, "Chart.yaml"), ReleaseSource: ReleaseSource{Kind: "Chart", Name: dir}}
+		jobs = append(jobs, job{src: src, files: filesUnder(files, dir)})
+	}
+
+	report := &InventoryReport{Repository: repo, ScannedAt: time.Now().UTC(), Sources: make([]InventorySource, len(jobs))}
+	results := make([]*ScanResult, len(jobs))
+	share := newDigestShare()
+	sem := make(chan struct{}, s.cfg.MaxScans)
+	var wg sync.WaitGroup
+	for i, j := range jobs {
+		if j.src.Error != "" {
+			report.Sources[i] = j.src
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, j job) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i], report.Sources[i] = s.scanInventorySource(ctx, j.src, j.rel, j.files, req, share)
+		}(i, j)
+	}
+	wg.Wait()
+	report.Dedup = share.result()
+
+	byRef := make(map[string]*InventoryImage)
+	for i, res := range results {
+		if res == nil {
+			continue
+		}
+		label := report.Sources[i].label()
+		for _, info := range res.Images {
+			img, ok := byRef[info.Image]
+			if !ok {
+				img = &InventoryImage{ImageInfo: info}
+				byRef[info.Image] = img
+			}
+			img.UsedBy = append(img.UsedBy, label)
+		}
+	}
+	report.Images = make([]InventoryImage, 0, len(byRef))
+	for _, img := range byRef {
+		sort.Strings(img.UsedBy)
+		report.Images = append(report.Images, *img)
+	}
+	sort.Slice(report.Images, func(a, b int) bool { return report.Images[a].Image < report.Images[b].Image })
+	return report
+}
+
+func (s *server) scanInventorySource(ctx context.Context, src InventorySource, rel *releaseSpec, files []chartFile, req inventoryRequest, share *digestShare) (*ScanResult, InventorySource) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.ScanTimeout)
+	defer cancel()
+	sr := scanRequest{Options: Options{Inspection: req.Inspection, Render: req.Render}}
+	if rel != nil {
+		sr.Values, sr.ReleaseName, sr.Namespace = rel.values, rel.releaseName, rel.namespace
+	}
+	opts, err := s.scanOptionsFor(sr, cacheControl{})
+	if err != nil {
+		src.Error = err.Error()
+		return nil, src
+	}
+	opts.Share = share
+	var result *ScanResult
+	if files != nil {
+		result, err = s.scanLocalChart(ctx, src.File, files, opts)
+	} else {
+		src.ChartURL, src.Version, err = s.locateChart(ctx, rel.source.Repository, rel.source.Chart, rel.constraint)
+		if err == nil {
+			result, err = s.scanChartForImages(ctx, src.ChartURL, opts)
+		}
+	}
+	if err != nil {
+		src.Error = err.Error()
+		return nil, src
+	}
+	s.publish(result)
+	src.Images = make([]string, 0, len(result.Images))
+	for _, info := range result.Images {
+		src.Images = append(src.Images, info.Image)
+	}
+	sort.Strings(src.Images)
+	return result, src
+}
+
+// topLevelCharts returns the chart directories that are not inside
+// another chart.
+func topLevelCharts(charts map[string]bool) []string {
+	var dirs []string
+	for dir := range charts {
+		if dir == "." || !inChart(path.Dir(dir), charts) {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// inChart reports whether dir is a chart directory or lies inside one.
+func inChart(dir string, charts map[string]bool) bool {
+	for ; dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if charts[dir] {
+			return true
+		}
+	}
+	return charts["."]
+}
+
+// filesUnder returns the files inside dir; "." is the whole repository.
+func filesUnder(files []chartFile, dir string) []chartFile {
+	if dir == "." {
+		return files
+	}
+	return filterFiles(files, func(name string) bool { return strings.HasPrefix(name, dir+"/") })
+}
+
+func filterFiles(files []chartFile, keep func(name string) bool) []chartFile {
+	var out []chartFile
+	for _, f := range files {
+		if keep(f.Name) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// terraformModules returns the directories holding Terraform
+// configuration, leaving out charts and the modules Terraform downloads
+// into .terraform.
+func terraformModules(files []chartFile, charts map[string]bool) []string {
+	dirs := make(map[string]bool)
+	for _, f := range files {
+		dir := path.Dir(f.Name)
+		if strings.HasSuffix(f.Name, ".tf") && !inChart(dir, charts) && !strings.Contains("/"+f.Name, "/.terraform/") {
+			dirs[dir] = true
+		}
+	}
+	out := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		out = append(out, dir)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// readRepoFile serves file() calls of Terraform configurations from the
+// repository's files.
+func readRepoFile(files []chartFile) func(string) ([]byte, error) {
+	return func(name string) ([]byte, error) {
+		for _, f := range files {
+			if f.Name == name {
+				return f.Data, nil
+			}
+		}
+		return nil, fmt.Errorf("%s is not in the repository", name)
+	}
+}
+
+// stripCommonDir removes a top-level directory shared by every file, as
+// in archives downloaded from Git hosting services.
+func stripCommonDir(files []chartFile) []chartFile {
+	if len(files) == 0 {
+		return files
+	}
+	top, _, ok := strings.Cut(files[0].Name, "/")
+	if !ok {
+		return files
+	}
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name, top+"/") {
+			return files
+		}
+	}
+	out := make([]chartFile, len(files))
+	for i, f := range files {
+		out[i] = chartFile{Name: strings.TrimPrefix(f.Name, top+"/"), Data: f.Data}
+	}
+	return out
+}
+
+// cloneRepository makes a shallow clone of a Git repository in a
+// workspace and reads its files within limits. Only network transports
+// are allowed, so a request cannot read the server's own file system.
+func (s *server) cloneRepository(ctx context.Context, url, ref string, limits archiveLimits) ([]chartFile, error) {
+	ws, err := s.workspaces.create(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer ws.Close()
+	dir := filepath.Join(ws.dir, "repo")
+	gitCtx, stop := ws.guard(ctx)
+	args := []string{"clone", "--quiet", "--depth", "1"}
+	if ref != "" {
+		args = append(args, "--branch", ref)
+	}
+	args = append(args, "--", url, dir)
+	cmd := exec.CommandContext(gitCtx, "git", args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ALLOW_PROTOCOL=http:https:ssh:git")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if quotaErr := stop(); quotaErr != nil {
+		return nil, quotaErr
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return readRepositoryDir(dir, limits)
+}
+
+// readRepositoryDir reads the regular files below root, skipping .git and
+// unpacking packaged subcharts, within the same limits as a chart archive.
+func readRepositoryDir(root string, limits archiveLimits) ([]chartFile, error) {
+	budget := limits
+	var files []chartFile
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if budget.MaxFiles--; budget.MaxFiles < 0 {
+			return errors.New("repository has too many files")
+		}
+		if info.Size() > budget.MaxBytes {
+			return errors.New("repository is larger than the allowed size")
+		}
+		budget.MaxBytes -= info.Size()
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		name := filepath.ToSlash(rel)
+		if isSubchartArchive(name) {
+			if err := readArchive(bytes.NewReader(data), path.Dir(name)+"/", 1, &budget, &files); err != nil {
+				log.Printf("warning: skipping %s: %v", name, err)
+			}
+			return nil
+		}
+		files = append(files, chartFile{Name: name, Data: data})
+		return nil
+	})
+	return files, err
+}
@@ -0,0 +1,339 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// issueTimeout bounds one request to the issue tracker.
+const issueTimeout = 30 * time.Second
+
+// issueLabel marks the issues the scanner opens.
+const issueLabel = "helm-image-scanner"
+
+// issueDraft is an issue about the violations of one policy rule by one
+// chart. Fingerprint identifies it across scans and chart versions.
+type issueDraft struct {
+	Title       string
+	Body        string
+	Fingerprint string
+	Assignees   []string
+}
+
+// issueTracker opens issues and finds the open one with a fingerprint.
+type issueTracker interface {
+	find(ctx context.Context, fingerprint string) (string, error)
+	create(ctx context.Context, issue issueDraft) (string, error)
+}
+
+// issueFiler opens an issue in the tracker for every chart and rule that
+// crawls find violated, unless one is still open, and assigns it to the
+// owners the image catalog records for the violating images.
+type issueFiler struct {
+	tracker issueTracker
+	// assigneeField is the catalog field naming an owner in the tracker.
+	assigneeField string
+
+	mu sync.Mutex
+	// filed are the issues opened or found open, by fingerprint, which
+	// saves asking again and covers the tracker's search lagging behind.
+	filed map[string]string
+}
+
+// openIssueFiler opens the tracker of the -issues flag:
+//
+//	github:owner/repo[?api=https://github.example.com/api/v3]  with GITHUB_TOKEN
+//	jira:https://jira.example.com?project=OPS[&type=Bug]         with JIRA_TOKEN
+//
+// Jira authenticates with basic authentication when JIRA_USER is set and
+// with the token as a bearer token otherwise. An empty spec means none.
+func openIssueFiler(spec, assigneeField string) (*issueFiler, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	kind, target, _ := strings.Cut(spec, ":")
+	client := &http.Client{Timeout: issueTimeout}
+	var tracker issueTracker
+	switch kind {
+	case "github":
+		repo, query, _ := strings.Cut(target, "?")
+		if strings.Count(repo, "/") != 1 || strings.HasPrefix(repo, "/") || strings.HasSuffix(repo, "/") {
+			return nil, fmt.Errorf("issues: want github:owner/repo, got %q", spec)
+		}
+		q, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, fmt.Errorf("issues: %w", err)
+		}
+		token := os.Getenv("GITHUB_TOKEN")
+		if token == "" {
+			return nil, errors.New("issues: GITHUB_TOKEN is not set")
+		}
+		api := strings.TrimSuffix(q.Get("api"), "/")
+		if api == "" {
+			api = "https://api.github.com"
+		}
+		tracker = &githubTracker{api: api, repo: repo, token: token, client: client}
+	case "jira":
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Query().Get("project") == "" {
+			return nil, fmt.Errorf("issues: want jira:https://<host>?project=<key>, got %q", spec)
+		}
+		token := os.Getenv("JIRA_TOKEN")
+		if token == "" {
+			return nil, errors.New("issues: JIRA_TOKEN is not set")
+		}
+		q := u.Query()
+		t := &jiraTracker{
+			project:   q.Get("project"),
+			issueType: q.Get("type"),
+			user:      os.Getenv("JIRA_USER"),
+			token:     token,
+			client:    client,
+		}
+		if t.issueType == "" {
+			t.issueType = "Bug"
+		}
+		u.RawQuery = ""
+		t.base = strings.TrimSuffix(u.String(), "/")
+		tracker = t
+	default:
+		return nil, fmt.Errorf("issues: unknown tracker %q, want github: or jira:", kind)
+	}
+	return &issueFiler{tracker: tracker, assigneeField: assigneeField, filed: make(map[string]string)}, nil
+}
+
+// fileIssues opens the issues for the policy violations of a crawled
+// chart. Failures are logged; the next crawl of the chart tries again.
+func (f *issueFiler) fileIssues(ctx context.Context, chart, version string, result *ScanResult) {
+	if f == nil || result.Policy == nil {
+		return
+	}
+	for _, issue := range f.drafts(chart, version, result) {
+		f.mu.Lock()
+		_, done := f.filed[issue.Fingerprint]
+		f.mu.Unlock()
+		if done {
+			continue
+		}
+		link, err := f.tracker.find(ctx, issue.Fingerprint)
+		if err == nil && link == "" {
+			link, err = f.tracker.create(ctx, issue)
+			if err == nil {
+				log.Printf("opened issue %s: %s", link, issue.Title)
+			}
+		}
+		if err != nil {
+			log.Printf("warning: issue for %s: %v", issue.Title, err)
+			continue
+		}
+		f.mu.Lock()
+		f.filed[issue.Fingerprint] = link
+		f.mu.Unlock()
+	}
+}
+
+// drafts groups the violations of result by rule, one issue each.
+func (f *issueFiler) drafts(chart, version string, result *ScanResult) []issueDraft {
+	byRule := make(map[string][]PolicyViolation)
+	var rules []string
+	for _, v := range result.Policy.Violations {
+		if byRule[v.Rule] == nil {
+			rules = append(rules, v.Rule)
+		}
+		byRule[v.Rule] = append(byRule[v.Rule], v)
+	}
+	owners := make(map[string]string)
+	for _, info := range result.Images {
+		if o := info.Metadata[f.assigneeField]; o != "" {
+			owners[info.Image] = o
+		}
+	}
+	var drafts []issueDraft
+	for _, rule := range rules {
+		sum := sha256.Sum256([]byte(chart + "\x00" + rule))
+		issue := issueDraft{
+			Title:       fmt.Sprintf("%s violates %s", chart, rule),
+			Fingerprint: "his-" + hex.EncodeToString(sum[:6]),
+		}
+		var body strings.Builder
+		fmt.Fprintf(&body, "Chart %s %s (%s) violates the %s policy:\n\n", chart, version, result.ChartURL, rule)
+		seen := make(map[string]bool)
+		for _, v := range byRule[rule] {
+			fmt.Fprintf(&body, "- %s\n", v.Message)
+			if o := owners[v.Image]; o != "" && !seen[o] {
+				seen[o] = true
+				issue.Assignees = append(issue.Assignees, o)
+			}
+		}
+		sort.Strings(issue.Assignees)
+		fmt.Fprintf(&body, "\nOpened by helm-image-scanner, fingerprint %s. Another issue is opened once this one is closed and a scan still finds violations.\n", issue.Fingerprint)
+		issue.Body = body.String()
+		drafts = append(drafts, issue)
+	}
+	return drafts
+}
+
+// githubTracker opens GitHub issues through the REST API. The fingerprint
+// is found by searching open issues for it.
+type githubTracker struct {
+	api, repo, token string
+	client           *http.Client
+}
+
+func (t *githubTracker) find(ctx context.Context, fingerprint string) (string, error) {
+	q := url.Values{"q": {fmt.Sprintf("%s in:body repo:%s is:issue is:open", fingerprint, t.repo)}}
+	var found struct {
+		Items []struct {
+			HTMLURL string `json:"html_url"`
+		} `json:"items"`
+	}
+	if err := t.do(ctx, http.MethodGet, "/search/issues?"+q.Encode(), nil, &found); err != nil {
+		return "", err
+	}
+	if len(found.Items) == 0 {
+		return "", nil
+	}
+	return found.Items[0].HTMLURL, nil
+}
+
+func (t *githubTracker) create(ctx context.Context, issue issueDraft) (string, error) {
+	body := map[string]interface{}{"title": issue.Title, "body": issue.Body, "labels": []string{issueLabel}}
+	if len(issue.Assignees) > 0 {
+		body["assignees"] = issue.Assignees
+	}
+	var created struct {
+		HTMLURL string `json:"html_url"`
+	}
+	err := t.do(ctx, http.MethodPost, "/repos/"+t.repo+"/issues", body, &created)
+	var status statusError
+	if errors.As(err, &status) && status.code == http.StatusUnprocessableEntity && len(issue.Assignees) > 0 {
+		// An owner who cannot be assigned in the repository should not
+		// keep the issue from being opened.
+		log.Printf("warning: cannot assign %s to GitHub issue: %v", strings.Join(issue.Assignees, ", "), err)
+		delete(body, "assignees")
+		err = t.do(ctx, http.MethodPost, "/repos/"+t.repo+"/issues", body, &created)
+	}
+	return created.HTMLURL, err
+}
+
+func (t *githubTracker) do(ctx context.Context, method, path string, in, out interface{}) error {
+	return trackerRequest(ctx, t.client, method, t.api+path, in, out, func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+		req.Header.Set("Accept", "application/vnd.github+json")
+	})
+}
+
+// jiraTracker opens Jira issues through the REST API v2. The fingerprint
+// is a label of the issue.
+type jiraTracker struct {
+	base, project, issueType string
+	user, token              string
+	client                   *http.Client
+}
+
+func (t *jiraTracker) find(ctx context.Context, fingerprint string) (string, error) {
+	jql := fmt.Sprintf("project = %q AND labels = %q AND statusCategory != Done", t.project, fingerprint)
+	q := url.Values{"jql": {jql}, "maxResults": {"1"}, "fields": {"key"}}
+	var found struct {
+		Issues []struct {
+			Key string `json:"key"`
+		} `json:"issues"`
+	}
+	if err := t.do(ctx, http.MethodGet, "/rest/api/2/search?"+q.Encode(), nil, &found); err != nil {
+		return "", err
+	}
+	if len(found.Issues) == 0 {
+		return "", nil
+	}
+	return t.base + "/browse/" + found.Issues[0].Key, nil
+}
+
+func (t *jiraTracker) create(ctx context.Context, issue issueDraft) (string, error) {
+	fields := map[string]interface{}{
+		"project":     map[string]string{"key": t.project},
+		"issuetype":   map[string]string{"name": t.issueType},
+		"summary":     issue.Title,
+		"description": issue.Body,
+		"labels":      []string{issueLabel, issue.Fingerprint},
+	}
+	// Jira issues have one assignee.
+	if len(issue.Assignees) > 0 {
+		fields["assignee"] = map[string]string{"name": issue.Assignees[0]}
+	}
+	var created struct {
+		Key string `json:"key"`
+	}
+	if err := t.do(ctx, http.MethodPost, "/rest/api/2/issue", map[string]interface{}{"fields": fields}, &created); err != nil {
+		return "", err
+	}
+	return t.base + "/browse/" + created.Key, nil
+}
+
+func (t *jiraTracker) do(ctx context.Context, method, path string, in, out interface{}) error {
+	return trackerRequest(ctx, t.client, method, t.base+path, in, out, func(req *http.Request) {
+		if t.user != "" {
+			req.SetBasicAuth(t.user, t.token)
+		} else {
+			req.Header.Set("Authorization", "Bearer "+t.token)
+		}
+	})
+}
+
+// statusError is a tracker answering with a non-2xx status.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e statusError) Error() string { return e.msg }
+
+// trackerRequest sends in as JSON and decodes the answer into out.
+func trackerRequest(ctx context.Context, client *http.Client, method, u string, in, out interface{}, auth func(*http.Request)) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	auth(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg := strings.TrimSpace(string(data))
+		if len(msg) > 200 {
+			msg = msg[:200]
+		}
+		return statusError{code: resp.StatusCode, msg: fmt.Sprintf("tracker returned %s: %s", resp.Status, msg)}
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,489 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// inClusterContext names the service account credentials of the pod the
+// scanner runs in.
+const inClusterContext = "in-cluster"
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeConfig is the cluster access set up with -kubeconfig or
+// -in-cluster. Clients are built per context on first use, so that exec
+// credential plugins only run for the clusters actually queried.
+type kubeConfig struct {
+	dir     string
+	keys    *keyRing
+	file    *kubeconfigFile // nil in-cluster
+	mu      sync.Mutex
+	clients map[string]*kubeClient
+}
+
+// kubeconfigFile is the subset of a kubeconfig the scanner understands.
+type kubeconfigFile struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string      `yaml:"name"`
+		Cluster kubeCluster `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string   `yaml:"name"`
+		User kubeUser `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+type kubeCluster struct {
+	Server                   string `yaml:"server"`
+	CertificateAuthority     string `yaml:"certificate-authority"`
+	CertificateAuthorityData string `yaml:"certificate-authority-data"`
+	InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+	TLSServerName            string `yaml:"tls-server-name"`
+}
+
+type kubeUser struct {
+	Token                 string    `yaml:"token"`
+	TokenFile             string    `yaml:"tokenFile"`
+	ClientCertificate     string    `yaml:"client-certificate"`
+	ClientCertificateData string    `yaml:"client-certificate-data"`
+	ClientKey             string    `yaml:"client-key"`
+	ClientKeyData         string    `yaml:"client-key-data"`
+	Username              string    `yaml:"username"`
+	Password              string    `yaml:"password"`
+	Exec                  *kubeExec `yaml:"exec"`
+}
+
+// kubeExec is a client-go credential plugin, such as the ones EKS, GKE and
+// AKS kubeconfigs use.
+type kubeExec struct {
+	APIVersion string   `yaml:"apiVersion"`
+	Command    string   `yaml:"command"`
+	Args       []string `yaml:"args"`
+	Env        []struct {
+		Name  string `yaml:"name"`
+		Value string `yaml:"value"`
+	} `yaml:"env"`
+}
+
+// openKubeConfig loads the kubeconfig at path, or prepares the service
+// account credentials when inCluster is set. With neither it returns nil
+// and the scanner has no cluster access. The kubeconfig and the files it
+// names may be encrypted with keys.
+func openKubeConfig(path string, inCluster bool, keys *keyRing) (*kubeConfig, error) {
+	switch {
+	case inCluster:
+		if os.Getenv("KUBERNETES_SERVICE_HOST") == "" {
+			return nil, errors.New("-in-cluster: KUBERNETES_SERVICE_HOST is not set, not running in a pod")
+		}
+		return &kubeConfig{clients: make(map[string]*kubeClient)}, nil
+	case path == "":
+		return nil, nil
+	}
+	data, err := readSecretFile(path, keys)
+	if err != nil {
+		return nil, fmt.Errorf("reading kubeconfig: %w", err)
+	}
+	var f kubeconfigFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parsing kubeconfig %s: %w", path, err)
+	}
+	if len(f.Contexts) == 0 {
+		return nil, fmt.Errorf("kubeconfig %s has no contexts", path)
+	}
+	return &kubeConfig{dir: filepath.Dir(path), keys: keys, file: &f, clients: make(map[string]*kubeClient)}, nil
+}
+
+// contexts lists the contexts that can be queried, in kubeconfig order.
+func (k *kubeConfig) contexts() []string {
+	if k.file == nil {
+		return []string{inClusterContext}
+	}
+	names := make([]string, len(k.file.Contexts))
+	for i, c := range k.file.Contexts {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// client returns the client for the named context; "" is the current
+// context of the kubeconfig.
+func (k *kubeConfig) client(name string) (*kubeClient, error) {
+	if name == "" {
+		name = inClusterContext
+		if k.file != nil {
+			name = k.file.CurrentContext
+		}
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if c, ok := k.clients[name]; ok {
+		return c, nil
+	}
+	var c *kubeClient
+	var err error
+	if k.file == nil {
+		if name != inClusterContext {
+			return nil, fmt.Errorf("unknown context %q, the scanner uses its in-cluster credentials", name)
+		}
+		c, err = inClusterClient()
+	} else {
+		c, err = k.contextClient(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	k.clients[name] = c
+	return c, nil
+}
+
+func (k *kubeConfig) contextClient(name string) (*kubeClient, error) {
+	f := k.file
+	var clusterName, userName, namespace string
+	found := false
+	for _, c := range f.Contexts {
+		if c.Name == name {
+			clusterName, userName, namespace = c.Context.Cluster, c.Context.User, c.Context.Namespace
+			found = true
+			break
+		}
+	}
+	if !found {
+		if name == "" {
+			return nil, errors.New("kubeconfig has no current-context; name a context")
+		}
+		return nil, fmt.Errorf("unknown context %q", name)
+	}
+	var cluster *kubeCluster
+	for i := range f.Clusters {
+		if f.Clusters[i].Name == clusterName {
+			cluster = &f.Clusters[i].Cluster
+		}
+	}
+	if cluster == nil || cluster.Server == "" {
+		return nil, fmt.Errorf("context %q: cluster %q has no server", name, clusterName)
+	}
+	var user kubeUser
+	for _, u := range f.Users {
+		if u.Name == userName {
+			user = u.User
+		}
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cluster.InsecureSkipTLSVerify,
+		ServerName:         cluster.TLSServerName,
+	}
+	ca, err := k.material(cluster.CertificateAuthorityData, cluster.CertificateAuthority)
+	if err != nil {
+		return nil, fmt.Errorf("context %q: certificate authority: %w", name, err)
+	}
+	if ca != nil {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("context %q: certificate authority holds no PEM certificates", name)
+		}
+	}
+	cert, err := k.material(user.ClientCertificateData, user.ClientCertificate)
+	if err != nil {
+		return nil, fmt.Errorf("context %q: client certificate: %w", name, err)
+	}
+	if cert != nil {
+		key, err := k.material(user.ClientKeyData, user.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("context %q: client key: %w", name, err)
+		}
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("context %q: client certificate: %w", name, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+
+	c := &kubeClient{
+		context:   name,
+		server:    strings.TrimRight(cluster.Server, "/"),
+		namespace: namespace,
+		http:      &http.Client{Transport: kubeTransport(tlsConfig), Timeout: time.Minute},
+	}
+	switch {
+	case user.Token != "":
+		c.auth = staticAuth("Bearer " + user.Token)
+	case user.TokenFile != "":
+		c.auth = fileAuth(k.resolve(user.TokenFile))
+	case user.Exec != nil:
+		c.auth = (&execAuth{plugin: user.Exec, dir: k.dir}).header
+	case user.Username != "":
+		c.auth = staticAuth("Basic " + base64.StdEncoding.EncodeToString([]byte(user.Username+":"+user.Password)))
+	}
+	return c, nil
+}
+
+// material returns inline base64 data or the contents of the file, which
+// kubeconfigs give relative to their own location.
+func (k *kubeConfig) material(data, file string) ([]byte, error) {
+	switch {
+	case data != "":
+		return base64.StdEncoding.DecodeString(data)
+	case file != "":
+		return readSecretFile(k.resolve(file), k.keys)
+	}
+	return nil, nil
+}
+
+func (k *kubeConfig) resolve(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(k.dir, p)
+}
+
+func inClusterClient() (*kubeClient, error) {
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("in-cluster credentials: %w", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	namespace, _ := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	host := net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"))
+	return &kubeClient{
+		context:   inClusterContext,
+		server:    "https://" + host,
+		namespace: strings.TrimSpace(string(namespace)),
+		http:      &http.Client{Transport: kubeTransport(&tls.Config{RootCAs: pool}), Timeout: time.Minute},
+		// Projected tokens are rotated, so the file is read per request.
+		auth: fileAuth(filepath.Join(serviceAccountDir, "token")),
+	}, nil
+}
+
+func kubeTransport(tlsConfig *tls.Config) http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tlsConfig
+	return t
+}
+
+func staticAuth(header string) func(context.Context) (string, error) {
+	return func(context.Context) (string, error) { return header, nil }
+}
+
+func fileAuth(path string) func(context.Context) (string, error) {
+	return func(context.Context) (string, error) {
+		token, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading token: %w", err)
+		}
+		return "Bearer " + strings.TrimSpace(string(token)), nil
+	}
+}
+
+// execAuth runs a credential plugin and caches its token until it
+// expires.
+type execAuth struct {
+	plugin *kubeExec
+	dir    string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (e *execAuth) header(ctx context.Context) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.token != "" && (e.expires.IsZero() || time.Until(e.expires) > time.Minute) {
+		return "Bearer " + e.token, nil
+	}
+	command := e.plugin.Command
+	if strings.Contains(command, "/") && !filepath.IsAbs(command) {
+		command = filepath.Join(e.dir, command)
+	}
+	cmd := exec.CommandContext(ctx, command, e.plugin.Args...)
+	cmd.Env = os.Environ()
+	for _, v := range e.plugin.Env {
+		cmd.Env = append(cmd.Env, v.Name+"="+v.Value)
+	}
+	info, _ := json.Marshal(map[string]interface{}{
+		"apiVersion": e.plugin.APIVersion,
+		"kind":       "ExecCredential",
+		"spec":       map[string]interface{}{"interactive": false},
+	})
+	cmd.Env = append(cmd.Env, "KUBERNETES_EXEC_INFO="+string(info))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("credential plugin %s: %v: %s", e.plugin.Command, err, strings.TrimSpace(stderr.String()))
+	}
+	var cred struct {
+		Status struct {
+			Token               string    `json:"token"`
+			ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(out, &cred); err != nil {
+		return "", fmt.Errorf("credential plugin %s: %w", e.plugin.Command, err)
+	}
+	if cred.Status.Token == "" {
+		return "", fmt.Errorf("credential plugin %s returned no token", e.plugin.Command)
+	}
+	e.token, e.expires = cred.Status.Token, cred.Status.ExpirationTimestamp
+	return "Bearer " + e.token, nil
+}
+
+// kubeClient reads from one cluster's API server.
+type kubeClient struct {
+	context string
+	server  string
+	// namespace is the default namespace of the context.
+	namespace string
+	http      *http.Client
+	auth      func(context.Context) (string, error)
+}
+
+// get decodes the JSON response of a GET on the API path.
+func (c *kubeClient) get(ctx context.Context, p string, query url.Values, out interface{}) error {
+	u := c.server + p
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.auth != nil {
+		h, err := c.auth(ctx)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", h)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// Errors come as a Status object; proxies in front of the API
+		// server may answer with anything else.
+		var status struct {
+			Message string `json:"message"`
+		}
+		if json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&status) != nil || status.Message == "" {
+			return fmt.Errorf("kubernetes API %s: %s", p, resp.Status)
+		}
+		return fmt.Errorf("kubernetes API %s: %s: %s", p, resp.Status, status.Message)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 256<<20)).Decode(out)
+}
+
+type kubePod struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Spec struct {
+		InitContainers []struct {
+			Image string `json:"image"`
+		} `json:"initContainers"`
+		Containers []struct {
+			Image string `json:"image"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		InitContainerStatuses []kubeContainerStatus `json:"initContainerStatuses"`
+		ContainerStatuses     []kubeContainerStatus `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+type kubeContainerStatus struct {
+	Image   string `json:"image"`
+	ImageID string `json:"imageID"`
+}
+
+// releaseSelectors find the pods of a Helm release: the recommended
+// instance label first, then the release label of older charts.
+var releaseSelectors = []string{"app.kubernetes.io/instance=%s", "release=%s"}
+
+// releasePods lists the pods of the release in namespace.
+func (c *kubeClient) releasePods(ctx context.Context, namespace, release string) ([]kubePod, error) {
+	for _, sel := range releaseSelectors {
+		var list struct {
+			Items []kubePod `json:"items"`
+		}
+		q := url.Values{"labelSelector": {fmt.Sprintf(sel, release)}}
+		if err := c.get(ctx, "/api/v1/namespaces/"+url.PathEscape(namespace)+"/pods", q, &list); err != nil {
+			return nil, err
+		}
+		if len(list.Items) > 0 {
+			return list.Items, nil
+		}
+	}
+	return nil, nil
+}
+
+// helmReleaseSecret is a release record of Helm's default storage driver.
+type helmReleaseSecret struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Data struct {
+		Release []byte `json:"release"`
+	} `json:"data"`
+}
+
+// deployedReleaseSecrets lists the records of the currently deployed
+// revision of every Helm release in namespace, or in all namespaces when
+// it is empty. Records are up to a megabyte each, so they are read in
+// pages.
+func (c *kubeClient) deployedReleaseSecrets(ctx context.Context, namespace string) ([]helmReleaseSecret, error) {
+	p := "/api/v1/secrets"
+	if namespace != "" {
+		p = "/api/v1/namespaces/" + url.PathEscape(namespace) + "/secrets"
+	}
+	q := url.Values{"labelSelector": {"owner=helm,status=deployed"}, "limit": {"50"}}
+	var out []helmReleaseSecret
+	for {
+		var list struct {
+			Metadata struct {
+				Continue string `json:"continue"`
+			} `json:"metadata"`
+			Items []helmReleaseSecret `json:"items"`
+		}
+		if err := c.get(ctx, p, q, &list); err != nil {
+			return nil, err
+		}
+		out = append(out, list.Items...)
+		if list.Metadata.Continue == "" {
+			return out, nil
+		}
+		q.Set("continue", list.Metadata.Continue)
+	}
+}
@@ -0,0 +1,217 @@
+package scanner
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Kinds of layers.
+const (
+	// layerStandard is a layer pulled from the image's registry.
+	layerStandard = "standard"
+	// layerForeign is a non-distributable layer, such as a Windows base
+	// layer, that registries do not serve and clients fetch from its URLs
+	// or already have.
+	layerForeign = "foreign"
+	// layerSquashed is a layer that merges several build steps, written by
+	// docker build --squash or crane flatten.
+	layerSquashed = "squashed"
+)
+
+// originOwn is the origin of a layer found in no configured base image.
+const originOwn = "own"
+
+// LayerBreakdown sums the layers of an image by kind and origin, to tell
+// what a pull transfers from where.
+type LayerBreakdown struct {
+	Standard int `json:"standard"`
+	Foreign  int `json:"foreign"`
+	Squashed int `json:"squashed"`
+	// Origins are sorted by size, largest first.
+	Origins []LayerOrigin `json:"origins"`
+}
+
+// LayerOrigin is where some layers of an image come from: a base image of
+// -base-images, the host serving foreign layers, or "own".
+type LayerOrigin struct {
+	Origin    string `json:"origin"`
+	Layers    int    `json:"layers"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+// layerKind classifies a layer descriptor, with the history entry that
+// created it when the config lists one per layer.
+func layerKind(l v1.Descriptor, h *v1.History) string {
+	switch l.MediaType {
+	case types.DockerForeignLayer, types.OCIRestrictedLayer, types.OCIUncompressedRestrictedLayer:
+		return layerForeign
+	}
+	if len(l.URLs) > 0 {
+		return layerForeign
+	}
+	if h != nil && (strings.HasPrefix(h.Comment, "merge sha256:") || strings.Contains(h.CreatedBy, " flatten sha256:")) {
+		return layerSquashed
+	}
+	return layerStandard
+}
+
+// layerHistory returns the history entry of every layer, or nil when the
+// config's history does not match the layers one to one.
+func layerHistory(cf *v1.ConfigFile, layers int) []*v1.History {
+	if cf == nil {
+		return nil
+	}
+	var out []*v1.History
+	for i := range cf.History {
+		if !cf.History[i].EmptyLayer {
+			out = append(out, &cf.History[i])
+		}
+	}
+	if len(out) != layers {
+		return nil
+	}
+	return out
+}
+
+// baseImages attributes layers to the base images of -base-images. The
+// layers of each base are read from its registry and kept for the cache
+// TTL; a base that cannot be read is retried a minute later.
+type baseImages struct {
+	refs []string
+	ttl  time.Duration
+
+	mu     sync.Mutex
+	layers map[string]baseEntry
+}
+
+type baseEntry struct {
+	layers  []string
+	fetched time.Time
+	failed  bool
+}
+
+const baseRetry = time.Minute
+
+// newBaseImages returns nil without base images.
+func newBaseImages(refs []string, ttl time.Duration) *baseImages {
+	if len(refs) == 0 {
+		return nil
+	}
+	return &baseImages{refs: refs, ttl: ttl, layers: make(map[string]baseEntry)}
+}
+
+// origins maps layer digests to the base image they belong to. A layer
+// shared by several bases, as the layers of a base built on another are,
+// belongs to the base with the most layers. Bases outside the scan's
+// allowed registries are not read.
+func (b *baseImages) origins(ctx context.Context, registry registryClient, opts scanOptions) map[string]string {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make(map[string]string)
+	size := make(map[string]int)
+	for _, ref := range b.refs {
+		if opts.egressAllowed(ref) != nil {
+			continue
+		}
+		e, ok := b.layers[ref]
+		if !ok || (e.failed && time.Since(e.fetched) > baseRetry) || (!e.failed && time.Since(e.fetched) > b.ttl) {
+			layers, err := baseLayers(ctx, registry, ref)
+			if err != nil {
+				log.Printf("warning: reading base image %s: %v", ref, err)
+			}
+			e = baseEntry{layers: layers, fetched: time.Now(), failed: err != nil}
+			b.layers[ref] = e
+		}
+		for _, d := range e.layers {
+			if cur, ok := out[d]; !ok || len(e.layers) > size[cur] {
+				out[d] = ref
+			}
+		}
+		size[ref] = len(e.layers)
+	}
+	return out
+}
+
+// baseLayers lists the layer digests of a base image, of the default
+// platform for an index.
+func baseLayers(ctx context.Context, registry registryClient, ref string) ([]string, error) {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	img, err := remote.Image(r, crane.GetOptions(registry.options(ctx)...).Remote...)
+	if err != nil {
+		return nil, err
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(m.Layers))
+	for _, l := range m.Layers {
+		out = append(out, l.Digest.String())
+	}
+	return out, nil
+}
+
+// layerBreakdown sets the origin of every layer of info, on a copy of its
+// layers since info may be shared with the cache, and sums them up.
+func layerBreakdown(info *ImageInfo, bases map[string]string) {
+	if info.Kind != kindImage || len(info.Layers) == 0 {
+		return
+	}
+	layers := make([]LayerInfo, len(info.Layers))
+	copy(layers, info.Layers)
+	b := &LayerBreakdown{}
+	byOrigin := make(map[string]*LayerOrigin)
+	for i := range layers {
+		l := &layers[i]
+		switch l.Kind {
+		case layerForeign:
+			b.Foreign++
+		case layerSquashed:
+			b.Squashed++
+		default:
+			b.Standard++
+		}
+		l.Origin = originOwn
+		if base, ok := bases[l.Digest]; ok {
+			l.Origin = base
+		} else if l.Kind == layerForeign && len(l.URLs) > 0 {
+			if u, err := url.Parse(l.URLs[0]); err == nil && u.Host != "" {
+				l.Origin = u.Host
+			}
+		}
+		o, ok := byOrigin[l.Origin]
+		if !ok {
+			o = &LayerOrigin{Origin: l.Origin}
+			byOrigin[l.Origin] = o
+		}
+		o.Layers++
+		o.SizeBytes += l.SizeBytes
+	}
+	for _, o := range byOrigin {
+		b.Origins = append(b.Origins, *o)
+	}
+	sort.Slice(b.Origins, func(i, j int) bool {
+		if b.Origins[i].SizeBytes != b.Origins[j].SizeBytes {
+			return b.Origins[i].SizeBytes > b.Origins[j].SizeBytes
+		}
+		return b.Origins[i].Origin < b.Origins[j].Origin
+	})
+	info.Layers, info.LayerBreakdown = layers, b
+}
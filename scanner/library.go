@@ -0,0 +1,91 @@
+package scanner
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// chartTypeLibrary is the Chart.yaml type of a chart that only provides
+// named templates to the charts depending on it and installs nothing.
+const chartTypeLibrary = "library"
+
+// LibraryReport is returned for a scan of a library chart, whose images
+// are only known once an application chart uses its helpers.
+type LibraryReport struct {
+	Chart string `json:"chart"`
+	// Helpers are the named templates the chart defines.
+	Helpers []string `json:"helpers"`
+}
+
+var defineRe = regexp.MustCompile(`{{-?\s*define\s+"([^"]+)"`)
+
+// libraryReport returns nil unless the root chart, the first of charts, is
+// a library chart.
+func libraryReport(charts []*helmChart) *LibraryReport {
+	if len(charts) == 0 || charts[0].meta.Type != chartTypeLibrary {
+		return nil
+	}
+	root := charts[0]
+	report := &LibraryReport{Chart: root.meta.Name, Helpers: []string{}}
+	seen := make(map[string]bool)
+	for rel, data := range root.files {
+		if !strings.HasPrefix(rel, "templates/") {
+			continue
+		}
+		for _, m := range defineRe.FindAllStringSubmatch(string(data), -1) {
+			if !seen[m[1]] {
+				seen[m[1]] = true
+				report.Helpers = append(report.Helpers, m[1])
+			}
+		}
+	}
+	sort.Strings(report.Helpers)
+	return report
+}
+
+// libraryOutput is the output of one include of a named template defined
+// by a library chart while rendering a template file.
+type libraryOutput struct {
+	helper string // <library chart>/<template name>
+	out    string
+}
+
+// libraryHelper returns the helper of outputs that produced img: the one
+// with the shortest output containing it, so that a helper building an
+// image reference is preferred over one writing a whole container.
+func libraryHelper(outputs []libraryOutput, img string) string {
+	best := -1
+	for i, o := range outputs {
+		if strings.Contains(o.out, img) && (best < 0 || len(o.out) < len(outputs[best].out)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return ""
+	}
+	return outputs[best].helper
+}
+
+// libraryDirs maps the directory of every library chart of the tree to
+// its name.
+func libraryDirs(charts []*valuesTree) map[string]string {
+	dirs := make(map[string]string)
+	for _, t := range charts {
+		if t.chart.meta.Type == chartTypeLibrary {
+			dirs[t.chart.dir] = t.chart.meta.Name
+		}
+	}
+	return dirs
+}
+
+// definedIn returns the library a template file belongs to, or "".
+func definedIn(dirs map[string]string, file string) string {
+	for dir := path.Dir(file); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if name, ok := dirs[dir]; ok {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,144 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// linkTimeout bounds the check of one chart link.
+const linkTimeout = 10 * time.Second
+
+// Chart.yaml fields whose links are checked.
+const (
+	linkIcon    = "icon"
+	linkHome    = "home"
+	linkSources = "sources"
+	// linkAppVersionImage is the main image tagged with the appVersion,
+	// checked when the chart's image tag disagrees with it.
+	linkAppVersionImage = "app_version_image"
+)
+
+// LinkReport checks the links of the root chart's metadata and the image
+// its appVersion hints at, for curators validating chart metadata.
+type LinkReport struct {
+	Chart string      `json:"chart"`
+	Links []LinkCheck `json:"links"`
+	// Broken counts the links that were not reachable.
+	Broken int `json:"broken"`
+}
+
+// LinkCheck is the outcome of fetching one link. URL is an image
+// reference for app_version_image.
+type LinkCheck struct {
+	Field     string `json:"field"`
+	URL       string `json:"url"`
+	Reachable bool   `json:"reachable"`
+	Status    int    `json:"status,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// checkLinks fetches the icon, home and sources of the root chart, the
+// first of charts, and, when the main image's tag disagrees with the
+// appVersion, looks for the image tagged with the appVersion.
+func (s *server) checkLinks(ctx context.Context, charts []*helmChart, appVersion *AppVersionReport, opts scanOptions) *LinkReport {
+	if len(charts) == 0 {
+		return nil
+	}
+	meta := charts[0].meta
+	rep := &LinkReport{Chart: meta.Name, Links: []LinkCheck{}}
+	if meta.Icon != "" {
+		rep.Links = append(rep.Links, LinkCheck{Field: linkIcon, URL: meta.Icon})
+	}
+	if meta.Home != "" {
+		rep.Links = append(rep.Links, LinkCheck{Field: linkHome, URL: meta.Home})
+	}
+	for _, src := range meta.Sources {
+		rep.Links = append(rep.Links, LinkCheck{Field: linkSources, URL: src})
+	}
+	if appVersion != nil && !appVersion.Matches {
+		repo, _, _ := refRepoTag(appVersion.Image)
+		tag := appVersion.AppVersion
+		if strings.HasPrefix(appVersion.Tag, "v") && !strings.HasPrefix(tag, "v") {
+			tag = "v" + tag
+		}
+		rep.Links = append(rep.Links, LinkCheck{Field: linkAppVersionImage, URL: repo + ":" + tag})
+	}
+	var wg sync.WaitGroup
+	for i := range rep.Links {
+		wg.Add(1)
+		go func(l *LinkCheck) {
+			defer wg.Done()
+			lctx, cancel := context.WithTimeout(ctx, linkTimeout)
+			defer cancel()
+			if l.Field == linkAppVersionImage {
+				s.checkImageLink(lctx, l, opts)
+			} else {
+				s.checkURL(lctx, l)
+			}
+		}(&rep.Links[i])
+	}
+	wg.Wait()
+	for _, l := range rep.Links {
+		if !l.Reachable {
+			rep.Broken++
+		}
+	}
+	return rep
+}
+
+// checkURL fetches an http(s) link with HEAD, and with GET when the server
+// does not answer HEAD. Inline data: icons are reachable by definition.
+func (s *server) checkURL(ctx context.Context, l *LinkCheck) {
+	u, err := url.Parse(l.URL)
+	switch {
+	case err == nil && u.Scheme == "data" && l.Field == linkIcon:
+		l.Reachable = true
+		return
+	case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+		l.Error = "not an http(s) URL"
+		return
+	}
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		req, err := http.NewRequestWithContext(ctx, method, l.URL, nil)
+		if err != nil {
+			l.Error = err.Error()
+			return
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			l.Error = err.Error()
+			return
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		l.Status = resp.StatusCode
+		if method == http.MethodHead && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusNotImplemented) {
+			continue
+		}
+		break
+	}
+	l.Reachable = l.Status/100 == 2
+	if !l.Reachable {
+		l.Error = fmt.Sprintf("answered %d %s", l.Status, http.StatusText(l.Status))
+	}
+}
+
+// checkImageLink looks for an image tag with a manifest HEAD, within the
+// registries the scan may contact.
+func (s *server) checkImageLink(ctx context.Context, l *LinkCheck, opts scanOptions) {
+	if err := opts.egressAllowed(l.URL); err != nil {
+		l.Error = err.Error()
+		return
+	}
+	if _, err := s.registry.resolveDigest(ctx, l.URL); err != nil {
+		l.Error = err.Error()
+		return
+	}
+	l.Reachable = true
+}
@@ -0,0 +1,122 @@
+package scanner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Log levels, lowest first. A message's level is read from its prefix:
+// "debug: ", "warning: " or "error: "; others are info.
+const (
+	levelDebug int32 = iota
+	levelInfo
+	levelWarning
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warning", "error"}
+
+// logLevel is the lowest level written, changed at runtime through
+// /admin/log-level.
+var logLevel atomic.Int32
+
+func init() { logLevel.Store(levelInfo) }
+
+func parseLogLevel(s string) (int32, error) {
+	for i, n := range levelNames {
+		if s == n {
+			return int32(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, want debug, info, warning or error", s)
+}
+
+// levelWriter drops log messages below logLevel. It is installed with
+// the logger's own flags cleared, so that it sees the bare message, and
+// adds the timestamp itself.
+type levelWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *levelWriter) Write(p []byte) (int, error) {
+	if messageLevel(p) < logLevel.Load() {
+		return len(p), nil
+	}
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if _, err := io.WriteString(lw.w, time.Now().Format("2006/01/02 15:04:05 ")); err != nil {
+		return 0, err
+	}
+	return lw.w.Write(p)
+}
+
+func messageLevel(p []byte) int32 {
+	switch {
+	case bytes.HasPrefix(p, []byte("debug: ")):
+		return levelDebug
+	case bytes.HasPrefix(p, []byte("warning: ")):
+		return levelWarning
+	case bytes.HasPrefix(p, []byte("error: ")):
+		return levelError
+	}
+	return levelInfo
+}
+
+// installLogLevel routes the standard logger through a levelWriter at
+// the given level.
+func installLogLevel(w io.Writer, level string) error {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	logLevel.Store(l)
+	log.SetFlags(0)
+	log.SetOutput(&levelWriter{w: w})
+	return nil
+}
+
+// debugEnabled reports whether debug messages are written, so that
+// callers can skip building them.
+func debugEnabled() bool { return logLevel.Load() <= levelDebug }
+
+type logLevelBody struct {
+	Level string `json:"level"`
+}
+
+// logLevelHandler serves GET /admin/log-level, the current level, and
+// PUT /admin/log-level with {"level": "debug"} to change it until the
+// next restart.
+func (s *server) logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		http.Error(w, "only GET and PUT allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	if r.Method == http.MethodPut {
+		var body logLevelBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			jsonError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		l, err := parseLogLevel(body.Level)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if old := logLevel.Swap(l); old != l {
+			log.Printf("log level changed from %s to %s", levelNames[old], levelNames[l])
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logLevelBody{Level: levelNames[logLevel.Load()]})
+}
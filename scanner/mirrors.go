@@ -0,0 +1,292 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// mirrorProbeTimeout bounds one probe of a registry.
+const mirrorProbeTimeout = 5 * time.Second
+
+// MirrorReport records which of the -mirrors of the chart's registries the
+// scan picked, and the probes it picked them by.
+type MirrorReport struct {
+	// Selected maps each registry prefix to the mirror its images were
+	// inspected at, or to itself when the registry was fastest.
+	Selected map[string]string `json:"selected"`
+	Probes   []MirrorProbe     `json:"probes"`
+	// RateLimited are the hosts passed over because they asked the
+	// scanner to back off.
+	RateLimited []string `json:"rate_limited,omitempty"`
+}
+
+// MirrorProbe is the outcome of a GET /v2/ of a registry or mirror host.
+type MirrorProbe struct {
+	Host      string  `json:"host"`
+	Healthy   bool    `json:"healthy"`
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	// Cached marks a probe taken by an earlier scan within
+	// -mirror-health-ttl.
+	Cached bool `json:"cached,omitempty"`
+}
+
+type mirrorHealth struct {
+	latency time.Duration
+	err     error
+	at      time.Time
+}
+
+// mirrorSet picks, per scan, the fastest healthy place to inspect the
+// images of a registry: the registry itself or one of its mirrors. Probes
+// and failures are remembered for the health TTL, so that scans share
+// them and a failing mirror is passed over until it expires.
+type mirrorSet struct {
+	mirrors map[string][]string // registry prefix -> mirror prefixes
+	ttl     time.Duration
+
+	mu     sync.Mutex
+	health map[string]mirrorHealth
+}
+
+// newMirrorSet returns nil without mirrors.
+func newMirrorSet(rules []rewriteRule, ttl time.Duration) *mirrorSet {
+	if len(rules) == 0 {
+		return nil
+	}
+	m := &mirrorSet{mirrors: make(map[string][]string), ttl: ttl, health: make(map[string]mirrorHealth)}
+	for _, r := range rules {
+		m.mirrors[r.From] = append(m.mirrors[r.From], r.To)
+	}
+	return m
+}
+
+// parseMirrors parses the -mirrors flag, a comma-separated list of
+// from=to mappings in which a registry may be given several mirrors.
+func parseMirrors(list []string) ([]rewriteRule, error) {
+	var rules []rewriteRule
+	for _, entry := range list {
+		from, to, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid mirror %q, want from=to", entry)
+		}
+		r, err := parseRewrites(map[string]string{from: to})
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r...)
+	}
+	return rules, nil
+}
+
+// selectFor probes the registries and mirrors the images need and returns
+// a rule per registry prefix leading to the fastest healthy one, which
+// maps the prefix to itself when the registry won. Candidates outside the
+// scan's allowed registries are not probed, and those rate limiting the
+// scanner are passed over.
+func (m *mirrorSet) selectFor(ctx context.Context, s *server, refs []string, opts scanOptions) ([]rewriteRule, *MirrorReport) {
+	if m == nil {
+		return nil, nil
+	}
+	froms := make([]rewriteRule, 0, len(m.mirrors))
+	for from := range m.mirrors {
+		froms = append(froms, rewriteRule{From: from, To: from})
+	}
+	used := make(map[string]bool)
+	for _, ref := range refs {
+		if r, ok := matchRule(ref, froms); ok {
+			used[r.From] = true
+		}
+	}
+	if len(used) == 0 {
+		return nil, nil
+	}
+
+	candidates := make(map[string][]string)
+	hosts := make(map[string]bool)
+	for from := range used {
+		for _, c := range append([]string{from}, m.mirrors[from]...) {
+			if opts.egressAllowed(c+"/repo") != nil {
+				continue
+			}
+			candidates[from] = append(candidates[from], c)
+			hosts[prefixHost(c)] = true
+		}
+	}
+	rep := &MirrorReport{Selected: make(map[string]string)}
+	health := m.probe(ctx, s, hosts, rep)
+
+	var rules []rewriteRule
+	for from, cands := range candidates {
+		best := ""
+		for _, c := range cands {
+			h := health[prefixHost(c)]
+			if s.limits.cooldown([]string{prefixHost(c)}) > 0 {
+				rep.RateLimited = appendUnique(rep.RateLimited, prefixHost(c))
+				continue
+			}
+			if h.err == nil && (best == "" || h.latency < health[prefixHost(best)].latency) {
+				best = c
+			}
+		}
+		if best == "" {
+			// Nothing answered; the registry is tried as without mirrors.
+			best = from
+		}
+		rep.Selected[from] = best
+		rules = append(rules, rewriteRule{From: from, To: best})
+	}
+	sort.Strings(rep.RateLimited)
+	return rules, rep
+}
+
+// probe returns the health of every host, probing those without a
+// fresh entry in parallel.
+func (m *mirrorSet) probe(ctx context.Context, s *server, hosts map[string]bool, rep *MirrorReport) map[string]mirrorHealth {
+	out := make(map[string]mirrorHealth, len(hosts))
+	var stale []string
+	m.mu.Lock()
+	for h := range hosts {
+		if e, ok := m.health[h]; ok && time.Since(e.at) < m.ttl {
+			out[h] = e
+			rep.Probes = append(rep.Probes, e.probe(h, true))
+		} else {
+			stale = append(stale, h)
+		}
+	}
+	m.mu.Unlock()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, h := range stale {
+		wg.Add(1)
+		go func(h string) {
+			defer wg.Done()
+			e := mirrorHealth{at: time.Now()}
+			e.latency, e.err = s.probeRegistry(ctx, h)
+			m.mu.Lock()
+			m.health[h] = e
+			m.mu.Unlock()
+			mu.Lock()
+			out[h] = e
+			rep.Probes = append(rep.Probes, e.probe(h, false))
+			mu.Unlock()
+		}(h)
+	}
+	wg.Wait()
+	sort.Slice(rep.Probes, func(i, j int) bool { return rep.Probes[i].Host < rep.Probes[j].Host })
+	return out
+}
+
+func (e mirrorHealth) probe(host string, cached bool) MirrorProbe {
+	p := MirrorProbe{Host: host, Healthy: e.err == nil, Cached: cached}
+	if e.err != nil {
+		p.Error = e.err.Error()
+	} else {
+		p.LatencyMS = float64(e.latency.Microseconds()) / 1000
+	}
+	return p
+}
+
+// failed marks the host of a mirror unhealthy after an inspection at it
+// failed, until the health TTL expires.
+func (m *mirrorSet) failed(mirrorRef string, err error) {
+	if m == nil {
+		return
+	}
+	host := registryHost(mirrorRef)
+	m.mu.Lock()
+	m.health[host] = mirrorHealth{err: err, at: time.Now()}
+	m.mu.Unlock()
+	log.Printf("warning: mirror %s failed, passed over for %s: %v", host, m.ttl, err)
+}
+
+// fallbacks returns the references ref can be inspected at in the mirrors
+// of its registry, for when the registry rate limits the scan. Mirrors
+// known to be unhealthy or rate limited themselves, outside the scan's
+// allowed registries, or already tried are left out.
+func (m *mirrorSet) fallbacks(ref, tried string, opts scanOptions, limits *rateLimits) []string {
+	if m == nil {
+		return nil
+	}
+	froms := make([]rewriteRule, 0, len(m.mirrors))
+	for from := range m.mirrors {
+		froms = append(froms, rewriteRule{From: from, To: from})
+	}
+	rule, ok := matchRule(ref, froms)
+	if !ok {
+		return nil
+	}
+	var out []string
+	for _, to := range m.mirrors[rule.From] {
+		host := prefixHost(to)
+		m.mu.Lock()
+		h, known := m.health[host]
+		m.mu.Unlock()
+		if known && h.err != nil && time.Since(h.at) < m.ttl {
+			continue
+		}
+		pull, ok := rewriteRef(ref, []rewriteRule{{From: rule.From, To: to}})
+		if !ok || pull == tried || opts.egressAllowed(pull) != nil || limits.cooldown([]string{registryHost(pull)}) > 0 {
+			continue
+		}
+		out = append(out, pull)
+	}
+	return out
+}
+
+// probeRegistry times a GET /v2/ of a registry host. An authentication
+// challenge counts as an answer.
+func (s *server) probeRegistry(ctx context.Context, host string) (time.Duration, error) {
+	reg, err := name.NewRegistry(host)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, mirrorProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reg.Scheme()+"://"+reg.RegistryStr()+"/v2/", nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	resp, err := (&http.Client{Transport: s.registry.transport}).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		return 0, fmt.Errorf("unexpected status %s from /v2/", resp.Status)
+	}
+	return time.Since(start), nil
+}
+
+// prefixHost returns the registry host of a registry or repository prefix.
+func prefixHost(prefix string) string {
+	host, _, _ := strings.Cut(prefix, "/")
+	if host == "docker.io" {
+		return name.DefaultRegistry
+	}
+	return host
+}
+
+// mirrorRef returns the reference ref is inspected at under the scan's
+// selected mirrors, ref itself when its registry was selected or has no
+// mirrors.
+func (o scanOptions) mirrorRef(ref string) string {
+	rule, ok := matchRule(ref, o.Mirrors)
+	if !ok || rule.To == rule.From {
+		return ref
+	}
+	if to, ok := rewriteRef(ref, []rewriteRule{rule}); ok {
+		return to
+	}
+	return ref
+}
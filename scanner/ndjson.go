@@ -0,0 +1,90 @@
+package scanner
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const ndjsonType = "application/x-ndjson"
+
+// acceptsNDJSON reports whether the request asks for a streamed response.
+func acceptsNDJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(part); err == nil && mt == ndjsonType {
+			return true
+		}
+	}
+	return false
+}
+
+// ndjsonWriter streams a scan as newline-delimited JSON: one line per
+// image as soon as its inspection finishes, then a line holding the
+// chart-level reports as {"summary": ...}. Errors after the first line
+// are written as an {"error": ...} line, since the status is already
+// sent.
+type ndjsonWriter struct {
+	w      http.ResponseWriter
+	fields fieldSelection
+	units  sizeUnits
+
+	mu      sync.Mutex
+	started bool
+}
+
+func (n *ndjsonWriter) line(v interface{}) {
+	data, _ := json.Marshal(v)
+	data = n.units.humanize(data)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.started {
+		n.w.Header().Set("Content-Type", ndjsonType)
+		n.started = true
+	}
+	n.w.Write(append(data, '\n'))
+	if f, ok := n.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (n *ndjsonWriter) image(info ImageInfo) {
+	if n.fields == nil {
+		n.line(info)
+		return
+	}
+	data, _ := json.Marshal(info)
+	var obj map[string]json.RawMessage
+	json.Unmarshal(data, &obj)
+	n.line(n.fields.apply(obj))
+}
+
+// ndjsonSummary is the last line of a streamed scan.
+type ndjsonSummary struct {
+	Summary scanSummary `json:"summary"`
+}
+
+// scanSummary is a result without its images, which are already out.
+type scanSummary struct {
+	ScanResult
+	Images []ImageInfo `json:"images,omitempty"`
+}
+
+// summary writes the result without its images.
+func (n *ndjsonWriter) summary(result *ScanResult) {
+	n.line(ndjsonSummary{Summary: scanSummary{ScanResult: *result}})
+}
+
+// fail reports an error, as a JSON error response while nothing has been
+// streamed yet.
+func (n *ndjsonWriter) fail(code int, msg string) {
+	n.mu.Lock()
+	started := n.started
+	n.mu.Unlock()
+	if !started {
+		jsonError(n.w, code, msg)
+		return
+	}
+	n.line(errorResponse{Error: msg})
+}
@@ -0,0 +1,326 @@
+package scanner
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// oidcTimeout bounds one request to the issuer.
+	oidcTimeout = 10 * time.Second
+	// oidcRefresh is the least time between two fetches of the issuer's
+	// keys, which are fetched again when a token names an unknown key.
+	oidcRefresh = time.Minute
+	// oidcLeeway allows for clock skew in exp and nbf.
+	oidcLeeway = time.Minute
+	// oidcMinRSABits is the smallest RSA key accepted.
+	oidcMinRSABits = 2048
+)
+
+// oidcAuth accepts JWTs of an OpenID Connect issuer as bearer tokens. The
+// signing keys are found through the issuer's discovery document; the
+// token must be unexpired, issued by the issuer and for the audience.
+type oidcAuth struct {
+	issuer, audience string
+	client           *http.Client
+
+	// fetchMu lets one request at a time fetch the keys, without holding
+	// up those whose keys are known, which only take mu.
+	fetchMu sync.Mutex
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+func newOIDCAuth(issuer, audience string) *oidcAuth {
+	return &oidcAuth{
+		issuer:   strings.TrimSuffix(issuer, "/"),
+		audience: audience,
+		client:   &http.Client{Timeout: oidcTimeout},
+	}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+func (o *oidcAuth) Authenticate(r *http.Request) (*Principal, error) {
+	token := bearerToken(r)
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		// Not a JWT, so not for this authenticator.
+		return nil, nil
+	}
+	var header jwtHeader
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	key, err := o.key(r.Context(), header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWT(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	switch {
+	case claims.Issuer != o.issuer:
+		return nil, fmt.Errorf("token issued by %q, not %q", claims.Issuer, o.issuer)
+	case !audienceIncludes(claims.Audience, o.audience):
+		return nil, fmt.Errorf("token is not for audience %q", o.audience)
+	case claims.ExpiresAt == nil || now.After(unixTime(*claims.ExpiresAt).Add(oidcLeeway)):
+		return nil, errors.New("token expired")
+	case claims.NotBefore != nil && now.Add(oidcLeeway).Before(unixTime(*claims.NotBefore)):
+		return nil, errors.New("token not valid yet")
+	case claims.Subject == "":
+		return nil, errors.New("token has no subject")
+	}
+	return &Principal{Subject: claims.Subject, Method: "oidc"}, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+func unixTime(sec float64) time.Time {
+	return time.Unix(int64(sec), 0)
+}
+
+// audienceIncludes reports whether aud, a string or a list of them, names
+// the audience.
+func audienceIncludes(aud json.RawMessage, audience string) bool {
+	var one string
+	if json.Unmarshal(aud, &one) == nil {
+		return one == audience
+	}
+	var list []string
+	json.Unmarshal(aud, &list)
+	for _, a := range list {
+		if a == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyJWT checks the signature of a token signed with RSA PKCS #1 v1.5
+// or ECDSA, the algorithms OIDC issuers sign with.
+func verifyJWT(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	invalid := errors.New("invalid token signature")
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'R' || rsa.VerifyPKCS1v15(k, hash, digest, sig) != nil {
+			return invalid
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[0] != 'E' || len(sig) != 2*size {
+			return invalid
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return invalid
+		}
+	default:
+		return invalid
+	}
+	return nil
+}
+
+// key returns the issuer's key with the id, fetching the keys again when
+// it is unknown, at most every oidcRefresh.
+func (o *oidcAuth) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	if k, done, err := o.cachedKey(kid); done {
+		return k, err
+	}
+	o.fetchMu.Lock()
+	defer o.fetchMu.Unlock()
+	// Another request may have fetched the keys while this one waited.
+	if k, done, err := o.cachedKey(kid); done {
+		return k, err
+	}
+	keys, err := o.fetchKeys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetching the keys of %s: %w", o.issuer, err)
+	}
+	o.mu.Lock()
+	o.keys, o.fetched = keys, time.Now()
+	o.mu.Unlock()
+	if k, ok := keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown token key %q", kid)
+}
+
+// cachedKey returns the known key with the id. It is not done when the
+// key is unknown and the keys may be fetched again.
+func (o *oidcAuth) cachedKey(kid string) (k crypto.PublicKey, done bool, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if k, ok := o.keys[kid]; ok {
+		return k, true, nil
+	}
+	if time.Since(o.fetched) < oidcRefresh {
+		return nil, true, fmt.Errorf("unknown token key %q", kid)
+	}
+	return nil, false, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (o *oidcAuth) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := o.getJSON(ctx, o.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	// OpenID Connect Discovery requires the issuer to be the one asked,
+	// so that one issuer cannot pass off another's keys.
+	if strings.TrimSuffix(discovery.Issuer, "/") != o.issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q", discovery.Issuer)
+	}
+	if discovery.JWKSURI == "" {
+		return nil, errors.New("discovery document has no jwks_uri")
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := o.getJSON(ctx, discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		k, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("warning: skipping key %q of %s: %v", jwk.Kid, o.issuer, err)
+			continue
+		}
+		keys[jwk.Kid] = k
+	}
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err1 := b64(k.N)
+		e, err2 := b64(k.E)
+		if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("malformed RSA key")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < oidcMinRSABits {
+			return nil, fmt.Errorf("RSA key of %d bits is shorter than %d", pub.N.BitLen(), oidcMinRSABits)
+		}
+		if pub.E < 3 || pub.E%2 == 0 {
+			return nil, errors.New("malformed RSA key")
+		}
+		return pub, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported curve")
+		}
+		x, err1 := b64(k.X)
+		y, err2 := b64(k.Y)
+		if err1 != nil || err2 != nil {
+			return nil, errors.New("malformed EC key")
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("EC key is not on its curve")
+		}
+		return pub, nil
+	}
+	return nil, errors.New("unsupported key type")
+}
+
+func (o *oidcAuth) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
@@ -0,0 +1,221 @@
+package scanner
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testIssuer is an OpenID Connect issuer serving its discovery document
+// and keys.
+type testIssuer struct {
+	srv *httptest.Server
+	// claimed is the issuer the discovery document names, the issuer's
+	// own URL when empty.
+	claimed string
+	jwks    []map[string]string
+	// block, when set, holds up requests for the keys until closed.
+	block   chan struct{}
+	fetches atomic.Int64
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	ti := &testIssuer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer := ti.claimed
+		if issuer == "" {
+			issuer = ti.srv.URL
+		}
+		json.NewEncoder(w).Encode(map[string]string{"issuer": issuer, "jwks_uri": ti.srv.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		ti.fetches.Add(1)
+		if ti.block != nil {
+			<-ti.block
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": ti.jwks})
+	})
+	ti.srv = httptest.NewServer(mux)
+	t.Cleanup(ti.srv.Close)
+	return ti
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func rsaJWK(kid string, k *rsa.PublicKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())}
+}
+
+func ecJWK(kid string, k *ecdsa.PublicKey) map[string]string {
+	return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(k.X.FillBytes(make([]byte, 32))), "y": b64(k.Y.FillBytes(make([]byte, 32)))}
+}
+
+// signToken returns a JWT of claims signed by key, RS256 for an RSA key
+// and ES256 for an ECDSA one.
+func signToken(t *testing.T, key crypto.Signer, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + b64(sig)
+}
+
+func authenticateBearer(a Authenticator, token string) (*Principal, error) {
+	r := httptest.NewRequest(http.MethodGet, "/scan", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return a.Authenticate(r)
+}
+
+func TestOIDCAuth(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ti := newTestIssuer(t)
+	ti.jwks = []map[string]string{rsaJWK("rsa", &rsaKey.PublicKey), ecJWK("ec", &ecKey.PublicKey)}
+	o := newOIDCAuth(ti.srv.URL+"/", "scanner")
+
+	now := time.Now().Unix()
+	claims := func(change func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{"iss": ti.srv.URL, "sub": "alice", "aud": "scanner", "exp": now + 300}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+	for _, tc := range []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{"valid RS256", signToken(t, rsaKey, "rsa", claims(nil)), ""},
+		{"valid ES256", signToken(t, ecKey, "ec", claims(nil)), ""},
+		{"audience in a list", signToken(t, rsaKey, "rsa", claims(func(c map[string]interface{}) { c["aud"] = []string{"other", "scanner"} })), ""},
+		{"wrong issuer", signToken(t, rsaKey, "rsa", claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" })), "issued by"},
+		{"wrong audience", signToken(t, rsaKey, "rsa", claims(func(c map[string]interface{}) { c["aud"] = "other" })), "audience"},
+		{"expired", signToken(t, rsaKey, "rsa", claims(func(c map[string]interface{}) { c["exp"] = now - 3600 })), "expired"},
+		{"no expiry", signToken(t, rsaKey, "rsa", claims(func(c map[string]interface{}) { delete(c, "exp") })), "expired"},
+		{"not valid yet", signToken(t, rsaKey, "rsa", claims(func(c map[string]interface{}) { c["nbf"] = now + 3600 })), "not valid yet"},
+		{"no subject", signToken(t, rsaKey, "rsa", claims(func(c map[string]interface{}) { delete(c, "sub") })), "no subject"},
+		{"unknown kid", signToken(t, rsaKey, "gone", claims(nil)), "unknown token key"},
+		{"signed by another key", signToken(t, otherKey, "ec", claims(nil)), "invalid token signature"},
+		{"ES256 under an RSA kid", signToken(t, ecKey, "rsa", claims(nil)), "invalid token signature"},
+		{"malformed", "a.b.c", "malformed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := authenticateBearer(o, tc.token)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("rejected: %v", err)
+			case tc.wantErr == "" && (p == nil || p.Subject != "alice" || p.Method != "oidc"):
+				t.Fatalf("principal %+v, want alice by oidc", p)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Fatalf("error %v, want one containing %q", err, tc.wantErr)
+			}
+		})
+	}
+	if n := ti.fetches.Load(); n != 1 {
+		t.Errorf("keys fetched %d times, want once: unknown kids are only fetched again after %s", n, oidcRefresh)
+	}
+	if p, err := authenticateBearer(o, "not-a-jwt"); p != nil || err != nil {
+		t.Errorf("a token that is no JWT got %+v, %v; want it left to the next authenticator", p, err)
+	}
+}
+
+func TestOIDCAuthChecksTheDiscoveryIssuer(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ti := newTestIssuer(t)
+	ti.jwks = []map[string]string{ecJWK("ec", &key.PublicKey)}
+	ti.claimed = "https://evil.example.com"
+	o := newOIDCAuth(ti.srv.URL, "scanner")
+	token := signToken(t, key, "ec", map[string]interface{}{"iss": ti.srv.URL, "sub": "alice", "aud": "scanner", "exp": time.Now().Unix() + 300})
+	if _, err := authenticateBearer(o, token); err == nil || !strings.Contains(err.Error(), "discovery document is for issuer") {
+		t.Errorf("error %v, want the discovery issuer mismatch", err)
+	}
+}
+
+func TestOIDCAuthRejectsShortRSAKeys(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (jsonWebKey{Kty: "RSA", N: b64(key.N.Bytes()), E: b64(big.NewInt(int64(key.E)).Bytes())}).publicKey(); err == nil {
+		t.Fatal("a 1024-bit RSA key was accepted")
+	}
+	ti := newTestIssuer(t)
+	ti.jwks = []map[string]string{rsaJWK("short", &key.PublicKey)}
+	o := newOIDCAuth(ti.srv.URL, "scanner")
+	token := signToken(t, key, "short", map[string]interface{}{"iss": ti.srv.URL, "sub": "alice", "aud": "scanner", "exp": time.Now().Unix() + 300})
+	if _, err := authenticateBearer(o, token); err == nil {
+		t.Error("a token signed with a 1024-bit key was accepted")
+	}
+}
+
+func TestOIDCAuthDoesNotWaitForAFetch(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ti := newTestIssuer(t)
+	ti.jwks = []map[string]string{ecJWK("ec", &key.PublicKey)}
+	o := newOIDCAuth(ti.srv.URL, "scanner")
+	claims := map[string]interface{}{"iss": ti.srv.URL, "sub": "alice", "aud": "scanner", "exp": time.Now().Unix() + 300}
+	known := signToken(t, key, "ec", claims)
+	if _, err := authenticateBearer(o, known); err != nil {
+		t.Fatal(err)
+	}
+
+	// Let the keys go stale and hold up the next fetch, which a token
+	// with a new kid starts.
+	o.mu.Lock()
+	o.fetched = time.Now().Add(-2 * oidcRefresh)
+	o.mu.Unlock()
+	ti.block = make(chan struct{})
+	defer close(ti.block)
+	go authenticateBearer(o, signToken(t, key, "rotated", claims))
+	for ti.fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := authenticateBearer(o, known)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a token with a known key waited for the fetch of the keys")
+	}
+}
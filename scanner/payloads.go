@@ -0,0 +1,120 @@
+package scanner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// payloadTemplate turns a scan result into the body a webhook with a
+// fixed schema expects, such as a ServiceNow incident or a Jira issue.
+type payloadTemplate struct {
+	tmpl        *template.Template
+	contentType string
+}
+
+// webhookOptions reads the options of a webhook sink from the fragment of
+// its URL, which is never sent:
+//
+//	https://jira.example.com/rest/api/2/issue#template=/etc/scanner/jira.tmpl
+//
+// template is a Go template file rendering the body, and content-type its
+// media type, application/json by default. It returns the URL without the
+// fragment.
+func webhookOptions(u *url.URL) (string, *payloadTemplate, error) {
+	if u.Fragment == "" {
+		return u.String(), nil, nil
+	}
+	opts, err := url.ParseQuery(u.Fragment)
+	if err != nil {
+		return "", nil, fmt.Errorf("webhook options: %w", err)
+	}
+	for key := range opts {
+		if key != "template" && key != "content-type" {
+			return "", nil, fmt.Errorf("unknown webhook option %q", key)
+		}
+	}
+	target := *u
+	target.Fragment, target.RawFragment = "", ""
+	file := opts.Get("template")
+	if file == "" {
+		if opts.Has("content-type") {
+			return "", nil, fmt.Errorf("webhook option content-type needs a template")
+		}
+		return target.String(), nil, nil
+	}
+	p, err := loadPayloadTemplate(file, opts.Get("content-type"))
+	if err != nil {
+		return "", nil, err
+	}
+	return target.String(), p, nil
+}
+
+func loadPayloadTemplate(file, contentType string) (*payloadTemplate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading payload template: %w", err)
+	}
+	tmpl, err := template.New(filepath.Base(file)).Option("missingkey=zero").Funcs(payloadFuncs()).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("parsing payload template: %w", err)
+	}
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	return &payloadTemplate{tmpl: tmpl, contentType: contentType}, nil
+}
+
+// payloadFuncs are the functions of chart templates, so that payloads are
+// written as charts are. Those only meaningful while rendering a chart
+// fail, and now is the time of delivery.
+func payloadFuncs() template.FuncMap {
+	f := (&renderer{}).funcMap()
+	delete(f, "sandboxTick")
+	for _, name := range []string{"include", "tpl"} {
+		name := name
+		f[name] = func(...interface{}) (string, error) {
+			return "", fmt.Errorf("%s is not available in payload templates", name)
+		}
+	}
+	f["now"] = time.Now
+	return f
+}
+
+// render executes the template with the result as its JSON document, so
+// fields are named as in the API: {{ .chart_url }}, {{ range .images }}.
+// A body that is not valid JSON for a JSON content type is an error, as no
+// retry can fix it.
+func (p *payloadTemplate) render(result ScanResult) ([]byte, error) {
+	b, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := p.tmpl.Execute(&buf, doc); err != nil {
+		return nil, permanentError{fmt.Errorf("payload template: %w", err)}
+	}
+	if isJSONType(p.contentType) {
+		var v interface{}
+		if err := json.Unmarshal(buf.Bytes(), &v); err != nil {
+			return nil, permanentError{fmt.Errorf("payload template produced invalid JSON: %w", err)}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func isJSONType(contentType string) bool {
+	media, _, _ := strings.Cut(contentType, ";")
+	media = strings.TrimSpace(media)
+	return media == "application/json" || strings.HasSuffix(media, "+json")
+}
@@ -0,0 +1,88 @@
+package scanner
+
+import (
+	"fmt"
+	"sort"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// PlatformReport lists the images that cannot run on every required
+// platform, e.g. images without an arm64 build in a cluster that has ARM
+// nodes.
+type PlatformReport struct {
+	Required []string      `json:"required"`
+	Missing  []PlatformGap `json:"missing"`
+}
+
+type PlatformGap struct {
+	Image     string   `json:"image"`
+	Missing   []string `json:"missing"`
+	Available []string `json:"available"`
+}
+
+// parsePlatforms validates a list of os/arch[/variant] platforms.
+func parsePlatforms(list []string) ([]v1.Platform, error) {
+	out := make([]v1.Platform, 0, len(list))
+	for _, s := range list {
+		p, err := v1.ParsePlatform(s)
+		if err == nil && (p.OS == "" || p.Architecture == "") {
+			err = fmt.Errorf("want os/arch")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid platform %q: %v", s, err)
+		}
+		out = append(out, *p)
+	}
+	return out, nil
+}
+
+// platformReport checks the inspected images against the required
+// platforms. Artifacts other than images, and images whose platform is
+// not recorded, are left out.
+func platformReport(required []v1.Platform, infos []ImageInfo) *PlatformReport {
+	rep := &PlatformReport{Required: make([]string, len(required)), Missing: []PlatformGap{}}
+	for i, p := range required {
+		rep.Required[i] = p.String()
+	}
+	for _, info := range infos {
+		if info.Kind != kindImage || len(info.Platforms) == 0 {
+			continue
+		}
+		var have []v1.Platform
+		for _, s := range info.Platforms {
+			if p, err := v1.ParsePlatform(s); err == nil {
+				have = append(have, defaultVariant(*p))
+			}
+		}
+		gap := PlatformGap{Image: info.Image, Available: info.Platforms}
+		for i, want := range required {
+			want = defaultVariant(want)
+			found := false
+			for _, h := range have {
+				if h.Satisfies(want) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				gap.Missing = append(gap.Missing, rep.Required[i])
+			}
+		}
+		if len(gap.Missing) > 0 {
+			rep.Missing = append(rep.Missing, gap)
+		}
+	}
+	sort.Slice(rep.Missing, func(i, j int) bool { return rep.Missing[i].Image < rep.Missing[j].Image })
+	return rep
+}
+
+// defaultVariant fills in the variant an architecture implies, the way
+// container runtimes match platforms: arm64 is arm64/v8 unless stated
+// otherwise.
+func defaultVariant(p v1.Platform) v1.Platform {
+	if p.Architecture == "arm64" && p.Variant == "" {
+		p.Variant = "v8"
+	}
+	return p
+}
@@ -0,0 +1,115 @@
+package scanner
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// PolicyReport is the verdict of the policies enabled for a scan. A chart
+// fails when any rule reports a violation.
+type PolicyReport struct {
+	Passed     bool              `json:"passed"`
+	Rules      []string          `json:"rules"`
+	Violations []PolicyViolation `json:"violations,omitempty"`
+}
+
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Image   string `json:"image,omitempty"`
+	Message string `json:"message"`
+}
+
+// PinningReport separates digest-pinned references from tag references.
+// Stale lists "repo:tag@digest" references whose tag has moved on.
+type PinningReport struct {
+	Pinned []string `json:"pinned"`
+	Tagged []string `json:"tagged"`
+	Stale  []string `json:"stale,omitempty"`
+}
+
+const (
+	ruleRequireDigest     = "require_digest"
+	ruleNoHardcodedImages = "no_hardcoded_images"
+	ruleTrustedDockerHub  = "trusted_docker_hub"
+)
+
+type policyOptions struct {
+	RequireDigest bool
+	// NoHardcodedImages fails charts with images written in templates
+	// instead of set through values.
+	NoHardcodedImages bool
+	// TrustedDockerHub fails charts with Docker Hub images from
+	// publishers that are neither of a trusted badge nor namespace.
+	TrustedDockerHub bool
+}
+
+func (p policyOptions) enabled() bool {
+	return p.RequireDigest || p.NoHardcodedImages || p.TrustedDockerHub
+}
+
+// pinningReport classifies every discovered reference, whether or not it
+// could be inspected.
+func pinningReport(refs []string, infos []ImageInfo) *PinningReport {
+	rep := &PinningReport{Pinned: []string{}, Tagged: []string{}}
+	for _, ref := range refs {
+		if isDigestPinned(ref) {
+			rep.Pinned = append(rep.Pinned, ref)
+		} else {
+			rep.Tagged = append(rep.Tagged, ref)
+		}
+	}
+	for _, info := range infos {
+		if v := info.TagVerification; v != nil && v.TagDigest != "" && !v.Matches {
+			rep.Stale = append(rep.Stale, info.Image)
+		}
+	}
+	sort.Strings(rep.Pinned)
+	sort.Strings(rep.Tagged)
+	sort.Strings(rep.Stale)
+	return rep
+}
+
+// evaluatePolicies runs the enabled rules against a finished scan. It
+// returns nil when no policy was requested.
+func evaluatePolicies(result *ScanResult, opts policyOptions) *PolicyReport {
+	if !opts.enabled() {
+		return nil
+	}
+	rep := &PolicyReport{}
+	if opts.RequireDigest {
+		rep.Rules = append(rep.Rules, ruleRequireDigest)
+		for _, ref := range result.Pinning.Tagged {
+			rep.Violations = append(rep.Violations, PolicyViolation{
+				Rule:    ruleRequireDigest,
+				Image:   ref,
+				Message: fmt.Sprintf("%s is referenced by tag, not pinned to a digest", ref),
+			})
+		}
+	}
+	if opts.NoHardcodedImages {
+		rep.Rules = append(rep.Rules, ruleNoHardcodedImages)
+		for _, h := range result.HardcodedImages {
+			rep.Violations = append(rep.Violations, PolicyViolation{
+				Rule:    ruleNoHardcodedImages,
+				Image:   h.Image,
+				Message: fmt.Sprintf("%s is written in %s rather than set through values, so it cannot be relocated to a mirror", h.Image, strings.Join(h.Templates, ", ")),
+			})
+		}
+	}
+	if opts.TrustedDockerHub && result.DockerHub != nil {
+		rep.Rules = append(rep.Rules, ruleTrustedDockerHub)
+		for _, img := range result.DockerHub.Images {
+			if img.Trusted {
+				continue
+			}
+			msg := fmt.Sprintf("%s is pulled from Docker Hub: %s", img.Image, img.Reason)
+			if img.Error != "" {
+				msg += ": " + img.Error
+			}
+			rep.Violations = append(rep.Violations, PolicyViolation{Rule: ruleTrustedDockerHub, Image: img.Image, Message: msg})
+		}
+	}
+	rep.Passed = len(rep.Violations) == 0
+	return rep
+}
@@ -0,0 +1,138 @@
+package scanner
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// postRenderSource names the manifests of a post-render run in its scan.
+const postRenderSource = "post-render"
+
+// runPostRender is the post-render subcommand, a Helm post-renderer: it
+// reads the manifests Helm rendered from stdin, checks their images and
+// writes the manifests unchanged to stdout, or lists the violations on
+// stderr and fails, which makes Helm abort the install or upgrade. It
+// returns the exit code.
+func runPostRender(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("post-render", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: helm-image-scanner post-render [flags] < manifests.yaml")
+		fmt.Fprintln(stderr, "\nUse as helm install|upgrade --post-renderer helm-image-scanner --post-renderer-args post-render.")
+		fs.PrintDefaults()
+	}
+	requireDigest := fs.Bool("require-digest", false, "fail images referenced by tag rather than digest")
+	platforms := fs.String("platforms", "", "comma-separated platforms every image must support")
+	allowed := fs.String("allowed-registries", "", "comma-separated registries images may come from")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	manifests, err := io.ReadAll(stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "reading manifests: %v\n", err)
+		return 2
+	}
+
+	cfg, err := LoadConfig(nil)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	keys, err := loadKeyRing(cfg.SecretsKeyFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	// Registry credentials come from Helm's registry config.
+	helm, err := loadHelmConfig(cfg.HelmRepositories, cfg.HelmRegistryConfig, keys)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	catalog, err := openCatalog(cfg.Catalog, cfg.CacheTTL)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	history, _ := openHistoryStore("")
+	crawls, _ := openCrawlState("")
+	s := newServer(cfg, history, crawls, nil, nil, nil, helm, catalog)
+	req := scanRequest{Options: Options{RequireDigest: *requireDigest, Platforms: splitList(*platforms), AllowedRegistries: splitList(*allowed)}}
+	opts, err := s.scanOptionsFor(req, cacheControl{})
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	// The manifests are rendered already.
+	opts.Render = false
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ScanTimeout)
+	defer cancel()
+	files := []chartFile{{Name: "manifests.yaml", Data: manifests}}
+	result, err := s.scanLocalChart(ctx, postRenderSource, files, opts)
+	if err != nil {
+		fmt.Fprintf(stderr, "post-render: checking images: %v\n", err)
+		return 1
+	}
+	violations := postRenderViolations(result)
+	if len(violations) > 0 {
+		for _, v := range violations {
+			fmt.Fprintf(stderr, "post-render: %s\n", v)
+		}
+		fmt.Fprintf(stderr, "post-render: %d violations, manifests rejected\n", len(violations))
+		return 1
+	}
+	if _, err := stdout.Write(manifests); err != nil {
+		fmt.Fprintf(stderr, "writing manifests: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// postRenderViolations lists what blocks the manifests: failed policies,
+// images outside the allowed registries, images past -max-images or that
+// could not be inspected, and missing platforms.
+func postRenderViolations(result *ScanResult) []string {
+	var out []string
+	if result.Policy != nil {
+		for _, v := range result.Policy.Violations {
+			out = append(out, v.Rule+": "+v.Message)
+		}
+	}
+	skipped := make(map[string]bool)
+	for _, img := range result.EgressBlocked {
+		skipped[img] = true
+		out = append(out, fmt.Sprintf("allowed_registries: %s is not in an allowed registry", img))
+	}
+	if t := result.Truncation; t != nil {
+		for _, ref := range t.NotInspected {
+			skipped[ref] = true
+			out = append(out, fmt.Sprintf("max_images: %s was not inspected, the manifests have more than %d images", ref, t.Limit))
+		}
+	}
+	inspected := make(map[string]bool)
+	for _, info := range result.Images {
+		inspected[info.Image] = true
+	}
+	refs := append(append([]string{}, result.Pinning.Pinned...), result.Pinning.Tagged...)
+	sort.Strings(refs)
+	for _, ref := range refs {
+		if !inspected[ref] && !skipped[ref] {
+			out = append(out, fmt.Sprintf("inspection: %s could not be inspected", ref))
+		}
+	}
+	if result.Platforms != nil {
+		for _, gap := range result.Platforms.Missing {
+			out = append(out, fmt.Sprintf("platforms: %s has no build for %s", gap.Image, strings.Join(gap.Missing, ", ")))
+		}
+	}
+	return out
+}
@@ -0,0 +1,163 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+)
+
+// PreflightReport tells whether every image of a chart can be pulled,
+// without inspecting the images.
+type PreflightReport struct {
+	ChartURL  string         `json:"chart_url"`
+	Source    *ReleaseSource `json:"source,omitempty"`
+	CheckedAt time.Time      `json:"checked_at"`
+	// Deployable is true when every image resolved.
+	Deployable bool `json:"deployable"`
+	Unresolved int  `json:"unresolved"`
+	// RenderError is set when the chart failed to render and its files
+	// were checked instead.
+	RenderError string           `json:"render_error,omitempty"`
+	Images      []PreflightImage `json:"images"`
+}
+
+type PreflightImage struct {
+	Image string `json:"image"`
+	// Pulled is the reference the cluster pulls instead, when a rewrite
+	// rule applies.
+	Pulled string `json:"pulled,omitempty"`
+	Digest string `json:"digest,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// preflightHandler serves POST /preflight. It takes the body of /scan,
+// plus docker_config, the content of the cluster's image pull secret, to
+// check the images with instead of the server's credentials.
+func (s *server) preflightHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	req, err := s.decodeScanRequest(bytes.NewReader(body))
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var creds struct {
+		DockerConfig json.RawMessage `json:"docker_config"`
+	}
+	json.Unmarshal(body, &creds)
+	registry := s.registry
+	if len(creds.DockerConfig) > 0 {
+		kc, err := parseRegistryConfig(creds.DockerConfig)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, "docker_config must be the JSON of a .dockerconfigjson, with auths")
+			return
+		}
+		// Only the given credentials count, as only they are in the
+		// cluster.
+		registry = registryClient{transport: s.registry.transport, anonymous: true, keychain: kc}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.ScanTimeout)
+	defer cancel()
+	source, code, err := s.resolveScanTarget(ctx, &req)
+	if err != nil {
+		msg := err.Error()
+		if code == http.StatusInternalServerError {
+			msg = "preflight failed: " + msg
+		}
+		jsonError(w, code, msg)
+		return
+	}
+	opts, err := s.scanOptionsFor(req, cacheControl{})
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	report, err := s.preflight(ctx, registry, req.ChartURL, opts)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, fmt.Sprintf("preflight failed: %v", err))
+		return
+	}
+	report.Source = source
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// preflight extracts the images of a chart and resolves each with a
+// manifest HEAD, bypassing the cache: the question is whether the pull
+// works now.
+func (s *server) preflight(ctx context.Context, registry registryClient, chartURL string, opts scanOptions) (*PreflightReport, error) {
+	job, ctx, err := s.tracker.start(ctx, "preflight of "+chartURL)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for a scan slot: %w", err)
+	}
+	defer s.tracker.finish(job)
+	files, err := s.fetchChart(ctx, chartURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	refs, _, _, renderErr, err := chartImages(ctx, job, files, opts)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(refs)
+
+	report := &PreflightReport{ChartURL: chartURL, CheckedAt: time.Now().UTC(), Images: make([]PreflightImage, len(refs))}
+	if renderErr != nil {
+		report.RenderError = renderErr.Error()
+	}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, opts.Concurrency)
+	for i, ref := range refs {
+		img := &report.Images[i]
+		img.Image = ref
+		if to, ok := rewriteRef(ref, opts.Rewrites); ok {
+			img.Pulled = to
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			ictx, cancel := context.WithTimeout(ctx, opts.ImageTimeout)
+			defer cancel()
+			pull := img.Image
+			if img.Pulled != "" {
+				pull = img.Pulled
+			}
+			if err := opts.egressAllowed(pull); err != nil {
+				img.Error = err.Error()
+				return
+			}
+			d, err := crane.Digest(pull, registry.options(ictx)...)
+			if err != nil {
+				img.Error = err.Error()
+				return
+			}
+			img.Digest = d
+		}()
+	}
+	wg.Wait()
+	for _, img := range report.Images {
+		if img.Error != "" {
+			report.Unresolved++
+		}
+	}
+	report.Deployable = report.Unresolved == 0
+	return report, nil
+}
@@ -0,0 +1,134 @@
+package scanner
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// scanProfiles are named presets of /scan options, kept as JSON so that
+// each request decodes a fresh copy to layer its own fields over.
+type scanProfiles map[string]json.RawMessage
+
+// loadProfiles reads a YAML file mapping profile names to the option
+// fields of a /scan request. An empty path means no profiles.
+func loadProfiles(path string) (scanProfiles, error) {
+	profiles := make(scanProfiles)
+	if path == "" {
+		return profiles, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading profiles: %w", err)
+	}
+	return parseProfiles(data, path)
+}
+
+// parseProfiles reads the content of a profiles file, named path in
+// errors.
+func parseProfiles(data []byte, path string) (scanProfiles, error) {
+	profiles := make(scanProfiles)
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parsing profiles %s: %w", path, err)
+	}
+	for name, v := range raw {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: %w", name, err)
+		}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		var req scanRequest
+		if err := dec.Decode(&req); err != nil {
+			return nil, fmt.Errorf("profile %q: %w", name, err)
+		}
+		if req.ChartURL != "" || req.Version != "" || req.Manifest != "" || req.Terraform != "" || req.Profile != "" {
+			return nil, fmt.Errorf("profile %q: profiles hold options, not chart_url, version, manifest, terraform or profile", name)
+		}
+		profiles[name] = b
+	}
+	return profiles, nil
+}
+
+// checkProfiles validates every profile against the server's bounds, so
+// that a profile asking for a disabled option fails at startup rather
+// than on each request.
+func (s *server) checkProfiles() error {
+	for name, p := range s.profiles {
+		var req scanRequest
+		json.Unmarshal(p, &req)
+		if _, err := s.scanOptionsFor(req, cacheControl{}); err != nil {
+			return fmt.Errorf("profile %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// decodeScanRequest decodes a /scan body over the profile it names, and
+// both over the stored defaults of its chart_url: fields given in the
+// request replace the profile's, which replace the chart's, and values
+// are merged in the same order.
+func (s *server) decodeScanRequest(body io.Reader) (scanRequest, error) {
+	var req scanRequest
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return req, errors.New("invalid JSON body")
+	}
+	var sel struct {
+		ChartURL        string `json:"chart_url"`
+		Profile         string `json:"profile"`
+		NoChartDefaults bool   `json:"no_chart_defaults"`
+	}
+	if err := json.Unmarshal(data, &sel); err != nil {
+		return req, errors.New("invalid JSON body")
+	}
+	var layers []json.RawMessage
+	var chart string
+	if sel.ChartURL != "" && !sel.NoChartDefaults {
+		if d, ok := s.chartDefaultsFor(sel.ChartURL); ok {
+			layers = append(layers, d.Options)
+			chart = d.Chart
+		}
+	}
+	if sel.Profile != "" {
+		p, ok := s.profiles[sel.Profile]
+		if !ok {
+			return req, fmt.Errorf("unknown profile %q", sel.Profile)
+		}
+		layers = append(layers, p)
+	}
+	var values map[string]interface{}
+	for _, l := range layers {
+		req.Values = nil
+		json.Unmarshal(l, &req)
+		if req.Values != nil {
+			values = mergeValues(values, req.Values)
+		}
+	}
+	req.Values = nil
+	if err := json.Unmarshal(data, &req); err != nil {
+		return req, errors.New("invalid JSON body")
+	}
+	if values != nil {
+		req.Values = mergeValues(values, req.Values)
+	}
+	req.chartDefaults = chart
+	return req, nil
+}
+
+// profilesHandler serves GET /profiles, the presets requests can name.
+func (s *server) profilesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.profiles)
+}
@@ -0,0 +1,101 @@
+package scanner
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// withBasePath serves h under prefix, e.g. "/image-scanner", so the
+// service can share a host with others behind an ingress. Requests outside
+// the prefix get a 404.
+func withBasePath(prefix string, h http.Handler) http.Handler {
+	if prefix == "" {
+		return h
+	}
+	return http.StripPrefix(prefix, h)
+}
+
+// normalizeBasePath turns "image-scanner/" into "/image-scanner"; "/" and
+// "" both mean no prefix.
+func normalizeBasePath(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// defaultTrustedProxies are the loopback and private networks an ingress
+// controller or sidecar proxy usually connects from.
+const defaultTrustedProxies = "127.0.0.0/8,::1/128,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7"
+
+// parseTrustedProxies reads -trusted-proxies entries, addresses or CIDR
+// ranges.
+func parseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, e := range entries {
+		if a, err := netip.ParseAddr(e); err == nil {
+			out = append(out, netip.PrefixFrom(a, a.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(e)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: want an address or CIDR range", e)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// externalURL returns the absolute URL clients should use for path, which
+// is relative to the service root. Behind a proxy the scheme, host and
+// prefix come from X-Forwarded-Proto, X-Forwarded-Host and
+// X-Forwarded-Prefix when the server is configured to trust them and the
+// request comes from a trusted proxy. A scheme other than http or https
+// is ignored.
+func (s *server) externalURL(r *http.Request, path string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	prefix := s.cfg.BasePath
+	if s.cfg.TrustForwarded && s.fromTrustedProxy(r) {
+		switch v := strings.ToLower(firstHeaderValue(r, "X-Forwarded-Proto")); v {
+		case "http", "https":
+			scheme = v
+		}
+		if v := firstHeaderValue(r, "X-Forwarded-Host"); v != "" {
+			host = v
+		}
+		if v := firstHeaderValue(r, "X-Forwarded-Prefix"); v != "" {
+			prefix = normalizeBasePath(v)
+		}
+	}
+	return scheme + "://" + host + prefix + path
+}
+
+// fromTrustedProxy reports whether the peer of r is one of the trusted
+// proxies.
+func (s *server) fromTrustedProxy(r *http.Request) bool {
+	ap, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := ap.Addr().Unmap()
+	for _, p := range s.cfg.TrustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstHeaderValue returns the first entry of a possibly comma-separated
+// header, as appended by chains of proxies.
+func firstHeaderValue(r *http.Request, key string) string {
+	v, _, _ := strings.Cut(r.Header.Get(key), ",")
+	return strings.TrimSpace(v)
+}
@@ -0,0 +1,59 @@
+package scanner
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExternalURL(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name, remote string
+		tls, trust   bool
+		headers      map[string]string
+		want         string
+	}{
+		{name: "direct", remote: "203.0.113.5:4000", want: "http://scanner.example.com/app/results/1"},
+		{name: "direct TLS", remote: "203.0.113.5:4000", tls: true, want: "https://scanner.example.com/app/results/1"},
+		{name: "headers not trusted", remote: "10.1.2.3:4000", headers: map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example.com"}, want: "http://scanner.example.com/app/results/1"},
+		{name: "trusted proxy", remote: "10.1.2.3:4000", trust: true, headers: map[string]string{"X-Forwarded-Proto": "HTTPS, http", "X-Forwarded-Host": "public.example.com", "X-Forwarded-Prefix": "scan/"}, want: "https://public.example.com/scan/results/1"},
+		{name: "trusted IPv6 proxy", remote: "[::1]:4000", trust: true, headers: map[string]string{"X-Forwarded-Proto": "https"}, want: "https://scanner.example.com/app/results/1"},
+		{name: "untrusted peer", remote: "203.0.113.5:4000", trust: true, headers: map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example.com"}, want: "http://scanner.example.com/app/results/1"},
+		{name: "script scheme", remote: "10.1.2.3:4000", trust: true, headers: map[string]string{"X-Forwarded-Proto": "javascript"}, want: "http://scanner.example.com/app/results/1"},
+		{name: "scheme with a path", remote: "10.1.2.3:4000", tls: true, trust: true, headers: map[string]string{"X-Forwarded-Proto": "https://evil.example.com/x"}, want: "https://scanner.example.com/app/results/1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &server{cfg: Config{BasePath: "/app", TrustForwarded: tc.trust, TrustedProxies: proxies}}
+			r := httptest.NewRequest("GET", "http://scanner.example.com/app/scan", nil)
+			r.RemoteAddr = tc.remote
+			if tc.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			if got := s.externalURL(r, "/results/1"); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	got, err := parseTrustedProxies(splitList(defaultTrustedProxies + ",192.0.2.7,10.1.2.3/8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(got); n != 8 || got[6].String() != "192.0.2.7/32" || got[7].String() != "10.0.0.0/8" {
+		t.Errorf("parsed %v", got)
+	}
+	for _, e := range []string{"proxy.example.com", "10.0.0.0/33", "10.0.0.1:80"} {
+		if _, err := parseTrustedProxies([]string{e}); err == nil {
+			t.Errorf("%q: accepted", e)
+		}
+	}
+}
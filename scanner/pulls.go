@@ -0,0 +1,157 @@
+package scanner
+
+import (
+	"fmt"
+	"sort"
+)
+
+// defaultNodeCount is the cluster size pull estimates assume when the
+// request does not give one.
+const defaultNodeCount = 10
+
+// PullReport estimates how many nodes pull each image when the chart is
+// rolled out: workloads land on at most as many nodes as they have
+// replicas, while DaemonSets pull their images on every node.
+type PullReport struct {
+	Nodes  int          `json:"nodes"`
+	Images []ImagePulls `json:"images"`
+}
+
+type ImagePulls struct {
+	Image string `json:"image"`
+	// Workloads are the controllers running the image, as Kind/name.
+	Workloads []string `json:"workloads"`
+	EveryNode bool     `json:"every_node"`
+	// Amplification is the number of nodes expected to pull the image.
+	Amplification int   `json:"amplification"`
+	SizeBytes     int64 `json:"size_bytes,omitempty"`
+	// PullBytes is the registry traffic of one rollout to nodes that do not
+	// have the image yet: the compressed size times Amplification.
+	PullBytes int64 `json:"pull_bytes,omitempty"`
+}
+
+// podSpecPaths locates the pod spec of each workload kind; those of custom
+// resources are in crdImageFields.
+var podSpecPaths = map[string]string{
+	"Pod":         "spec",
+	"Deployment":  "spec.template.spec",
+	"StatefulSet": "spec.template.spec",
+	"ReplicaSet":  "spec.template.spec",
+	"DaemonSet":   "spec.template.spec",
+	"Job":         "spec.template.spec",
+	"CronJob":     "spec.jobTemplate.spec.template.spec",
+}
+
+// pullReport classifies the images of the rendered workloads. The report
+// is sorted so that the images worth slimming first, those with the most
+// pull traffic, come first.
+func pullReport(manifests []renderedManifest, infos []ImageInfo, nodes int) *PullReport {
+	sizes := make(map[string]int64, len(infos))
+	for _, info := range infos {
+		sizes[info.Image] = info.SizeBytes
+	}
+	byImage := make(map[string]*ImagePulls)
+	spread := make(map[string]int)
+	for _, m := range manifests {
+		docs, _ := decodeDocuments(m.Data)
+		for _, d := range docs {
+			specs := podSpecs(d)
+			if len(specs) == 0 {
+				continue
+			}
+			kind := manifestKind(d)
+			workload := kind + "/" + valueString(lookupValue(d, "metadata.name"))
+			n := workloadSpread(d, kind, nodes)
+			var images []string
+			for _, spec := range specs {
+				images = append(images, podImages(spec)...)
+			}
+			for _, img := range images {
+				ip, ok := byImage[img]
+				if !ok {
+					ip = &ImagePulls{Image: img}
+					byImage[img] = ip
+				}
+				if !containsString(ip.Workloads, workload) {
+					ip.Workloads = append(ip.Workloads, workload)
+					spread[img] += n
+				}
+				ip.EveryNode = ip.EveryNode || kind == "DaemonSet"
+			}
+		}
+	}
+
+	rep := &PullReport{Nodes: nodes, Images: make([]ImagePulls, 0, len(byImage))}
+	for img, ip := range byImage {
+		ip.Amplification = spread[img]
+		if ip.EveryNode || ip.Amplification > nodes {
+			ip.Amplification = nodes
+		}
+		ip.SizeBytes = sizes[img]
+		ip.PullBytes = ip.SizeBytes * int64(ip.Amplification)
+		sort.Strings(ip.Workloads)
+		rep.Images = append(rep.Images, *ip)
+	}
+	sort.Slice(rep.Images, func(i, j int) bool {
+		a, b := rep.Images[i], rep.Images[j]
+		if a.PullBytes != b.PullBytes {
+			return a.PullBytes > b.PullBytes
+		}
+		if a.Amplification != b.Amplification {
+			return a.Amplification > b.Amplification
+		}
+		return a.Image < b.Image
+	})
+	return rep
+}
+
+// workloadSpread is the number of nodes a workload's pods can land on.
+func workloadSpread(d map[string]interface{}, kind string, nodes int) int {
+	var n interface{}
+	switch kind {
+	case "DaemonSet":
+		return nodes
+	case "Deployment", "StatefulSet", "ReplicaSet", "Rollout", "CloneSet":
+		n = lookupValue(d, "spec.replicas")
+	case "Job":
+		n = lookupValue(d, "spec.parallelism")
+	case "CronJob":
+		n = lookupValue(d, "spec.jobTemplate.spec.parallelism")
+	}
+	if f, ok := crdFieldsOf(d); ok && f.replicas != nil {
+		n = f.replicas(d)
+	}
+	replicas := 1
+	if n != nil {
+		// Replicas left to an autoscaler are rendered empty or as 0.
+		fmt.Sscan(valueString(n), &replicas)
+	}
+	if replicas < 1 {
+		replicas = 1
+	}
+	return replicas
+}
+
+// podImages lists the images of a pod spec's containers.
+func podImages(spec map[string]interface{}) []string {
+	var out []string
+	for _, key := range []string{"initContainers", "containers", "ephemeralContainers"} {
+		list, _ := spec[key].([]interface{})
+		for _, c := range list {
+			m, _ := c.(map[string]interface{})
+			if img := valueString(m["image"]); img != "" {
+				out = append(out, img)
+			}
+		}
+	}
+	return out
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package scanner
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// Outcomes of the scanner's own pulls from a registry.
+const (
+	// credentialsAccepted: the scanner had credentials and they worked.
+	credentialsAccepted = "accepted"
+	// credentialsRejected: the registry refused the scanner's credentials.
+	credentialsRejected = "rejected"
+	// credentialsAnonymous: the scanner pulled without credentials.
+	credentialsAnonymous = "anonymous"
+	// credentialsRequired: the registry refused an anonymous pull.
+	credentialsRequired = "required"
+	// credentialsUnknown: every pull failed for another reason.
+	credentialsUnknown = "unknown"
+)
+
+// PullSecretReport is a deploy-readiness checklist of the registries the
+// rendered workloads pull from.
+type PullSecretReport struct {
+	Registries []RegistryReadiness `json:"registries"`
+	Ready      bool                `json:"ready"`
+}
+
+// RegistryReadiness says whether the workloads pulling from one registry
+// can be expected to pull once deployed.
+type RegistryReadiness struct {
+	Registry string   `json:"registry"`
+	Images   []string `json:"images"`
+	// Workloads are the controllers running images of the registry, as
+	// Kind/name.
+	Workloads []string `json:"workloads"`
+	// PullSecrets are the secrets those workloads name, directly or
+	// through their service account.
+	PullSecrets []string `json:"pull_secrets,omitempty"`
+	// WithoutSecret are the workloads that name no pull secret.
+	WithoutSecret []string `json:"without_secret,omitempty"`
+	// Credentials is how the scanner's own pulls went: accepted,
+	// rejected, anonymous, required or unknown.
+	Credentials string `json:"credentials"`
+	Ready       bool   `json:"ready"`
+	// Checklist lists what to fix before deploying.
+	Checklist []string `json:"checklist,omitempty"`
+}
+
+// pullSecretReport gathers the pull secrets of the rendered workloads per
+// registry, and weighs them against how the scanner's own pulls from the
+// registry went. failed holds the inspection error of every image that
+// failed.
+func (c registryClient) pullSecretReport(manifests []renderedManifest, failed map[string]error) *PullSecretReport {
+	type workload struct {
+		name    string
+		secrets []string
+		account string
+		images  []string
+	}
+	accounts := make(map[string][]string)
+	var workloads []workload
+	for _, m := range manifests {
+		docs, _ := decodeDocuments(m.Data)
+		for _, d := range docs {
+			kind := manifestKind(d)
+			if kind == "ServiceAccount" {
+				accounts[valueString(lookupValue(d, "metadata.name"))] = pullSecrets(d["imagePullSecrets"])
+				continue
+			}
+			for _, spec := range podSpecs(d) {
+				workloads = append(workloads, workload{
+					name:    kind + "/" + valueString(lookupValue(d, "metadata.name")),
+					secrets: pullSecrets(spec["imagePullSecrets"]),
+					account: valueString(spec["serviceAccountName"]),
+					images:  podImages(spec),
+				})
+			}
+		}
+	}
+
+	byHost := make(map[string]*RegistryReadiness)
+	withSecret := make(map[string]map[string]bool)
+	for _, w := range workloads {
+		secrets := mergeSecrets(w.secrets, accounts[w.account])
+		for _, img := range w.images {
+			host := registryHost(img)
+			if host == "" {
+				continue
+			}
+			r := byHost[host]
+			if r == nil {
+				r = &RegistryReadiness{Registry: host}
+				byHost[host] = r
+				withSecret[host] = make(map[string]bool)
+			}
+			if !containsString(r.Images, img) {
+				r.Images = append(r.Images, img)
+			}
+			if !containsString(r.Workloads, w.name) {
+				r.Workloads = append(r.Workloads, w.name)
+			}
+			r.PullSecrets = mergeSecrets(r.PullSecrets, secrets)
+			if len(secrets) > 0 {
+				withSecret[host][w.name] = true
+			}
+		}
+	}
+
+	rep := &PullSecretReport{Registries: make([]RegistryReadiness, 0, len(byHost)), Ready: true}
+	for host, r := range byHost {
+		for _, w := range r.Workloads {
+			if !withSecret[host][w] {
+				r.WithoutSecret = append(r.WithoutSecret, w)
+			}
+		}
+		sort.Strings(r.Images)
+		sort.Strings(r.Workloads)
+		sort.Strings(r.WithoutSecret)
+		r.Credentials = c.pullOutcome(host, r.Images, failed)
+		r.Ready = true
+		switch r.Credentials {
+		case credentialsAccepted:
+			if len(r.WithoutSecret) > 0 {
+				r.Ready = false
+				r.Checklist = append(r.Checklist, fmt.Sprintf("the scanner pulled from %s with credentials, but no pull secret is named by %s; add imagePullSecrets unless %s allows anonymous pulls or the nodes are logged in to it", host, strings.Join(r.WithoutSecret, ", "), host))
+			}
+		case credentialsRejected:
+			r.Ready = false
+			r.Checklist = append(r.Checklist, fmt.Sprintf("%s rejected the scanner's credentials; renew them, and check the pull secret %s use", host, strings.Join(r.Workloads, ", ")))
+		case credentialsRequired:
+			r.Ready = false
+			r.Checklist = append(r.Checklist, fmt.Sprintf("%s refused an anonymous pull; give the scanner a login for it to check the images, and make sure %s have a pull secret", host, strings.Join(r.Workloads, ", ")))
+		case credentialsUnknown:
+			r.Ready = false
+			r.Checklist = append(r.Checklist, fmt.Sprintf("no image of %s could be inspected; see the scanner log for the errors", host))
+		}
+		rep.Ready = rep.Ready && r.Ready
+		rep.Registries = append(rep.Registries, *r)
+	}
+	sort.Slice(rep.Registries, func(i, j int) bool { return rep.Registries[i].Registry < rep.Registries[j].Registry })
+	return rep
+}
+
+// pullOutcome classifies the scanner's pulls of images from host.
+func (c registryClient) pullOutcome(host string, images []string, failed map[string]error) string {
+	authFailed, succeeded := false, false
+	for _, img := range images {
+		err, ok := failed[img]
+		switch {
+		case !ok:
+			succeeded = true
+		case isAuthError(err):
+			authFailed = true
+		}
+	}
+	hasCreds := c.hasCredentials(host)
+	switch {
+	case authFailed && hasCreds:
+		return credentialsRejected
+	case authFailed:
+		return credentialsRequired
+	case !succeeded:
+		return credentialsUnknown
+	case hasCreds:
+		return credentialsAccepted
+	}
+	return credentialsAnonymous
+}
+
+// hasCredentials reports whether pulls from host authenticate.
+func (c registryClient) hasCredentials(host string) bool {
+	reg, err := name.NewRegistry(host)
+	if err != nil {
+		return false
+	}
+	var kc authn.Keychain
+	switch {
+	case c.anonymous && c.keychain == nil:
+		return false
+	case c.anonymous:
+		kc = c.keychain
+	case c.keychain != nil:
+		kc = authn.NewMultiKeychain(c.keychain, authn.DefaultKeychain)
+	default:
+		kc = authn.DefaultKeychain
+	}
+	auth, err := kc.Resolve(reg)
+	return err == nil && auth != authn.Anonymous
+}
@@ -0,0 +1,160 @@
+package scanner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// RegistrySummary lists the registries and repositories a chart pulls
+// from, for egress rules and pull secrets, without inspecting any image.
+type RegistrySummary struct {
+	ChartURL  string         `json:"chart_url"`
+	Source    *ReleaseSource `json:"source,omitempty"`
+	ScannedAt time.Time      `json:"scanned_at"`
+	// RenderError is set when the chart failed to render and its files
+	// were read instead.
+	RenderError string          `json:"render_error,omitempty"`
+	Registries  []RegistryUsage `json:"registries"`
+	// Invalid lists the references that name no registry, such as ones
+	// with template placeholders left in them.
+	Invalid []string `json:"invalid,omitempty"`
+}
+
+// RegistryUsage is one registry of a chart. Namespaces are the first path
+// components of its repositories, such as bitnami for
+// docker.io/bitnami/redis.
+type RegistryUsage struct {
+	Registry     string   `json:"registry"`
+	Namespaces   []string `json:"namespaces"`
+	Repositories []string `json:"repositories"`
+	Images       int      `json:"images"`
+	// PullSecrets are the pull secrets the chart configures for the
+	// registry's images.
+	PullSecrets []string `json:"pull_secrets,omitempty"`
+}
+
+// registriesHandler serves POST /registries, which takes the body of
+// /scan.
+func (s *server) registriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req, err := s.decodeScanRequest(r.Body)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.ScanTimeout)
+	defer cancel()
+	source, code, err := s.resolveScanTarget(ctx, &req)
+	if err != nil {
+		msg := err.Error()
+		if code == http.StatusInternalServerError {
+			msg = "scan failed: " + msg
+		}
+		jsonError(w, code, msg)
+		return
+	}
+	opts, err := s.scanOptionsFor(req, cacheControl{})
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	summary, err := s.registrySummary(ctx, req.ChartURL, opts)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, fmt.Sprintf("scan failed: %v", err))
+		return
+	}
+	summary.Source = source
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// registrySummary extracts the images of a chart and groups them by the
+// registry they are pulled from, after rewrite rules.
+func (s *server) registrySummary(ctx context.Context, chartURL string, opts scanOptions) (*RegistrySummary, error) {
+	job, ctx, err := s.tracker.start(ctx, "registries of "+chartURL)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for a scan slot: %w", err)
+	}
+	defer s.tracker.finish(job)
+	files, err := s.fetchChart(ctx, chartURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	refs, secrets, _, renderErr, err := chartImages(ctx, job, files, opts)
+	if err != nil {
+		return nil, err
+	}
+	summary := summarizeRegistries(refs, secrets, opts.Rewrites)
+	summary.ChartURL = chartURL
+	summary.ScannedAt = time.Now().UTC()
+	if renderErr != nil {
+		summary.RenderError = renderErr.Error()
+	}
+	return summary, nil
+}
+
+func summarizeRegistries(refs []string, secrets map[string][]string, rewrites []rewriteRule) *RegistrySummary {
+	type usage struct {
+		namespaces, repos, secrets map[string]bool
+		images                     int
+	}
+	byRegistry := make(map[string]*usage)
+	summary := &RegistrySummary{Registries: []RegistryUsage{}}
+	for _, ref := range refs {
+		pull := ref
+		if to, ok := rewriteRef(ref, rewrites); ok {
+			pull = to
+		}
+		r, err := name.ParseReference(pull)
+		if err != nil {
+			summary.Invalid = append(summary.Invalid, ref)
+			continue
+		}
+		reg := r.Context().RegistryStr()
+		if reg == name.DefaultRegistry {
+			reg = "docker.io"
+		}
+		u := byRegistry[reg]
+		if u == nil {
+			u = &usage{namespaces: map[string]bool{}, repos: map[string]bool{}, secrets: map[string]bool{}}
+			byRegistry[reg] = u
+		}
+		repo := r.Context().RepositoryStr()
+		ns, _, _ := strings.Cut(repo, "/")
+		u.namespaces[ns] = true
+		u.repos[repo] = true
+		for _, sec := range secrets[ref] {
+			u.secrets[sec] = true
+		}
+		u.images++
+	}
+	for reg, u := range byRegistry {
+		ru := RegistryUsage{Registry: reg, Namespaces: sortedKeys(u.namespaces), Repositories: sortedKeys(u.repos), Images: u.images}
+		if len(u.secrets) > 0 {
+			ru.PullSecrets = sortedKeys(u.secrets)
+		}
+		summary.Registries = append(summary.Registries, ru)
+	}
+	sort.Slice(summary.Registries, func(i, j int) bool { return summary.Registries[i].Registry < summary.Registries[j].Registry })
+	sort.Strings(summary.Invalid)
+	return summary
+}
+
+func sortedKeys(set map[string]bool) []string {
+	out := make([]string, 0, len(set))
+	for k := range set {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
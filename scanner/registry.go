@@ -0,0 +1,291 @@
+package scanner
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// helmChartLayer is the media type of the chart archive in an OCI-hosted
+// Helm chart.
+const helmChartLayer = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+
+// registryClient carries the transport and credentials used for every
+// registry request.
+type registryClient struct {
+	transport http.RoundTripper
+	// anonymous ignores local credentials (docker config, credential
+	// helpers) and pulls without authenticating, or with keychain alone
+	// when one is set.
+	anonymous bool
+	// keychain holds credentials tried before the Docker config, such as
+	// the logins of Helm's registry config.
+	keychain authn.Keychain
+}
+
+func (c registryClient) options(ctx context.Context) []crane.Option {
+	opts := []crane.Option{crane.WithContext(ctx), crane.WithTransport(c.transport)}
+	switch {
+	case c.anonymous && c.keychain != nil:
+		opts = append(opts, crane.WithAuthFromKeychain(c.keychain))
+	case c.anonymous:
+		opts = append(opts, crane.WithAuth(authn.Anonymous))
+	case c.keychain != nil:
+		opts = append(opts, crane.WithAuthFromKeychain(authn.NewMultiKeychain(c.keychain, authn.DefaultKeychain)))
+	}
+	return opts
+}
+
+// pullChart streams the chart archive of an OCI-hosted Helm chart, given
+// as "registry/path/chart:version" without the oci:// scheme.
+func (c registryClient) pullChart(ctx context.Context, ref string) (io.ReadCloser, error) {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	img, err := remote.Image(r, crane.GetOptions(c.options(ctx)...).Remote...)
+	if err != nil {
+		return nil, err
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range m.Layers {
+		if string(l.MediaType) != helmChartLayer {
+			continue
+		}
+		layer, err := img.LayerByDigest(l.Digest)
+		if err != nil {
+			return nil, err
+		}
+		return layer.Compressed()
+	}
+	return nil, fmt.Errorf("%s is not a Helm chart", ref)
+}
+
+// listTags returns the tags of an OCI repository.
+func (c registryClient) listTags(ctx context.Context, repo string) ([]string, error) {
+	return crane.ListTags(repo, c.options(ctx)...)
+}
+
+// newTransport returns the transport shared by chart downloads and
+// registry requests. With an allowlist, requests to any other host fail
+// before a connection is made, including redirects.
+func newTransport(allowedHosts []string, resolver *hostResolver, conns connSettings) http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if resolver != nil {
+		t.DialContext = resolver.DialContext
+	}
+	conns.apply(t)
+	sw := &tlsSwitch{base: t, conns: conns, clones: make(map[*tls.Config]*http.Transport)}
+	if len(allowedHosts) == 0 {
+		return sw
+	}
+	return &egressGuard{next: sw, allowed: allowedHosts}
+}
+
+type tlsConfigKey struct{}
+
+// withTLSConfig has the requests made with ctx use tc, such as a Helm
+// repository's CA and client certificate, instead of the default TLS
+// settings.
+func withTLSConfig(ctx context.Context, tc *tls.Config) context.Context {
+	return context.WithValue(ctx, tlsConfigKey{}, tc)
+}
+
+// tlsSwitch sends the requests carrying TLS settings of their own to a
+// clone of base using them, one per settings, so that they keep its
+// dialer, DNS pins and connection settings and share no connection
+// with requests made with other settings.
+type tlsSwitch struct {
+	base  *http.Transport
+	conns connSettings
+
+	mu     sync.Mutex
+	clones map[*tls.Config]*http.Transport
+}
+
+func (t *tlsSwitch) RoundTrip(req *http.Request) (*http.Response, error) {
+	tc, _ := req.Context().Value(tlsConfigKey{}).(*tls.Config)
+	if tc == nil {
+		return t.base.RoundTrip(req)
+	}
+	t.mu.Lock()
+	clone, ok := t.clones[tc]
+	if !ok {
+		clone = t.base.Clone()
+		clone.TLSClientConfig = tc.Clone()
+		t.conns.apply(clone)
+		t.clones[tc] = clone
+	}
+	t.mu.Unlock()
+	return clone.RoundTrip(req)
+}
+
+// connSettings tune connection reuse, so that the dozens of requests a
+// scan makes to one registry share a few connections rather than start a
+// handshake each.
+type connSettings struct {
+	HTTP2 bool
+	// KeepAlive is how long an idle connection is kept; 0 turns
+	// keep-alives off.
+	KeepAlive      time.Duration
+	MaxIdlePerHost int
+	// MaxPerHost bounds the connections to one host, 0 is unlimited.
+	MaxPerHost int
+}
+
+func (c connSettings) apply(t *http.Transport) {
+	// A custom DialContext turns off HTTP/2 unless it is forced.
+	t.ForceAttemptHTTP2 = c.HTTP2
+	if !c.HTTP2 {
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		// The clone of the default transport already offers h2 in ALPN.
+		if t.TLSClientConfig != nil {
+			t.TLSClientConfig = t.TLSClientConfig.Clone()
+			t.TLSClientConfig.NextProtos = nil
+		}
+	}
+	if c.KeepAlive == 0 {
+		t.DisableKeepAlives = true
+	} else {
+		t.IdleConnTimeout = c.KeepAlive
+	}
+	t.MaxIdleConnsPerHost = c.MaxIdlePerHost
+	if t.MaxIdleConns < c.MaxIdlePerHost {
+		t.MaxIdleConns = c.MaxIdlePerHost
+	}
+	t.MaxConnsPerHost = c.MaxPerHost
+}
+
+// egressGuard restricts outbound requests to a list of hosts. Entries may
+// be exact host names or "*.example.com" to match any subdomain.
+type egressGuard struct {
+	next    http.RoundTripper
+	allowed []string
+}
+
+func (g *egressGuard) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !hostAllowed(req.URL.Hostname(), g.allowed) {
+		return nil, fmt.Errorf("egress to %s is not allowed", req.URL.Hostname())
+	}
+	return g.next.RoundTrip(req)
+}
+
+// politeTransport identifies the scanner with its User-Agent and paces
+// outbound requests, so that large crawls do not get the scanner's
+// address blocked by registries.
+type politeTransport struct {
+	next      http.RoundTripper
+	userAgent string
+	// hostInterval is the least time between two requests to one host,
+	// interval the least time between any two requests.
+	hostInterval time.Duration
+	interval     time.Duration
+
+	mu       sync.Mutex
+	nextHost map[string]time.Time
+	nextAny  time.Time
+}
+
+func (t *politeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.wait(req.Context(), req.URL.Host); err != nil {
+		return nil, err
+	}
+	if t.userAgent != "" {
+		// go-containerregistry sets its own User-Agent, which is replaced
+		// so registries see who is calling.
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// wait reserves the next free slot for host and sleeps until it comes.
+func (t *politeTransport) wait(ctx context.Context, host string) error {
+	if t.hostInterval <= 0 && t.interval <= 0 {
+		return nil
+	}
+	t.mu.Lock()
+	at := time.Now()
+	if n := t.nextHost[host]; n.After(at) {
+		at = n
+	}
+	if t.nextAny.After(at) {
+		at = t.nextAny
+	}
+	if t.hostInterval > 0 {
+		t.nextHost[host] = at.Add(t.hostInterval)
+	}
+	if t.interval > 0 {
+		t.nextAny = at.Add(t.interval)
+	}
+	t.mu.Unlock()
+
+	d := time.Until(at)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func hostAllowed(host string, allowed []string) bool {
+	host = strings.ToLower(host)
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if host == a {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(a, "*."); ok && strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// errEgressBlocked is the error of an image whose registry a scan may not
+// contact.
+var errEgressBlocked = errors.New("registry is not in allowed_registries")
+
+// egressAllowed fails for an image whose registry is outside the scan's
+// allowed registries. Entries match the registry with or without its port,
+// and docker.io stands for Docker Hub.
+func (o scanOptions) egressAllowed(ref string) error {
+	if len(o.AllowedRegistries) == 0 {
+		return nil
+	}
+	reg := registryHost(ref)
+	names := []string{reg}
+	if h, _, err := net.SplitHostPort(reg); err == nil {
+		names = append(names, h)
+	}
+	if reg == name.DefaultRegistry {
+		names = append(names, "docker.io")
+	}
+	for _, n := range names {
+		if hostAllowed(n, o.AllowedRegistries) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: %w", reg, errEgressBlocked)
+}
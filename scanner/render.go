@@ -0,0 +1,533 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// Rendering runs chart templates with a Helm-compatible set of objects
+// (.Values, .Release, .Chart, .Capabilities, .Files, .Template) and a
+// subset of the sprig function library. Charts are untrusted input, so
+// every render is sandboxed: it has a wall-clock limit, a cap on the bytes
+// templates may produce, a cap on include/tpl nesting, and no function
+// that reaches the network, the cluster or the process environment
+// (lookup always returns an empty result, env returns "").
+
+var (
+	errRenderTimeout     = errors.New("rendering exceeded its time limit")
+	errRenderOutputLimit = errors.New("rendering exceeded its output size limit")
+	errRenderDepth       = errors.New("include/tpl nested too deeply")
+)
+
+type renderOptions struct {
+	Timeout     time.Duration
+	MaxOutput   int64
+	MaxDepth    int
+	Values      map[string]interface{}
+	ReleaseName string
+	Namespace   string
+	KubeVersion string
+	// KeepGoing renders the remaining templates after one fails and
+	// returns every failure, joined.
+	KeepGoing bool
+}
+
+// renderedManifest is the output of one template file.
+type renderedManifest struct {
+	Template string
+	Data     []byte
+	// Libraries are the outputs of the library chart helpers the
+	// template included.
+	Libraries []libraryOutput
+}
+
+const defaultKubeVersion = "v1.29.0"
+
+// renderer holds the state of one sandboxed render.
+type renderer struct {
+	tmpl      *template.Template
+	opts      renderOptions
+	deadline  time.Time
+	remaining int64
+	depth     int
+	stopped   atomic.Value // the error that stopped the render
+	tplCache  map[string]string
+	tick      parse.Node
+	ticked    map[*parse.Tree]bool
+	apis      apiVersionSet
+	libraries map[string]string // library chart dir -> name
+	libOut    []libraryOutput
+}
+
+func renderChart(ctx context.Context, files []chartFile, opts renderOptions) ([]renderedManifest, error) {
+	root, err := buildChartTree(files)
+	if err != nil {
+		return nil, err
+	}
+	tree := coalesceValues(root, opts.Values)
+	if opts.ReleaseName == "" {
+		opts.ReleaseName = "release"
+	}
+	if opts.Namespace == "" {
+		opts.Namespace = "default"
+	}
+	if opts.KubeVersion == "" {
+		opts.KubeVersion = defaultKubeVersion
+	}
+
+	r := &renderer{
+		opts:      opts,
+		deadline:  time.Now().Add(opts.Timeout),
+		remaining: opts.MaxOutput,
+		tplCache:  make(map[string]string),
+		ticked:    make(map[*parse.Tree]bool),
+		apis:      apiVersionsFor(opts.KubeVersion),
+	}
+	type outcome struct {
+		out []renderedManifest
+		err error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		out, err := r.run(tree)
+		done <- outcome{out, err}
+	}()
+	timer := time.NewTimer(opts.Timeout)
+	defer timer.Stop()
+	select {
+	case o := <-done:
+		return o.out, o.err
+	case <-timer.C:
+		r.stop(errRenderTimeout)
+		return nil, errRenderTimeout
+	case <-ctx.Done():
+		r.stop(ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+func (r *renderer) run(tree *valuesTree) ([]renderedManifest, error) {
+	var charts []*valuesTree
+	var walk func(t *valuesTree)
+	walk = func(t *valuesTree) {
+		charts = append(charts, t)
+		for _, sub := range t.subcharts {
+			walk(sub)
+		}
+	}
+	walk(tree)
+	r.libraries = libraryDirs(charts)
+
+	// Like Helm, all charts share one template namespace so that parents
+	// can include helpers defined by library subcharts.
+	funcs := r.funcMap()
+	r.chargeResults(funcs)
+	r.tmpl = template.New("chart").Option("missingkey=zero").Funcs(funcs)
+	tick, err := template.New("tick").Funcs(r.funcMap()).Parse("{{sandboxTick}}")
+	if err != nil {
+		return nil, err
+	}
+	r.tick = tick.Tree.Root.Nodes[0]
+	type job struct {
+		name string
+		data map[string]interface{}
+	}
+	var jobs []job
+	var errs []error
+	for _, t := range charts {
+		names := make([]string, 0)
+		for rel := range t.chart.files {
+			if strings.HasPrefix(rel, "templates/") {
+				names = append(names, rel)
+			}
+		}
+		sort.Strings(names)
+		for _, rel := range names {
+			full := t.chart.dir + "/" + rel
+			if _, err := r.tmpl.New(full).Parse(string(t.chart.files[rel])); err != nil {
+				if !r.opts.KeepGoing {
+					return nil, err
+				}
+				errs = append(errs, err)
+				continue
+			}
+			base := path.Base(rel)
+			// Library charts only provide helpers; Helm renders none of
+			// their template files.
+			if strings.HasPrefix(base, "_") || !isYAMLFile(base) || t.chart.meta.Type == chartTypeLibrary {
+				continue
+			}
+			jobs = append(jobs, job{full, r.topLevel(t, full)})
+		}
+	}
+	r.instrument()
+
+	var out []renderedManifest
+	for _, j := range jobs {
+		var w budgetWriter
+		w.r = r
+		r.libOut = nil
+		if err := r.tmpl.ExecuteTemplate(&w, j.name, j.data); err != nil {
+			if stop := r.stopErr(); stop != nil {
+				return nil, stop
+			}
+			if !r.opts.KeepGoing {
+				return nil, err
+			}
+			errs = append(errs, err)
+			continue
+		}
+		data := strings.ReplaceAll(w.buf.String(), "<no value>", "")
+		if strings.TrimSpace(data) == "" {
+			continue
+		}
+		out = append(out, renderedManifest{Template: j.name, Data: []byte(data), Libraries: r.libOut})
+	}
+	return out, errors.Join(errs...)
+}
+
+// topLevel builds the "." passed to a template file.
+func (r *renderer) topLevel(t *valuesTree, name string) map[string]interface{} {
+	m := t.chart.meta
+	files := chartFilesObject{}
+	for rel, data := range t.chart.files {
+		if !strings.HasPrefix(rel, "templates/") {
+			files[rel] = data
+		}
+	}
+	major, minor := "1", "29"
+	if v, err := parseSemver(r.opts.KubeVersion); err == nil {
+		major, minor = fmt.Sprint(v.major), fmt.Sprint(v.minor)
+	}
+	annotations := make(map[string]interface{}, len(m.Annotations))
+	for k, v := range m.Annotations {
+		annotations[k] = v
+	}
+	return map[string]interface{}{
+		"Values": t.values,
+		"Release": map[string]interface{}{
+			"Name":      r.opts.ReleaseName,
+			"Namespace": r.opts.Namespace,
+			"Service":   "Helm",
+			"IsInstall": true,
+			"IsUpgrade": false,
+			"Revision":  1,
+		},
+		"Chart": map[string]interface{}{
+			"Name":        t.name,
+			"Version":     m.Version,
+			"AppVersion":  m.AppVersion,
+			"Description": m.Description,
+			"Type":        m.Type,
+			"KubeVersion": m.KubeVersion,
+			"APIVersion":  m.APIVersion,
+			"Home":        m.Home,
+			"Icon":        m.Icon,
+			"Annotations": annotations,
+		},
+		"Capabilities": map[string]interface{}{
+			"KubeVersion": map[string]interface{}{
+				"Version":    r.opts.KubeVersion,
+				"GitVersion": r.opts.KubeVersion,
+				"Major":      major,
+				"Minor":      minor,
+			},
+			"APIVersions": r.apis,
+			"HelmVersion": map[string]interface{}{"Version": "v3.14.0"},
+		},
+		"Template": map[string]interface{}{
+			"Name":     name,
+			"BasePath": t.chart.dir + "/templates",
+		},
+		"Files": files,
+	}
+}
+
+// check aborts the render once it has been stopped or run out of time.
+func (r *renderer) check() error {
+	if err := r.stopErr(); err != nil {
+		return err
+	}
+	if time.Now().After(r.deadline) {
+		r.stop(errRenderTimeout)
+		return errRenderTimeout
+	}
+	return nil
+}
+
+func (r *renderer) stop(err error) { r.stopped.CompareAndSwap(nil, err) }
+
+func (r *renderer) stopErr() error {
+	err, _ := r.stopped.Load().(error)
+	return err
+}
+
+// sandboxTick is called at the start of every template and every range
+// iteration so that loops which neither write output nor call functions
+// still notice when the render has to stop.
+func (r *renderer) sandboxTick() (string, error) {
+	return "", r.check()
+}
+
+// instrument inserts a sandboxTick action into every template body and
+// range body parsed so far.
+func (r *renderer) instrument() {
+	for _, t := range r.tmpl.Templates() {
+		if t.Tree == nil || t.Tree.Root == nil || r.ticked[t.Tree] {
+			continue
+		}
+		r.ticked[t.Tree] = true
+		r.instrumentList(t.Tree.Root)
+		t.Tree.Root.Nodes = append([]parse.Node{r.tick}, t.Tree.Root.Nodes...)
+	}
+}
+
+func (r *renderer) instrumentList(l *parse.ListNode) {
+	if l == nil {
+		return
+	}
+	for _, n := range l.Nodes {
+		switch n := n.(type) {
+		case *parse.RangeNode:
+			r.instrumentList(n.List)
+			r.instrumentList(n.ElseList)
+			n.List.Nodes = append([]parse.Node{r.tick}, n.List.Nodes...)
+		case *parse.IfNode:
+			r.instrumentList(n.List)
+			r.instrumentList(n.ElseList)
+		case *parse.WithNode:
+			r.instrumentList(n.List)
+			r.instrumentList(n.ElseList)
+		case *parse.ListNode:
+			r.instrumentList(n)
+		}
+	}
+}
+
+// budgetWriter collects template output, charging it against the
+// render's output budget and failing once the render should stop.
+type budgetWriter struct {
+	r   *renderer
+	buf strings.Builder
+}
+
+func (w *budgetWriter) Write(p []byte) (int, error) {
+	if err := w.r.check(); err != nil {
+		return 0, err
+	}
+	if !w.r.charge(len(p)) {
+		return 0, errRenderOutputLimit
+	}
+	return w.buf.Write(p)
+}
+
+// charge takes n bytes from the output budget, stopping the render when
+// they are not left.
+func (r *renderer) charge(n int) bool {
+	if int64(n) > r.remaining {
+		r.stop(errRenderOutputLimit)
+		return false
+	}
+	r.remaining -= int64(n)
+	return true
+}
+
+// uncharged are the functions whose results are not charged: include and
+// tpl, which charge what they write, and those returning their argument
+// or a part of it, which would be charged again on every call.
+var uncharged = map[string]bool{
+	"include": true, "tpl": true,
+	"set": true, "unset": true,
+	"merge": true, "mustMerge": true, "mergeOverwrite": true, "mustMergeOverwrite": true,
+	"slice": true, "rest": true, "initial": true,
+}
+
+// listEntryBytes is what an entry of a list or map built by a function is
+// charged, whatever it holds.
+const listEntryBytes = 16
+
+// chargeResults wraps the functions of f returning strings, lists or maps
+// so that their results are charged to the output budget like written
+// bytes. Values held in variables never reach a writer, so without this
+// a loop doubling one, such as {{ $s = print $s $s }}, would grow it until
+// memory ran out. include and tpl charge their output as they write it.
+func (r *renderer) chargeResults(f template.FuncMap) {
+	for name, fn := range f {
+		v := reflect.ValueOf(fn)
+		t := v.Type()
+		if uncharged[name] || t.NumOut() == 0 {
+			continue
+		}
+		switch t.Out(0).Kind() {
+		case reflect.String, reflect.Slice, reflect.Map:
+		default:
+			continue
+		}
+		f[name] = reflect.MakeFunc(t, func(args []reflect.Value) []reflect.Value {
+			var out []reflect.Value
+			if t.IsVariadic() {
+				out = v.CallSlice(args)
+			} else {
+				out = v.Call(args)
+			}
+			if !r.charge(resultBytes(out[0])) {
+				// The next check ends the render; drop the value now.
+				out[0] = reflect.Zero(t.Out(0))
+			}
+			return out
+		}).Interface()
+	}
+}
+
+// resultBytes is the charge for a function result: the length of a
+// string, and listEntryBytes per entry of a list or map plus the strings
+// of a []string.
+func resultBytes(v reflect.Value) int {
+	switch v.Kind() {
+	case reflect.String:
+		return v.Len()
+	case reflect.Slice, reflect.Map:
+		n := v.Len() * listEntryBytes
+		if l, ok := v.Interface().([]string); ok {
+			for _, s := range l {
+				n += len(s)
+			}
+		}
+		return n
+	}
+	return 0
+}
+
+// include executes a named template and returns its output.
+func (r *renderer) include(name string, data interface{}) (string, error) {
+	if err := r.enter(); err != nil {
+		return "", err
+	}
+	defer func() { r.depth-- }()
+	w := budgetWriter{r: r}
+	if err := r.tmpl.ExecuteTemplate(&w, name, data); err != nil {
+		return "", err
+	}
+	out := strings.ReplaceAll(w.buf.String(), "<no value>", "")
+	if t := r.tmpl.Lookup(name); t != nil && t.Tree != nil && len(r.libraries) > 0 {
+		if lib := definedIn(r.libraries, t.Tree.ParseName); lib != "" {
+			r.libOut = append(r.libOut, libraryOutput{helper: lib + "/" + name, out: out})
+		}
+	}
+	return out, nil
+}
+
+// tpl renders a string as a template. Each distinct string is parsed once
+// into the shared namespace so repeated calls stay cheap.
+func (r *renderer) tpl(text string, data interface{}) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	name, ok := r.tplCache[text]
+	if !ok {
+		name = fmt.Sprintf("tpl-%d", len(r.tplCache))
+		if _, err := r.tmpl.New(name).Parse(text); err != nil {
+			return "", err
+		}
+		r.instrument()
+		r.tplCache[text] = name
+	}
+	return r.include(name, data)
+}
+
+func (r *renderer) enter() error {
+	if err := r.check(); err != nil {
+		return err
+	}
+	if r.depth >= r.opts.MaxDepth {
+		return errRenderDepth
+	}
+	r.depth++
+	return nil
+}
+
+// apiVersionSet is .Capabilities.APIVersions.
+type apiVersionSet []string
+
+// Has reports whether a group/version, or a group/version/kind of one, is
+// available.
+func (s apiVersionSet) Has(v string) bool {
+	for _, a := range s {
+		if a == v || strings.HasPrefix(v, a+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+var defaultAPIVersions = apiVersionSet{
+	"v1",
+	"admissionregistration.k8s.io/v1",
+	"apiextensions.k8s.io/v1",
+	"apps/v1",
+	"authentication.k8s.io/v1",
+	"authorization.k8s.io/v1",
+	"autoscaling/v1",
+	"autoscaling/v2",
+	"batch/v1",
+	"certificates.k8s.io/v1",
+	"coordination.k8s.io/v1",
+	"discovery.k8s.io/v1",
+	"events.k8s.io/v1",
+	"flowcontrol.apiserver.k8s.io/v1beta3",
+	"networking.k8s.io/v1",
+	"node.k8s.io/v1",
+	"policy/v1",
+	"rbac.authorization.k8s.io/v1",
+	"scheduling.k8s.io/v1",
+	"storage.k8s.io/v1",
+}
+
+// chartFilesObject is .Files: the chart's non-template files.
+type chartFilesObject map[string][]byte
+
+func (f chartFilesObject) Get(name string) string      { return string(f[name]) }
+func (f chartFilesObject) GetBytes(name string) []byte { return f[name] }
+
+func (f chartFilesObject) Lines(name string) []string {
+	s := strings.TrimSuffix(string(f[name]), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+func (f chartFilesObject) Glob(pattern string) chartFilesObject {
+	out := chartFilesObject{}
+	for name, data := range f {
+		if ok, _ := path.Match(pattern, name); ok {
+			out[name] = data
+		}
+	}
+	return out
+}
+
+func (f chartFilesObject) AsConfig() string {
+	m := make(map[string]interface{}, len(f))
+	for name, data := range f {
+		m[path.Base(name)] = string(data)
+	}
+	return toYAML(m)
+}
+
+func (f chartFilesObject) AsSecrets() string {
+	m := make(map[string]interface{}, len(f))
+	for name, data := range f {
+		m[path.Base(name)] = base64Encode(data)
+	}
+	return toYAML(m)
+}
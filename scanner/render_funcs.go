@@ -0,0 +1,926 @@
+package scanner
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	yamlv2 "gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// maxListLen caps lists built by until/untilStep/repeat so a template
+// cannot allocate without bound before the time limit catches it.
+const maxListLen = 100000
+
+// funcMap returns the functions available to chart templates. Names and
+// argument orders follow sprig so existing charts work unchanged. Functions
+// whose real behaviour would be non-deterministic, reach outside the
+// sandbox, or only matter at install time (random strings, certificates,
+// passwords) return inert placeholders.
+func (r *renderer) funcMap() template.FuncMap {
+	f := template.FuncMap{
+		"sandboxTick": r.sandboxTick,
+
+		// Helm
+		"include":  r.include,
+		"tpl":      r.tpl,
+		"required": required,
+		"fail":     func(msg string) (string, error) { return "", errors.New(msg) },
+		"lookup": func(...interface{}) map[string]interface{} {
+			return map[string]interface{}{}
+		},
+		"toYaml":        toYAML,
+		"mustToYaml":    toYAML,
+		"fromYaml":      fromYAML,
+		"fromYamlArray": fromYAMLArray,
+		"toJson":        toJSON,
+		"mustToJson":    toJSON,
+		"toPrettyJson":  toPrettyJSON,
+		"toRawJson":     toJSON,
+		"fromJson":      fromJSON,
+		"fromJsonArray": fromJSONArray,
+		"toToml":        func(interface{}) (string, error) { return "", errors.New("toToml is not supported") },
+
+		// Defaults and flow
+		"default":  dfault,
+		"empty":    empty,
+		"coalesce": coalesce,
+		"ternary": func(a, b interface{}, cond bool) interface{} {
+			if cond {
+				return a
+			}
+			return b
+		},
+		"all": func(v ...interface{}) bool {
+			for _, x := range v {
+				if empty(x) {
+					return false
+				}
+			}
+			return true
+		},
+		"any": func(v ...interface{}) bool {
+			for _, x := range v {
+				if !empty(x) {
+					return true
+				}
+			}
+			return false
+		},
+
+		// Strings. print, printf and println replace the builtins so that
+		// their results are charged like those of the other functions.
+		"print":      fmt.Sprint,
+		"printf":     fmt.Sprintf,
+		"println":    fmt.Sprintln,
+		"quote":      func(v ...interface{}) string { return joinQuoted(v, `"`) },
+		"squote":     func(v ...interface{}) string { return joinQuoted(v, "'") },
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"title":      strings.Title,
+		"untitle":    func(s string) string { return lowerFirst(s) },
+		"trim":       strings.TrimSpace,
+		"trimAll":    func(cut, s string) string { return strings.Trim(s, cut) },
+		"trimPrefix": func(p, s string) string { return strings.TrimPrefix(s, p) },
+		"trimSuffix": func(p, s string) string { return strings.TrimSuffix(s, p) },
+		"contains":   func(sub, s string) bool { return strings.Contains(s, sub) },
+		"hasPrefix":  func(p, s string) bool { return strings.HasPrefix(s, p) },
+		"hasSuffix":  func(p, s string) bool { return strings.HasSuffix(s, p) },
+		"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"repeat": func(n int, s string) string {
+			// Compare by division, as n*len(s) can overflow.
+			if n < 0 || len(s) > 0 && n > maxListLen*16/len(s) {
+				return ""
+			}
+			return strings.Repeat(s, n)
+		},
+		"indent":  indent,
+		"nindent": func(n int, s string) string { return "\n" + indent(n, s) },
+		"trunc":   trunc,
+		"substr": func(start, end int, s string) string {
+			if start < 0 {
+				start = 0
+			}
+			if end < 0 || end > len(s) {
+				end = len(s)
+			}
+			if start > end {
+				return ""
+			}
+			return s[start:end]
+		},
+		"nospace":   func(s string) string { return strings.Map(dropSpace, s) },
+		"cat":       func(v ...interface{}) string { return strings.TrimSpace(fmt.Sprintln(v...)) },
+		"wrap":      func(n int, s string) string { return wrapWords(n, "\n", s, false) },
+		"wrapWith":  func(n int, sep, s string) string { return wrapWords(n, sep, s, true) },
+		"abbrev":    func(n int, s string) string { return trunc(n, s) },
+		"plural":    func(one, many string, n int) string { return map[bool]string{true: one, false: many}[n == 1] },
+		"snakecase": func(s string) string { return caseWords(s, "_") },
+		"kebabcase": func(s string) string { return caseWords(s, "-") },
+		"camelcase": camelCase,
+		"toString":  toString,
+		"toStrings": func(v interface{}) []string {
+			var out []string
+			for _, e := range toList(v) {
+				out = append(out, toString(e))
+			}
+			return out
+		},
+		"join": func(sep string, v interface{}) string {
+			var out []string
+			for _, e := range toList(v) {
+				out = append(out, toString(e))
+			}
+			return strings.Join(out, sep)
+		},
+		"split": func(sep, s string) map[string]string {
+			m := map[string]string{}
+			for i, p := range strings.Split(s, sep) {
+				m["_"+strconv.Itoa(i)] = p
+			}
+			return m
+		},
+		"splitList": func(sep, s string) []string { return strings.Split(s, sep) },
+		"splitn": func(sep string, n int, s string) map[string]string {
+			m := map[string]string{}
+			for i, p := range strings.SplitN(s, sep, n) {
+				m["_"+strconv.Itoa(i)] = p
+			}
+			return m
+		},
+		"regexMatch":          regexMatch,
+		"mustRegexMatch":      regexMatch,
+		"regexFind":           regexFind,
+		"regexFindAll":        regexFindAll,
+		"regexReplaceAll":     regexReplaceAll,
+		"mustRegexReplaceAll": regexReplaceAll,
+		"regexReplaceAllLiteral": func(re, s, repl string) (string, error) {
+			rx, err := regexp.Compile(re)
+			if err != nil {
+				return "", err
+			}
+			return rx.ReplaceAllLiteralString(s, repl), nil
+		},
+		"regexSplit": func(re, s string, n int) ([]string, error) {
+			rx, err := regexp.Compile(re)
+			if err != nil {
+				return nil, err
+			}
+			return rx.Split(s, n), nil
+		},
+
+		// Encoding
+		"b64enc":     func(s string) string { return base64Encode([]byte(s)) },
+		"b64dec":     func(s string) string { b, _ := base64.StdEncoding.DecodeString(s); return string(b) },
+		"b32enc":     func(s string) string { return base32.StdEncoding.EncodeToString([]byte(s)) },
+		"sha256sum":  func(s string) string { h := sha256.Sum256([]byte(s)); return hex.EncodeToString(h[:]) },
+		"sha1sum":    func(s string) string { h := sha1.Sum([]byte(s)); return hex.EncodeToString(h[:]) },
+		"adler32sum": func(s string) string { return strconv.FormatUint(uint64(adler32.Checksum([]byte(s))), 10) },
+
+		// Numbers
+		"int":     func(v interface{}) int { return int(toInt64(v)) },
+		"int64":   toInt64,
+		"float64": toFloat64,
+		"atoi":    func(s string) int { n, _ := strconv.Atoi(s); return n },
+		"add1":    func(v interface{}) int64 { return toInt64(v) + 1 },
+		"add": func(v ...interface{}) int64 {
+			var n int64
+			for _, x := range v {
+				n += toInt64(x)
+			}
+			return n
+		},
+		"sub": func(a, b interface{}) int64 { return toInt64(a) - toInt64(b) },
+		"mul": func(a interface{}, v ...interface{}) int64 {
+			n := toInt64(a)
+			for _, x := range v {
+				n *= toInt64(x)
+			}
+			return n
+		},
+		"div": func(a, b interface{}) (int64, error) {
+			if toInt64(b) == 0 {
+				return 0, errors.New("division by zero")
+			}
+			return toInt64(a) / toInt64(b), nil
+		},
+		"mod": func(a, b interface{}) (int64, error) {
+			if toInt64(b) == 0 {
+				return 0, errors.New("division by zero")
+			}
+			return toInt64(a) % toInt64(b), nil
+		},
+		"max": func(a interface{}, v ...interface{}) int64 {
+			n := toInt64(a)
+			for _, x := range v {
+				if m := toInt64(x); m > n {
+					n = m
+				}
+			}
+			return n
+		},
+		"min": func(a interface{}, v ...interface{}) int64 {
+			n := toInt64(a)
+			for _, x := range v {
+				if m := toInt64(x); m < n {
+					n = m
+				}
+			}
+			return n
+		},
+		"floor": func(v interface{}) float64 { return math.Floor(toFloat64(v)) },
+		"ceil":  func(v interface{}) float64 { return math.Ceil(toFloat64(v)) },
+		"round": func(v interface{}, p int) float64 {
+			m := math.Pow(10, float64(p))
+			return math.Round(toFloat64(v)*m) / m
+		},
+		"addf":      func(a, b interface{}) float64 { return toFloat64(a) + toFloat64(b) },
+		"subf":      func(a, b interface{}) float64 { return toFloat64(a) - toFloat64(b) },
+		"mulf":      func(a, b interface{}) float64 { return toFloat64(a) * toFloat64(b) },
+		"divf":      func(a, b interface{}) float64 { return toFloat64(a) / toFloat64(b) },
+		"until":     func(n int) ([]int, error) { return untilStep(0, n, 1) },
+		"untilStep": untilStep,
+
+		// Lists
+		"list":    func(v ...interface{}) []interface{} { return v },
+		"tuple":   func(v ...interface{}) []interface{} { return v },
+		"first":   func(v interface{}) interface{} { l := toList(v); return at(l, 0) },
+		"last":    func(v interface{}) interface{} { l := toList(v); return at(l, len(l)-1) },
+		"rest":    func(v interface{}) []interface{} { l := toList(v); return sliceFrom(l, 1) },
+		"initial": func(v interface{}) []interface{} { l := toList(v); return sliceTo(l, len(l)-1) },
+		"append":  func(v interface{}, e interface{}) []interface{} { return append(cloneList(toList(v)), e) },
+		"mustAppend": func(v interface{}, e interface{}) ([]interface{}, error) {
+			return append(cloneList(toList(v)), e), nil
+		},
+		"prepend": func(v interface{}, e interface{}) []interface{} {
+			return append([]interface{}{e}, toList(v)...)
+		},
+		"concat": func(v ...interface{}) []interface{} {
+			var out []interface{}
+			for _, l := range v {
+				out = append(out, toList(l)...)
+			}
+			return out
+		},
+		"uniq": func(v interface{}) []interface{} {
+			var out []interface{}
+			for _, e := range toList(v) {
+				if !inList(out, e) {
+					out = append(out, e)
+				}
+			}
+			return out
+		},
+		"has":     func(e interface{}, v interface{}) bool { return inList(toList(v), e) },
+		"without": without,
+		"compact": func(v interface{}) []interface{} {
+			var out []interface{}
+			for _, e := range toList(v) {
+				if !empty(e) {
+					out = append(out, e)
+				}
+			}
+			return out
+		},
+		"reverse": func(v interface{}) []interface{} {
+			l := toList(v)
+			out := make([]interface{}, len(l))
+			for i, e := range l {
+				out[len(l)-1-i] = e
+			}
+			return out
+		},
+		"sortAlpha": func(v interface{}) []string {
+			var out []string
+			for _, e := range toList(v) {
+				out = append(out, toString(e))
+			}
+			sort.Strings(out)
+			return out
+		},
+		"slice": func(v interface{}, idx ...int) []interface{} {
+			l := toList(v)
+			start, end := 0, len(l)
+			if len(idx) > 0 {
+				start = idx[0]
+			}
+			if len(idx) > 1 {
+				end = idx[1]
+			}
+			if start < 0 || end > len(l) || start > end {
+				return nil
+			}
+			return l[start:end]
+		},
+
+		// Dictionaries
+		"dict": func(v ...interface{}) map[string]interface{} {
+			m := map[string]interface{}{}
+			for i := 0; i+1 < len(v); i += 2 {
+				m[toString(v[i])] = v[i+1]
+			}
+			return m
+		},
+		"set": func(m map[string]interface{}, k string, v interface{}) map[string]interface{} {
+			m[k] = v
+			return m
+		},
+		"unset": func(m map[string]interface{}, k string) map[string]interface{} {
+			delete(m, k)
+			return m
+		},
+		"hasKey": func(m map[string]interface{}, k string) bool { _, ok := m[k]; return ok },
+		"get": func(m map[string]interface{}, k string) interface{} {
+			if v, ok := m[k]; ok {
+				return v
+			}
+			return ""
+		},
+		"keys": func(ms ...map[string]interface{}) []string {
+			var out []string
+			for _, m := range ms {
+				for k := range m {
+					out = append(out, k)
+				}
+			}
+			return out
+		},
+		"values": func(m map[string]interface{}) []interface{} {
+			var out []interface{}
+			for _, v := range m {
+				out = append(out, v)
+			}
+			return out
+		},
+		"pluck": func(k string, ms ...map[string]interface{}) []interface{} {
+			var out []interface{}
+			for _, m := range ms {
+				if v, ok := m[k]; ok {
+					out = append(out, v)
+				}
+			}
+			return out
+		},
+		"pick": func(m map[string]interface{}, ks ...string) map[string]interface{} {
+			out := map[string]interface{}{}
+			for _, k := range ks {
+				if v, ok := m[k]; ok {
+					out[k] = v
+				}
+			}
+			return out
+		},
+		"omit": func(m map[string]interface{}, ks ...string) map[string]interface{} {
+			out := map[string]interface{}{}
+			for k, v := range m {
+				out[k] = v
+			}
+			for _, k := range ks {
+				delete(out, k)
+			}
+			return out
+		},
+		"dig": dig,
+		"merge": func(dst map[string]interface{}, srcs ...map[string]interface{}) map[string]interface{} {
+			return mergeMaps(dst, srcs, false)
+		},
+		"mustMerge": func(dst map[string]interface{}, srcs ...map[string]interface{}) (map[string]interface{}, error) {
+			return mergeMaps(dst, srcs, false), nil
+		},
+		"mergeOverwrite": func(dst map[string]interface{}, srcs ...map[string]interface{}) map[string]interface{} {
+			return mergeMaps(dst, srcs, true)
+		},
+		"mustMergeOverwrite": func(dst map[string]interface{}, srcs ...map[string]interface{}) (map[string]interface{}, error) {
+			return mergeMaps(dst, srcs, true), nil
+		},
+		"deepCopy":     deepCopyValue,
+		"mustDeepCopy": func(v interface{}) (interface{}, error) { return deepCopyValue(v), nil },
+
+		// Types
+		"kindOf":    func(v interface{}) string { return kindOf(v) },
+		"kindIs":    func(k string, v interface{}) bool { return kindOf(v) == k },
+		"typeOf":    func(v interface{}) string { return fmt.Sprintf("%T", v) },
+		"typeIs":    func(t string, v interface{}) bool { return fmt.Sprintf("%T", v) == t },
+		"deepEqual": func(a, b interface{}) bool { return reflect.DeepEqual(a, b) },
+
+		// Versions
+		"semverCompare": semverCompare,
+		"semver": func(s string) (map[string]interface{}, error) {
+			v, err := parseSemver(s)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"Major": v.major, "Minor": v.minor, "Patch": v.patch, "Prerelease": v.pre}, nil
+		},
+
+		// Time. Scans should be reproducible, so "now" is fixed per render.
+		"now":        func() time.Time { return r.deadline.Add(-r.opts.Timeout) },
+		"date":       func(layout string, t interface{}) string { return toTime(t).Format(layout) },
+		"dateInZone": func(layout string, t interface{}, _ string) string { return toTime(t).UTC().Format(layout) },
+		"htmlDate":   func(t interface{}) string { return toTime(t).Format("2006-01-02") },
+		"unixEpoch":  func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) },
+		"toDate": func(layout, s string) time.Time {
+			t, _ := time.Parse(layout, s)
+			return t
+		},
+		"ago": func(interface{}) string { return "0s" },
+
+		// Sandboxed: no environment, network, randomness or key material.
+		"env":             func(string) string { return "" },
+		"expandenv":       func(s string) string { return s },
+		"getHostByName":   func(string) string { return "" },
+		"randAlphaNum":    placeholderString,
+		"randAlpha":       placeholderString,
+		"randNumeric":     func(n int) string { return strings.Repeat("0", clampLen(n)) },
+		"randAscii":       placeholderString,
+		"randInt":         func(min, _ int) int { return min },
+		"uuidv4":          func() string { return "00000000-0000-4000-8000-000000000000" },
+		"derivePassword":  func(...interface{}) string { return "" },
+		"htpasswd":        func(...interface{}) string { return "" },
+		"encryptAES":      func(...interface{}) string { return "" },
+		"decryptAES":      func(...interface{}) string { return "" },
+		"genPrivateKey":   func(string) string { return "" },
+		"buildCustomCert": func(...interface{}) map[string]interface{} { return placeholderCert() },
+		"genCA":           func(...interface{}) map[string]interface{} { return placeholderCert() },
+		"genCAWithKey":    func(...interface{}) map[string]interface{} { return placeholderCert() },
+		"genSelfSignedCert": func(...interface{}) map[string]interface{} {
+			return placeholderCert()
+		},
+		"genSelfSignedCertWithKey": func(...interface{}) map[string]interface{} { return placeholderCert() },
+		"genSignedCert":            func(...interface{}) map[string]interface{} { return placeholderCert() },
+		"genSignedCertWithKey":     func(...interface{}) map[string]interface{} { return placeholderCert() },
+	}
+	return f
+}
+
+func required(msg string, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, errors.New(msg)
+	}
+	if s, ok := v.(string); ok && s == "" {
+		return nil, errors.New(msg)
+	}
+	return v, nil
+}
+
+// toYAML encodes v the way Helm's toYaml does, with the YAML library that
+// leaves sequences under a key unindented.
+func toYAML(v interface{}) string {
+	data, err := yamlv2.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(string(data), "\n")
+}
+
+func fromYAML(s string) map[string]interface{} {
+	m := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(s), &m); err != nil {
+		return map[string]interface{}{"Error": err.Error()}
+	}
+	return m
+}
+
+func fromYAMLArray(s string) []interface{} {
+	var l []interface{}
+	if err := yaml.Unmarshal([]byte(s), &l); err != nil {
+		return []interface{}{err.Error()}
+	}
+	return l
+}
+
+func toJSON(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func toPrettyJSON(v interface{}) string {
+	b, _ := json.MarshalIndent(v, "", "  ")
+	return string(b)
+}
+
+func fromJSON(s string) map[string]interface{} {
+	m := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(s), &m); err != nil {
+		return map[string]interface{}{"Error": err.Error()}
+	}
+	return m
+}
+
+func fromJSONArray(s string) []interface{} {
+	var l []interface{}
+	if err := json.Unmarshal([]byte(s), &l); err != nil {
+		return []interface{}{err.Error()}
+	}
+	return l
+}
+
+func base64Encode(b []byte) string { return base64.StdEncoding.EncodeToString(b) }
+
+func dfault(d interface{}, given ...interface{}) interface{} {
+	if len(given) == 0 || empty(given[0]) {
+		return d
+	}
+	return given[0]
+}
+
+// empty follows sprig: nil, zero numbers, false, and empty strings,
+// lists and maps are empty.
+func empty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return rv.Len() == 0
+	case reflect.Bool:
+		return !rv.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return rv.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return rv.Float() == 0
+	case reflect.Ptr, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+func coalesce(v ...interface{}) interface{} {
+	for _, x := range v {
+		if !empty(x) {
+			return x
+		}
+	}
+	return nil
+}
+
+func joinQuoted(v []interface{}, q string) string {
+	out := make([]string, 0, len(v))
+	for _, x := range v {
+		if x == nil {
+			continue
+		}
+		s := toString(x)
+		if q == `"` {
+			out = append(out, strconv.Quote(s))
+		} else {
+			out = append(out, q+s+q)
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+func toString(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	case error:
+		return x.Error()
+	case fmt.Stringer:
+		return x.String()
+	}
+	return fmt.Sprint(v)
+}
+
+// wrapWords breaks s into lines of at most n bytes at spaces, as sprig's
+// wrap and wrapWith do; words longer than n are split only with
+// longWords.
+func wrapWords(n int, sep, s string, longWords bool) string {
+	if n < 1 {
+		n = 1
+	}
+	var b strings.Builder
+	offset := 0
+	for len(s)-offset > n {
+		if s[offset] == ' ' {
+			offset++
+			continue
+		}
+		if at := strings.LastIndexByte(s[offset:offset+n+1], ' '); at >= 0 {
+			b.WriteString(s[offset : offset+at])
+			b.WriteString(sep)
+			offset += at + 1
+			continue
+		}
+		if longWords {
+			b.WriteString(s[offset : offset+n])
+			b.WriteString(sep)
+			offset += n
+			continue
+		}
+		// Leave a long word whole, up to the next space.
+		at := strings.IndexByte(s[offset+n:], ' ')
+		if at < 0 {
+			break
+		}
+		b.WriteString(s[offset : offset+n+at])
+		b.WriteString(sep)
+		offset += n + at + 1
+	}
+	b.WriteString(s[offset:])
+	return b.String()
+}
+
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+func trunc(n int, s string) string {
+	if n < 0 {
+		if -n >= len(s) {
+			return s
+		}
+		return s[len(s)+n:]
+	}
+	if n >= len(s) {
+		return s
+	}
+	return s[:n]
+}
+
+func dropSpace(r rune) rune {
+	if unicode.IsSpace(r) {
+		return -1
+	}
+	return r
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+func caseWords(s, sep string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteString(sep)
+		}
+		if r == '-' || r == '_' || r == ' ' {
+			b.WriteString(sep)
+			continue
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+func camelCase(s string) string {
+	parts := strings.FieldsFunc(s, func(r rune) bool { return r == '-' || r == '_' || r == ' ' })
+	for i, p := range parts {
+		parts[i] = strings.ToUpper(p[:1]) + p[1:]
+	}
+	return strings.Join(parts, "")
+}
+
+func regexMatch(re, s string) (bool, error) { return regexp.MatchString(re, s) }
+
+func regexFind(re, s string) (string, error) {
+	rx, err := regexp.Compile(re)
+	if err != nil {
+		return "", err
+	}
+	return rx.FindString(s), nil
+}
+
+func regexFindAll(re, s string, n int) ([]string, error) {
+	rx, err := regexp.Compile(re)
+	if err != nil {
+		return nil, err
+	}
+	return rx.FindAllString(s, n), nil
+}
+
+func regexReplaceAll(re, s, repl string) (string, error) {
+	rx, err := regexp.Compile(re)
+	if err != nil {
+		return "", err
+	}
+	return rx.ReplaceAllString(s, repl), nil
+}
+
+func toInt64(v interface{}) int64 {
+	switch x := v.(type) {
+	case int:
+		return int64(x)
+	case int64:
+		return x
+	case int32:
+		return int64(x)
+	case uint64:
+		return int64(x)
+	case float64:
+		return int64(x)
+	case float32:
+		return int64(x)
+	case bool:
+		if x {
+			return 1
+		}
+		return 0
+	case string:
+		n, err := strconv.ParseInt(strings.TrimSpace(x), 10, 64)
+		if err != nil {
+			f, _ := strconv.ParseFloat(strings.TrimSpace(x), 64)
+			return int64(f)
+		}
+		return n
+	}
+	return 0
+}
+
+func toFloat64(v interface{}) float64 {
+	switch x := v.(type) {
+	case float64:
+		return x
+	case string:
+		f, _ := strconv.ParseFloat(strings.TrimSpace(x), 64)
+		return f
+	}
+	return float64(toInt64(v))
+}
+
+func untilStep(start, stop, step int) ([]int, error) {
+	if step == 0 {
+		return nil, nil
+	}
+	if n := (stop - start) / step; n > maxListLen {
+		return nil, fmt.Errorf("list of %d elements exceeds the limit of %d", n, maxListLen)
+	}
+	var out []int
+	if step > 0 {
+		for i := start; i < stop; i += step {
+			out = append(out, i)
+		}
+	} else {
+		for i := start; i > stop; i += step {
+			out = append(out, i)
+		}
+	}
+	return out, nil
+}
+
+func toList(v interface{}) []interface{} {
+	if v == nil {
+		return nil
+	}
+	if l, ok := v.([]interface{}); ok {
+		return l
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil
+	}
+	out := make([]interface{}, rv.Len())
+	for i := range out {
+		out[i] = rv.Index(i).Interface()
+	}
+	return out
+}
+
+func at(l []interface{}, i int) interface{} {
+	if i < 0 || i >= len(l) {
+		return nil
+	}
+	return l[i]
+}
+
+func sliceFrom(l []interface{}, i int) []interface{} {
+	if i > len(l) {
+		return nil
+	}
+	return l[i:]
+}
+
+func sliceTo(l []interface{}, i int) []interface{} {
+	if i < 0 {
+		return nil
+	}
+	return l[:i]
+}
+
+func cloneList(l []interface{}) []interface{} {
+	return append(make([]interface{}, 0, len(l)+1), l...)
+}
+
+func inList(l []interface{}, e interface{}) bool {
+	for _, x := range l {
+		if reflect.DeepEqual(x, e) {
+			return true
+		}
+	}
+	return false
+}
+
+func without(v interface{}, drop ...interface{}) []interface{} {
+	var out []interface{}
+	for _, e := range toList(v) {
+		if !inList(drop, e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// dig walks nested maps: dig "a" "b" "default" $dict.
+func dig(args ...interface{}) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, errors.New("dig needs at least three arguments")
+	}
+	m, ok := args[len(args)-1].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("dig: last argument must be a map")
+	}
+	def := args[len(args)-2]
+	var cur interface{} = m
+	for _, k := range args[:len(args)-2] {
+		cm, ok := cur.(map[string]interface{})
+		if !ok {
+			return def, nil
+		}
+		if cur, ok = cm[toString(k)]; !ok {
+			return def, nil
+		}
+	}
+	return cur, nil
+}
+
+// mergeMaps merges srcs into dst left to right. Without overwrite, keys
+// already in dst win, as in sprig's merge.
+func mergeMaps(dst map[string]interface{}, srcs []map[string]interface{}, overwrite bool) map[string]interface{} {
+	for _, src := range srcs {
+		for k, v := range src {
+			dv, exists := dst[k]
+			dm, dok := dv.(map[string]interface{})
+			sm, sok := v.(map[string]interface{})
+			switch {
+			case dok && sok:
+				dst[k] = mergeMaps(dm, []map[string]interface{}{sm}, overwrite)
+			case !exists || (overwrite && v != nil):
+				dst[k] = v
+			}
+		}
+	}
+	return dst
+}
+
+func kindOf(v interface{}) string {
+	if v == nil {
+		return "invalid"
+	}
+	return reflect.ValueOf(v).Kind().String()
+}
+
+func toTime(v interface{}) time.Time {
+	switch x := v.(type) {
+	case time.Time:
+		return x
+	case int64:
+		return time.Unix(x, 0)
+	case int:
+		return time.Unix(int64(x), 0)
+	}
+	return time.Time{}
+}
+
+func clampLen(n int) int {
+	if n < 0 {
+		return 0
+	}
+	if n > 4096 {
+		return 4096
+	}
+	return n
+}
+
+func placeholderString(n int) string { return strings.Repeat("x", clampLen(n)) }
+
+func placeholderCert() map[string]interface{} {
+	return map[string]interface{}{"Cert": "", "Key": ""}
+}
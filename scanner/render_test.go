@@ -0,0 +1,186 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The golden files under testdata/render were rendered by Helm v3.14.4
+// from the charts next to them, as release "release" in namespace
+// "default" against Kubernetes v1.29.0. Each holds the non-empty YAML
+// templates, ordered by name, each after a "# Source:" line. The
+// subcharts of subchart sit in directories named after the charts, as
+// helm package lays them out, since template names follow directories.
+var goldenRenders = []struct {
+	name, chart, values string
+}{
+	{"external-dns", "external-dns", ""},
+	{"external-dns-ci", "external-dns", "ci/ci-values.yaml"},
+	{"metrics-server", "metrics-server", ""},
+	{"metrics-server-ci", "metrics-server", "ci/ci-values.yaml"},
+	{"subchart", "subchart", ""},
+	{"subchart-extra", "subchart", "extra_values.yaml"},
+	{"starter", "starter", ""},
+}
+
+func TestRenderMatchesHelm(t *testing.T) {
+	root := filepath.Join("testdata", "render")
+	all, err := readRepositoryDir(root, defaultArchiveLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range goldenRenders {
+		t.Run(tc.name, func(t *testing.T) {
+			var files []chartFile
+			for _, f := range all {
+				if strings.HasPrefix(f.Name, tc.chart+"/") {
+					files = append(files, f)
+				}
+			}
+			opts := renderOptions{Timeout: 30 * time.Second, MaxOutput: 16 << 20, MaxDepth: 100}
+			if tc.values != "" {
+				vals, err := readValuesFile(filepath.Join(root, tc.chart, tc.values))
+				if err != nil {
+					t.Fatal(err)
+				}
+				opts.Values = vals
+			}
+			manifests, err := renderChart(context.Background(), files, opts)
+			if err != nil {
+				t.Fatalf("render: %v", err)
+			}
+			got := make(map[string]string)
+			for _, m := range manifests {
+				got[m.Template] = string(m.Data)
+			}
+			golden, err := os.ReadFile(filepath.Join(root, tc.name+".golden"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := splitGolden(string(golden))
+			for name, w := range want {
+				g, ok := got[name]
+				switch {
+				case !ok:
+					t.Errorf("%s was not rendered", name)
+				case g != w:
+					t.Errorf("%s differs from Helm:\n%s", name, lineDiff(w, g))
+				}
+			}
+			for name := range got {
+				if _, ok := want[name]; !ok {
+					t.Errorf("%s was rendered, but Helm renders it empty", name)
+				}
+			}
+		})
+	}
+}
+
+// splitGolden returns the templates of a golden file by name.
+func splitGolden(s string) map[string]string {
+	out := make(map[string]string)
+	parts := strings.Split(s, "# Source: ")
+	for _, p := range parts[1:] {
+		name, body, _ := strings.Cut(p, "\n")
+		out[name] = strings.TrimSuffix(body, "\n")
+	}
+	return out
+}
+
+// lineDiff describes the first line where got leaves want.
+func lineDiff(want, got string) string {
+	w, g := strings.Split(want, "\n"), strings.Split(got, "\n")
+	for i := 0; i < len(w) || i < len(g); i++ {
+		var wl, gl string
+		if i < len(w) {
+			wl = w[i]
+		}
+		if i < len(g) {
+			gl = g[i]
+		}
+		if wl != gl {
+			return fmt.Sprintf("line %d: want %q, got %q", i+1, wl, gl)
+		}
+	}
+	return "identical lines"
+}
+
+func TestRenderRepeatBounds(t *testing.T) {
+	repeat := (&renderer{}).funcMap()["repeat"].(func(int, string) string)
+	for _, n := range []int{-1, math.MaxInt, math.MaxInt/2 + 1, maxListLen * 16} {
+		if got := repeat(n, "ab"); got != "" {
+			t.Errorf("repeat(%d, %q) is %d bytes, want none", n, "ab", len(got))
+		}
+	}
+	if got := repeat(3, "ab"); got != "ababab" {
+		t.Errorf("repeat(3, %q) = %q", "ab", got)
+	}
+	if got := repeat(math.MaxInt, ""); got != "" {
+		t.Errorf("repeat of an empty string = %q", got)
+	}
+}
+
+// renderTemplate renders text as the only template of a chart, with an
+// output budget of maxOutput bytes.
+func renderTemplate(text string, maxOutput int64) (string, error) {
+	files := []chartFile{
+		{Name: "demo/Chart.yaml", Data: []byte("apiVersion: v2\nname: demo\nversion: 1.0.0\n")},
+		{Name: "demo/templates/out.yaml", Data: []byte(text)},
+	}
+	manifests, err := renderChart(context.Background(), files, renderOptions{Timeout: 10 * time.Second, MaxOutput: maxOutput, MaxDepth: 10})
+	if err != nil || len(manifests) == 0 {
+		return "", err
+	}
+	return string(manifests[0].Data), nil
+}
+
+func TestRenderFuncs(t *testing.T) {
+	for _, tc := range []struct {
+		template, want, wantErr string
+	}{
+		{`{{ wrap 10 "the quick brown fox jumps" }}`, "the quick\nbrown fox\njumps", ""},
+		{`{{ wrap 4 "a longword here" }}`, "a\nlongword\nhere", ""},
+		{`{{ wrap 80 "short" }}`, "short", ""},
+		{`{{ wrapWith 4 "|" "a longword" }}`, "a|long|word", ""},
+		{`{{ adler32sum "Hello world!" }}`, "487130206", ""},
+		{`{{ adler32sum "" }}`, "1", ""},
+		{`{{ printf "%s-%d" "a" 1 }}`, "a-1", ""},
+		{`{{ toToml .Values }}`, "", "toToml is not supported"},
+	} {
+		got, err := renderTemplate(tc.template, 1<<20)
+		switch {
+		case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+			t.Errorf("%s: error %v, want %q", tc.template, err, tc.wantErr)
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("%s: %v", tc.template, err)
+		case tc.wantErr == "" && got != tc.want:
+			t.Errorf("%s = %q, want %q", tc.template, got, tc.want)
+		}
+	}
+}
+
+func TestRenderChargesIntermediateValues(t *testing.T) {
+	for _, tc := range []struct {
+		name, template string
+		wantErr        error
+	}{
+		{"string doubled in a variable", `{{ $s := "x" }}{{ range until 64 }}{{ $s = print $s $s }}{{ end }}ok`, errRenderOutputLimit},
+		{"list doubled in a variable", `{{ $l := list 1 }}{{ range until 64 }}{{ $l = concat $l $l }}{{ end }}ok`, errRenderOutputLimit},
+		{"repeat in a loop", `{{ range until 100000 }}{{ $_ := repeat 100000 "ab" }}{{ end }}ok`, errRenderOutputLimit},
+		{"values within the budget", `{{ $s := "" }}{{ range until 100 }}{{ $s = printf "%s%d," $s . }}{{ end }}{{ len $s }}`, nil},
+		{"dict built with set", `{{ $d := dict }}{{ range until 1000 }}{{ $_ := set $d (toString .) . }}{{ end }}{{ len $d }}`, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := renderTemplate(tc.template, 1<<20)
+			if err != tc.wantErr {
+				t.Errorf("error %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
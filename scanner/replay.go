@@ -0,0 +1,208 @@
+package scanner
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// recordedExchange is one response kept by -record, as a JSON file named
+// after the hash of its request key. Token responses are kept with their
+// tokens redacted and cookies are dropped, but bodies are otherwise saved
+// as received, so a recording of private content is as private.
+type recordedExchange struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Accept string      `json:"accept,omitempty"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// exchangeKey identifies a request for recording and replay: its method,
+// URL and accepted media types, whether it was authorized, and for other
+// methods than GET and HEAD its body. Credentials and tokens are not part
+// of it, so a replay needs none.
+func exchangeKey(req *http.Request) (string, error) {
+	accept := strings.Split(req.Header.Get("Accept"), ",")
+	for i := range accept {
+		accept[i] = strings.TrimSpace(accept[i])
+	}
+	sort.Strings(accept)
+	key := fmt.Sprintf("%s %s\n%s\n%t", req.Method, req.URL, strings.Join(accept, ","), req.Header.Get("Authorization") != "")
+	if req.Body != nil && req.Method != http.MethodGet && req.Method != http.MethodHead {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		key += "\n" + string(body)
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// recordingTransport writes every response it receives to dir, for
+// -replay to serve later. Bodies are buffered in memory.
+type recordingTransport struct {
+	next http.RoundTripper
+	dir  string
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, err := exchangeKey(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	ex := recordedExchange{
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Accept: req.Header.Get("Accept"),
+		Status: resp.StatusCode,
+		Header: resp.Header.Clone(),
+		Body:   body,
+	}
+	ex.Header.Del("Set-Cookie")
+	if redacted, ok := redactTokens(body); ok {
+		ex.Body = redacted
+		ex.Header.Set("Content-Length", strconv.Itoa(len(redacted)))
+	}
+	if err := writeExchange(filepath.Join(t.dir, key+".json"), ex); err != nil {
+		return nil, fmt.Errorf("recording %s %s: %w", req.Method, req.URL, err)
+	}
+	return resp, nil
+}
+
+// tokenFields are the fields of a token endpoint's response that hold
+// credentials, as Docker and OAuth2 token servers name them.
+var tokenFields = []string{"token", "access_token", "refresh_token", "id_token"}
+
+// redactedToken replaces tokens in recordings. Replayed requests are
+// matched on whether they were authorized, not on the token, so any
+// value serves.
+const redactedToken = "redacted"
+
+// redactTokens returns body with its tokens replaced, when it is a JSON
+// object with any of tokenFields.
+func redactTokens(body []byte) ([]byte, bool) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, false
+	}
+	found := false
+	for _, f := range tokenFields {
+		if _, ok := m[f]; ok {
+			m[f] = json.RawMessage(strconv.Quote(redactedToken))
+			found = true
+		}
+	}
+	if !found {
+		return nil, false
+	}
+	out, err := json.Marshal(m)
+	if err != nil {
+		return nil, false
+	}
+	return out, true
+}
+
+// writeExchange replaces the file atomically, so that concurrent scans
+// recording the same request leave one complete copy.
+func writeExchange(path string, ex recordedExchange) error {
+	data, err := json.MarshalIndent(ex, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it over path.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// replayTransport answers requests from the responses recorded in dir and
+// never reaches the network. Requests that were not recorded fail.
+type replayTransport struct {
+	dir string
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, err := exchangeKey(req)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(t.dir, key+".json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no recorded response for %s %s", req.Method, req.URL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ex recordedExchange
+	if err := json.Unmarshal(data, &ex); err != nil {
+		return nil, fmt.Errorf("reading recorded response for %s %s: %w", req.Method, req.URL, err)
+	}
+	length := int64(len(ex.Body))
+	if req.Method == http.MethodHead {
+		length, _ = strconv.ParseInt(ex.Header.Get("Content-Length"), 10, 64)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", ex.Status, http.StatusText(ex.Status)),
+		StatusCode:    ex.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        ex.Header,
+		Body:          io.NopCloser(bytes.NewReader(ex.Body)),
+		ContentLength: length,
+		Request:       req,
+	}, nil
+}
+
+// replayable wraps the outbound transport for -record or -replay.
+func replayable(next http.RoundTripper, record, replay string) http.RoundTripper {
+	switch {
+	case replay != "":
+		return &replayTransport{dir: replay}
+	case record != "":
+		return &recordingTransport{next: next, dir: record}
+	}
+	return next
+}
@@ -0,0 +1,63 @@
+package scanner
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestRecordingRedactsTokens(t *testing.T) {
+	dir := t.TempDir()
+	const body = `{"token":"secret-1","access_token":"secret-2","expires_in":300}`
+	next := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		h := http.Header{}
+		h.Set("Content-Type", "application/json")
+		h.Set("Set-Cookie", "session=secret-3")
+		return &http.Response{StatusCode: http.StatusOK, Header: h, Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+	})
+	req, _ := http.NewRequest(http.MethodGet, "https://auth.example.com/token?scope=repository:app:pull", nil)
+	resp, err := (&recordingTransport{next: next, dir: dir}).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, _ := io.ReadAll(resp.Body)
+	if string(live) != body {
+		t.Errorf("the scan got %s, want the token response unchanged", live)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("%d recordings, want 1", len(files))
+	}
+	saved, _ := os.ReadFile(files[0])
+	for _, secret := range []string{"secret-1", "secret-2", "secret-3"} {
+		if strings.Contains(string(saved), secret) {
+			t.Errorf("the recording holds %s:\n%s", secret, saved)
+		}
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, req.URL.String(), nil)
+	resp, err = (&replayTransport{dir: dir}).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed, _ := io.ReadAll(resp.Body)
+	if want := `{"access_token":"redacted","expires_in":300,"token":"redacted"}`; string(replayed) != want {
+		t.Errorf("replayed %s, want %s", replayed, want)
+	}
+}
+
+func TestRedactTokensLeavesOtherBodies(t *testing.T) {
+	for _, body := range []string{`{"schemaVersion":2}`, `[{"token":"x"}]`, "not json"} {
+		if _, ok := redactTokens([]byte(body)); ok {
+			t.Errorf("%s was redacted", body)
+		}
+	}
+}
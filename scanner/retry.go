@@ -0,0 +1,132 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+const (
+	// defaultRateLimitCooldown is assumed when a 429 response carries no
+	// usable Retry-After header.
+	defaultRateLimitCooldown = 10 * time.Second
+	// maxRateLimitCooldown caps how long a retry pass waits for a
+	// registry to lift its rate limit.
+	maxRateLimitCooldown = 2 * time.Minute
+)
+
+// rateLimits remembers, per host, until when the host asked us to back
+// off with a 429 response.
+type rateLimits struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+func newRateLimits() *rateLimits {
+	return &rateLimits{until: make(map[string]time.Time)}
+}
+
+func (l *rateLimits) limit(host string, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t := time.Now().Add(d)
+	if t.After(l.until[host]) {
+		l.until[host] = t
+	}
+}
+
+// cooldown returns how long to wait before any of hosts may be contacted
+// again.
+func (l *rateLimits) cooldown(hosts []string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var d time.Duration
+	for _, h := range hosts {
+		if w := time.Until(l.until[h]); w > d {
+			d = w
+		}
+	}
+	if d > maxRateLimitCooldown {
+		d = maxRateLimitCooldown
+	}
+	return d
+}
+
+// rateLimitTransport records the Retry-After of 429 responses.
+type rateLimitTransport struct {
+	next   http.RoundTripper
+	limits *rateLimits
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		t.limits.limit(req.URL.Host, parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()))
+	}
+	return resp, err
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an
+// HTTP date.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	v = strings.TrimSpace(v)
+	if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return defaultRateLimitCooldown
+}
+
+// isTransient reports whether an inspection failure may succeed when
+// tried again: timeouts, dropped connections, rate limiting and registry
+// server errors. Missing images and authorization failures are final.
+func isTransient(err error) bool {
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		return terr.StatusCode == http.StatusTooManyRequests || terr.Temporary()
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// isRateLimited reports whether a registry refused err's request with
+// 429 Too Many Requests, as Docker Hub does past its pull limit.
+func isRateLimited(err error) bool {
+	var terr *transport.Error
+	return errors.As(err, &terr) && terr.StatusCode == http.StatusTooManyRequests
+}
+
+// isAuthError reports whether a registry refused err's request for lack
+// of valid credentials.
+func isAuthError(err error) bool {
+	var terr *transport.Error
+	return errors.As(err, &terr) && (terr.StatusCode == http.StatusUnauthorized || terr.StatusCode == http.StatusForbidden)
+}
+
+// registryHost returns the host serving ref, for rate limit lookups.
+func registryHost(ref string) string {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return ""
+	}
+	return r.Context().RegistryStr()
+}
@@ -0,0 +1,199 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// rewriteRule maps a registry or repository prefix to the place it is
+// mirrored, e.g. docker.io to harbor.example.com/dockerhub for a
+// pull-through cache.
+type rewriteRule struct {
+	From string
+	To   string
+}
+
+// RewriteReport previews the chart's images as they would be pulled
+// through the configured mirrors, and whether the mirrors serve them.
+type RewriteReport struct {
+	Rules  map[string]string `json:"rules"`
+	Images []RewrittenImage  `json:"images"`
+	// Missing counts rewritten images a mirror does not serve.
+	Missing int `json:"missing"`
+	// Unchanged are the images no rule applies to.
+	Unchanged []string `json:"unchanged"`
+}
+
+type RewrittenImage struct {
+	Original  string `json:"original"`
+	Rewritten string `json:"rewritten"`
+	Exists    bool   `json:"exists"`
+	Digest    string `json:"digest,omitempty"`
+	// DigestMatches is false when the mirror serves other content than
+	// the original registry, as with a stale copy of a moved tag. It is
+	// left out when the original could not be resolved.
+	DigestMatches *bool  `json:"digest_matches,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// parseRewrites validates a mapping of prefixes to mirrors. Prefixes are
+// registry hosts or repository paths; Docker Hub may be written as
+// docker.io.
+func parseRewrites(m map[string]string) ([]rewriteRule, error) {
+	rules := make([]rewriteRule, 0, len(m))
+	for from, to := range m {
+		from, to = strings.TrimSuffix(from, "/"), strings.TrimSuffix(to, "/")
+		if from == "" || to == "" || strings.Contains(from, "://") || strings.Contains(to, "://") {
+			return nil, fmt.Errorf("invalid rewrite %q to %q, want registry[/path] prefixes", from, to)
+		}
+		if _, err := name.NewRepository(to + "/repo"); err != nil {
+			return nil, fmt.Errorf("invalid rewrite target %q: %v", to, err)
+		}
+		rules = append(rules, rewriteRule{From: canonicalRegistry(from), To: to})
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].From < rules[j].From })
+	return rules, nil
+}
+
+// rewriteList parses the -rewrites flag, a comma-separated list of
+// from=to mappings.
+func rewriteList(list []string) (map[string]string, error) {
+	m := make(map[string]string, len(list))
+	for _, r := range list {
+		from, to, ok := strings.Cut(r, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rewrite %q, want from=to", r)
+		}
+		m[from] = to
+	}
+	return m, nil
+}
+
+// canonicalRegistry spells Docker Hub's registry as docker.io, the way
+// image references and rewrite rules usually name it.
+func canonicalRegistry(p string) string {
+	host, rest, _ := strings.Cut(p, "/")
+	if host == name.DefaultRegistry || host == "registry-1.docker.io" {
+		host = "docker.io"
+	}
+	if rest == "" {
+		return host
+	}
+	return host + "/" + rest
+}
+
+// matchRule returns the rule with the longest prefix matching ref. A
+// prefix matches whole path segments only.
+func matchRule(ref string, rules []rewriteRule) (rewriteRule, bool) {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return rewriteRule{}, false
+	}
+	repo := canonicalRegistry(r.Context().RegistryStr() + "/" + r.Context().RepositoryStr())
+	var best rewriteRule
+	for _, rule := range rules {
+		if (repo == rule.From || strings.HasPrefix(repo, rule.From+"/")) && len(rule.From) > len(best.From) {
+			best = rule
+		}
+	}
+	return best, best.From != ""
+}
+
+// rewriteRef applies the rule with the longest matching prefix to ref.
+func rewriteRef(ref string, rules []rewriteRule) (string, bool) {
+	best, ok := matchRule(ref, rules)
+	if !ok {
+		return "", false
+	}
+	r, _ := name.ParseReference(ref)
+	repo := canonicalRegistry(r.Context().RegistryStr() + "/" + r.Context().RepositoryStr())
+	out := best.To + strings.TrimPrefix(repo, best.From)
+	if d, ok := r.(name.Digest); ok {
+		if base, ok := dualReferenceTag(ref); ok {
+			if t, err := name.NewTag(base); err == nil {
+				out += ":" + t.TagStr()
+			}
+		}
+		return out + "@" + d.DigestStr(), true
+	}
+	return out + ":" + r.Identifier(), true
+}
+
+// rewriteReport rewrites every image of the chart and checks with a
+// manifest HEAD that the mirror serves it. Images that could not be
+// inspected at their origin are checked too, since a mirror may be the
+// only registry the cluster can reach.
+func (s *server) rewriteReport(ctx context.Context, rules []rewriteRule, refs []string, infos []ImageInfo, opts scanOptions) *RewriteReport {
+	rep := &RewriteReport{Rules: make(map[string]string, len(rules)), Images: []RewrittenImage{}, Unchanged: []string{}}
+	for _, r := range rules {
+		rep.Rules[r.From] = r.To
+	}
+	digests := make(map[string]string, len(infos))
+	for _, info := range infos {
+		digests[info.Image] = info.Digest
+	}
+	for _, ref := range refs {
+		if to, ok := rewriteRef(ref, rules); ok {
+			rep.Images = append(rep.Images, RewrittenImage{Original: ref, Rewritten: to})
+		} else {
+			rep.Unchanged = append(rep.Unchanged, ref)
+		}
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, opts.Concurrency)
+	for i := range rep.Images {
+		wg.Add(1)
+		go func(img *RewrittenImage) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			ictx, cancel := context.WithTimeout(ctx, opts.ImageTimeout)
+			defer cancel()
+			if err := opts.egressAllowed(img.Rewritten); err != nil {
+				img.Error = err.Error()
+				return
+			}
+			// Digest references are looked up too: the question is
+			// whether the mirror has them.
+			d, err := crane.Digest(img.Rewritten, s.registry.options(ictx)...)
+			if err != nil {
+				if !isNotFound(err) {
+					img.Error = err.Error()
+				}
+				return
+			}
+			img.Exists, img.Digest = true, d
+			if orig := digests[img.Original]; orig != "" {
+				match := orig == d
+				img.DigestMatches = &match
+			}
+		}(&rep.Images[i])
+	}
+	wg.Wait()
+
+	for _, img := range rep.Images {
+		if !img.Exists {
+			rep.Missing++
+		}
+	}
+	sort.Slice(rep.Images, func(i, j int) bool { return rep.Images[i].Original < rep.Images[j].Original })
+	sort.Strings(rep.Unchanged)
+	return rep
+}
+
+// isNotFound reports whether a registry answered that a manifest or
+// repository does not exist.
+func isNotFound(err error) bool {
+	var terr *transport.Error
+	return errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,110 @@
+// Package scanner finds the container images a Helm chart references and
+// inspects them at their registries. Serve runs the service; a Scanner
+// runs scans in process, for programs embedding the scanner.
+package scanner
+
+import (
+	"context"
+	"errors"
+)
+
+// Request is a scan run by Scanner.Run.
+type Request struct {
+	// Chart is a chart archive URL, an oci:// reference or repo/chart
+	// with a repository from Helm's repositories.yaml.
+	Chart string
+	// Version constrains the version of a repo/chart reference.
+	Version string
+	Options Options
+}
+
+// Stages of a scan, as Progress and /status report them.
+const (
+	StageQueued      = stageQueued
+	StageDownloading = stageDownloading
+	StageRendering   = stageRendering
+	StageInspecting  = stageInspecting
+	StageCoolingDown = stageCoolingDown
+	StageRetrying    = stageRetrying
+	StageReporting   = stageReporting
+)
+
+// Progress is a step of a scan: it entered Stage, or, in StageInspecting
+// and StageRetrying, finished inspecting Image, which failed with Err
+// when that is set. ImagesDone of ImagesTotal images are inspected in
+// the current inspection stage.
+type Progress struct {
+	Stage       string
+	ImagesTotal int
+	ImagesDone  int
+	Image       string
+	Err         error
+}
+
+// ProgressFunc receives the progress of a scan. It is called from the
+// scan's goroutines, one call at a time, and holds the scan up until it
+// returns.
+type ProgressFunc func(Progress)
+
+type progressKey struct{}
+
+// Scanner runs scans in process with the settings of one Config. Scans
+// of a Scanner share its caches and scan slots; Scanners share nothing,
+// so one process can run several configurations.
+type Scanner struct {
+	s    *server
+	stop context.CancelFunc
+}
+
+// New returns a Scanner for cfg, such as LoadConfig returns. Close stops
+// its background work.
+func New(cfg Config) (*Scanner, error) {
+	keys, err := loadKeyRing(cfg.SecretsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	helm, err := loadHelmConfig(cfg.HelmRepositories, cfg.HelmRegistryConfig, keys)
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := openCatalog(cfg.Catalog, cfg.CacheTTL)
+	if err != nil {
+		return nil, err
+	}
+	history, _ := openHistoryStore("")
+	crawls, _ := openCrawlState("")
+	s := newServer(cfg, history, crawls, nil, nil, nil, helm, catalog)
+	ctx, stop := context.WithCancel(context.Background())
+	go s.cache.sweepEvery(ctx)
+	return &Scanner{s: s, stop: stop}, nil
+}
+
+// Close stops the Scanner's background work. Scans still running are not
+// cancelled; their contexts do that.
+func (sc *Scanner) Close() error {
+	sc.stop()
+	return nil
+}
+
+// Run scans the chart of req, calling progress, if not nil, as the scan
+// advances. Cancelling ctx stops the scan.
+func (sc *Scanner) Run(ctx context.Context, req Request, progress ProgressFunc) (*ScanResult, error) {
+	return sc.s.run(ctx, req, progress)
+}
+
+func (s *server) run(ctx context.Context, req Request, progress ProgressFunc) (*ScanResult, error) {
+	if req.Chart == "" {
+		return nil, errors.New("chart is required")
+	}
+	if req.Version != "" && !isChartRef(req.Chart) {
+		return nil, errors.New("version applies to repo/chart references only")
+	}
+	opts, err := s.scanOptionsFor(scanRequest{Options: req.Options}, cacheControl{})
+	if err != nil {
+		return nil, err
+	}
+	if progress != nil {
+		ctx = context.WithValue(ctx, progressKey{}, progress)
+	}
+	return s.scanChartArg(ctx, req.Chart, req.Version, opts)
+}
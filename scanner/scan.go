@@ -0,0 +1,681 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// minImageTimeout is the smallest per-image timeout handed out while the
+// scan deadline still allows it, so late images are not starved entirely.
+const minImageTimeout = 10 * time.Second
+
+// ScanResult is the outcome of scanning one chart.
+type ScanResult struct {
+	// ID is the scan's id in the result store, when one is configured.
+	ID         string           `json:"id,omitempty"`
+	ChartURL   string           `json:"chart_url"`
+	Source     *ReleaseSource   `json:"source,omitempty"`
+	ScannedAt  time.Time        `json:"scanned_at"`
+	Images     []ImageInfo      `json:"images"`
+	Duplicates []DuplicateGroup `json:"duplicates,omitempty"`
+	Pinning    *PinningReport   `json:"pinning"`
+	Policy     *PolicyReport    `json:"policy,omitempty"`
+	// HardcodedImages are images written in templates that no value
+	// sets.
+	HardcodedImages []HardcodedImage `json:"hardcoded_images,omitempty"`
+	// ChartDefaults is the chart whose stored options the scan applied,
+	// see /chart-defaults.
+	ChartDefaults string `json:"chart_defaults,omitempty"`
+	// DockerHub classifies the Docker Hub images by publisher, for the
+	// trusted_docker_hub policy.
+	DockerHub *DockerHubReport `json:"docker_hub,omitempty"`
+	// DeclaredImages cross-checks the artifacthub.io/images annotations
+	// with the images found, when a chart has one.
+	DeclaredImages *DeclaredImagesReport `json:"declared_images,omitempty"`
+	// AppVersion compares the main image's tag with the chart's
+	// appVersion, when it has one.
+	AppVersion *AppVersionReport `json:"app_version,omitempty"`
+	// Library is set for a library chart, which installs nothing.
+	Library *LibraryReport `json:"library,omitempty"`
+	// Links checks the links of the chart's metadata, when asked for.
+	Links *LinkReport `json:"links,omitempty"`
+	// DeprecatedAPIs lists rendered objects using deprecated API
+	// versions; it is only filled when the chart is rendered.
+	DeprecatedAPIs []DeprecatedAPI `json:"deprecated_apis,omitempty"`
+	// Pulls estimates the pull amplification of each workload image; it
+	// is only filled when the chart is rendered.
+	Pulls *PullReport `json:"pulls,omitempty"`
+	// PullSecrets checks, per registry, that the rendered workloads can
+	// pull; it is only filled when the chart is rendered.
+	PullSecrets *PullSecretReport `json:"pull_secrets,omitempty"`
+	// ValuesRendered reconciles the images of the effective values with
+	// those of the rendered manifests; it is only filled when the chart is
+	// rendered.
+	ValuesRendered *ValuesRenderedReport `json:"values_rendered,omitempty"`
+	// Compatibility is set when a target Kubernetes version was given.
+	Compatibility *CompatibilityReport `json:"compatibility,omitempty"`
+	// Deployed compares the chart with the running release when the
+	// request asked for it.
+	Deployed *DeployedDiff `json:"deployed,omitempty"`
+	// Platforms is set when required platforms were given.
+	Platforms *PlatformReport `json:"platforms,omitempty"`
+	// Cost estimates hosting the images, when prices are configured.
+	Cost *CostReport `json:"cost,omitempty"`
+	// Rewrites previews the images pulled through mirrors, when rewrite
+	// rules are configured.
+	Rewrites *RewriteReport `json:"rewrites,omitempty"`
+	// Mirrors records the mirrors the images were inspected at, when
+	// -mirrors has some for their registries.
+	Mirrors *MirrorReport `json:"mirrors,omitempty"`
+	// EgressBlocked are the images of registries outside the request's
+	// allowed_registries, which were not inspected.
+	EgressBlocked []string `json:"egress_blocked,omitempty"`
+	// Truncation is set when the chart has more images than the scan
+	// inspects.
+	Truncation *TruncationReport `json:"truncation,omitempty"`
+	// RenderError is set when rendering was asked for but failed; the
+	// images are then those found in the chart's files.
+	RenderError string `json:"render_error,omitempty"`
+	// Warnings are the findings worth a look, less those a suppression
+	// list drops; WarningsSuppressed counts those per code.
+	Warnings           []ScanWarning  `json:"warnings"`
+	WarningsSuppressed map[string]int `json:"warnings_suppressed,omitempty"`
+	// Retried lists images that failed transiently and were tried again.
+	Retried []string `json:"retried,omitempty"`
+	// Usage is what the scan cost the scanner.
+	Usage *ScanUsage `json:"usage,omitempty"`
+	// Trace lists the pipeline's decisions when the request set debug.
+	Trace []TraceEvent `json:"trace,omitempty"`
+	// Provenance records, for every image found, where it was found and
+	// the steps taken to inspect it; see /scans/{id}/images/{ref}/explain.
+	Provenance map[string]*ImageProvenance `json:"provenance,omitempty"`
+}
+
+type scanOptions struct {
+	Concurrency  int
+	ImageTimeout time.Duration
+	// Deep streams layers whose uncompressed size is not recorded in the
+	// manifest to measure it exactly.
+	Deep bool
+	// Revalidate re-resolves every tag against the registry instead of
+	// trusting a cached resolution. Results cached by digest are still
+	// reused, since the content behind a digest cannot change.
+	Revalidate bool
+	// MaxAge, when set, is the oldest cached tag resolution accepted.
+	MaxAge time.Duration
+	Policy policyOptions
+	// Render executes the chart templates in the sandbox and extracts
+	// images from the resulting manifests as well as from the raw files.
+	Render     bool
+	RenderOpts renderOptions
+	Archive    archiveLimits
+	// CheckLinks fetches the icon, home and sources of the chart.
+	CheckLinks bool
+	// KubeVersion, when set, is the Kubernetes version the chart is
+	// checked against; it is also the version templates are rendered for.
+	KubeVersion string
+	// Nodes is the cluster size pull estimates assume.
+	Nodes int
+	// Platforms, when set, are the platforms every image must support.
+	Platforms []v1.Platform
+	// Rewrites map image prefixes to the mirrors they are checked in.
+	Rewrites []rewriteRule
+	// Prices, when set, turn on the cost estimate.
+	Prices CostPrices
+	// Mirrors map registry prefixes to the mirror selected for the scan.
+	Mirrors []rewriteRule
+	// SuppressWarnings drop warnings; LargeImageBytes is the size
+	// above which images are LARGE_IMAGE.
+	SuppressWarnings []warningFilter
+	LargeImageBytes  int64
+	// AllowedRegistries, when set, are the only registries the scan
+	// contacts for images.
+	AllowedRegistries []string
+	// MaxImages, when set, is the most images the scan inspects.
+	MaxImages int
+	// Share, set for the scans of a batch, inspects each digest once
+	// across them.
+	Share *digestShare
+	// OnImage, when set, is called from the inspection workers with each
+	// image as soon as it has been inspected successfully.
+	OnImage func(ImageInfo)
+}
+
+// scanChartForImages waits for a free scan slot, then downloads the chart,
+// inspects every image it references and builds the chart-level reports.
+// Time spent queued counts towards ctx's deadline.
+func (s *server) scanChartForImages(ctx context.Context, chartURL string, opts scanOptions) (*ScanResult, error) {
+	job, ctx, err := s.tracker.start(ctx, chartURL)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for a scan slot: %w", err)
+	}
+	defer s.tracker.finish(job)
+
+	files, err := s.fetchChart(ctx, chartURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	tracef(ctx, "download", "%s: %d files", chartURL, len(files))
+	return s.scanFiles(ctx, job, chartURL, files, opts)
+}
+
+// scanLocalChart scans a chart that is already unpacked, such as one
+// found in a Git repository. name identifies it in the result.
+func (s *server) scanLocalChart(ctx context.Context, name string, files []chartFile, opts scanOptions) (*ScanResult, error) {
+	job, ctx, err := s.tracker.start(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for a scan slot: %w", err)
+	}
+	defer s.tracker.finish(job)
+	return s.scanFiles(ctx, job, name, files, opts)
+}
+
+// scanFiles extracts the images referenced by a chart's files, inspects
+// them and builds the chart-level reports.
+func (s *server) scanFiles(ctx context.Context, job *scanJob, chartURL string, files []chartFile, opts scanOptions) (*ScanResult, error) {
+	imageList, secrets, manifests, renderErr, err := chartImages(ctx, job, files, opts)
+	if err != nil {
+		return nil, err
+	}
+	rendered := opts.Render && renderErr == nil
+	if emit := opts.OnImage; emit != nil {
+		opts.OnImage = func(info ImageInfo) {
+			info.PullSecrets = secrets[info.Image]
+			emit(info)
+		}
+	}
+
+	inspectList, truncation := limitImages(imageList, opts.MaxImages)
+	if truncation != nil {
+		log.Printf("warning: %s has %d images, only the first %d are inspected", chartURL, truncation.Discovered, truncation.Limit)
+		tracef(ctx, "inspect", "%d of %d images inspected, max_images reached", truncation.Limit, truncation.Discovered)
+	}
+	var mirrors *MirrorReport
+	opts.Mirrors, mirrors = s.mirrors.selectFor(ctx, s, inspectList, opts)
+	results := s.inspectAll(ctx, inspectList, opts, job, stageInspecting)
+	retried := s.retryTransient(ctx, results, opts, job)
+
+	job.setStage(stageReporting)
+	result := &ScanResult{
+		ChartURL:   chartURL,
+		ScannedAt:  time.Now().UTC(),
+		Images:     make([]ImageInfo, 0, len(imageList)),
+		Retried:    retried,
+		Provenance: job.prov.result(),
+		Mirrors:    mirrors,
+		Truncation: truncation,
+	}
+	if renderErr != nil {
+		log.Printf("warning: rendering %s failed, images taken from the chart's files: %v", chartURL, renderErr)
+		result.RenderError = renderErr.Error()
+	}
+	failed := make(map[string]error)
+	for _, r := range results {
+		if errors.Is(r.err, errEgressBlocked) {
+			result.EgressBlocked = append(result.EgressBlocked, r.info.Image)
+			continue
+		}
+		if r.err != nil {
+			log.Printf("warning: failed %q: %v", r.info.Image, r.err)
+			failed[r.info.Image] = r.err
+			continue
+		}
+		s.history.record(r.info)
+		r.info.PullSecrets = secrets[r.info.Image]
+		result.Images = append(result.Images, r.info)
+	}
+	result.Duplicates = findDuplicates(imageList, result.Images)
+	result.Pinning = pinningReport(imageList, result.Images)
+	if job.prov.valuesRead {
+		result.HardcodedImages = hardcodedImages(result.Provenance)
+	}
+	if opts.Policy.TrustedDockerHub {
+		result.DockerHub = s.dockerHubReport(ctx, inspectList, opts.Concurrency)
+	}
+	result.Policy = evaluatePolicies(result, opts.Policy)
+	charts, chartsErr := enabledCharts(files, opts.RenderOpts.Values)
+	if chartsErr == nil {
+		result.DeclaredImages = declaredImagesReport(charts, imageList)
+		result.AppVersion = appVersionReport(charts, imageList, result.Provenance)
+		result.Library = libraryReport(charts)
+		if opts.CheckLinks {
+			result.Links = s.checkLinks(ctx, charts, result.AppVersion, opts)
+		}
+	}
+	if rendered {
+		if chartsErr == nil {
+			result.DeprecatedAPIs = findDeprecatedAPIs(charts, manifests)
+		}
+		result.Pulls = pullReport(manifests, result.Images, opts.Nodes)
+		result.PullSecrets = s.registry.pullSecretReport(manifests, failed)
+		if job.prov.valuesRead {
+			result.ValuesRendered = valuesRenderedReport(result.Provenance)
+		}
+	}
+	if len(opts.Platforms) > 0 {
+		result.Platforms = platformReport(opts.Platforms, result.Images)
+	}
+	if opts.Prices.set() {
+		result.Cost = costReport(result.Images, opts.Prices)
+	}
+	if len(opts.Rewrites) > 0 {
+		result.Rewrites = s.rewriteReport(ctx, opts.Rewrites, inspectList, result.Images, opts)
+	}
+	if opts.KubeVersion != "" {
+		result.Compatibility = checkCompatibility(opts.KubeVersion, files, opts.RenderOpts.Values, manifests, rendered)
+	}
+	result.Warnings, result.WarningsSuppressed = scanWarnings(result, failed, opts)
+	result.Usage = job.usage()
+	return result, nil
+}
+
+// TruncationReport lists the images a scan found but did not inspect,
+// because the chart has more than max_images of them. The chart-level
+// reports, such as pinning, still cover every image found.
+type TruncationReport struct {
+	Limit        int      `json:"limit"`
+	Discovered   int      `json:"discovered"`
+	NotInspected []string `json:"not_inspected"`
+	Reason       string   `json:"reason"`
+}
+
+// limitImages sorts refs and keeps the first max of them for inspection,
+// reporting the rest. A max of 0 keeps every image.
+func limitImages(refs []string, max int) ([]string, *TruncationReport) {
+	sort.Strings(refs)
+	if max <= 0 || len(refs) <= max {
+		return refs, nil
+	}
+	return refs[:max], &TruncationReport{
+		Limit:        max,
+		Discovered:   len(refs),
+		NotInspected: append([]string(nil), refs[max:]...),
+		Reason:       fmt.Sprintf("the chart has %d images and scans inspect at most %d (max_images)", len(refs), max),
+	}
+}
+
+// chartImages collects the images referenced by a chart's files and, when
+// rendering, by its manifests, with the pull secrets values declare for
+// them. A chart that fails to render still yields the images of its
+// files, with the failure in renderErr.
+func chartImages(ctx context.Context, job *scanJob, files []chartFile, opts scanOptions) (images []string, secrets map[string][]string, manifests []renderedManifest, renderErr, err error) {
+	foundImages := make(map[string]struct{})
+	secrets = make(map[string][]string)
+	// Images in values files are taken from the effective values, so
+	// that overrides and globals apply; a tree without a Chart.yaml is
+	// simply extracted file by file.
+	fromValues, valuesErr := chartValuesImages(files, opts.RenderOpts.Values)
+	if fromValues != nil {
+		job.prov.valuesRead = true
+		for img, s := range fromValues.images {
+			foundImages[img] = struct{}{}
+			secrets[img] = s
+			for _, o := range fromValues.origins[img] {
+				job.prov.origin(img, o)
+			}
+			tracef(ctx, "extract", "effective values: %s", img)
+		}
+	} else {
+		tracef(ctx, "extract", "values not merged, so every file is extracted on its own: %v", valuesErr)
+	}
+	trace := tracing(ctx)
+	for _, f := range files {
+		switch {
+		case !isYAMLFile(f.Name):
+			tracef(ctx, "extract", "%s: skipped, not YAML", f.Name)
+			continue
+		case fromValues != nil && fromValues.valuesFiles[f.Name]:
+			tracef(ctx, "extract", "%s: skipped, covered by the effective values", f.Name)
+			if trace {
+				traceRejected(ctx, "extract", f.Name, f.Data)
+			}
+			continue
+		case fromValues != nil && fromValues.libraryTemplates[f.Name]:
+			tracef(ctx, "extract", "%s: skipped, a template of a library chart", f.Name)
+			continue
+		}
+		imgs, err := fileImages(job, originFile, f.Name, f.Data, nil, foundImages)
+		if trace {
+			if err == nil {
+				tracef(ctx, "extract", "%s: %d images %v", f.Name, len(imgs), imgs)
+			}
+			traceRejected(ctx, "extract", f.Name, f.Data)
+		}
+	}
+	if opts.Render {
+		job.setStage(stageRendering)
+		manifests, renderErr = renderChart(ctx, files, opts.RenderOpts)
+		if renderErr != nil && ctx.Err() != nil {
+			return nil, nil, nil, nil, fmt.Errorf("rendering chart: %w", renderErr)
+		}
+		if renderErr != nil {
+			tracef(ctx, "render", "failed, only the images of the chart's files are used: %v", renderErr)
+		} else {
+			tracef(ctx, "render", "%d manifests", len(manifests))
+		}
+		for _, m := range manifests {
+			imgs, _ := fileImages(job, originManifest, m.Template, m.Data, m.Libraries, foundImages)
+			if trace {
+				tracef(ctx, "render", "%s: %d images %v", m.Template, len(imgs), imgs)
+				traceRejected(ctx, "render", m.Template, m.Data)
+			}
+		}
+	}
+
+	images = make([]string, 0, len(foundImages))
+	for img := range foundImages {
+		images = append(images, img)
+	}
+	return images, secrets, manifests, renderErr, nil
+}
+
+// fileImages adds the images of a chart file or rendered manifest to
+// found, recording where each was found and, for a manifest, the library
+// helper that wrote it, and returns them sorted.
+func fileImages(job *scanJob, source, name string, data []byte, libraries []libraryOutput, found map[string]struct{}) ([]string, error) {
+	seen := make(map[string]struct{})
+	err := walkYAMLImages(data, func(doc int, img, path, rule string) {
+		found[img] = struct{}{}
+		seen[img] = struct{}{}
+		job.prov.origin(img, ImageOrigin{Source: source, File: name, Document: doc, Path: path, Rule: rule, Helper: libraryHelper(libraries, img)})
+	})
+	imgs := make([]string, 0, len(seen))
+	for img := range seen {
+		imgs = append(imgs, img)
+	}
+	sort.Strings(imgs)
+	return imgs, err
+}
+
+// openChart starts downloading a chart archive from an HTTP(S) URL or,
+// for oci:// references, from a registry.
+func (s *server) openChart(ctx context.Context, chartURL string) (io.ReadCloser, error) {
+	if ref, ok := strings.CutPrefix(chartURL, "oci://"); ok {
+		body, err := s.registry.pullChart(ctx, ref)
+		if err != nil {
+			return nil, fmt.Errorf("pulling chart: %w", err)
+		}
+		return body, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, chartURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("downloading chart: %w", err)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("downloading chart: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("bad status downloading chart: %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+type inspectResult struct {
+	info ImageInfo
+	err  error
+}
+
+// inspectAll inspects refs on a pool of opts.Concurrency workers. Results
+// are returned in the order of refs.
+func (s *server) inspectAll(ctx context.Context, refs []string, opts scanOptions, job *scanJob, stage string) []inspectResult {
+	results := make([]inspectResult, len(refs))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, opts.Concurrency)
+	var waiting atomic.Int64
+	waiting.Store(int64(len(refs)))
+	job.startInspecting(stage, len(refs), opts.Concurrency)
+
+	for i, ref := range refs {
+		wg.Add(1)
+		go func(i int, ref string) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				results[i] = inspectResult{ImageInfo{Image: ref}, ctx.Err()}
+				return
+			}
+			defer func() { <-sem }()
+			n := int(waiting.Add(-1)) + 1
+			ictx, cancel := context.WithTimeout(ctx, imageTimeout(ctx, opts.ImageTimeout, n, opts.Concurrency))
+			defer cancel()
+			s.tracker.inspecting(job, ref, func() error {
+				info, err := s.inspectCached(ictx, ref, opts)
+				results[i] = inspectResult{info, err}
+				return err
+			})
+			if results[i].err == nil {
+				results[i].info.Metadata = s.catalog.lookup(ctx, ref)
+				results[i].info.EOL = s.eol.check(ctx, results[i].info)
+				if opts.OnImage != nil {
+					opts.OnImage(results[i].info)
+				}
+			}
+		}(i, ref)
+	}
+	wg.Wait()
+	return results
+}
+
+// retryTransient gives images that failed with a transient error a second
+// attempt, once any rate limit their registries imposed has expired, and
+// updates results in place. The retry is skipped when the scan deadline
+// would not leave each image its minimum timeout after the cooldown. It
+// returns the references that were retried.
+func (s *server) retryTransient(ctx context.Context, results []inspectResult, opts scanOptions, job *scanJob) []string {
+	if ctx.Err() != nil {
+		return nil
+	}
+	var idx []int
+	var refs, hosts []string
+	for i, r := range results {
+		if r.err != nil && isTransient(r.err) {
+			idx = append(idx, i)
+			refs = append(refs, r.info.Image)
+			hosts = append(hosts, registryHost(r.info.Image))
+		}
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+	wait := s.limits.cooldown(hosts)
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait+minImageTimeout {
+		log.Printf("warning: not retrying %d images, scan deadline too close", len(refs))
+		return nil
+	}
+	log.Printf("retrying %d images after %s", len(refs), wait.Round(time.Second))
+	for _, ref := range refs {
+		imageStep(ctx, "retry", ref, "failed transiently, retrying after %s", wait.Round(time.Second))
+	}
+	job.setStage(stageCoolingDown)
+	select {
+	case <-time.After(wait):
+	case <-ctx.Done():
+		return nil
+	}
+	for k, r := range s.inspectAll(ctx, refs, opts, job, stageRetrying) {
+		if r.err != nil {
+			log.Printf("warning: retry of %q failed: %v", r.info.Image, r.err)
+		}
+		results[idx[k]] = r
+	}
+	return refs
+}
+
+// inspectCached resolves ref to a manifest digest and inspects it, using
+// the cache for both steps where opts allow. An image whose registry has
+// a selected mirror is inspected there, and at its registry when the
+// mirror fails.
+func (s *server) inspectCached(ctx context.Context, ref string, opts scanOptions) (ImageInfo, error) {
+	pull := opts.mirrorRef(ref)
+	if pull != ref && opts.egressAllowed(pull) == nil {
+		info, err := s.inspectAt(ctx, ref, pull, opts)
+		if err == nil || ctx.Err() != nil {
+			return info, err
+		}
+		if !isNotFound(err) {
+			// A mirror missing one image is still a healthy mirror.
+			s.mirrors.failed(pull, err)
+		}
+		imageStep(ctx, "mirror", ref, "%s failed, inspecting at the registry: %v", pull, err)
+	}
+	if err := opts.egressAllowed(ref); err != nil {
+		imageStep(ctx, "egress", ref, "not contacted: %v", err)
+		return ImageInfo{Image: ref}, err
+	}
+	// A registry rate limiting the scan is passed over for its mirrors,
+	// while it asks to back off or once it answers 429.
+	fallbacks := s.mirrors.fallbacks(ref, pull, opts, s.limits)
+	if wait := s.limits.cooldown([]string{registryHost(ref)}); len(fallbacks) > 0 && wait > 0 {
+		imageStep(ctx, "mirror", ref, "%s rate limited for %s, inspecting at a mirror", registryHost(ref), wait.Round(time.Second))
+		if info, ok := s.inspectFallback(ctx, ref, fallbacks, opts); ok {
+			return info, nil
+		}
+		fallbacks = nil
+	}
+	info, err := s.inspectAt(ctx, ref, ref, opts)
+	if err != nil && isRateLimited(err) && len(fallbacks) > 0 && ctx.Err() == nil {
+		imageStep(ctx, "mirror", ref, "rate limited, inspecting at a mirror: %v", err)
+		if info, ok := s.inspectFallback(ctx, ref, fallbacks, opts); ok {
+			return info, nil
+		}
+	}
+	return info, err
+}
+
+// inspectFallback inspects ref at the first of the mirror references pulls
+// that answers, for a registry rate limiting the scan.
+func (s *server) inspectFallback(ctx context.Context, ref string, pulls []string, opts scanOptions) (ImageInfo, bool) {
+	for _, pull := range pulls {
+		info, err := s.inspectAt(ctx, ref, pull, opts)
+		if err == nil {
+			info.RateLimited = true
+			return info, true
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if !isNotFound(err) {
+			s.mirrors.failed(pull, err)
+		}
+		imageStep(ctx, "mirror", ref, "%s failed: %v", pull, err)
+	}
+	return ImageInfo{}, false
+}
+
+// inspectAt inspects ref in the registry or mirror of pull, the
+// reference ref is pulled by.
+func (s *server) inspectAt(ctx context.Context, ref, pull string, opts scanOptions) (ImageInfo, error) {
+	digest, err := s.resolveAt(ctx, ref, pull, opts)
+	if err != nil {
+		return ImageInfo{Image: ref}, err
+	}
+	info, ok := s.cache.inspected(digest, opts.Deep)
+	if ok {
+		imageStep(ctx, "inspect", ref, "%s inspected from cache", digest)
+		info.Image = ref
+		info.Pinned = isDigestPinned(ref)
+	} else {
+		imageStep(ctx, "inspect", ref, "%s not cached, inspecting at %s", digest, registryHost(pull))
+		var shared bool
+		info, shared, err = opts.Share.inspect(digest, opts.Deep, func() (ImageInfo, error) {
+			return s.registry.inspectImage(ctx, pull, digest, opts.Deep)
+		})
+		if err != nil {
+			imageStep(ctx, "inspect", ref, "failed: %v", err)
+			return ImageInfo{Image: ref}, err
+		}
+		if shared {
+			imageStep(ctx, "inspect", ref, "%s shared with another scan of the batch", digest)
+		}
+		info.Image, info.Pinned = ref, isDigestPinned(ref)
+		s.cache.putInspected(digest, info, opts.Deep)
+	}
+	info.Mirror, info.RateLimited = "", false
+	if pull != ref {
+		info.Mirror = pull
+	}
+	if tagRef, ok := dualReferenceTag(ref); ok {
+		info.TagVerification = s.verifyTag(ctx, tagRef, digest, opts)
+	}
+	layerBreakdown(&info, s.bases.origins(ctx, s.registry, opts))
+	return info, nil
+}
+
+// resolve returns the manifest digest ref currently points at.
+func (s *server) resolve(ctx context.Context, ref string, opts scanOptions) (string, error) {
+	return s.resolveAt(ctx, ref, opts.mirrorRef(ref), opts)
+}
+
+// resolveAt resolves ref, asking the registry or mirror of pull when the
+// cache has no answer. Answers are cached under ref.
+func (s *server) resolveAt(ctx context.Context, ref, pull string, opts scanOptions) (string, error) {
+	if !opts.Revalidate {
+		if digest, ok := s.cache.resolved(ref, opts.MaxAge); ok {
+			imageStep(ctx, "resolve", ref, "%s from cache", digest)
+			return digest, nil
+		}
+	}
+	digest, err := s.registry.resolveDigest(ctx, pull)
+	if err != nil {
+		imageStep(ctx, "resolve", ref, "failed: %v", err)
+		return "", err
+	}
+	imageStep(ctx, "resolve", ref, "%s from %s", digest, registryHost(pull))
+	s.cache.putResolved(ref, digest)
+	return digest, nil
+}
+
+// verifyTag checks that the tag of a "repo:tag@digest" reference still
+// points at the pinned digest.
+func (s *server) verifyTag(ctx context.Context, tagRef, pinned string, opts scanOptions) *TagVerification {
+	v := &TagVerification{Tag: tagRef}
+	current, err := s.resolve(ctx, tagRef, opts)
+	if err != nil {
+		v.Error = err.Error()
+		return v
+	}
+	v.TagDigest = current
+	v.Matches = current == pinned
+	return v
+}
+
+// imageTimeout returns the timeout for the next image to be inspected. It
+// is the configured per-image limit, shrunk as the scan deadline nears so
+// that the images still waiting (including this one) each get a fair share
+// of the remaining budget across the worker pool.
+func imageTimeout(ctx context.Context, limit time.Duration, waiting, workers int) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return limit
+	}
+	remaining := time.Until(deadline)
+	rounds := (waiting + workers - 1) / workers
+	if rounds < 1 {
+		rounds = 1
+	}
+	share := remaining / time.Duration(rounds)
+	if share < minImageTimeout {
+		share = minImageTimeout
+		if remaining < share {
+			share = remaining
+		}
+	}
+	if share > limit {
+		share = limit
+	}
+	return share
+}
@@ -0,0 +1,197 @@
+package scanner
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// schemaVersion versions the published response schemas. Fields may be
+// added within a version; removing, renaming or retyping one starts the
+// next.
+const schemaVersion = "v1"
+
+// responseSchemas are the documents served under /schema/<version>/,
+// named after what they describe.
+var responseSchemas = map[string]interface{}{
+	"scan":                []ImageInfo{},
+	"scan-result":         ScanResult{},
+	"scan-summary":        ndjsonSummary{},
+	"image":               ImageInfo{},
+	"error":               errorResponse{},
+	"image-history":       historyResponse{},
+	"status":              StatusResponse{},
+	"cache-warm":          warmResponse{},
+	"crawl":               crawlResponse{},
+	"inventory":           InventoryReport{},
+	"fleet":               FleetReport{},
+	"preflight":           PreflightReport{},
+	"registries":          RegistrySummary{},
+	"diagnose":            RenderDiagnostics{},
+	"deliveries":          DeliveryReport{},
+	"results":             resultsResponse{},
+	"restore":             RestoreReport{},
+	"explain":             ImageExplanation{},
+	"train":               TrainReport{},
+	"approval":            Approval{},
+	"approvals":           approvalsResponse{},
+	"chart-defaults":      ChartDefaults{},
+	"chart-defaults-list": chartDefaultsResponse{},
+	"audit":               auditResponse{},
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaHandler serves GET /schema, the index of the schemas, and
+// GET /schema/<version>/<name>.json, one JSON Schema document.
+func (s *server) schemaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/schema"), "/")
+	if rest == "" {
+		index := make(map[string]string, len(responseSchemas))
+		for name := range responseSchemas {
+			index[name] = schemaPath(name)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"version": schemaVersion, "schemas": index})
+		return
+	}
+	version, file, _ := strings.Cut(rest, "/")
+	v, ok := responseSchemas[strings.TrimSuffix(file, ".json")]
+	if version != schemaVersion || !ok {
+		jsonError(w, http.StatusNotFound, "unknown schema "+rest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(jsonSchema(schemaPath(strings.TrimSuffix(file, ".json")), reflect.TypeOf(v)))
+}
+
+func schemaPath(name string) string {
+	return "/schema/" + schemaVersion + "/" + name + ".json"
+}
+
+// jsonSchema describes how encoding/json writes values of type t, as a
+// draft 2020-12 document. Named structs become $defs, so recursive and
+// shared types are described once.
+func jsonSchema(id string, t reflect.Type) map[string]interface{} {
+	g := &schemaGen{defs: make(map[string]interface{})}
+	doc := g.schema(t)
+	doc["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	doc["$id"] = id
+	if t.Name() != "" {
+		doc["title"] = t.Name()
+	}
+	if len(g.defs) > 0 {
+		doc["$defs"] = g.defs
+	}
+	return doc
+}
+
+type schemaGen struct {
+	defs map[string]interface{}
+}
+
+func (g *schemaGen) schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		ref := map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+		if _, ok := g.defs[t.Name()]; !ok {
+			g.defs[t.Name()] = nil // placeholder, for recursive types
+			g.defs[t.Name()] = g.object(t)
+		}
+		return ref
+	}
+	return map[string]interface{}{}
+}
+
+// object describes a struct's fields, including those promoted from
+// embedded structs. Fields without omitempty are required; nil slices,
+// maps and pointers among them are written as null.
+func (g *schemaGen) object(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	var required []string
+	g.fields(t, props, &required)
+	sort.Strings(required)
+	obj := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		obj["required"] = required
+	}
+	return obj
+}
+
+// fields adds the fields of t that props does not have yet. A struct's
+// own fields are added before those of its embedded structs, so that,
+// as for encoding/json, they hide promoted fields of the same name.
+func (g *schemaGen) fields(t reflect.Type, props map[string]interface{}, required *[]string) {
+	var embedded []reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			embedded = append(embedded, f.Type)
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if _, ok := props[name]; ok {
+			continue
+		}
+		prop := g.schema(f.Type)
+		if strings.Contains(","+opts+",", ",omitempty,") {
+			props[name] = prop
+			continue
+		}
+		*required = append(*required, name)
+		if k := f.Type.Kind(); (k == reflect.Ptr || k == reflect.Slice || k == reflect.Map) && f.Type != rawMessageType {
+			prop = map[string]interface{}{"anyOf": []interface{}{prop, map[string]interface{}{"type": "null"}}}
+		}
+		props[name] = prop
+	}
+	for _, e := range embedded {
+		g.fields(e, props, required)
+	}
+}
@@ -0,0 +1,258 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSchemasDescribePayloads encodes a value of every response type with
+// all its fields set and validates it against the published schema.
+func TestSchemasDescribePayloads(t *testing.T) {
+	names := make([]string, 0, len(responseSchemas))
+	for name := range responseSchemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			typ := reflect.TypeOf(responseSchemas[name])
+			v := reflect.New(typ).Elem()
+			populate(v, 0)
+			data, err := json.Marshal(v.Interface())
+			if err != nil {
+				t.Fatal(err)
+			}
+			validatePayload(t, name, data)
+		})
+	}
+}
+
+// TestSchemasDescribeScanResponses validates the responses of real scans:
+// the default list of images, the full report, and the lines of a stream.
+func TestSchemasDescribeScanResponses(t *testing.T) {
+	h, s := newE2E(t)
+	body := `{"chart_url": "` + h.chartURL("missing") + `", "render": true, "require_digest": true}`
+	scan := func(query, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/scan"+query, strings.NewReader(body))
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		s.scanHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("/scan%s answered %d: %s", query, w.Code, w.Body)
+		}
+		return w
+	}
+	validatePayload(t, "scan", scan("", "").Body.Bytes())
+	validatePayload(t, "scan-result", scan("?report=full", "").Body.Bytes())
+
+	sc := bufio.NewScanner(scan("", ndjsonType).Body)
+	lines := 0
+	for sc.Scan() {
+		lines++
+		if bytes.HasPrefix(sc.Bytes(), []byte(`{"summary"`)) {
+			validatePayload(t, "scan-summary", sc.Bytes())
+			continue
+		}
+		validatePayload(t, "image", sc.Bytes())
+	}
+	if lines != 2 {
+		t.Errorf("%d lines streamed, want an image and the summary", lines)
+	}
+
+	w := httptest.NewRecorder()
+	s.scanHandler(w, httptest.NewRequest(http.MethodPost, "/scan", strings.NewReader(`{}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("empty request answered %d, want 400", w.Code)
+	}
+	validatePayload(t, "error", w.Body.Bytes())
+}
+
+// validatePayload checks data against the schema published as name.
+func validatePayload(t *testing.T, name string, data []byte) {
+	t.Helper()
+	doc := jsonSchema(schemaPath(name), reflect.TypeOf(responseSchemas[name]))
+	// Round-trip the schema, so that it is checked as consumers read it.
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatalf("%s payload is not JSON: %v", name, err)
+	}
+	defs, _ := schema["$defs"].(map[string]interface{})
+	for _, p := range validate(schema, defs, v, "$") {
+		t.Errorf("%s: %s", name, p)
+	}
+}
+
+// validate checks v against the keywords jsonSchema writes. Properties
+// the schema does not list are reported too, since every field the
+// server writes should be described.
+func validate(schema, defs map[string]interface{}, v interface{}, at string) []string {
+	if ref, ok := schema["$ref"].(string); ok {
+		def, ok := defs[strings.TrimPrefix(ref, "#/$defs/")].(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: unresolved %s", at, ref)}
+		}
+		return validate(def, defs, v, at)
+	}
+	if any, ok := schema["anyOf"].([]interface{}); ok {
+		var problems []string
+		for _, alt := range any {
+			p := validate(alt.(map[string]interface{}), defs, v, at)
+			if len(p) == 0 {
+				return nil
+			}
+			problems = append(problems, p...)
+		}
+		return problems
+	}
+	typ, _ := schema["type"].(string)
+	switch typ {
+	case "":
+		return nil
+	case "null":
+		if v != nil {
+			return []string{fmt.Sprintf("%s: %v is not null", at, v)}
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return []string{fmt.Sprintf("%s: %v is not a boolean", at, v)}
+		}
+	case "integer":
+		n, ok := v.(json.Number)
+		if _, err := n.Int64(); !ok || err != nil {
+			return []string{fmt.Sprintf("%s: %v is not an integer", at, v)}
+		}
+	case "number":
+		if _, ok := v.(json.Number); !ok {
+			return []string{fmt.Sprintf("%s: %v is not a number", at, v)}
+		}
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return []string{fmt.Sprintf("%s: %v is not a string", at, v)}
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+				return []string{fmt.Sprintf("%s: %q is not a date-time", at, s)}
+			}
+		}
+	case "array":
+		list, ok := v.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: %v is not an array", at, v)}
+		}
+		items, _ := schema["items"].(map[string]interface{})
+		var problems []string
+		for i, item := range list {
+			problems = append(problems, validate(items, defs, item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+		return problems
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: %v is not an object", at, v)}
+		}
+		var problems []string
+		if extra, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+			for k, val := range obj {
+				problems = append(problems, validate(extra, defs, val, at+"."+k)...)
+			}
+			return problems
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		required, _ := schema["required"].([]interface{})
+		for _, r := range required {
+			if _, ok := obj[r.(string)]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: required %s is missing", at, r))
+			}
+		}
+		for k, val := range obj {
+			prop, ok := props[k].(map[string]interface{})
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s: %s is not in the schema", at, k))
+				continue
+			}
+			problems = append(problems, validate(prop, defs, val, at+"."+k)...)
+		}
+		return problems
+	default:
+		return []string{fmt.Sprintf("%s: unknown type %s", at, typ)}
+	}
+	return nil
+}
+
+// populate sets every field of v it can reach, a few levels deep, so
+// that the encoding of v has every field the type may write.
+func populate(v reflect.Value, depth int) {
+	if depth > 8 || !v.CanSet() {
+		return
+	}
+	switch {
+	case v.Type() == timeType:
+		v.Set(reflect.ValueOf(time.Date(2024, 6, 12, 8, 30, 0, 0, time.UTC)))
+		return
+	case v.Type() == rawMessageType:
+		v.Set(reflect.ValueOf(json.RawMessage(`{"key":"value"}`)))
+		return
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		p := reflect.New(v.Type().Elem())
+		populate(p.Elem(), depth+1)
+		v.Set(p)
+	case reflect.Interface:
+		if v.NumMethod() == 0 {
+			v.Set(reflect.ValueOf("value"))
+		}
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(7)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(7)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1.5)
+	case reflect.String:
+		v.SetString("value")
+	case reflect.Slice:
+		s := reflect.MakeSlice(v.Type(), 1, 1)
+		populate(s.Index(0), depth+1)
+		v.Set(s)
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			populate(v.Index(i), depth+1)
+		}
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		k := reflect.New(v.Type().Key()).Elem()
+		populate(k, depth+1)
+		e := reflect.New(v.Type().Elem()).Elem()
+		populate(e, depth+1)
+		m.SetMapIndex(k, e)
+		v.Set(m)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			populate(v.Field(i), depth+1)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// encryptedFormat marks files encrypted by the secrets subcommand.
+const encryptedFormat = "helm-image-scanner-encrypted"
+
+// encryptedFile is an envelope: the content is sealed with a random data
+// key, and the data key with a key of the key file, so that rotating the
+// key file only rewraps the data key.
+type encryptedFile struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	KeyID   string `json:"key_id"`
+	// WrappedKey is the data key sealed with the key KeyID, nonce first.
+	WrappedKey []byte `json:"wrapped_key"`
+	// Data is the content sealed with the data key, nonce first.
+	Data []byte `json:"data"`
+}
+
+// keyRing holds the keys of a -secrets-key-file. The first key encrypts;
+// all of them decrypt, so files wrapped with a retired key keep working
+// until they are rotated.
+type keyRing struct {
+	ids  []string
+	keys map[string][]byte
+}
+
+// loadKeyRing reads a key file: one "<id>:<base64 of 32 bytes>" per line,
+// the current key first. Empty lines and lines starting with # are
+// skipped. An empty path means no keys.
+func loadKeyRing(path string) (*keyRing, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading secrets key file: %w", err)
+	}
+	defer f.Close()
+	kr := &keyRing{keys: make(map[string][]byte)}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, enc, ok := strings.Cut(line, ":")
+		key, err := base64.StdEncoding.DecodeString(enc)
+		if !ok || id == "" || err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("secrets key file %s, line %d: want <id>:<base64 of 32 bytes>", path, n)
+		}
+		if _, dup := kr.keys[id]; dup {
+			return nil, fmt.Errorf("secrets key file %s, line %d: key %q is defined twice", path, n, id)
+		}
+		kr.ids = append(kr.ids, id)
+		kr.keys[id] = key
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading secrets key file: %w", err)
+	}
+	if len(kr.ids) == 0 {
+		return nil, fmt.Errorf("secrets key file %s holds no keys", path)
+	}
+	return kr, nil
+}
+
+func sealGCM(key, plaintext, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func openGCM(key, sealed, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed data is too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additional)
+}
+
+// encrypt seals plaintext with a new data key wrapped in the current key.
+func (kr *keyRing) encrypt(plaintext []byte) ([]byte, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	env := encryptedFile{Format: encryptedFormat, Version: 1}
+	data, err := sealGCM(dataKey, plaintext, []byte(encryptedFormat))
+	if err != nil {
+		return nil, err
+	}
+	env.Data = data
+	if err := kr.wrap(&env, dataKey); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(env, "", "  ")
+}
+
+func (kr *keyRing) wrap(env *encryptedFile, dataKey []byte) error {
+	env.KeyID = kr.ids[0]
+	wrapped, err := sealGCM(kr.keys[env.KeyID], dataKey, []byte(env.KeyID))
+	env.WrappedKey = wrapped
+	return err
+}
+
+func (kr *keyRing) unwrap(env encryptedFile) ([]byte, error) {
+	if kr == nil {
+		return nil, errors.New("the file is encrypted but no secrets key file is configured, see -secrets-key-file")
+	}
+	key := kr.keys[env.KeyID]
+	if key == nil {
+		return nil, fmt.Errorf("encrypted with key %q, which is not in the secrets key file", env.KeyID)
+	}
+	dataKey, err := openGCM(key, env.WrappedKey, []byte(env.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("key %q does not decrypt it", env.KeyID)
+	}
+	return dataKey, nil
+}
+
+// parseEncrypted returns the envelope of data, if it is one.
+func parseEncrypted(data []byte) (encryptedFile, bool) {
+	var env encryptedFile
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) || json.Unmarshal(data, &env) != nil || env.Format != encryptedFormat {
+		return env, false
+	}
+	return env, true
+}
+
+// decrypt returns the content of data, which is returned unchanged unless
+// it is an encrypted file.
+func (kr *keyRing) decrypt(data []byte) ([]byte, error) {
+	env, ok := parseEncrypted(data)
+	if !ok {
+		return data, nil
+	}
+	dataKey, err := kr.unwrap(env)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := openGCM(dataKey, env.Data, []byte(encryptedFormat))
+	if err != nil {
+		return nil, errors.New("the encrypted content is corrupt")
+	}
+	return plaintext, nil
+}
+
+// rotate rewraps the data key of an encrypted file with the current key.
+func (kr *keyRing) rotate(data []byte) ([]byte, bool, error) {
+	env, ok := parseEncrypted(data)
+	if !ok {
+		return nil, false, errors.New("not an encrypted file")
+	}
+	if env.KeyID == kr.ids[0] {
+		return data, false, nil
+	}
+	dataKey, err := kr.unwrap(env)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := kr.wrap(&env, dataKey); err != nil {
+		return nil, false, err
+	}
+	out, err := json.MarshalIndent(env, "", "  ")
+	return out, true, err
+}
+
+// readSecretFile reads a file that holds credentials, decrypting it when
+// it was encrypted with the secrets subcommand.
+func readSecretFile(path string, keys *keyRing) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := keys.decrypt(data)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %s: %w", path, err)
+	}
+	return plaintext, nil
+}
+
+// runSecrets is the secrets subcommand, which creates keys and encrypts,
+// decrypts and rotates credential files. It returns the exit code.
+func runSecrets(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("secrets", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: helm-image-scanner secrets [flags] keygen")
+		fmt.Fprintln(stderr, "       helm-image-scanner secrets [flags] encrypt|rotate <file>...")
+		fmt.Fprintln(stderr, "       helm-image-scanner secrets [flags] decrypt <file>")
+		fmt.Fprintln(stderr, "\nencrypt and rotate rewrite the files in place; decrypt writes to standard output.")
+		fs.PrintDefaults()
+	}
+	keyFile := fs.String("key-file", envString("SCANNER_SECRETS_KEY_FILE", ""), "secrets key file, the current key first (SCANNER_SECRETS_KEY_FILE)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	action, files := fs.Arg(0), fs.Args()[1:]
+	if action == "keygen" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "%s:%s\n", time.Now().UTC().Format("20060102T150405"), base64.StdEncoding.EncodeToString(key))
+		return 0
+	}
+	if (action != "encrypt" && action != "decrypt" && action != "rotate") || len(files) == 0 || (action == "decrypt" && len(files) > 1) {
+		fs.Usage()
+		return 2
+	}
+	keys, err := loadKeyRing(*keyFile)
+	if err == nil && keys == nil {
+		err = errors.New("no secrets key file, set -key-file or SCANNER_SECRETS_KEY_FILE")
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	code := 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			code = 1
+			continue
+		}
+		var out []byte
+		changed := true
+		switch action {
+		case "encrypt":
+			if _, ok := parseEncrypted(data); ok {
+				err = errors.New("already encrypted, use rotate to rewrap it")
+			} else {
+				out, err = keys.encrypt(data)
+			}
+		case "rotate":
+			out, changed, err = keys.rotate(data)
+		case "decrypt":
+			if out, err = keys.decrypt(data); err == nil {
+				stdout.Write(out)
+			}
+			changed = false
+		}
+		if err == nil && changed {
+			err = writeFileAtomic(file, out)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", file, err)
+			code = 1
+			continue
+		}
+		switch {
+		case action == "encrypt":
+			fmt.Fprintf(stderr, "%s: encrypted\n", file)
+		case action == "rotate" && changed:
+			fmt.Fprintf(stderr, "%s: rotated\n", file)
+		case action == "rotate":
+			fmt.Fprintf(stderr, "%s: already uses the current key\n", file)
+		}
+	}
+	return code
+}
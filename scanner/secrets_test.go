@@ -0,0 +1,215 @@
+package scanner
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeKeyFile writes a secrets key file holding lines and returns its
+// path.
+func writeKeyFile(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func keyLine(id string, b byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func TestLoadKeyRing(t *testing.T) {
+	kr, err := loadKeyRing(writeKeyFile(t, "# current first", keyLine("k2", 2), "", keyLine("k1", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(kr.ids, ",") != "k2,k1" || kr.keys["k1"][0] != 1 {
+		t.Errorf("keys %v", kr.ids)
+	}
+	if kr, err := loadKeyRing(""); kr != nil || err != nil {
+		t.Errorf("no path: %v, %v", kr, err)
+	}
+	short := "k:" + base64.StdEncoding.EncodeToString([]byte("short"))
+	for _, tc := range []struct {
+		name    string
+		lines   []string
+		wantErr string
+	}{
+		{"no id", []string{":" + strings.TrimPrefix(keyLine("k", 1), "k:")}, "line 1: want <id>:<base64 of 32 bytes>"},
+		{"no separator", []string{"k1"}, "line 1: want"},
+		{"bad base64", []string{"k1:***"}, "line 1: want"},
+		{"short key", []string{keyLine("k1", 1), short}, "line 2: want"},
+		{"duplicate", []string{keyLine("k1", 1), keyLine("k1", 2)}, `key "k1" is defined twice`},
+		{"only comments", []string{"# none yet"}, "holds no keys"},
+	} {
+		if _, err := loadKeyRing(writeKeyFile(t, tc.lines...)); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: error %v, want one containing %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestKeyRingEncryption(t *testing.T) {
+	kr := testKeyRing()
+	plaintext := []byte("repositories:\n  - name: private\n    password: s3cret\n")
+	sealed, err := kr.encrypt(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("s3cret")) {
+		t.Fatal("the encrypted file holds the password")
+	}
+	env, ok := parseEncrypted(sealed)
+	if !ok || env.KeyID != "k2" {
+		t.Fatalf("envelope %+v, want one wrapped with k2", env)
+	}
+	if got, err := kr.decrypt(sealed); err != nil || !bytes.Equal(got, plaintext) {
+		t.Fatalf("decrypted %q, %v", got, err)
+	}
+	if got, err := kr.decrypt(plaintext); err != nil || !bytes.Equal(got, plaintext) {
+		t.Errorf("a plain file was returned as %q, %v", got, err)
+	}
+	if got, err := (*keyRing)(nil).decrypt(plaintext); err != nil || !bytes.Equal(got, plaintext) {
+		t.Errorf("a plain file without keys was returned as %q, %v", got, err)
+	}
+
+	// edit returns the envelope changed by f.
+	edit := func(f func(*encryptedFile)) []byte {
+		e := env
+		e.Data = append([]byte(nil), env.Data...)
+		e.WrappedKey = append([]byte(nil), env.WrappedKey...)
+		f(&e)
+		out, _ := json.Marshal(e)
+		return out
+	}
+	for _, tc := range []struct {
+		name    string
+		keys    *keyRing
+		data    []byte
+		wantErr string
+	}{
+		{"no key file", nil, sealed, "no secrets key file is configured"},
+		{"key retired and removed", &keyRing{ids: []string{"k1"}, keys: map[string][]byte{"k1": kr.keys["k1"]}}, sealed, `key "k2", which is not in the secrets key file`},
+		{"key replaced", &keyRing{ids: []string{"k2"}, keys: map[string][]byte{"k2": kr.keys["k1"]}}, sealed, `key "k2" does not decrypt it`},
+		{"key ID relabelled", kr, edit(func(e *encryptedFile) { e.KeyID = "k1" }), `key "k1" does not decrypt it`},
+		{"wrapped key altered", kr, edit(func(e *encryptedFile) { e.WrappedKey[len(e.WrappedKey)-1] ^= 1 }), `key "k2" does not decrypt it`},
+		{"content altered", kr, edit(func(e *encryptedFile) { e.Data[len(e.Data)-1] ^= 1 }), "the encrypted content is corrupt"},
+		{"content truncated", kr, edit(func(e *encryptedFile) { e.Data = e.Data[:4] }), "the encrypted content is corrupt"},
+	} {
+		if _, err := tc.keys.decrypt(tc.data); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: error %v, want one containing %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestKeyRingRotate(t *testing.T) {
+	old := &keyRing{ids: []string{"k1"}, keys: map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)}}
+	sealed, err := old.encrypt([]byte("token: abc\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr := testKeyRing()
+	rotated, changed, err := kr.rotate(sealed)
+	if err != nil || !changed {
+		t.Fatalf("rotate: changed %v, %v", changed, err)
+	}
+	if env, _ := parseEncrypted(rotated); env.KeyID != "k2" {
+		t.Errorf("rotated to key %q, want k2", env.KeyID)
+	}
+	if got, err := kr.decrypt(rotated); err != nil || string(got) != "token: abc\n" {
+		t.Errorf("decrypted %q, %v", got, err)
+	}
+	if _, err := old.decrypt(rotated); err == nil {
+		t.Error("the retired key alone still decrypts the rotated file")
+	}
+	if again, changed, err := kr.rotate(rotated); err != nil || changed || !bytes.Equal(again, rotated) {
+		t.Errorf("second rotate: changed %v, %v", changed, err)
+	}
+	if _, _, err := kr.rotate([]byte("token: abc\n")); err == nil {
+		t.Error("a plain file was rotated")
+	}
+}
+
+func TestReadSecretFile(t *testing.T) {
+	dir := t.TempDir()
+	kr := testKeyRing()
+	sealed, _ := kr.encrypt([]byte("auths: {}\n"))
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, sealed, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readSecretFile(path, kr); err != nil || string(got) != "auths: {}\n" {
+		t.Errorf("read %q, %v", got, err)
+	}
+	if _, err := readSecretFile(path, nil); err == nil || !strings.Contains(err.Error(), "decrypting "+path) {
+		t.Errorf("error %v, want one naming the file", err)
+	}
+}
+
+func TestRunSecrets(t *testing.T) {
+	t.Setenv("SCANNER_SECRETS_KEY_FILE", "")
+	run := func(args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		code := runSecrets(args, &stdout, &stderr)
+		return code, stdout.String(), stderr.String()
+	}
+	code, key1, _ := run("keygen")
+	if code != 0 {
+		t.Fatalf("keygen exited %d", code)
+	}
+	keys := writeKeyFile(t, strings.TrimSpace(key1))
+	if _, err := loadKeyRing(keys); err != nil {
+		t.Fatalf("keygen wrote %q: %v", key1, err)
+	}
+
+	file := filepath.Join(t.TempDir(), "repositories.yaml")
+	plaintext := "repositories:\n  - name: private\n    password: s3cret\n"
+	if err := os.WriteFile(file, []byte(plaintext), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if code, _, stderr := run("-key-file", keys, "encrypt", file); code != 0 || !strings.Contains(stderr, "encrypted") {
+		t.Fatalf("encrypt exited %d: %s", code, stderr)
+	}
+	if data, _ := os.ReadFile(file); strings.Contains(string(data), "s3cret") {
+		t.Fatal("the file was not encrypted in place")
+	}
+	if code, _, stderr := run("-key-file", keys, "encrypt", file); code != 1 || !strings.Contains(stderr, "already encrypted") {
+		t.Errorf("second encrypt exited %d: %s", code, stderr)
+	}
+
+	// A new current key is added in front of the old one.
+	keys = writeKeyFile(t, keyLine("new", 9), strings.TrimSpace(key1))
+	if code, _, stderr := run("-key-file", keys, "rotate", file); code != 0 || !strings.Contains(stderr, "rotated") {
+		t.Fatalf("rotate exited %d: %s", code, stderr)
+	}
+	if code, _, stderr := run("-key-file", keys, "rotate", file); code != 0 || !strings.Contains(stderr, "already uses the current key") {
+		t.Errorf("second rotate exited %d: %s", code, stderr)
+	}
+	newOnly := writeKeyFile(t, keyLine("new", 9))
+	if code, stdout, stderr := run("-key-file", newOnly, "decrypt", file); code != 0 || stdout != plaintext {
+		t.Errorf("decrypt with the new key alone exited %d with %q: %s", code, stdout, stderr)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		args     []string
+		wantCode int
+	}{
+		{"no action", nil, 2},
+		{"unknown action", []string{"-key-file", keys, "shred", file}, 2},
+		{"no files", []string{"-key-file", keys, "encrypt"}, 2},
+		{"decrypt of two files", []string{"-key-file", keys, "decrypt", file, file}, 2},
+		{"no key file", []string{"encrypt", file}, 2},
+		{"missing file", []string{"-key-file", keys, "rotate", filepath.Join(t.TempDir(), "none")}, 1},
+	} {
+		if code, _, _ := run(tc.args...); code != tc.wantCode {
+			t.Errorf("%s: exited %d, want %d", tc.name, code, tc.wantCode)
+		}
+	}
+}
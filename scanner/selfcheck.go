@@ -0,0 +1,305 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// checkTimeout bounds each network check.
+const checkTimeout = 15 * time.Second
+
+// configCheck is the outcome of one configuration check.
+type configCheck struct {
+	Check  string
+	Detail string
+	Err    error
+	// Hint says what to change when the check failed.
+	Hint string
+}
+
+func (c configCheck) String() string {
+	if c.Err == nil {
+		if c.Detail == "" {
+			return "ok    " + c.Check
+		}
+		return "ok    " + c.Check + ": " + c.Detail
+	}
+	s := "FAIL  " + c.Check + ": " + c.Err.Error()
+	if c.Hint != "" {
+		s += "\n      " + c.Hint
+	}
+	return s
+}
+
+// pinger is implemented by result stores that live behind a connection,
+// such as a Config.ResultStore in a database, for the checks to ping.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// runValidateConfig is the validate-config subcommand. It takes the
+// server's flags and SCANNER_* variables, opens everything the server
+// would open, and checks that the chart repositories, registries and
+// clusters it has credentials for accept them, without serving. It returns
+// the exit code.
+func runValidateConfig(args []string, stdout, stderr io.Writer) int {
+	var checks []configCheck
+	add := func(check, detail string, err error, hint string) bool {
+		checks = append(checks, configCheck{Check: check, Detail: detail, Err: err, Hint: hint})
+		return err == nil
+	}
+	report := func() int {
+		code := 0
+		for _, c := range checks {
+			fmt.Fprintln(stdout, c)
+			if c.Err != nil {
+				code = 1
+			}
+		}
+		return code
+	}
+
+	cfg, err := LoadConfig(args)
+	if !add("flags and environment", "", err, "run helm-image-scanner -h for the flags and their SCANNER_* variables") {
+		return report()
+	}
+	keys, err := loadKeyRing(cfg.SecretsKeyFile)
+	add("secrets key file", optional(cfg.SecretsKeyFile), err, "")
+	helm, err := loadHelmConfig(cfg.HelmRepositories, cfg.HelmRegistryConfig, keys)
+	add("Helm configuration", helm.summary(), err, "fix the file named in the error, or point -helm-repositories and -helm-registry-config elsewhere")
+	kube, err := openKubeConfig(cfg.Kubeconfig, cfg.InCluster, keys)
+	add("cluster access", kube.summary(), err, "")
+	profiles, err := loadProfiles(cfg.ProfilesFile)
+	add("profiles", fmt.Sprintf("%d profiles", len(profiles)), err, "")
+	history, err := openHistoryStore(cfg.HistoryFile)
+	if add("history file", optional(cfg.HistoryFile), err, "the file must be writable by the scanner") {
+		defer history.Close()
+	}
+	crawls, err := openCrawlState(cfg.CrawlStateFile)
+	if add("crawl state file", optional(cfg.CrawlStateFile), err, "the file must be writable by the scanner") {
+		defer crawls.Close()
+	}
+	approvals, err := openApprovalLog(cfg.ApprovalsFile)
+	if add("approvals file", optional(cfg.ApprovalsFile), err, "the file must be writable by the scanner") {
+		defer approvals.Close()
+	}
+	audit, err := openAuditLog(cfg.AuditFile, keys)
+	if add("audit file", optional(cfg.AuditFile), err, "the file must be writable by the scanner, and an entry that fails verification was changed after it was written") {
+		defer audit.Close()
+	}
+	store, err := openResultStore(cfg)
+	if err == nil && store != nil {
+		defer store.Close()
+		if p, ok := store.(pinger); ok {
+			ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+			err = p.Ping(ctx)
+			cancel()
+		}
+	}
+	add("result store", optional(cfg.Store), err, "check -store; the embedded store's file must be writable and not open in another process")
+	sinks, err := openSinks(cfg)
+	add("sinks", fmt.Sprintf("%d sinks", len(sinks)), err, "")
+	catalog, err := openCatalog(cfg.Catalog, cfg.CacheTTL)
+	add("image catalog", optional(cfg.Catalog), err, "")
+	_, err = openEOLFeed(cfg.EOLFeed, cfg.EOLProducts, cfg.CacheTTL)
+	add("EOL feed", optional(cfg.EOLFeed), err, "")
+	_, err = openIssueFiler(cfg.Issues, cfg.IssuesAssigneeField)
+	add("issue tracker", optional(cfg.Issues), err, "")
+	auth, err := openAuthenticators(cfg)
+	add("authentication", fmt.Sprintf("%d authenticators", len(auth)), err, "")
+	workspaces, err := openWorkspaces(cfg.WorkDir, cfg.WorkspaceQuota, cfg.MaxWorkspaces)
+	if err == nil {
+		var ws *workspace
+		if ws, err = workspaces.create(context.Background()); err == nil {
+			err = ws.Close()
+		}
+	}
+	add("work directory", cfg.WorkDir, err, "the directory must be writable by the scanner")
+
+	if history == nil {
+		history, _ = openHistoryStore("")
+	}
+	if crawls == nil {
+		crawls, _ = openCrawlState("")
+	}
+	s := newServer(cfg, history, crawls, nil, kube, profiles, helm, catalog)
+	if profiles != nil {
+		err := s.checkProfiles()
+		add("profile options and policies", "", err, "fix the profile in "+cfg.ProfilesFile)
+	}
+	checks = append(checks, s.remoteChecks(context.Background())...)
+	return report()
+}
+
+func optional(setting string) string {
+	if setting == "" {
+		return "not configured"
+	}
+	return setting
+}
+
+func (hc *helmConfig) summary() string {
+	if hc == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d repositories, %d registry logins", len(hc.repos), len(hc.registry))
+}
+
+func (k *kubeConfig) summary() string {
+	switch {
+	case k == nil:
+		return "not configured"
+	case k.file == nil:
+		return "in cluster"
+	}
+	return fmt.Sprintf("%d contexts", len(k.contexts()))
+}
+
+// remoteChecks fetches the index of every Helm repository, authenticates
+// to every registry with a Helm registry login, asks every cluster
+// context for its version and reads every base image, so that
+// unreachable hosts and rejected credentials show before the first scan.
+func (s *server) remoteChecks(ctx context.Context) []configCheck {
+	var checks []configCheck
+	if s.helm != nil {
+		for _, r := range s.helm.repos {
+			c := configCheck{Check: "Helm repository " + r.Name, Detail: r.URL}
+			cctx, cancel := context.WithTimeout(ctx, checkTimeout)
+			idx, err := s.fetchIndex(cctx, r.URL)
+			cancel()
+			if err != nil {
+				c.Err = err
+				c.Hint = fmt.Sprintf("check the url of %s in repositories.yaml", r.Name)
+				if strings.Contains(err.Error(), "401") || strings.Contains(err.Error(), "403") {
+					c.Hint = fmt.Sprintf("the repository rejected the credentials: check username and password of %s in repositories.yaml", r.Name)
+				}
+			} else {
+				c.Detail = fmt.Sprintf("%s, %d charts", r.URL, len(idx.Entries))
+			}
+			checks = append(checks, c)
+		}
+		hosts := make([]string, 0, len(s.helm.registry))
+		for host := range s.helm.registry {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			checks = append(checks, s.checkRegistry(ctx, host))
+		}
+	}
+	if s.kube != nil {
+		for _, n := range s.kube.contexts() {
+			c := configCheck{Check: "cluster context " + n}
+			cctx, cancel := context.WithTimeout(ctx, checkTimeout)
+			var version struct {
+				GitVersion string `json:"gitVersion"`
+			}
+			client, err := s.kube.client(n)
+			if err == nil {
+				err = client.get(cctx, "/version", nil, &version)
+			}
+			cancel()
+			c.Detail, c.Err = version.GitVersion, err
+			if err != nil {
+				c.Hint = "check the server and credentials of the context in the kubeconfig"
+			}
+			checks = append(checks, c)
+		}
+	}
+	for _, ref := range s.cfg.BaseImages {
+		c := configCheck{Check: "base image " + ref}
+		cctx, cancel := context.WithTimeout(ctx, checkTimeout)
+		layers, err := baseLayers(cctx, s.registry, ref)
+		cancel()
+		if c.Err = err; err != nil {
+			c.Hint = "check the reference in -base-images and the registry's credentials"
+		} else {
+			c.Detail = fmt.Sprintf("%d layers", len(layers))
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+// checkRegistry authenticates to host as image pulls would and requests
+// the registry's API root.
+func (s *server) checkRegistry(ctx context.Context, host string) configCheck {
+	c := configCheck{Check: "registry " + host}
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	reg, err := name.NewRegistry(host)
+	if err != nil {
+		c.Err = err
+		return c
+	}
+	auth, err := s.helm.registry.Resolve(reg)
+	if err != nil {
+		c.Err = err
+		return c
+	}
+	hint := fmt.Sprintf("the registry rejected the login: run helm registry login %s again", host)
+	rt, err := transport.NewWithContext(ctx, reg, auth, s.registry.transport, nil)
+	if err != nil {
+		c.Err = err
+		if isAuthError(err) {
+			c.Hint = hint
+		}
+		return c
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reg.Scheme()+"://"+reg.RegistryStr()+"/v2/", nil)
+	if err != nil {
+		c.Err = err
+		return c
+	}
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	if err != nil {
+		c.Err = err
+		return c
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		c.Err, c.Hint = fmt.Errorf("login rejected: %s", resp.Status), hint
+	case resp.StatusCode != http.StatusOK:
+		c.Err = fmt.Errorf("unexpected status %s from /v2/", resp.Status)
+	case auth == authn.Anonymous:
+		c.Detail = "reachable, anonymous"
+	default:
+		c.Detail = "login accepted"
+	}
+	return c
+}
+
+// startupChecks runs the network checks of validate-config before the
+// server listens, for -startup-checks.
+func (s *server) startupChecks() error {
+	var failed []string
+	for _, c := range s.remoteChecks(context.Background()) {
+		if c.Err != nil {
+			log.Print("error: ", c)
+			failed = append(failed, c.Check)
+		}
+	}
+	if p, ok := s.store.(pinger); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+		defer cancel()
+		if err := p.Ping(ctx); err != nil {
+			log.Printf("error: result store: %v", err)
+			failed = append(failed, "result store")
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("startup checks failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,721 @@
+package scanner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"helm-image-scanner/internal/cli"
+)
+
+type scanRequest struct {
+	// ChartURL is a chart archive URL, an oci:// reference or repo/chart
+	// with a repository from Helm's repositories.yaml.
+	ChartURL string `json:"chart_url"`
+	// Version constrains the version of a repo/chart reference.
+	Version string `json:"version,omitempty"`
+	// Manifest is a Flux HelmRelease or Argo CD Application to scan
+	// instead of a chart URL.
+	Manifest string `json:"manifest,omitempty"`
+	// Terraform is a Terraform configuration with a helm_release.
+	Terraform string `json:"terraform,omitempty"`
+	// Profile names a server-side preset of the options below; fields
+	// set in the request override it.
+	Profile string `json:"profile,omitempty"`
+	// NoChartDefaults skips the options stored for the chart, see
+	// /chart-defaults.
+	NoChartDefaults bool `json:"no_chart_defaults,omitempty"`
+	// chartDefaults is the chart whose stored options were applied.
+	chartDefaults string
+
+	Options
+}
+
+// Options are the option fields of a /scan request, which Run takes as
+// well. The zero value scans with the server's settings.
+type Options struct {
+	// Optional overrides of the server defaults, limited by the
+	// admin-configured bounds.
+	Concurrency int    `json:"concurrency,omitempty"`
+	Inspection  string `json:"inspection,omitempty"`
+	NoCache     bool   `json:"no_cache,omitempty"`
+	// MaxImages lowers the server's cap on the images one scan inspects.
+	MaxImages int `json:"max_images,omitempty"`
+
+	// Policies; a policy enabled in the server config cannot be turned
+	// off by a request.
+	RequireDigest     bool `json:"require_digest,omitempty"`
+	NoHardcodedImages bool `json:"no_hardcoded_images,omitempty"`
+	TrustedDockerHub  bool `json:"trusted_docker_hub,omitempty"`
+
+	// Template rendering. Values are merged over the chart's values.yaml.
+	Render      *bool                  `json:"render,omitempty"`
+	Values      map[string]interface{} `json:"values,omitempty"`
+	ReleaseName string                 `json:"release_name,omitempty"`
+	Namespace   string                 `json:"namespace,omitempty"`
+
+	// KubeVersion is the Kubernetes version to check the chart against.
+	KubeVersion string `json:"kube_version,omitempty"`
+	// Nodes is the cluster size pull estimates assume.
+	Nodes int `json:"nodes,omitempty"`
+	// Platforms every image must have a build for, as os/arch[/variant].
+	Platforms []string `json:"platforms,omitempty"`
+	// Prices override the server's prices for the cost estimate.
+	Prices *CostPrices `json:"prices,omitempty"`
+	// Rewrites map registry or repository prefixes to mirrors, such as a
+	// pull-through cache, that the images are checked in.
+	Rewrites map[string]string `json:"rewrites,omitempty"`
+	// AllowedRegistries restricts the registries the scan contacts for
+	// images and oci:// charts; images of any other registry are
+	// reported, not inspected, and such a chart fails the scan.
+	AllowedRegistries []string `json:"allowed_registries,omitempty"`
+	// SuppressWarnings are warning codes, or CODE:prefix, to leave out in
+	// addition to those of the server.
+	SuppressWarnings []string `json:"suppress_warnings,omitempty"`
+
+	// CompareDeployed diffs the chart's images against the pods of the
+	// release named by ReleaseName, in the cluster of KubeContext.
+	CompareDeployed bool   `json:"compare_deployed,omitempty"`
+	KubeContext     string `json:"kube_context,omitempty"`
+	// Debug returns a trace of the pipeline's decisions with the result.
+	Debug bool `json:"debug,omitempty"`
+	// CheckLinks verifies the icon, home and sources links of the chart.
+	CheckLinks bool `json:"check_links,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type server struct {
+	cfg        Config
+	cache      *imageCache
+	indexes    *indexCache
+	history    *historyStore
+	store      ResultStore
+	sinks      fanOut
+	deliveries *deliveryTracker
+	registry   registryClient
+	client     *http.Client
+	tracker    *scanTracker
+	limits     *rateLimits
+	crawls     *crawlState
+	approvals  *approvalLog
+	// chartDefaults are the options stored per chart.
+	chartDefaults *chartDefaultsStore
+	audit         *auditLog
+	kube          *kubeConfig
+	profiles      scanProfiles
+	helm          *helmConfig
+	catalog       *imageCatalog
+	eol           *eolFeed
+	windows       *scanCalendar
+	issues        *issueFiler
+	auth          authenticators
+	workspaces    *workspaces
+	bases         *baseImages
+	hub           *dockerHub
+	mirrors       *mirrorSet
+}
+
+func init() { cli.Main = command }
+
+// command runs the command line: the service, or the subcommand named by
+// the first argument. It returns once the service has shut down;
+// subcommands exit the process.
+func command() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "scan":
+			os.Exit(runScan(os.Args[2:], os.Stdout, os.Stderr))
+		case "post-render":
+			os.Exit(runPostRender(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		case "bench":
+			os.Exit(runBench(os.Args[2:], os.Stdout, os.Stderr))
+		case "backup":
+			os.Exit(runBackup(os.Args[2:], os.Stdout, os.Stderr))
+		case "restore":
+			os.Exit(runRestore(os.Args[2:], os.Stdout, os.Stderr))
+		case "secrets":
+			os.Exit(runSecrets(os.Args[2:], os.Stdout, os.Stderr))
+		case "validate-config":
+			os.Exit(runValidateConfig(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+	cfg, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := installLogLevel(os.Stderr, cfg.LogLevel); err != nil {
+		log.Fatal(err)
+	}
+	// SIGINT and SIGTERM stop the server: requests in flight get up to
+	// -scan-timeout to finish, and the stores are closed on the way out.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := Serve(ctx, cfg); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+}
+
+// Serve runs the service of cfg on cfg.Addr until ctx is done, then gives
+// the requests in flight up to cfg.ScanTimeout to finish and closes its
+// files and stores.
+func Serve(ctx context.Context, cfg Config) error {
+	history, err := openHistoryStore(cfg.HistoryFile)
+	if err != nil {
+		return err
+	}
+	defer history.Close()
+	crawls, err := openCrawlState(cfg.CrawlStateFile)
+	if err != nil {
+		return err
+	}
+	defer crawls.Close()
+	sinks, err := openSinks(cfg)
+	if err != nil {
+		return err
+	}
+	keys, err := loadKeyRing(cfg.SecretsKeyFile)
+	if err != nil {
+		return err
+	}
+	kube, err := openKubeConfig(cfg.Kubeconfig, cfg.InCluster, keys)
+	if err != nil {
+		return err
+	}
+	profiles, err := loadProfiles(cfg.ProfilesFile)
+	if err != nil {
+		return err
+	}
+	helm, err := loadHelmConfig(cfg.HelmRepositories, cfg.HelmRegistryConfig, keys)
+	if err != nil {
+		return err
+	}
+	catalog, err := openCatalog(cfg.Catalog, cfg.CacheTTL)
+	if err != nil {
+		return err
+	}
+	eol, err := openEOLFeed(cfg.EOLFeed, cfg.EOLProducts, cfg.CacheTTL)
+	if err != nil {
+		return err
+	}
+	issues, err := openIssueFiler(cfg.Issues, cfg.IssuesAssigneeField)
+	if err != nil {
+		return err
+	}
+	auth, err := openAuthenticators(cfg)
+	if err != nil {
+		return err
+	}
+	workspaces, err := openWorkspaces(cfg.WorkDir, cfg.WorkspaceQuota, cfg.MaxWorkspaces)
+	if err != nil {
+		return err
+	}
+	workspaces.sweep()
+	store, err := openResultStore(cfg)
+	if err != nil {
+		return err
+	}
+	if store != nil {
+		defer store.Close()
+	}
+	approvals, err := openApprovalLog(cfg.ApprovalsFile)
+	if err != nil {
+		return err
+	}
+	defer approvals.Close()
+	chartDefaults, err := openChartDefaults(cfg.ChartDefaultsFile)
+	if err != nil {
+		return err
+	}
+	defer chartDefaults.Close()
+	audit, err := openAuditLog(cfg.AuditFile, keys)
+	if err != nil {
+		return err
+	}
+	defer audit.Close()
+	s := newServer(cfg, history, crawls, sinks, kube, profiles, helm, catalog)
+	s.store = store
+	s.eol = eol
+	s.issues = issues
+	s.auth = auth
+	s.workspaces = workspaces
+	s.approvals = approvals
+	s.chartDefaults = chartDefaults
+	s.audit = audit
+	if err := s.auditStartup(keys); err != nil {
+		return err
+	}
+	if err := s.checkProfiles(); err != nil {
+		return err
+	}
+	if cfg.StartupChecks {
+		if err := s.startupChecks(); err != nil {
+			return err
+		}
+	}
+	if len(cfg.CrawlRepos) > 0 {
+		go s.crawlPeriodically(cfg.CrawlRepos, cfg.CrawlInterval)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go s.cache.sweepEvery(ctx)
+	srv := &http.Server{Addr: cfg.Addr, Handler: withBasePath(cfg.BasePath, withAuth(s.auth, s.routes()))}
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-ctx.Done()
+		log.Printf("Shutting down")
+		shutdown, cancel := context.WithTimeout(context.Background(), cfg.ScanTimeout)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+	log.Printf("Listening on %s%s", cfg.Addr, cfg.BasePath)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-drained
+	return nil
+}
+
+func newServer(cfg Config, history *historyStore, crawls *crawlState, sinks fanOut, kube *kubeConfig, profiles scanProfiles, helm *helmConfig, catalog *imageCatalog) *server {
+	var allowed []string
+	if cfg.Untrusted {
+		allowed = cfg.AllowedHosts
+	}
+	limits := newRateLimits()
+	polite := &politeTransport{
+		next:         helm.transport(replayable(newTransport(allowed, newHostResolver(cfg.Pins, cfg.DNSCacheTTL), cfg.connSettings()), cfg.Record, cfg.Replay)),
+		userAgent:    cfg.UserAgent,
+		hostInterval: cfg.HostInterval,
+		nextHost:     make(map[string]time.Time),
+	}
+	if cfg.MaxRequestsPerSec > 0 {
+		polite.interval = time.Second / time.Duration(cfg.MaxRequestsPerSec)
+	}
+	transport := &countingTransport{next: &rateLimitTransport{next: polite, limits: limits}}
+	registry := registryClient{transport: transport, anonymous: cfg.Untrusted}
+	if helm != nil && len(helm.registry) > 0 {
+		registry.keychain = helm.registry
+	}
+	approvals, _ := openApprovalLog("")
+	chartDefaults, _ := openChartDefaults("")
+	audit, _ := openAuditLog("", nil)
+	return &server{
+		cfg:           cfg,
+		cache:         newImageCache(cfg.CacheTTL),
+		indexes:       newIndexCache(cfg.CacheTTL),
+		history:       history,
+		sinks:         sinks,
+		deliveries:    newDeliveryTracker(sinks, cfg.SinkRetries, cfg.SinkBackoff),
+		registry:      registry,
+		client:        &http.Client{Transport: transport},
+		tracker:       newScanTracker(cfg.MaxScans),
+		limits:        limits,
+		crawls:        crawls,
+		approvals:     approvals,
+		chartDefaults: chartDefaults,
+		audit:         audit,
+		kube:          kube,
+		profiles:      profiles,
+		helm:          helm,
+		catalog:       catalog,
+		bases:         newBaseImages(cfg.BaseImages, cfg.CacheTTL),
+		hub:           newDockerHub(cfg.DockerHubAPI, cfg.DockerHubTrustedBadges, cfg.DockerHubTrustedNamespaces, cfg.CacheTTL),
+		mirrors:       newMirrorSet(cfg.Mirrors, cfg.MirrorHealthTTL),
+		windows:       newScanCalendar(cfg.BulkWindows, cfg.BulkTimezone),
+	}
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/scan", s.scanHandler)
+	mux.HandleFunc("/images/", s.imageHistoryHandler)
+	mux.HandleFunc("/status", s.statusHandler)
+	mux.HandleFunc("/cache/warm", s.cacheWarmHandler)
+	mux.HandleFunc("/crawl", s.crawlHandler)
+	mux.HandleFunc("/inventory", s.inventoryHandler)
+	mux.HandleFunc("/train", s.trainHandler)
+	mux.HandleFunc("/fleet", s.fleetHandler)
+	mux.HandleFunc("/profiles", s.profilesHandler)
+	mux.HandleFunc("/chart-defaults", s.chartDefaultsHandler)
+	mux.HandleFunc("/preflight", s.preflightHandler)
+	mux.HandleFunc("/registries", s.registriesHandler)
+	mux.HandleFunc("/diagnose", s.diagnoseHandler)
+	mux.HandleFunc("/deliveries", s.deliveriesHandler)
+	mux.HandleFunc("/deliveries/", s.deliveriesHandler)
+	mux.HandleFunc("/results", s.resultsHandler)
+	mux.HandleFunc("/results/", s.resultsHandler)
+	mux.HandleFunc("/approvals", s.approvalsHandler)
+	mux.HandleFunc("/scans/", s.explainHandler)
+	mux.HandleFunc("/admin/backup", s.backupHandler)
+	mux.HandleFunc("/admin/restore", s.restoreHandler)
+	mux.HandleFunc("/admin/log-level", s.logLevelHandler)
+	mux.HandleFunc("/admin/audit", s.auditHandler)
+	mux.HandleFunc("/schema", s.schemaHandler)
+	mux.HandleFunc("/schema/", s.schemaHandler)
+	return mux
+}
+
+func (s *server) scanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fields, err := parseFields(r, ImageInfo{})
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	units, err := s.unitsFor(r)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	report, err := wantsReport(r)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req, err := s.decodeScanRequest(r.Body)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.ScanTimeout)
+	defer cancel()
+	if req.Debug {
+		ctx = withTrace(ctx)
+	}
+	source, code, err := s.resolveScanTarget(ctx, &req)
+	if err != nil {
+		msg := err.Error()
+		if code == http.StatusInternalServerError {
+			msg = "scan failed: " + msg
+		}
+		jsonError(w, code, msg)
+		return
+	}
+
+	opts, err := s.scanOptionsFor(req, parseCacheControl(r.Header.Get("Cache-Control")))
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.CompareDeployed {
+		switch {
+		case s.kube == nil:
+			jsonError(w, http.StatusBadRequest, "cluster access is not configured, see -kubeconfig and -in-cluster")
+			return
+		case req.ReleaseName == "":
+			jsonError(w, http.StatusBadRequest, "compare_deployed requires release_name")
+			return
+		}
+	}
+
+	fail := func(code int, msg string) { jsonError(w, code, msg) }
+	var stream *ndjsonWriter
+	if acceptsNDJSON(r) {
+		stream = &ndjsonWriter{w: w, fields: fields, units: units}
+		fail = stream.fail
+		opts.OnImage = func(info ImageInfo) {
+			info.HistoryURL = s.externalURL(r, "/images/"+info.Image+"/history")
+			stream.image(info)
+		}
+	}
+
+	result, err := s.scanChartForImages(ctx, req.ChartURL, opts)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, errEgressBlocked) {
+			code = http.StatusForbidden
+		}
+		fail(code, fmt.Sprintf("scan failed: %v", err))
+		return
+	}
+	result.Source = source
+	result.ChartDefaults = req.chartDefaults
+	if req.CompareDeployed {
+		result.Deployed, err = s.compareDeployed(ctx, req.KubeContext, req.Namespace, req.ReleaseName, result)
+		if err != nil {
+			fail(http.StatusBadGateway, fmt.Sprintf("comparing with the deployed release: %v", err))
+			return
+		}
+	}
+
+	for i := range result.Images {
+		result.Images[i].HistoryURL = s.externalURL(r, "/images/"+result.Images[i].Image+"/history")
+	}
+	result.Trace = traceEvents(ctx)
+	s.publish(result)
+	if stream != nil {
+		stream.summary(result)
+		return
+	}
+	if !report {
+		// The documented response is the list of images; the chart-level
+		// reports come with ?report=full.
+		writeSelected(w, result.Images, fields, units)
+		return
+	}
+	writeSelected(w, result, fields, units)
+}
+
+// wantsReport reads the report query parameter of /scan: full asks for
+// the whole ScanResult instead of the list of images.
+func wantsReport(r *http.Request) (bool, error) {
+	switch v := r.URL.Query().Get("report"); v {
+	case "":
+		return false, nil
+	case "full":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown report %q, want full", v)
+	}
+}
+
+// resolveScanTarget turns the chart a /scan request names, as chart_url,
+// repo/chart, manifest or terraform, into the archive URL in
+// req.ChartURL, applying a release's values, name and namespace. Failures
+// come with the status code to answer with.
+func (s *server) resolveScanTarget(ctx context.Context, req *scanRequest) (*ReleaseSource, int, error) {
+	given := 0
+	for _, f := range []string{req.ChartURL, req.Manifest, req.Terraform} {
+		if f != "" {
+			given++
+		}
+	}
+	if given != 1 {
+		return nil, http.StatusBadRequest, errors.New("exactly one of chart_url, manifest and terraform is required")
+	}
+	if req.Version != "" && !isChartRef(req.ChartURL) {
+		return nil, http.StatusBadRequest, errors.New("version applies to repo/chart references only")
+	}
+	if req.ChartURL != "" {
+		if isChartRef(req.ChartURL) {
+			repo, chart, err := s.splitChartRef(req.ChartURL)
+			if err != nil {
+				return nil, http.StatusBadRequest, err
+			}
+			if err := chartRepoAllowed(repo.URL, req.AllowedRegistries); err != nil {
+				return nil, http.StatusForbidden, err
+			}
+			if req.ChartURL, _, err = s.locateChart(ctx, repo.URL, chart, req.Version); err != nil {
+				return nil, http.StatusInternalServerError, fmt.Errorf("resolving chart: %w", err)
+			}
+		}
+		return nil, 0, nil
+	}
+	var rel *releaseSpec
+	var err error
+	if req.Manifest != "" {
+		rel, err = parseReleaseManifest([]byte(req.Manifest))
+	} else {
+		rel, err = parseTerraformRelease([]byte(req.Terraform))
+	}
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if rel.localPath != "" {
+		return nil, http.StatusBadRequest, errors.New("local charts can only be scanned with their repository, see /inventory")
+	}
+	if err := chartRepoAllowed(rel.source.Repository, req.AllowedRegistries); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+	chartURL, version, err := s.resolveRelease(ctx, rel)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("resolving chart: %w", err)
+	}
+	rel.source.Version = version
+	req.ChartURL = chartURL
+	// Request values refine the release's own values.
+	req.Values = mergeValues(rel.values, req.Values)
+	if req.ReleaseName == "" {
+		req.ReleaseName = rel.releaseName
+	}
+	if req.Namespace == "" {
+		req.Namespace = rel.namespace
+	}
+	return &rel.source, 0, nil
+}
+
+// chartRepoAllowed fails for an oci:// chart repository outside allowed,
+// before its tags are listed to pick a version.
+func chartRepoAllowed(repo string, allowed []string) error {
+	base, ok := strings.CutPrefix(repo, "oci://")
+	if !ok {
+		return nil
+	}
+	if err := (scanOptions{AllowedRegistries: allowed}).egressAllowed(base); err != nil {
+		return fmt.Errorf("resolving chart: %w", err)
+	}
+	return nil
+}
+
+// scanOptionsFor applies the request's overrides to the server defaults,
+// rejecting any that fall outside the configured bounds.
+func (s *server) scanOptionsFor(req scanRequest, cc cacheControl) (scanOptions, error) {
+	opts := scanOptions{
+		Concurrency:  s.cfg.Concurrency,
+		ImageTimeout: s.cfg.ImageTimeout,
+		Deep:         s.cfg.Inspection == inspectionDeep,
+		Policy: policyOptions{
+			RequireDigest:     s.cfg.RequireDigest || req.RequireDigest,
+			NoHardcodedImages: s.cfg.NoHardcodedImages || req.NoHardcodedImages,
+			TrustedDockerHub:  s.cfg.TrustedDockerHub || req.TrustedDockerHub,
+		},
+		Render: s.cfg.Render,
+		RenderOpts: renderOptions{
+			Timeout:     s.cfg.RenderTimeout,
+			MaxOutput:   s.cfg.RenderMaxOutput,
+			MaxDepth:    s.cfg.RenderMaxDepth,
+			Values:      req.Values,
+			ReleaseName: req.ReleaseName,
+			Namespace:   req.Namespace,
+		},
+		Archive:    defaultArchiveLimits,
+		Nodes:      defaultNodeCount,
+		CheckLinks: s.cfg.CheckLinks || req.CheckLinks,
+		MaxImages:  s.cfg.MaxImages,
+	}
+	if req.Render != nil {
+		opts.Render = *req.Render
+	}
+	if s.cfg.Untrusted {
+		// Hardened mode: no template execution and tight archive limits,
+		// whatever the request asks for.
+		if opts.Render {
+			return opts, fmt.Errorf("rendering is disabled in untrusted mode")
+		}
+		opts.Archive = strictArchiveLimits
+	}
+	if req.Concurrency != 0 {
+		if req.Concurrency < 1 || req.Concurrency > s.cfg.MaxConcurrency {
+			return opts, fmt.Errorf("concurrency must be between 1 and %d", s.cfg.MaxConcurrency)
+		}
+		opts.Concurrency = req.Concurrency
+	}
+	switch req.Inspection {
+	case "":
+	case inspectionMetadata:
+		opts.Deep = false
+	case inspectionDeep:
+		if !s.cfg.AllowDeep && s.cfg.Inspection != inspectionDeep {
+			return opts, fmt.Errorf("deep inspection is disabled on this server")
+		}
+		opts.Deep = true
+	default:
+		return opts, fmt.Errorf("inspection must be %q or %q", inspectionMetadata, inspectionDeep)
+	}
+	if req.MaxImages != 0 {
+		switch {
+		case req.MaxImages < 1:
+			return opts, fmt.Errorf("max_images must be at least 1")
+		case s.cfg.MaxImages > 0 && req.MaxImages > s.cfg.MaxImages:
+			return opts, fmt.Errorf("max_images must not exceed %d", s.cfg.MaxImages)
+		}
+		opts.MaxImages = req.MaxImages
+	}
+	if req.Nodes != 0 {
+		if req.Nodes < 1 {
+			return opts, fmt.Errorf("nodes must be at least 1")
+		}
+		opts.Nodes = req.Nodes
+	}
+	platforms := s.cfg.Platforms
+	if req.Platforms != nil {
+		platforms = req.Platforms
+	}
+	var err error
+	if opts.Platforms, err = parsePlatforms(platforms); err != nil {
+		return opts, err
+	}
+	opts.Prices = s.cfg.Prices
+	if req.Prices != nil {
+		if err := req.Prices.validate(); err != nil {
+			return opts, err
+		}
+		opts.Prices = opts.Prices.over(*req.Prices)
+	}
+	rewrites := s.cfg.Rewrites
+	if req.Rewrites != nil {
+		rewrites = req.Rewrites
+	}
+	if opts.Rewrites, err = parseRewrites(rewrites); err != nil {
+		return opts, err
+	}
+	suppress := append(append([]string(nil), s.cfg.SuppressWarnings...), req.SuppressWarnings...)
+	if opts.SuppressWarnings, err = parseWarningFilters(suppress); err != nil {
+		return opts, err
+	}
+	opts.LargeImageBytes = s.cfg.LargeImageBytes
+	for _, r := range req.AllowedRegistries {
+		r = strings.TrimSpace(r)
+		if r == "" || strings.Contains(r, "/") {
+			return opts, fmt.Errorf("invalid allowed registry %q, want a host name, host:port or *.domain", r)
+		}
+		opts.AllowedRegistries = append(opts.AllowedRegistries, r)
+	}
+	if req.KubeVersion != "" {
+		v, _, err := normalizeKubeVersion(req.KubeVersion)
+		if err != nil {
+			return opts, err
+		}
+		opts.KubeVersion = v
+		opts.RenderOpts.KubeVersion = v
+	}
+	if req.NoCache || cc.noCache || cc.maxAge > 0 {
+		if !s.cfg.AllowCacheBypass {
+			return opts, fmt.Errorf("cache bypass is disabled on this server")
+		}
+		opts.Revalidate = req.NoCache || cc.noCache
+		opts.MaxAge = cc.maxAge
+	}
+	return opts, nil
+}
+
+type cacheControl struct {
+	noCache bool
+	maxAge  time.Duration
+}
+
+// parseCacheControl picks the request directives the scanner honours out
+// of a Cache-Control header: no-cache and max-age=<seconds>. A max-age of
+// zero is treated as no-cache.
+func parseCacheControl(h string) cacheControl {
+	var cc cacheControl
+	for _, d := range strings.Split(h, ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		switch {
+		case d == "no-cache":
+			cc.noCache = true
+		case strings.HasPrefix(d, "max-age="):
+			n, err := strconv.Atoi(strings.TrimPrefix(d, "max-age="))
+			if err != nil || n < 0 {
+				continue
+			}
+			if n == 0 {
+				cc.noCache = true
+			} else {
+				cc.maxAge = time.Duration(n) * time.Second
+			}
+		}
+	}
+	return cc
+}
+
+func jsonError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(errorResponse{Error: msg})
+}
@@ -0,0 +1,309 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink receives every finished scan. Implementations must be safe for
+// concurrent use.
+type Sink interface {
+	Write(ctx context.Context, result ScanResult) error
+}
+
+// sinkTimeout bounds how long publishing one result to all sinks may take.
+const sinkTimeout = 30 * time.Second
+
+// fanOut writes each result to all of its sinks in parallel. A failing
+// sink does not stop the others; their errors are joined.
+type fanOut []Sink
+
+func (f fanOut) Write(ctx context.Context, result ScanResult) error {
+	errs := make([]error, len(f))
+	var wg sync.WaitGroup
+	for i, sink := range f {
+		wg.Add(1)
+		go func(i int, sink Sink) {
+			defer wg.Done()
+			errs[i] = sink.Write(ctx, result)
+		}(i, sink)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// parseSinks builds the sink pipeline from a comma-separated list of
+// destinations:
+//
+//	stdout                          one JSON document per line on stdout
+//	file:///var/lib/scans.jsonl     appended as JSON lines
+//	https://hooks.example.com/scan  POSTed as JSON
+//	https://...#template=jira.tmpl  POSTed as the template renders it
+//	s3://bucket/prefix?region=eu-west-1[&endpoint=https://minio:9000]
+//
+// Sinks of other kinds are passed in Config.ExtraSinks; openSinks adds
+// them after these.
+func parseSinks(spec string) (fanOut, error) {
+	var sinks fanOut
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		sink, err := parseSink(s)
+		if err != nil {
+			return nil, fmt.Errorf("sink %q: %w", s, err)
+		}
+		sinks = append(sinks, &namedSink{Sink: sink, name: sinkName(s)})
+	}
+	return sinks, nil
+}
+
+// openSinks builds the sinks of the configuration: those cfg.Sinks names
+// and then cfg.ExtraSinks.
+func openSinks(cfg Config) (fanOut, error) {
+	sinks, err := parseSinks(cfg.Sinks)
+	if err != nil {
+		return nil, err
+	}
+	return append(sinks, cfg.ExtraSinks...), nil
+}
+
+func parseSink(s string) (Sink, error) {
+	if s == "stdout" {
+		return &writerSink{w: os.Stdout}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		f, err := os.OpenFile(u.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		return &writerSink{w: f}, nil
+	case "http", "https":
+		target, payload, err := webhookOptions(u)
+		if err != nil {
+			return nil, err
+		}
+		return &webhookSink{url: target, payload: payload, client: &http.Client{Timeout: sinkTimeout}}, nil
+	case "s3":
+		return newS3Sink(u)
+	}
+	return nil, fmt.Errorf("unknown sink type")
+}
+
+// writerSink writes results as JSON lines to w.
+type writerSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *writerSink) Write(_ context.Context, result ScanResult) error {
+	b, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
+
+// webhookSink POSTs each result as a JSON body, or as the body its payload
+// template renders.
+type webhookSink struct {
+	url     string
+	payload *payloadTemplate
+	client  *http.Client
+}
+
+func (s *webhookSink) Write(ctx context.Context, result ScanResult) error {
+	b, err := json.Marshal(result)
+	contentType := "application/json"
+	if s.payload != nil {
+		b, err = s.payload.render(result)
+		contentType = s.payload.contentType
+	}
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		err := fmt.Errorf("webhook returned %s", resp.Status)
+		// Other client errors mean the hook rejects the payload, which
+		// sending it again will not change.
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return permanentError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+// s3Sink PUTs each result as an object under prefix, signed with AWS
+// Signature Version 4 using the standard AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and optional AWS_SESSION_TOKEN variables. An
+// endpoint parameter selects an S3-compatible store, addressed path-style.
+type s3Sink struct {
+	bucket, prefix, region string
+	endpoint               *url.URL
+	accessKey, secretKey   string
+	sessionToken           string
+	client                 *http.Client
+}
+
+func newS3Sink(u *url.URL) (*s3Sink, error) {
+	s := &s3Sink{
+		bucket:       u.Host,
+		prefix:       strings.Trim(u.Path, "/"),
+		region:       u.Query().Get("region"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{Timeout: sinkTimeout},
+	}
+	if s.bucket == "" {
+		return nil, fmt.Errorf("missing bucket")
+	}
+	if s.region == "" {
+		s.region = envString("AWS_REGION", "us-east-1")
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	endpoint := u.Query().Get("endpoint")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region)
+	}
+	ep, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("endpoint: %w", err)
+	}
+	s.endpoint = ep
+	return s, nil
+}
+
+func (s *s3Sink) Write(ctx context.Context, result ScanResult) error {
+	b, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(b)
+	key := fmt.Sprintf("%s/%s-%s.json", result.ScannedAt.UTC().Format("2006/01/02"),
+		result.ScannedAt.UTC().Format("150405"), hex.EncodeToString(sum[:6]))
+	if s.prefix != "" {
+		key = s.prefix + "/" + key
+	}
+	u := *s.endpoint
+	u.Path = "/" + s.bucket + "/" + key
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	s.sign(req, hex.EncodeToString(sum[:]), time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("s3 PUT returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (s *s3Sink) sign(req *http.Request, payloadHash string, now time.Time) {
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signed := []string{"content-type", "x-amz-content-sha256"}
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+		signed = append(signed, "x-amz-security-token")
+	}
+	signV4(req, signed, payloadHash, s.accessKey, s.secretKey, s.region, "s3", now)
+}
+
+// signV4 signs req for an AWS service with Signature Version 4: it sets
+// X-Amz-Date and an Authorization header covering the method, path,
+// query, host, X-Amz-Date and the headers named, lower-case, in signed.
+func signV4(req *http.Request, signed []string, payloadHash, accessKey, secretKey, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	names := append([]string{"host", "x-amz-date"}, signed...)
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	// Query values are sorted by Encode; SigV4 wants spaces as %20.
+	query := strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20")
+	canonical := strings.Join([]string{
+		req.Method, req.URL.EscapedPath(), query, headers.String(), signedHeaders, payloadHash,
+	}, "\n")
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	digest := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+	sig := hex.EncodeToString(hmacSHA256(sigV4Key(secretKey, day, region, service), toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, sig))
+}
+
+// sigV4Key derives the key signing a day's requests to service in region.
+func sigV4Key(secretKey, day, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// publish hands result to the configured sinks in the background so that
+// slow destinations do not delay the HTTP response. Failed deliveries are
+// retried and, failing that, kept as dead letters, see /deliveries.
+func (s *server) publish(result *ScanResult) {
+	s.storeResult(result)
+	if len(s.sinks) == 0 {
+		return
+	}
+	s.deliveries.deliver(*result)
+}
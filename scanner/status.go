@@ -0,0 +1,239 @@
+package scanner
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Scan stages reported by /status.
+const (
+	stageQueued      = "queued"
+	stageDownloading = "downloading"
+	stageRendering   = "rendering"
+	stageInspecting  = "inspecting"
+	stageCoolingDown = "cooling_down"
+	stageRetrying    = "retrying"
+	stageReporting   = "reporting"
+)
+
+// scanTracker admits at most a fixed number of scans at a time and keeps
+// track of every scan that is queued or running, for /status.
+type scanTracker struct {
+	slots chan struct{}
+
+	mu     sync.Mutex
+	nextID int64
+	scans  map[int64]*scanJob
+
+	// busy counts image inspections in progress across all scans.
+	busy atomic.Int64
+
+	finished   atomic.Int64
+	downloaded atomic.Int64
+}
+
+// scanJob is the tracked state of one scan.
+type scanJob struct {
+	id       int64
+	chartURL string
+	queuedAt time.Time
+
+	// progress is the callback Run was given, if any; reportMu keeps its
+	// calls in order.
+	progress ProgressFunc
+	reportMu sync.Mutex
+
+	mu          sync.Mutex
+	stage       string
+	startedAt   time.Time
+	workers     int
+	imagesTotal int
+	imagesDone  int
+
+	cpuStart       float64
+	peakHeap       uint64
+	peakGoroutines int
+	downloaded     atomic.Int64
+
+	prov provenance
+}
+
+func newScanTracker(maxScans int) *scanTracker {
+	t := &scanTracker{
+		slots: make(chan struct{}, maxScans),
+		scans: make(map[int64]*scanJob),
+	}
+	go t.sampleUsage()
+	return t
+}
+
+// start queues a scan of chartURL and blocks until a slot is free or ctx
+// is done. The returned job must be passed to finish; requests made with
+// the returned context count towards the job's downloads.
+func (t *scanTracker) start(ctx context.Context, chartURL string) (*scanJob, context.Context, error) {
+	t.mu.Lock()
+	t.nextID++
+	j := &scanJob{id: t.nextID, chartURL: chartURL, queuedAt: time.Now(), stage: stageQueued}
+	j.progress, _ = ctx.Value(progressKey{}).(ProgressFunc)
+	t.scans[j.id] = j
+	t.mu.Unlock()
+	j.advance(func() {}, "", nil)
+
+	select {
+	case t.slots <- struct{}{}:
+	case <-ctx.Done():
+		t.remove(j)
+		return nil, ctx, ctx.Err()
+	}
+	j.advance(func() {
+		j.stage = stageDownloading
+		j.startedAt = time.Now()
+		j.cpuStart = processCPU()
+	}, "", nil)
+	return j, context.WithValue(ctx, jobKey{}, j), nil
+}
+
+func (t *scanTracker) finish(j *scanJob) {
+	<-t.slots
+	t.remove(j)
+	t.finished.Add(1)
+	t.downloaded.Add(j.downloaded.Load())
+}
+
+func (t *scanTracker) remove(j *scanJob) {
+	t.mu.Lock()
+	delete(t.scans, j.id)
+	t.mu.Unlock()
+}
+
+// inspecting wraps one image inspection so it counts towards the worker
+// utilization.
+func (t *scanTracker) inspecting(j *scanJob, ref string, fn func() error) {
+	t.busy.Add(1)
+	defer t.busy.Add(-1)
+	err := fn()
+	j.advance(func() { j.imagesDone++ }, ref, err)
+}
+
+func (j *scanJob) setStage(stage string) {
+	j.advance(func() { j.stage = stage }, "", nil)
+}
+
+// advance applies change under the job's lock and passes the job's state
+// to its progress callback, for image, the image just inspected, and err,
+// why it failed. Calls are serialized so that counts never go backwards.
+func (j *scanJob) advance(change func(), image string, err error) {
+	j.reportMu.Lock()
+	defer j.reportMu.Unlock()
+	j.mu.Lock()
+	change()
+	p := Progress{Stage: j.stage, ImagesTotal: j.imagesTotal, ImagesDone: j.imagesDone, Image: image, Err: err}
+	j.mu.Unlock()
+	if j.progress != nil {
+		j.progress(p)
+	}
+}
+
+// startInspecting moves the job to an inspection stage with n images to go
+// on a pool of workers.
+func (j *scanJob) startInspecting(stage string, n, workers int) {
+	j.advance(func() {
+		j.stage = stage
+		j.imagesTotal = n
+		j.imagesDone = 0
+		j.workers = workers
+	}, "", nil)
+}
+
+// StatusResponse is the body of GET /status.
+type StatusResponse struct {
+	MaxScans int          `json:"max_scans"`
+	Running  int          `json:"running"`
+	Queued   int          `json:"queued"`
+	Scans    []ScanStatus `json:"scans"`
+	Workers  WorkerStatus `json:"workers"`
+	Cache    CacheStats   `json:"cache"`
+	Usage    ProcessUsage `json:"usage"`
+	// BulkWindow is left out without -bulk-windows.
+	BulkWindow *BulkWindowStatus `json:"bulk_window,omitempty"`
+}
+
+// ScanStatus describes one queued or running scan. Elapsed counts from the
+// moment the scan was queued.
+type ScanStatus struct {
+	ID             int64   `json:"id"`
+	ChartURL       string  `json:"chart_url"`
+	Stage          string  `json:"stage"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	QueuedSeconds  float64 `json:"queued_seconds"`
+	ImagesTotal    int     `json:"images_total,omitempty"`
+	ImagesDone     int     `json:"images_done,omitempty"`
+	// Usage is left out while the scan is queued.
+	Usage *ScanUsage `json:"usage,omitempty"`
+}
+
+// WorkerStatus relates the image inspections in progress to the worker
+// slots of the scans currently inspecting.
+type WorkerStatus struct {
+	Busy        int     `json:"busy"`
+	Capacity    int     `json:"capacity"`
+	Utilization float64 `json:"utilization"`
+}
+
+func (t *scanTracker) status() StatusResponse {
+	now := time.Now()
+	st := StatusResponse{MaxScans: cap(t.slots), Scans: []ScanStatus{}}
+	t.mu.Lock()
+	for _, j := range t.scans {
+		j.mu.Lock()
+		s := ScanStatus{
+			ID:             j.id,
+			ChartURL:       j.chartURL,
+			Stage:          j.stage,
+			ElapsedSeconds: now.Sub(j.queuedAt).Seconds(),
+			ImagesTotal:    j.imagesTotal,
+			ImagesDone:     j.imagesDone,
+		}
+		queued := j.stage == stageQueued
+		if queued {
+			s.QueuedSeconds = s.ElapsedSeconds
+			st.Queued++
+		} else {
+			s.QueuedSeconds = j.startedAt.Sub(j.queuedAt).Seconds()
+			st.Running++
+		}
+		if j.stage == stageInspecting || j.stage == stageRetrying {
+			st.Workers.Capacity += j.workers
+		}
+		j.mu.Unlock()
+		if !queued {
+			s.Usage = j.usage()
+		}
+		st.Scans = append(st.Scans, s)
+	}
+	t.mu.Unlock()
+	sort.Slice(st.Scans, func(a, b int) bool { return st.Scans[a].ID < st.Scans[b].ID })
+	st.Workers.Busy = int(t.busy.Load())
+	if st.Workers.Capacity > 0 {
+		st.Workers.Utilization = float64(st.Workers.Busy) / float64(st.Workers.Capacity)
+	}
+	return st
+}
+
+func (s *server) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st := s.tracker.status()
+	st.Cache = s.cache.stats()
+	st.Usage = s.tracker.processUsage()
+	st.BulkWindow = s.windows.status()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
@@ -0,0 +1,354 @@
+package scanner
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ResultStore keeps finished scans so that they can be read back through
+// /results. Implementations are safe for concurrent use.
+type ResultStore interface {
+	// Put stores result under id, replacing any result stored under it.
+	Put(ctx context.Context, id string, result ScanResult) error
+	// Get returns the result stored under id, or ErrNotStored.
+	Get(ctx context.Context, id string) (ScanResult, error)
+	// List returns the newest results first, of one chart when chartURL
+	// is set, at most limit of them unless limit is 0.
+	List(ctx context.Context, chartURL string, limit int) ([]StoredScan, error)
+	Close() error
+}
+
+// StoredScan summarises a stored result for listings.
+type StoredScan struct {
+	ID        string    `json:"id"`
+	ChartURL  string    `json:"chart_url"`
+	ScannedAt time.Time `json:"scanned_at"`
+	Images    int       `json:"images"`
+	URL       string    `json:"url,omitempty"`
+}
+
+// ErrNotStored is the error of ResultStore.Get for an unknown id.
+var ErrNotStored = errors.New("no stored result")
+
+const (
+	// memoryStoreLimit is how many results the memory store keeps; the
+	// oldest are dropped first.
+	memoryStoreLimit = 1000
+	// defaultResultsLimit and maxResultsLimit bound /results listings.
+	defaultResultsLimit = 50
+	maxResultsLimit     = 1000
+)
+
+// openResultStore returns cfg.ResultStore when set, or else opens the
+// store cfg.Store names: empty for none, "memory", or a file path or
+// file:// URL for the embedded store.
+func openResultStore(cfg Config) (ResultStore, error) {
+	if cfg.ResultStore != nil {
+		return cfg.ResultStore, nil
+	}
+	spec := cfg.Store
+	switch {
+	case spec == "":
+		return nil, nil
+	case spec == "memory":
+		return newMemoryStore(memoryStoreLimit), nil
+	case strings.HasPrefix(spec, "db:"):
+		// Not a file name: SQL stores were dropped, no driver being
+		// linked in.
+		return nil, fmt.Errorf("result store %q: database stores are not built in; embed the scanner with a Config.ResultStore", spec)
+	case strings.HasPrefix(spec, "file://"):
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("result store %q: %w", spec, err)
+		}
+		return openBoltStore(u.Path)
+	}
+	return openBoltStore(spec)
+}
+
+func newResultID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func summarizeResult(id string, result ScanResult) StoredScan {
+	return StoredScan{ID: id, ChartURL: result.ChartURL, ScannedAt: result.ScannedAt, Images: len(result.Images)}
+}
+
+// newestFirst sorts summaries by scan time, newest first, and keeps those
+// of chartURL when it is set, at most limit of them.
+func newestFirst(all []StoredScan, chartURL string, limit int) []StoredScan {
+	out := make([]StoredScan, 0, len(all))
+	for _, sc := range all {
+		if chartURL == "" || sc.ChartURL == chartURL {
+			out = append(out, sc)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].ScannedAt.After(out[j].ScannedAt) })
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// memoryStore keeps the newest results in memory; they are lost on
+// restart.
+type memoryStore struct {
+	mu      sync.Mutex
+	limit   int
+	results map[string]ScanResult
+	order   []string // ids, oldest first
+}
+
+func newMemoryStore(limit int) *memoryStore {
+	return &memoryStore{limit: limit, results: make(map[string]ScanResult)}
+}
+
+func (m *memoryStore) Put(_ context.Context, id string, result ScanResult) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.results[id]; !ok {
+		m.order = append(m.order, id)
+	}
+	m.results[id] = result
+	for len(m.order) > m.limit {
+		delete(m.results, m.order[0])
+		m.order = m.order[1:]
+	}
+	return nil
+}
+
+func (m *memoryStore) Get(_ context.Context, id string) (ScanResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result, ok := m.results[id]
+	if !ok {
+		return ScanResult{}, ErrNotStored
+	}
+	return result, nil
+}
+
+func (m *memoryStore) List(_ context.Context, chartURL string, limit int) ([]StoredScan, error) {
+	m.mu.Lock()
+	all := make([]StoredScan, 0, len(m.order))
+	for _, id := range m.order {
+		all = append(all, summarizeResult(id, m.results[id]))
+	}
+	m.mu.Unlock()
+	return newestFirst(all, chartURL, limit), nil
+}
+
+func (m *memoryStore) Close() error { return nil }
+
+// boltStore is the embedded store, a bbolt database file: results are
+// kept by id, with their summaries and an index by scan time next to
+// them, so listings and startup read no result. Space freed by replaced
+// results is reused for later ones.
+type boltStore struct {
+	db *bolt.DB
+}
+
+var (
+	boltResults   = []byte("results")
+	boltSummaries = []byte("summaries")
+	// boltByTime maps the scan time, as big-endian Unix nanoseconds,
+	// and the id to nothing; it orders listings.
+	boltByTime = []byte("by_time")
+)
+
+func openBoltStore(path string) (*boltStore, error) {
+	// The file is locked while open; wait a little for a process that is
+	// closing it rather than forever.
+	db, err := bolt.Open(path, 0o644, &bolt.Options{Timeout: 5 * time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("opening result store: %s is in use by another process", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening result store: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{boltResults, boltSummaries, boltByTime} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening result store: %w", err)
+	}
+	return &boltStore{db: db}, nil
+}
+
+func timeKey(t time.Time, id string) []byte {
+	k := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	return append(k, id...)
+}
+
+func (s *boltStore) Put(_ context.Context, id string, result ScanResult) error {
+	b, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	summary := summarizeResult(id, result)
+	sb, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		summaries, byTime := tx.Bucket(boltSummaries), tx.Bucket(boltByTime)
+		if old := summaries.Get([]byte(id)); old != nil {
+			var prev StoredScan
+			if json.Unmarshal(old, &prev) == nil {
+				if err := byTime.Delete(timeKey(prev.ScannedAt, id)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := tx.Bucket(boltResults).Put([]byte(id), b); err != nil {
+			return err
+		}
+		if err := summaries.Put([]byte(id), sb); err != nil {
+			return err
+		}
+		return byTime.Put(timeKey(summary.ScannedAt, id), nil)
+	})
+}
+
+func (s *boltStore) Get(_ context.Context, id string) (ScanResult, error) {
+	var result ScanResult
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltResults).Get([]byte(id))
+		if b == nil {
+			return ErrNotStored
+		}
+		if err := json.Unmarshal(b, &result); err != nil {
+			return fmt.Errorf("result %s is corrupt: %w", id, err)
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (s *boltStore) List(_ context.Context, chartURL string, limit int) ([]StoredScan, error) {
+	var out []StoredScan
+	err := s.db.View(func(tx *bolt.Tx) error {
+		summaries := tx.Bucket(boltSummaries)
+		c := tx.Bucket(boltByTime).Cursor()
+		for k, _ := c.Last(); k != nil && (limit == 0 || len(out) < limit); k, _ = c.Prev() {
+			var sc StoredScan
+			if err := json.Unmarshal(summaries.Get(k[8:]), &sc); err != nil {
+				return fmt.Errorf("summary of %s is corrupt: %w", k[8:], err)
+			}
+			if chartURL == "" || sc.ChartURL == chartURL {
+				out = append(out, sc)
+			}
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (s *boltStore) Close() error { return s.db.Close() }
+
+// storeResult saves a finished scan when a store is configured, and sets
+// its ID.
+func (s *server) storeResult(result *ScanResult) {
+	if s.store == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sinkTimeout)
+	defer cancel()
+	result.ID = newResultID()
+	if err := s.store.Put(ctx, result.ID, *result); err != nil {
+		log.Printf("warning: storing result of %s: %v", result.ChartURL, err)
+	}
+}
+
+type resultsResponse struct {
+	Results []StoredScan `json:"results"`
+}
+
+// resultsHandler serves GET /results, the stored scans newest first, and
+// GET /results/<id>, one stored result. /results/<id>/approvals is served
+// by scanApprovalsHandler.
+func (s *server) resultsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.store == nil {
+		jsonError(w, http.StatusNotFound, "no result store configured, see -store")
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/results"), "/")
+	if scan, ok := strings.CutSuffix(id, "/approvals"); ok && scan != "" && !strings.Contains(scan, "/") {
+		s.scanApprovalsHandler(w, r, scan)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if id != "" {
+		fields, err := parseFields(r, ImageInfo{})
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		units, err := s.unitsFor(r)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		result, err := s.store.Get(r.Context(), id)
+		if errors.Is(err, ErrNotStored) {
+			jsonError(w, http.StatusNotFound, fmt.Sprintf("no stored result %q", id))
+			return
+		}
+		if err != nil {
+			jsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		result.ID = id
+		writeSelected(w, result, fields, units)
+		return
+	}
+	limit := defaultResultsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			jsonError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		if limit = n; limit > maxResultsLimit {
+			limit = maxResultsLimit
+		}
+	}
+	list, err := s.store.List(r.Context(), r.URL.Query().Get("chart_url"), limit)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp := resultsResponse{Results: make([]StoredScan, 0, len(list))}
+	for _, sc := range list {
+		sc.URL = s.externalURL(r, "/results/"+sc.ID)
+		resp.Results = append(resp.Results, sc)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
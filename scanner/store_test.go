@@ -0,0 +1,104 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoltStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "results.db")
+	s, err := openBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2024, 6, 12, 8, 0, 0, 0, time.UTC)
+	for i, chart := range []string{"a.tgz", "b.tgz", "a.tgz"} {
+		result := ScanResult{ChartURL: chart, ScannedAt: base.Add(time.Duration(i) * time.Minute), Images: []ImageInfo{{Image: "nginx:1.25"}}}
+		if err := s.Put(ctx, chart+string(rune('0'+i)), result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Replacing a result moves it in the listing.
+	if err := s.Put(ctx, "b.tgz1", ScanResult{ChartURL: "b.tgz", ScannedAt: base.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = openBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	list, err := s.List(ctx, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, sc := range list {
+		ids = append(ids, sc.ID)
+	}
+	if got := ids; len(got) != 3 || got[0] != "b.tgz1" || got[1] != "a.tgz2" || got[2] != "a.tgz0" {
+		t.Errorf("listed %v, want b.tgz1 a.tgz2 a.tgz0", got)
+	}
+	if list, _ := s.List(ctx, "a.tgz", 1); len(list) != 1 || list[0].ID != "a.tgz2" || list[0].Images != 1 {
+		t.Errorf("listed %+v for a.tgz, want a.tgz2 with 1 image", list)
+	}
+	result, err := s.Get(ctx, "b.tgz1")
+	if err != nil || !result.ScannedAt.Equal(base.Add(time.Hour)) {
+		t.Errorf("got %+v, %v, want the replacement", result, err)
+	}
+	if _, err := s.Get(ctx, "missing"); !errors.Is(err, ErrNotStored) {
+		t.Errorf("got %v for a missing id, want ErrNotStored", err)
+	}
+}
+
+func TestOpenResultStore(t *testing.T) {
+	dir := t.TempDir()
+	custom := newMemoryStore(1)
+	for _, tc := range []struct {
+		name    string
+		cfg     Config
+		want    string
+		wantErr bool
+	}{
+		{"none", Config{}, "<nil>", false},
+		{"memory", Config{Store: "memory"}, "*scanner.memoryStore", false},
+		{"file path", Config{Store: filepath.Join(dir, "a.db")}, "*scanner.boltStore", false},
+		{"file URL", Config{Store: "file://" + filepath.Join(dir, "b.db")}, "*scanner.boltStore", false},
+		{"database", Config{Store: "db:postgres:postgres://localhost/scans"}, "", true},
+		{"Config.ResultStore", Config{Store: filepath.Join(dir, "c.db"), ResultStore: custom}, "*scanner.memoryStore", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store, err := openResultStore(tc.cfg)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("opened")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprintf("%T", store); got != tc.want {
+				t.Errorf("store %s, want %s", got, tc.want)
+			}
+			if tc.cfg.ResultStore != nil && store != tc.cfg.ResultStore {
+				t.Error("Config.ResultStore was not used")
+			}
+			if store != nil {
+				store.Close()
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(dir, "c.db")); !os.IsNotExist(err) {
+		t.Errorf("Store was opened next to Config.ResultStore: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package scanner
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxSetIndex is the largest list index a --set name may use, as in Helm,
+// so that a[99999999] cannot allocate a list of that length.
+const maxSetIndex = 65536
+
+// setHelmValue sets name to value in vals, reading name the way helm --set
+// does: dots separate keys, a backslash takes the next character
+// literally, as in prometheus\.io/scrape, and [i] indexes a list, which
+// grows to hold it. A string value is typed like --set types it, true,
+// false, null or an integer, and {a,b} is a list, unless asString asks for
+// --set-string. A list value is set as the list of its elements.
+func setHelmValue(vals map[string]interface{}, name string, value interface{}, asString bool) error {
+	path, err := parseSetName(name)
+	if err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case string:
+		value = typedSetValue(v, asString)
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, e := range v {
+			if s, ok := hclString(e); ok {
+				list[i] = typedSetValue(s, asString)
+			} else {
+				list[i] = e
+			}
+		}
+		value = list
+	}
+	setPath(vals, path, value)
+	return nil
+}
+
+// setKey is one step of a --set name: a map key, or a list index when
+// index is not negative.
+type setKey struct {
+	key   string
+	index int
+}
+
+func parseSetName(name string) ([]setKey, error) {
+	var path []setKey
+	var key strings.Builder
+	// pending is whether key holds a key to be added, even an empty one.
+	pending := true
+	endKey := func() error {
+		if key.Len() == 0 {
+			return fmt.Errorf("set name %q has an empty key", name)
+		}
+		path = append(path, setKey{key: key.String(), index: -1})
+		key.Reset()
+		pending = false
+		return nil
+	}
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; c {
+		case '\\':
+			if i+1 == len(name) {
+				return nil, fmt.Errorf("set name %q ends in a backslash", name)
+			}
+			i++
+			key.WriteByte(name[i])
+		case '.':
+			if pending {
+				if err := endKey(); err != nil {
+					return nil, err
+				}
+			}
+			pending = true
+		case '[':
+			if pending {
+				if err := endKey(); err != nil {
+					return nil, err
+				}
+			}
+			end := strings.IndexByte(name[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("set name %q has an unclosed [", name)
+			}
+			n, err := strconv.Atoi(name[i+1 : i+end])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("set name %q: list index %q is not a number", name, name[i+1:i+end])
+			}
+			if n > maxSetIndex {
+				return nil, fmt.Errorf("set name %q: list index %d exceeds %d", name, n, maxSetIndex)
+			}
+			path = append(path, setKey{index: n})
+			i += end
+			if i+1 < len(name) && name[i+1] != '.' && name[i+1] != '[' {
+				return nil, fmt.Errorf("set name %q: want . or [ after ]", name)
+			}
+		default:
+			if !pending {
+				return nil, fmt.Errorf("set name %q: want . or [ after ]", name)
+			}
+			key.WriteByte(c)
+		}
+	}
+	if pending {
+		if err := endKey(); err != nil {
+			return nil, err
+		}
+	}
+	return path, nil
+}
+
+// setPath sets the value at path under cur, returning cur or, when it is
+// not of the kind the first step needs, the map or list replacing it.
+func setPath(cur interface{}, path []setKey, v interface{}) interface{} {
+	step := path[0]
+	if step.index < 0 {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			m = map[string]interface{}{}
+		}
+		if len(path) == 1 {
+			m[step.key] = v
+		} else {
+			m[step.key] = setPath(m[step.key], path[1:], v)
+		}
+		return m
+	}
+	l, _ := cur.([]interface{})
+	for len(l) <= step.index {
+		l = append(l, nil)
+	}
+	if len(path) == 1 {
+		l[step.index] = v
+	} else {
+		l[step.index] = setPath(l[step.index], path[1:], v)
+	}
+	return l
+}
+
+// typedSetValue types a --set value: true, false and null, integers
+// without a leading zero, and {a,b} lists of such values. With asString
+// it is kept as given.
+func typedSetValue(s string, asString bool) interface{} {
+	if asString {
+		return s
+	}
+	if len(s) >= 2 && s[0] == '{' && s[len(s)-1] == '}' {
+		list := []interface{}{}
+		if inner := s[1 : len(s)-1]; inner != "" {
+			for _, e := range strings.Split(inner, ",") {
+				list = append(list, typedSetValue(e, false))
+			}
+		}
+		return list
+	}
+	switch {
+	case strings.EqualFold(s, "true"):
+		return true
+	case strings.EqualFold(s, "false"):
+		return false
+	case strings.EqualFold(s, "null"):
+		return nil
+	case s == "0":
+		return int64(0)
+	}
+	if s != "" && s[0] != '0' {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n
+		}
+	}
+	return s
+}
@@ -0,0 +1,86 @@
+package scanner
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSetHelmValue(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		value    interface{}
+		asString bool
+		want     map[string]interface{}
+	}{
+		{"image.tag", "1.25", false, map[string]interface{}{"image": map[string]interface{}{"tag": "1.25"}}},
+		{`podAnnotations.prometheus\.io/scrape`, "true", false, map[string]interface{}{"podAnnotations": map[string]interface{}{"prometheus.io/scrape": true}}},
+		{`podAnnotations.prometheus\.io/scrape`, "true", true, map[string]interface{}{"podAnnotations": map[string]interface{}{"prometheus.io/scrape": "true"}}},
+		{`a\\b`, "x", false, map[string]interface{}{`a\b`: "x"}},
+		{"replicas", "3", false, map[string]interface{}{"replicas": int64(3)}},
+		{"replicas", "0", false, map[string]interface{}{"replicas": int64(0)}},
+		{"zip", "007", false, map[string]interface{}{"zip": "007"}},
+		{"ratio", "1.5", false, map[string]interface{}{"ratio": "1.5"}},
+		{"nothing", "null", false, map[string]interface{}{"nothing": nil}},
+		{"args", "{a,1,false}", false, map[string]interface{}{"args": []interface{}{"a", int64(1), false}}},
+		{"args", "{}", false, map[string]interface{}{"args": []interface{}{}}},
+		{"args", []interface{}{"a", "2"}, false, map[string]interface{}{"args": []interface{}{"a", int64(2)}}},
+		{"tolerations[1].key", "gpu", false, map[string]interface{}{"tolerations": []interface{}{nil, map[string]interface{}{"key": "gpu"}}}},
+		{"matrix[0][1]", "x", false, map[string]interface{}{"matrix": []interface{}{[]interface{}{nil, "x"}}}},
+		{"port", 8080, false, map[string]interface{}{"port": 8080}},
+	} {
+		vals := map[string]interface{}{}
+		if err := setHelmValue(vals, tc.name, tc.value, tc.asString); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(vals, tc.want) {
+			t.Errorf("%s=%v set %#v, want %#v", tc.name, tc.value, vals, tc.want)
+		}
+	}
+}
+
+func TestSetHelmValueMerges(t *testing.T) {
+	vals := map[string]interface{}{
+		"image":       map[string]interface{}{"repository": "nginx", "tag": "1.24"},
+		"tolerations": []interface{}{map[string]interface{}{"key": "a"}},
+		"plain":       "x",
+	}
+	for name, v := range map[string]string{
+		"image.tag":          "1.25",
+		"tolerations[0].op":  "Exists",
+		"tolerations[1].key": "b",
+		"plain.inner":        "y",
+	} {
+		if err := setHelmValue(vals, name, v, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]interface{}{
+		"image":       map[string]interface{}{"repository": "nginx", "tag": "1.25"},
+		"tolerations": []interface{}{map[string]interface{}{"key": "a", "op": "Exists"}, map[string]interface{}{"key": "b"}},
+		"plain":       map[string]interface{}{"inner": "y"},
+	}
+	if !reflect.DeepEqual(vals, want) {
+		t.Errorf("got %#v, want %#v", vals, want)
+	}
+}
+
+func TestSetHelmValueRejects(t *testing.T) {
+	for _, name := range []string{
+		"",
+		"a..b",
+		"a.",
+		".a",
+		"[0]",
+		"a[",
+		"a[x]",
+		"a[-1]",
+		"a[65537]",
+		"a[0]b",
+		`a\`,
+	} {
+		if err := setHelmValue(map[string]interface{}{}, name, "v", false); err == nil {
+			t.Errorf("%q: accepted", name)
+		}
+	}
+}
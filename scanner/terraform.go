@@ -0,0 +1,286 @@
+package scanner
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// terraformRelease is a helm_release resource of a Terraform module. rel
+// is set even when err is, for the resource's name.
+type terraformRelease struct {
+	file string
+	rel  *releaseSpec
+	err  error
+}
+
+// isTerraformFile reports whether name is read as part of a module:
+// configuration files and the variable files Terraform loads by itself.
+func isTerraformFile(name string) bool {
+	base := path.Base(name)
+	return strings.HasSuffix(base, ".tf") || base == "terraform.tfvars" || strings.HasSuffix(base, ".auto.tfvars")
+}
+
+// parseTerraformRelease reads the first helm_release in a standalone
+// Terraform configuration, for /scan. Referenced files are not available.
+func parseTerraformRelease(data []byte) (*releaseSpec, error) {
+	noFiles := func(string) ([]byte, error) {
+		return nil, errors.New("files are only read when scanning a repository with /inventory")
+	}
+	releases, err := parseTerraformReleases([]chartFile{{Name: "main.tf", Data: data}}, noFiles)
+	if err != nil {
+		return nil, err
+	}
+	if len(releases) == 0 {
+		return nil, errors.New("configuration contains no helm_release resource")
+	}
+	r := releases[0]
+	if r.err != nil {
+		return nil, fmt.Errorf("helm_release.%s: %w", r.rel.source.Name, r.err)
+	}
+	if len(releases) > 1 {
+		r.rel.source.Warnings = append(r.rel.source.Warnings, fmt.Sprintf("only the first of %d helm_release resources is scanned; use /inventory to scan all of them", len(releases)))
+	}
+	return r.rel, nil
+}
+
+// parseTerraformReleases reads the helm_release resources of the module
+// made of files, which are all in one directory. Variables take their
+// defaults, overridden by terraform.tfvars and *.auto.tfvars; file() reads
+// paths relative to the module through readFile.
+func parseTerraformReleases(files []chartFile, readFile func(name string) ([]byte, error)) ([]terraformRelease, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	dir := path.Dir(files[0].Name)
+	sc := &hclScope{
+		vars:    make(map[string]interface{}),
+		locals:  make(map[string]hclExpr),
+		values:  make(map[string]interface{}),
+		pending: make(map[string]bool),
+		readFile: func(name string) ([]byte, error) {
+			if path.IsAbs(name) {
+				return nil, errors.New("absolute paths are outside the repository")
+			}
+			return readFile(path.Join(dir, name))
+		},
+	}
+	files = append([]chartFile(nil), files...)
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	type resource struct {
+		file  string
+		block *hclBlock
+	}
+	var resources []resource
+	var tfvars []*hclBlock
+	for _, f := range files {
+		body, err := parseHCL(f.Data)
+		if err != nil {
+			// A file that cannot hold a release only matters for its
+			// variables, which then show up as unresolved references.
+			if bytes.Contains(f.Data, []byte("helm_release")) {
+				return nil, fmt.Errorf("parsing %s: %w", f.Name, err)
+			}
+			continue
+		}
+		if !strings.HasSuffix(f.Name, ".tf") {
+			tfvars = append(tfvars, body)
+			continue
+		}
+		for _, b := range body.Blocks {
+			switch {
+			case b.Type == "variable" && len(b.Labels) == 1:
+				if x, ok := b.Attrs["default"]; ok {
+					if v, err := sc.eval(x); err == nil {
+						sc.vars[b.Labels[0]] = v
+					}
+				}
+			case b.Type == "locals":
+				for name, x := range b.Attrs {
+					sc.locals[name] = x
+				}
+			case b.Type == "resource" && len(b.Labels) == 2 && b.Labels[0] == "helm_release":
+				resources = append(resources, resource{f.Name, b})
+			}
+		}
+	}
+	for _, body := range tfvars {
+		for name, x := range body.Attrs {
+			if v, err := sc.eval(x); err == nil {
+				sc.vars[name] = v
+			}
+		}
+	}
+
+	out := make([]terraformRelease, len(resources))
+	for i, r := range resources {
+		rel, err := terraformHelmRelease(r.block, sc, dir)
+		out[i] = terraformRelease{file: r.file, rel: rel, err: err}
+	}
+	return out, nil
+}
+
+// terraformHelmRelease maps a helm_release to a release the way the Helm
+// provider installs it: values documents in order, then set blocks.
+func terraformHelmRelease(b *hclBlock, sc *hclScope, dir string) (*releaseSpec, error) {
+	spec := &releaseSpec{source: ReleaseSource{Kind: "helm_release", Name: b.Labels[1]}, values: map[string]interface{}{}}
+	str := func(attr string) (string, error) {
+		x, ok := b.Attrs[attr]
+		if !ok {
+			return "", nil
+		}
+		v, err := sc.eval(x)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", attr, err)
+		}
+		s, ok := hclString(v)
+		if !ok && v != nil {
+			return "", fmt.Errorf("%s is %s, not a string", attr, hclTypeName(v))
+		}
+		return s, nil
+	}
+	warn := func(format string, args ...interface{}) {
+		spec.source.Warnings = append(spec.source.Warnings, fmt.Sprintf(format, args...))
+	}
+
+	var err error
+	if spec.releaseName, err = str("name"); err != nil || spec.releaseName == "" {
+		spec.releaseName = b.Labels[1]
+		if err != nil {
+			warn("%v; the resource name is used as release name", err)
+		}
+	}
+	if spec.namespace, err = str("namespace"); err != nil {
+		warn("%v", err)
+	}
+	if spec.namespace == "" {
+		spec.namespace = "default"
+	}
+	spec.source.Namespace = spec.namespace
+	if _, ok := b.Attrs["count"]; ok {
+		warn("count is ignored; the release is scanned once")
+	} else if _, ok := b.Attrs["for_each"]; ok {
+		warn("for_each is ignored; the release is scanned once")
+	}
+
+	chart, err := str("chart")
+	if err != nil {
+		return spec, err
+	}
+	if chart == "" {
+		return spec, errors.New("helm_release has no chart")
+	}
+	repo, err := str("repository")
+	if err != nil {
+		return spec, err
+	}
+	if spec.constraint, err = str("version"); err != nil {
+		return spec, err
+	}
+	repo = strings.TrimRight(repo, "/")
+	spec.source.Chart = chart
+	switch {
+	case repo != "":
+		spec.source.Repository = repo
+	case strings.HasPrefix(chart, "oci://"):
+		i := strings.LastIndex(chart, "/")
+		spec.source.Repository, spec.source.Chart = chart[:i], chart[i+1:]
+	case strings.Contains(chart, "://"):
+		spec.chartURL = chart
+	default:
+		// Without a repository the provider installs from a local path.
+		spec.localPath = path.Join(dir, chart)
+	}
+
+	if x, ok := b.Attrs["values"]; ok {
+		docs := []hclExpr{x}
+		if t, ok := x.(hclTuple); ok {
+			docs = t.elems
+		}
+		for i, d := range docs {
+			v, err := sc.eval(d)
+			if err != nil {
+				warn("values[%d] is not applied: %v", i, err)
+				continue
+			}
+			// A non-tuple expression yields the whole list.
+			list, ok := v.([]interface{})
+			if !ok {
+				list = []interface{}{v}
+			}
+			for _, e := range list {
+				s, _ := e.(string)
+				var vals map[string]interface{}
+				if err := yaml.Unmarshal([]byte(s), &vals); err != nil {
+					warn("values[%d] is not applied: %v", i, err)
+					continue
+				}
+				spec.values = mergeValues(spec.values, vals)
+			}
+		}
+	}
+
+	for _, sb := range b.Blocks {
+		if sb.Type == "dynamic" && len(sb.Labels) == 1 && strings.HasPrefix(sb.Labels[0], "set") {
+			warn("dynamic %q blocks are not applied; their values depend on for_each", sb.Labels[0])
+		}
+	}
+	// set entries are blocks in provider 2.x and a list attribute in 3.x.
+	for _, kind := range []string{"set", "set_list", "set_sensitive"} {
+		var entries []map[string]interface{}
+		for _, sb := range b.Blocks {
+			if sb.Type != kind {
+				continue
+			}
+			e := make(map[string]interface{})
+			for _, attr := range []string{"name", "value", "type"} {
+				x, ok := sb.Attrs[attr]
+				if !ok {
+					continue
+				}
+				v, err := sc.eval(x)
+				if err != nil {
+					warn("%s: %s is not applied: %v", kind, attr, err)
+					e = nil
+					break
+				}
+				e[attr] = v
+			}
+			if e != nil {
+				entries = append(entries, e)
+			}
+		}
+		if x, ok := b.Attrs[kind]; ok {
+			v, err := sc.eval(x)
+			if err != nil {
+				warn("%s is not applied: %v", kind, err)
+			}
+			list, _ := v.([]interface{})
+			for _, e := range list {
+				if m, ok := e.(map[string]interface{}); ok {
+					entries = append(entries, m)
+				}
+			}
+		}
+		for _, e := range entries {
+			name, _ := hclString(e["name"])
+			v := e["value"]
+			if s, ok := hclString(v); ok {
+				v = s
+			}
+			// The provider hands entries to Helm's --set parser, or to
+			// --set-string's for type = "string".
+			typ, _ := hclString(e["type"])
+			if err := setHelmValue(spec.values, name, v, typ == "string"); err != nil {
+				warn("%s: %v; it is not applied", kind, err)
+			}
+		}
+	}
+	return spec, nil
+}
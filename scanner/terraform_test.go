@@ -0,0 +1,162 @@
+package scanner
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTerraformRelease(t *testing.T) {
+	rel, err := parseTerraformRelease([]byte(`
+variable "tag" {
+  default = "1.25"
+}
+
+locals {
+  registry = "registry.example.com"
+}
+
+resource "helm_release" "web" {
+  name       = "frontend"
+  namespace  = "apps"
+  repository = "https://charts.example.com/"
+  chart      = "web"
+  version    = "~1.2"
+
+  values = [<<-EOT
+    image:
+      repository: ${local.registry}/web
+      tag: "1.24"
+    EOT
+  ]
+
+  set {
+    name  = "image.tag"
+    value = var.tag
+  }
+  set {
+    name  = "podAnnotations.prometheus\\.io/scrape"
+    value = "true"
+    type  = "string"
+  }
+  set {
+    name  = "replicas"
+    value = 3
+  }
+  set_list {
+    name  = "tolerations[0].values"
+    value = ["a", "b"]
+  }
+  set_sensitive {
+    name  = "auth.password"
+    value = "secret"
+  }
+  dynamic "set" {
+    for_each = var.extra
+    content {
+      name  = set.key
+      value = set.value
+    }
+  }
+}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel.releaseName != "frontend" || rel.namespace != "apps" || rel.constraint != "~1.2" {
+		t.Errorf("release %s in %s at %s", rel.releaseName, rel.namespace, rel.constraint)
+	}
+	if rel.source.Repository != "https://charts.example.com" || rel.source.Chart != "web" || rel.source.Kind != "helm_release" || rel.source.Name != "web" {
+		t.Errorf("source %+v", rel.source)
+	}
+	want := map[string]interface{}{
+		"image":          map[string]interface{}{"repository": "registry.example.com/web", "tag": "1.25"},
+		"podAnnotations": map[string]interface{}{"prometheus.io/scrape": "true"},
+		"replicas":       int64(3),
+		"tolerations":    []interface{}{map[string]interface{}{"values": []interface{}{"a", "b"}}},
+		"auth":           map[string]interface{}{"password": "secret"},
+	}
+	if !reflect.DeepEqual(rel.values, want) {
+		t.Errorf("values %#v, want %#v", rel.values, want)
+	}
+	if len(rel.source.Warnings) != 1 || !strings.Contains(rel.source.Warnings[0], `dynamic "set" blocks are not applied`) {
+		t.Errorf("warnings %q, want one for the dynamic block", rel.source.Warnings)
+	}
+}
+
+func TestParseTerraformReleaseSources(t *testing.T) {
+	for _, tc := range []struct {
+		name, attrs                string
+		repo, chart, url, local    string
+		wantWarning, wantErrSubstr string
+	}{
+		{name: "OCI chart", attrs: `chart = "oci://ghcr.io/acme/charts/web"`, repo: "oci://ghcr.io/acme/charts", chart: "web"},
+		{name: "archive URL", attrs: `chart = "https://example.com/web-1.0.0.tgz"`, chart: "https://example.com/web-1.0.0.tgz", url: "https://example.com/web-1.0.0.tgz"},
+		{name: "local path", attrs: `chart = "./charts/web"`, chart: "./charts/web", local: "charts/web"},
+		{name: "count", attrs: "chart = \"web\"\nrepository = \"https://c.example.com\"\ncount = 2", repo: "https://c.example.com", chart: "web", wantWarning: "count is ignored"},
+		{name: "unresolvable set", attrs: "chart = \"web\"\nrepository = \"https://c.example.com\"\nset {\n name = \"a\"\n value = aws_s3_bucket.b.id\n}", repo: "https://c.example.com", chart: "web", wantWarning: "set: value is not applied"},
+		{name: "bad set name", attrs: "chart = \"web\"\nrepository = \"https://c.example.com\"\nset {\n name = \"a[x]\"\n value = \"1\"\n}", repo: "https://c.example.com", chart: "web", wantWarning: "is not a number"},
+		{name: "no chart", attrs: `name = "web"`, wantErrSubstr: "has no chart"},
+		{name: "unresolvable chart", attrs: `chart = data.x.y`, wantErrSubstr: "chart"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rel, err := parseTerraformRelease([]byte("resource \"helm_release\" \"r\" {\n" + tc.attrs + "\n}\n"))
+			if tc.wantErrSubstr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErrSubstr) {
+					t.Fatalf("error %v, want one containing %q", err, tc.wantErrSubstr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rel.source.Repository != tc.repo || rel.source.Chart != tc.chart || rel.chartURL != tc.url || rel.localPath != tc.local {
+				t.Errorf("repository %q, chart %q, URL %q, local path %q", rel.source.Repository, rel.source.Chart, rel.chartURL, rel.localPath)
+			}
+			warnings := strings.Join(rel.source.Warnings, "; ")
+			if tc.wantWarning == "" && warnings != "" || !strings.Contains(warnings, tc.wantWarning) {
+				t.Errorf("warnings %q, want %q", warnings, tc.wantWarning)
+			}
+		})
+	}
+}
+
+func TestParseTerraformReleasesOfAModule(t *testing.T) {
+	files := []chartFile{
+		{Name: "infra/main.tf", Data: []byte(`
+resource "helm_release" "a" {
+  chart      = "a"
+  repository = var.repo
+  values     = [file("values/a.yaml")]
+}
+resource "helm_release" "b" {
+  chart      = "b"
+  repository = var.repo
+}
+`)},
+		{Name: "infra/variables.tf", Data: []byte(`variable "repo" { default = "https://default.example.com" }`)},
+		{Name: "infra/terraform.tfvars", Data: []byte(`repo = "https://charts.example.com"`)},
+	}
+	read := func(name string) ([]byte, error) {
+		if name == "infra/values/a.yaml" {
+			return []byte("replicas: 2\n"), nil
+		}
+		return nil, errors.New("no such file")
+	}
+	releases, err := parseTerraformReleases(files, read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(releases) != 2 {
+		t.Fatalf("%d releases, want 2", len(releases))
+	}
+	for _, r := range releases {
+		if r.err != nil || r.rel.source.Repository != "https://charts.example.com" || r.file != "infra/main.tf" {
+			t.Errorf("release %+v in %s, error %v", r.rel.source, r.file, r.err)
+		}
+	}
+	if got := releases[0].rel.values["replicas"]; got != 2 {
+		t.Errorf("replicas %v from values/a.yaml, want 2", got)
+	}
+}
@@ -0,0 +1,159 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxTraceEvents bounds the trace of one scan; later events are counted
+// but dropped.
+const maxTraceEvents = 2000
+
+// TraceEvent is one decision of the scan pipeline, returned for requests
+// with debug set.
+type TraceEvent struct {
+	// AtMs is the time since the scan was received.
+	AtMs    float64 `json:"at_ms"`
+	Stage   string  `json:"stage"`
+	Message string  `json:"message"`
+}
+
+type scanTrace struct {
+	start   time.Time
+	mu      sync.Mutex
+	events  []TraceEvent
+	dropped int
+}
+
+type traceKey struct{}
+
+// withTrace makes ctx collect the trace events of the scans made with it.
+func withTrace(ctx context.Context) context.Context {
+	return context.WithValue(ctx, traceKey{}, &scanTrace{start: time.Now()})
+}
+
+// tracing reports whether events of ctx are kept or logged, so that
+// callers can skip work done only for the trace.
+func tracing(ctx context.Context) bool {
+	_, ok := ctx.Value(traceKey{}).(*scanTrace)
+	return ok || debugEnabled()
+}
+
+// tracef records an event in the trace of ctx, if it has one, and logs it
+// at debug level.
+func tracef(ctx context.Context, stage, format string, args ...interface{}) {
+	t, _ := ctx.Value(traceKey{}).(*scanTrace)
+	if t == nil && !debugEnabled() {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if debugEnabled() {
+		if j := jobFrom(ctx); j != nil {
+			log.Printf("debug: scan %d: %s: %s", j.id, stage, msg)
+		} else {
+			log.Printf("debug: %s: %s", stage, msg)
+		}
+	}
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.events) >= maxTraceEvents {
+		t.dropped++
+		return
+	}
+	at := math.Round(float64(time.Since(t.start).Microseconds())/10) / 100
+	t.events = append(t.events, TraceEvent{AtMs: at, Stage: stage, Message: msg})
+}
+
+// traceEvents returns the trace of ctx, nil without one.
+func traceEvents(ctx context.Context) []TraceEvent {
+	t, _ := ctx.Value(traceKey{}).(*scanTrace)
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	events := append([]TraceEvent(nil), t.events...)
+	if t.dropped > 0 {
+		events = append(events, TraceEvent{Stage: "trace", Message: fmt.Sprintf("%d more events dropped", t.dropped)})
+	}
+	return events
+}
+
+// rejectedCandidates lists the places in a YAML document that look like
+// image references but that extraction passes over: image fields that
+// are neither a string nor a map naming a repository, and repository
+// fields whose tag is missing or not a string, as with an unquoted
+// `tag: 1.20`.
+func rejectedCandidates(node interface{}, path string, out *[]string) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		if iv, ok := v["image"]; ok {
+			switch x := iv.(type) {
+			case string:
+				if x == "" {
+					*out = append(*out, path+".image: empty")
+				}
+			case map[string]interface{}:
+				if buildFromMap(x) == "" {
+					*out = append(*out, path+".image: has no repository or name")
+				}
+			default:
+				*out = append(*out, fmt.Sprintf("%s.image: %T is not an image reference", path, iv))
+			}
+		}
+		if rv, ok := v["repository"].(string); ok && rv != "" {
+			tv, hasTag := v["tag"]
+			if _, isString := tv.(string); hasTag && tv != nil && !isString {
+				*out = append(*out, fmt.Sprintf("%s.tag: %v is a %T, not a string; quote it", path, tv, tv))
+			} else if !hasTag && !strings.HasSuffix(path, ".image") {
+				*out = append(*out, path+".repository: no tag next to it")
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			rejectedCandidates(v[k], path+"."+k, out)
+		}
+	case []interface{}:
+		for i, e := range v {
+			rejectedCandidates(e, path+"["+strconv.Itoa(i)+"]", out)
+		}
+	}
+}
+
+// traceRejected records the rejected candidates of a YAML file or
+// rendered manifest.
+func traceRejected(ctx context.Context, stage, name string, data []byte) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc interface{}
+		if err := dec.Decode(&doc); err != nil {
+			if err != io.EOF {
+				tracef(ctx, stage, "%s: not parsed, no images taken from it: %v", name, err)
+			}
+			return
+		}
+		var rejected []string
+		rejectedCandidates(doc, "", &rejected)
+		for _, r := range rejected {
+			tracef(ctx, stage, "%s: rejected %s", name, strings.TrimPrefix(r, "."))
+		}
+	}
+}
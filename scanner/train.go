@@ -0,0 +1,323 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxTrainCharts bounds the charts of one /train request.
+const maxTrainCharts = 200
+
+type trainRequest struct {
+	Charts []trainChart `json:"charts"`
+}
+
+// trainChart is one chart of a release train. From and To are /scan
+// bodies of the previous and next version; either is left out for a
+// chart that joins or leaves the train.
+type trainChart struct {
+	Name string          `json:"name"`
+	From json.RawMessage `json:"from,omitempty"`
+	To   json.RawMessage `json:"to,omitempty"`
+}
+
+// TrainReport is the image diff of a release train, per chart and for
+// the train as a whole.
+type TrainReport struct {
+	ScannedAt time.Time        `json:"scanned_at"`
+	Charts    []TrainChartDiff `json:"charts"`
+	// Added, Removed and Changed consolidate the charts: an image is only
+	// added when no chart of the train used it before.
+	Added   []TrainImage  `json:"added"`
+	Removed []TrainImage  `json:"removed"`
+	Changed []TrainChange `json:"changed"`
+	// SizeDeltaBytes is how much the compressed size of the train's
+	// distinct images grows, negative when it shrinks.
+	SizeDeltaBytes int64       `json:"size_delta_bytes"`
+	Dedup          *DedupStats `json:"dedup"`
+}
+
+// TrainChartDiff is the image diff of one chart. A chart whose scan of
+// either version failed carries the error and is left out of the
+// consolidated diff.
+type TrainChartDiff struct {
+	Name      string        `json:"name"`
+	From      string        `json:"from,omitempty"`
+	To        string        `json:"to,omitempty"`
+	Added     []string      `json:"added"`
+	Removed   []string      `json:"removed"`
+	Changed   []ImageChange `json:"changed"`
+	Unchanged []string      `json:"unchanged"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// TrainImage is an image added to or removed from the train, with the
+// charts that add or drop it.
+type TrainImage struct {
+	Image  string   `json:"image"`
+	Charts []string `json:"charts"`
+}
+
+type TrainChange struct {
+	ImageChange
+	Charts []string `json:"charts"`
+}
+
+// trainSide is one version of a chart to scan.
+type trainSide struct {
+	req    scanRequest
+	result *ScanResult
+	err    error
+}
+
+// trainHandler serves POST /train, which scans the previous and next
+// versions of every chart of a release train concurrently and diffs
+// their images.
+func (s *server) trainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	units, err := s.unitsFor(r)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var req trainRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	sides, err := s.decodeTrain(req)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	share := newDigestShare()
+	sem := make(chan struct{}, s.cfg.MaxScans)
+	var wg sync.WaitGroup
+	for _, pair := range sides {
+		for _, side := range pair {
+			if side == nil {
+				continue
+			}
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(side *trainSide) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				side.result, side.err = s.scanTrainSide(r.Context(), side.req, share)
+			}(side)
+		}
+	}
+	wg.Wait()
+	report := trainReport(req.Charts, sides)
+	report.Dedup = share.result()
+	writeSelected(w, report, nil, units)
+}
+
+// decodeTrain checks the request and decodes the /scan bodies of every
+// chart, returning the previous and next version of each.
+func (s *server) decodeTrain(req trainRequest) ([][2]*trainSide, error) {
+	switch {
+	case len(req.Charts) == 0:
+		return nil, errors.New("charts is required")
+	case len(req.Charts) > maxTrainCharts:
+		return nil, fmt.Errorf("at most %d charts per train", maxTrainCharts)
+	}
+	names := make(map[string]bool)
+	sides := make([][2]*trainSide, len(req.Charts))
+	for i, c := range req.Charts {
+		if c.Name == "" || names[c.Name] {
+			return nil, fmt.Errorf("chart %d: every chart needs a unique name", i)
+		}
+		names[c.Name] = true
+		if c.From == nil && c.To == nil {
+			return nil, fmt.Errorf("chart %s: from or to is required", c.Name)
+		}
+		for k, raw := range []json.RawMessage{c.From, c.To} {
+			if raw == nil {
+				continue
+			}
+			sr, err := s.decodeScanRequest(bytes.NewReader(raw))
+			if err == nil {
+				_, err = s.scanOptionsFor(sr, cacheControl{})
+			}
+			if err != nil {
+				return nil, fmt.Errorf("chart %s, %s: %w", c.Name, [2]string{"from", "to"}[k], err)
+			}
+			sides[i][k] = &trainSide{req: sr}
+		}
+	}
+	return sides, nil
+}
+
+func (s *server) scanTrainSide(ctx context.Context, req scanRequest, share *digestShare) (*ScanResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.ScanTimeout)
+	defer cancel()
+	source, _, err := s.resolveScanTarget(ctx, &req)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := s.scanOptionsFor(req, cacheControl{})
+	if err != nil {
+		return nil, err
+	}
+	opts.Share = share
+	result, err := s.scanChartForImages(ctx, req.ChartURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	result.Source = source
+	s.publish(result)
+	return result, nil
+}
+
+// foundImages is every image a scan found, inspected or not.
+func foundImages(result *ScanResult) []string {
+	if result == nil {
+		return nil
+	}
+	return append(append([]string(nil), result.Pinning.Pinned...), result.Pinning.Tagged...)
+}
+
+func trainReport(charts []trainChart, sides [][2]*trainSide) *TrainReport {
+	report := &TrainReport{ScannedAt: time.Now().UTC(), Charts: make([]TrainChartDiff, len(charts))}
+	fromCharts := make(map[string][]string)
+	toCharts := make(map[string][]string)
+	sizes := make(map[string]int64)
+	for i, c := range charts {
+		d := TrainChartDiff{Name: c.Name}
+		var from, to []string
+		failed := false
+		for k, side := range sides[i] {
+			if side == nil {
+				continue
+			}
+			if side.err != nil {
+				d.Error = fmt.Sprintf("scanning %s: %v", [2]string{"from", "to"}[k], side.err)
+				failed = true
+				continue
+			}
+			for _, info := range side.result.Images {
+				sizes[historyKey(info.Image)] = info.SizeBytes
+			}
+			if k == 0 {
+				d.From, from = side.result.ChartURL, foundImages(side.result)
+			} else {
+				d.To, to = side.result.ChartURL, foundImages(side.result)
+			}
+		}
+		if failed {
+			report.Charts[i] = d
+			continue
+		}
+		d.Added, d.Removed, d.Changed, d.Unchanged = diffImages(from, to)
+		report.Charts[i] = d
+		for _, img := range from {
+			fromCharts[img] = append(fromCharts[img], c.Name)
+		}
+		for _, img := range to {
+			toCharts[img] = append(toCharts[img], c.Name)
+		}
+	}
+
+	keys := func(m map[string][]string) []string {
+		out := make([]string, 0, len(m))
+		for k := range m {
+			out = append(out, k)
+		}
+		return out
+	}
+	added, removed, changed, _ := diffImages(keys(fromCharts), keys(toCharts))
+	report.Added = make([]TrainImage, 0, len(added))
+	for _, img := range added {
+		report.Added = append(report.Added, TrainImage{Image: img, Charts: toCharts[img]})
+	}
+	report.Removed = make([]TrainImage, 0, len(removed))
+	for _, img := range removed {
+		report.Removed = append(report.Removed, TrainImage{Image: img, Charts: fromCharts[img]})
+	}
+	report.Changed = make([]TrainChange, 0, len(changed))
+	for _, ch := range changed {
+		names := append([]string(nil), fromCharts[ch.From]...)
+		for _, n := range toCharts[ch.To] {
+			names = appendUnique(names, n)
+		}
+		report.Changed = append(report.Changed, TrainChange{ImageChange: ch, Charts: names})
+	}
+
+	distinct := func(m map[string][]string) int64 {
+		seen := make(map[string]bool)
+		var total int64
+		for img := range m {
+			if key := historyKey(img); !seen[key] {
+				seen[key] = true
+				total += sizes[key]
+			}
+		}
+		return total
+	}
+	report.SizeDeltaBytes = distinct(toCharts) - distinct(fromCharts)
+	return report
+}
+
+// diffImages compares two sets of references after normalising them.
+// References left over on both sides are paired by repository as
+// changes.
+func diffImages(from, to []string) (added, removed []string, changed []ImageChange, unchanged []string) {
+	added, removed, changed, unchanged = []string{}, []string{}, []ImageChange{}, []string{}
+	before := make(map[string]string, len(from))
+	for _, ref := range from {
+		before[historyKey(ref)] = ref
+	}
+	addedByRepo := make(map[string][]string)
+	for _, ref := range to {
+		key := historyKey(ref)
+		if _, ok := before[key]; ok {
+			delete(before, key)
+			unchanged = append(unchanged, ref)
+			continue
+		}
+		repo := repositoryOf(ref)
+		addedByRepo[repo] = append(addedByRepo[repo], ref)
+	}
+	removedByRepo := make(map[string][]string)
+	for _, ref := range before {
+		repo := repositoryOf(ref)
+		removedByRepo[repo] = append(removedByRepo[repo], ref)
+	}
+	for repo, refs := range addedByRepo {
+		old := removedByRepo[repo]
+		sort.Strings(refs)
+		sort.Strings(old)
+		for len(refs) > 0 && len(old) > 0 {
+			changed = append(changed, ImageChange{Repository: repo, From: old[0], To: refs[0]})
+			refs, old = refs[1:], old[1:]
+		}
+		added = append(added, refs...)
+		removedByRepo[repo] = old
+	}
+	for _, refs := range removedByRepo {
+		removed = append(removed, refs...)
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(unchanged)
+	sort.Slice(changed, func(i, j int) bool {
+		a, b := changed[i], changed[j]
+		if a.Repository != b.Repository {
+			return a.Repository < b.Repository
+		}
+		return a.To < b.To
+	})
+	return added, removed, changed, unchanged
+}
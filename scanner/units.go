@@ -0,0 +1,131 @@
+package scanner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// sizeUnits selects the human-readable sizes written next to every
+// *_bytes field of a response: binary (KiB, MiB, GiB) or decimal (kB, MB,
+// GB). Empty writes none; "none" is accepted for it, so that a request
+// can turn off the server's default.
+type sizeUnits string
+
+const (
+	unitsBinary  sizeUnits = "binary"
+	unitsDecimal sizeUnits = "decimal"
+)
+
+func parseSizeUnits(s string) (sizeUnits, error) {
+	switch u := sizeUnits(s); u {
+	case "", unitsBinary, unitsDecimal:
+		return u, nil
+	case "none":
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown units %q, want binary, decimal or none", s)
+}
+
+// unitsFor returns the units of the request's ?units= parameter, or the
+// server's -size-units.
+func (s *server) unitsFor(r *http.Request) (sizeUnits, error) {
+	if v := r.URL.Query().Get("units"); v != "" {
+		return parseSizeUnits(v)
+	}
+	return s.cfg.SizeUnits, nil
+}
+
+// format renders n bytes with one decimal, as in 117.7 MiB.
+func (u sizeUnits) format(n float64) string {
+	base, names := 1024.0, []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	if u == unitsDecimal {
+		base, names = 1000, []string{"B", "kB", "MB", "GB", "TB", "PB"}
+	}
+	i := 0
+	for ; n >= base && i < len(names)-1; i++ {
+		n /= base
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	return fmt.Sprintf("%.1f %s", n, names[i])
+}
+
+// humanize adds a "<name>_human" field after every numeric "<name>_bytes"
+// field of the JSON document data, keeping the order of the fields.
+func (u sizeUnits) humanize(data []byte) []byte {
+	if u == "" {
+		return data
+	}
+	var b bytes.Buffer
+	if err := u.humanizeValue(&b, data); err != nil {
+		return data
+	}
+	return b.Bytes()
+}
+
+func (u sizeUnits) humanizeValue(b *bytes.Buffer, raw []byte) error {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || (raw[0] != '{' && raw[0] != '[') {
+		b.Write(raw)
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if raw[0] == '[' {
+		var elems []json.RawMessage
+		if err := dec.Decode(&elems); err != nil {
+			return err
+		}
+		b.WriteByte('[')
+		for i, e := range elems {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			if err := u.humanizeValue(b, e); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(']')
+		return nil
+	}
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	b.WriteByte('{')
+	for first := true; dec.More(); first = false {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return err
+		}
+		key, _ := tok.(string)
+		if !first {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		b.Write(k)
+		b.WriteByte(':')
+		if err := u.humanizeValue(b, v); err != nil {
+			return err
+		}
+		if name, ok := strings.CutSuffix(key, "_bytes"); ok {
+			if n, err := strconv.ParseFloat(string(v), 64); err == nil {
+				k, _ := json.Marshal(name + "_human")
+				h, _ := json.Marshal(u.format(n))
+				b.WriteByte(',')
+				b.Write(k)
+				b.WriteByte(':')
+				b.Write(h)
+			}
+		}
+	}
+	b.WriteByte('}')
+	return nil
+}
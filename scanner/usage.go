@@ -0,0 +1,140 @@
+package scanner
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"runtime/metrics"
+	"time"
+)
+
+// usageInterval is how often the heap and goroutines are sampled for the
+// scans that are running.
+const usageInterval = 200 * time.Millisecond
+
+// ScanUsage is what one scan cost the scanner itself. Go cannot attribute
+// CPU time or memory to a scan, so those are measured for the process
+// while the scan ran and overlap with scans running at the same time;
+// DownloadedBytes is the scan's own.
+type ScanUsage struct {
+	CPUSeconds     float64 `json:"cpu_seconds"`
+	PeakHeapBytes  uint64  `json:"peak_heap_bytes"`
+	PeakGoroutines int     `json:"peak_goroutines"`
+	// DownloadedBytes counts the response bodies read for the scan:
+	// the chart, registry manifests and configs, and layers measured in
+	// deep mode.
+	DownloadedBytes int64 `json:"downloaded_bytes"`
+}
+
+// ProcessUsage is the scanner's consumption since startup, for /status.
+type ProcessUsage struct {
+	CPUSeconds      float64 `json:"cpu_seconds"`
+	HeapBytes       uint64  `json:"heap_bytes"`
+	Goroutines      int     `json:"goroutines"`
+	ScansFinished   int64   `json:"scans_finished"`
+	DownloadedBytes int64   `json:"downloaded_bytes"`
+}
+
+// heapSample reads the bytes of live and not yet swept heap objects,
+// without stopping the world as runtime.ReadMemStats does.
+func heapSample() uint64 {
+	s := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(s)
+	if s[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return s[0].Value.Uint64()
+}
+
+// observe records the current heap and goroutines as peaks of the job.
+func (j *scanJob) observe(heap uint64, goroutines int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stage == stageQueued {
+		return
+	}
+	if heap > j.peakHeap {
+		j.peakHeap = heap
+	}
+	if goroutines > j.peakGoroutines {
+		j.peakGoroutines = goroutines
+	}
+}
+
+// usage reports the job's consumption so far.
+func (j *scanJob) usage() *ScanUsage {
+	j.observe(heapSample(), runtime.NumGoroutine())
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	u := &ScanUsage{
+		PeakHeapBytes:   j.peakHeap,
+		PeakGoroutines:  j.peakGoroutines,
+		DownloadedBytes: j.downloaded.Load(),
+	}
+	if cpu := processCPU(); cpu > 0 {
+		u.CPUSeconds = roundSeconds(cpu - j.cpuStart)
+	}
+	return u
+}
+
+func roundSeconds(s float64) float64 {
+	return math.Round(s*1000) / 1000
+}
+
+// sampleUsage updates the peaks of running scans until the process
+// exits.
+func (t *scanTracker) sampleUsage() {
+	for range time.Tick(usageInterval) {
+		heap, goroutines := heapSample(), runtime.NumGoroutine()
+		t.mu.Lock()
+		for _, j := range t.scans {
+			j.observe(heap, goroutines)
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (t *scanTracker) processUsage() ProcessUsage {
+	return ProcessUsage{
+		CPUSeconds:      roundSeconds(processCPU()),
+		HeapBytes:       heapSample(),
+		Goroutines:      runtime.NumGoroutine(),
+		ScansFinished:   t.finished.Load(),
+		DownloadedBytes: t.downloaded.Load(),
+	}
+}
+
+type jobKey struct{}
+
+// jobFrom returns the scan a request is made for, if any.
+func jobFrom(ctx context.Context) *scanJob {
+	j, _ := ctx.Value(jobKey{}).(*scanJob)
+	return j
+}
+
+// countingTransport counts the response bytes read for each scan, found
+// by the scan job in the request's context.
+type countingTransport struct {
+	next http.RoundTripper
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := c.next.RoundTrip(req)
+	if j := jobFrom(req.Context()); j != nil && resp != nil && resp.Body != nil {
+		resp.Body = &countingBody{ReadCloser: resp.Body, job: j}
+	}
+	return resp, err
+}
+
+type countingBody struct {
+	io.ReadCloser
+	job *scanJob
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.job.downloaded.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package scanner
+
+import "syscall"
+
+// processCPU returns the user and system CPU time of the process, in
+// seconds.
+func processCPU() float64 {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return float64(ru.Utime.Nano()+ru.Stime.Nano()) / 1e9
+}
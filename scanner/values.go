@@ -0,0 +1,224 @@
+package scanner
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// bitnamiImageHelper is the library template Bitnami-style charts build
+// their image references with, from an image map in values and the
+// chart-wide globals.
+const bitnamiImageHelper = "common.images.image"
+
+// valuesImages holds the images derived from a chart's effective values
+// rather than read from its files.
+type valuesImages struct {
+	// images maps each reference to the pull secrets the chart would
+	// configure for it.
+	images map[string][]string
+	// valuesFiles are the archive paths of values.yaml files whose images
+	// are covered, so that they are not extracted a second time.
+	valuesFiles map[string]bool
+	// libraryTemplates are the template files of library charts, which
+	// Helm never renders on their own.
+	libraryTemplates map[string]bool
+	// origins records where in the effective values each image was found.
+	origins map[string][]ImageOrigin
+}
+
+// chartValuesImages builds the image references of every chart in the
+// tree found in files from the values it would be installed with: chart
+// defaults, parent chart overrides and user values, with globals flowing
+// down to subcharts and disabled subcharts left out.
+//
+// Charts that route image construction through the common.images.image
+// helper are read the way the helper assembles references: a digest
+// replaces the tag, a missing tag falls back to the chart's appVersion,
+// and pull secrets come from global.imagePullSecrets and the image's own
+// pullSecrets. Other charts are read with the usual extraction rules, and
+// their pull secrets are global.imagePullSecrets plus the chart's
+// imagePullSecrets. In both cases global.imageRegistry replaces the
+// registry of every image map.
+func chartValuesImages(files []chartFile, user map[string]interface{}) (*valuesImages, error) {
+	root, err := buildChartTree(files)
+	if err != nil {
+		return nil, err
+	}
+	out := &valuesImages{images: make(map[string][]string), valuesFiles: make(map[string]bool), libraryTemplates: make(map[string]bool), origins: make(map[string][]ImageOrigin)}
+	var list func(c *helmChart)
+	list = func(c *helmChart) {
+		out.valuesFiles[path.Join(c.dir, "values.yaml")] = true
+		if c.meta.Type == chartTypeLibrary {
+			for rel := range c.files {
+				if strings.HasPrefix(rel, "templates/") {
+					out.libraryTemplates[path.Join(c.dir, rel)] = true
+				}
+			}
+		}
+		for _, sub := range c.subcharts {
+			list(sub)
+		}
+	}
+	list(root)
+
+	var walk func(t *valuesTree, prefix string)
+	walk = func(t *valuesTree, prefix string) {
+		file := path.Join(t.chart.dir, "values.yaml")
+		origin := func(img, p, rule string, c *ImageConstruction) {
+			out.origins[img] = append(out.origins[img], ImageOrigin{Source: originValues, File: file, Path: p, Rule: rule, Construction: c})
+		}
+		global, _ := t.values["global"].(map[string]interface{})
+		// Values under a subchart's name are covered by that subchart.
+		own := make(map[string]interface{}, len(t.values))
+		for k, v := range t.values {
+			own[k] = v
+		}
+		for _, sub := range t.chart.subcharts {
+			name := sub.meta.Name
+			if dep, ok := t.chart.dependency(name); ok && dep.Alias != "" {
+				name = dep.Alias
+			}
+			delete(own, name)
+		}
+		if usesHelper(t.chart, bitnamiImageHelper) {
+			delete(own, "global")
+			appVersion := t.chart.meta.AppVersion
+			collectHelperImages(own, global, appVersion, strings.TrimSuffix(prefix, "."), func(ref, p string, m map[string]interface{}, secrets []string) {
+				out.images[ref] = mergeSecrets(out.images[ref], secrets)
+				origin(ref, p, ruleImageHelper, describeImageMap(m, p, valueString(global["imageRegistry"]), appVersion, true, ref))
+			})
+		} else {
+			secrets := mergeSecrets(pullSecrets(global["imagePullSecrets"]), pullSecrets(t.values["imagePullSecrets"]))
+			walkValuesImages(own, valueString(global["imageRegistry"]), strings.TrimSuffix(prefix, "."), func(img, p, rule string, c *ImageConstruction) {
+				out.images[img] = mergeSecrets(out.images[img], secrets)
+				origin(img, p, rule, c)
+			})
+		}
+		for _, sub := range t.subcharts {
+			walk(sub, prefix+sub.name+".")
+		}
+	}
+	walk(coalesceValues(root, user), "")
+	return out, nil
+}
+
+// usesHelper reports whether any of the chart's own templates calls the
+// named template.
+func usesHelper(c *helmChart, name string) bool {
+	for rel, data := range c.files {
+		if strings.HasPrefix(rel, "templates/") && strings.Contains(string(data), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// collectHelperImages finds image maps (a repository with a registry, tag
+// or digest) anywhere below v, which is at path p, and calls found with
+// each reference, its path, the map and its pull secrets.
+func collectHelperImages(v interface{}, global map[string]interface{}, appVersion, p string, found func(ref, path string, m map[string]interface{}, secrets []string)) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		if ref := helperImageRef(x, global, appVersion); ref != "" {
+			found(ref, p, x, mergeSecrets(pullSecrets(global["imagePullSecrets"]), pullSecrets(x["pullSecrets"])))
+			return
+		}
+		for k, child := range x {
+			sub := k
+			if p != "" {
+				sub = p + "." + k
+			}
+			collectHelperImages(child, global, appVersion, sub, found)
+		}
+	case []interface{}:
+		for i, child := range x {
+			collectHelperImages(child, global, appVersion, p+"["+strconv.Itoa(i)+"]", found)
+		}
+	}
+}
+
+// helperImageRef mirrors common.images.image for one image map.
+func helperImageRef(m map[string]interface{}, global map[string]interface{}, appVersion string) string {
+	repo, _ := m["repository"].(string)
+	if repo == "" {
+		return ""
+	}
+	_, hasReg := m["registry"]
+	_, hasTag := m["tag"]
+	_, hasDigest := m["digest"]
+	if !hasReg && !hasTag && !hasDigest {
+		return ""
+	}
+	reg := valueString(m["registry"])
+	if g := valueString(global["imageRegistry"]); g != "" {
+		reg = g
+	}
+	sep, term := ":", valueString(m["tag"])
+	if term == "" {
+		term = appVersion
+	}
+	if d := valueString(m["digest"]); d != "" {
+		sep, term = "@", d
+	}
+	ref := repo
+	if reg != "" {
+		ref = strings.TrimRight(reg, "/") + "/" + repo
+	}
+	if term != "" {
+		ref += sep + term
+	}
+	return ref
+}
+
+// valueString renders a scalar value as a template would; tags such as
+// 15 or 1.21 are often written unquoted.
+func valueString(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case bool, int, int64, float64:
+		return fmt.Sprint(x)
+	}
+	return ""
+}
+
+// pullSecrets reads a list of pull secrets written either as names or as
+// {name: ...} maps.
+func pullSecrets(v interface{}) []string {
+	list, _ := v.([]interface{})
+	var out []string
+	for _, e := range list {
+		switch x := e.(type) {
+		case string:
+			out = append(out, x)
+		case map[string]interface{}:
+			if n := valueString(x["name"]); n != "" {
+				out = append(out, n)
+			}
+		}
+	}
+	return out
+}
+
+func mergeSecrets(lists ...[]string) []string {
+	set := make(map[string]bool)
+	for _, l := range lists {
+		for _, s := range l {
+			set[s] = true
+		}
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	out := make([]string, 0, len(set))
+	for s := range set {
+		out = append(out, s)
+	}
+	sort.Strings(out)
+	return out
+}
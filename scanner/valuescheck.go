@@ -0,0 +1,130 @@
+package scanner
+
+import (
+	"sort"
+	"strings"
+)
+
+// ValuesRenderedReport reconciles the images of a chart's effective
+// values with those of its rendered manifests.
+type ValuesRenderedReport struct {
+	// NotRendered are images set in the values that no manifest uses:
+	// knobs left over from an old template, or images of a feature the
+	// values leave disabled.
+	NotRendered []ValuesImage `json:"not_rendered,omitempty"`
+	// NotInValues are rendered images that no value sets, hard-coded in
+	// a template or built from values in a way extraction does not see.
+	NotInValues []RenderedImage `json:"not_in_values,omitempty"`
+	Consistent  bool            `json:"consistent"`
+}
+
+type ValuesImage struct {
+	Image string `json:"image"`
+	// Paths are the paths of the values that set the image.
+	Paths []string `json:"paths"`
+}
+
+type RenderedImage struct {
+	Image string `json:"image"`
+	// Templates are the templates that render the image.
+	Templates []string `json:"templates"`
+	// Helpers are the library chart helpers that write it.
+	Helpers []string `json:"helpers,omitempty"`
+}
+
+// valuesRenderedReport compares the values and manifest origins of the
+// images in prov. References are compared in canonical form, since
+// templates often add the registry or tag a value leaves implicit.
+func valuesRenderedReport(prov map[string]*ImageProvenance) *ValuesRenderedReport {
+	inValues := make(map[string]bool)
+	rendered := make(map[string]bool)
+	for img, p := range prov {
+		for _, o := range p.Origins {
+			switch o.Source {
+			case originValues:
+				inValues[canonicalRef(img)] = true
+			case originManifest:
+				rendered[canonicalRef(img)] = true
+			}
+		}
+	}
+	report := &ValuesRenderedReport{}
+	for img, p := range prov {
+		var paths, templates []string
+		for _, o := range p.Origins {
+			switch o.Source {
+			case originValues:
+				paths = appendUnique(paths, o.Path)
+			case originManifest:
+				templates = appendUnique(templates, o.File)
+			}
+		}
+		key := canonicalRef(img)
+		if len(paths) > 0 && !rendered[key] {
+			report.NotRendered = append(report.NotRendered, ValuesImage{Image: img, Paths: paths})
+		}
+		if len(templates) > 0 && !inValues[key] {
+			report.NotInValues = append(report.NotInValues, RenderedImage{Image: img, Templates: templates})
+		}
+	}
+	sort.Slice(report.NotRendered, func(i, j int) bool { return report.NotRendered[i].Image < report.NotRendered[j].Image })
+	sort.Slice(report.NotInValues, func(i, j int) bool { return report.NotInValues[i].Image < report.NotInValues[j].Image })
+	report.Consistent = len(report.NotRendered) == 0 && len(report.NotInValues) == 0
+	return report
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, x := range list {
+		if x == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// HardcodedImage is an image written literally in a chart's templates
+// rather than set through values, so that it cannot be relocated to a
+// mirror without changing the chart.
+type HardcodedImage struct {
+	Image string `json:"image"`
+	// Templates are the templates the image appears in, as written or as
+	// rendered.
+	Templates []string `json:"templates"`
+	// Helpers are the library chart helpers that write it.
+	Helpers []string `json:"helpers,omitempty"`
+}
+
+// hardcodedImages lists the images of prov found in templates, raw or
+// rendered, that no value sets. References still holding template
+// actions, read from unrendered templates, are not literal and are
+// passed over.
+func hardcodedImages(prov map[string]*ImageProvenance) []HardcodedImage {
+	inValues := make(map[string]bool)
+	for img, p := range prov {
+		for _, o := range p.Origins {
+			if o.Source == originValues {
+				inValues[canonicalRef(img)] = true
+			}
+		}
+	}
+	var out []HardcodedImage
+	for img, p := range prov {
+		if inValues[canonicalRef(img)] || strings.Contains(img, "{{") {
+			continue
+		}
+		var templates, helpers []string
+		for _, o := range p.Origins {
+			if o.Source == originManifest || (o.Source == originFile && strings.Contains("/"+o.File, "/templates/")) {
+				templates = appendUnique(templates, o.File)
+			}
+			if o.Helper != "" {
+				helpers = appendUnique(helpers, o.Helper)
+			}
+		}
+		if len(templates) > 0 {
+			out = append(out, HardcodedImage{Image: img, Templates: templates, Helpers: helpers})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Image < out[j].Image })
+	return out
+}
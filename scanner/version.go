@@ -0,0 +1,250 @@
+package scanner
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// compareVersions orders two tags the way a person would read them:
+// numeric runs compare as numbers and everything else lexically, so
+// "1.10" > "1.9" and "7.2-alpine" > "6". A leading "v" is ignored. It
+// returns -1, 0 or 1.
+func compareVersions(a, b string) int {
+	ta, tb := versionTokens(a), versionTokens(b)
+	for i := 0; i < len(ta) && i < len(tb); i++ {
+		x, y := ta[i], tb[i]
+		nx, errx := strconv.ParseUint(x, 10, 64)
+		ny, erry := strconv.ParseUint(y, 10, 64)
+		switch {
+		case errx == nil && erry == nil:
+			if nx != ny {
+				if nx < ny {
+					return -1
+				}
+				return 1
+			}
+		case errx == nil:
+			return 1
+		case erry == nil:
+			return -1
+		default:
+			if c := strings.Compare(x, y); c != 0 {
+				return c
+			}
+		}
+	}
+	switch {
+	case len(ta) < len(tb):
+		return -1
+	case len(ta) > len(tb):
+		return 1
+	}
+	return 0
+}
+
+// versionTokens splits s into alternating numeric and non-numeric runs,
+// dropping separators.
+func versionTokens(s string) []string {
+	s = strings.TrimPrefix(strings.ToLower(s), "v")
+	var out []string
+	var cur strings.Builder
+	digit := false
+	flush := func() {
+		if cur.Len() > 0 {
+			out = append(out, cur.String())
+			cur.Reset()
+		}
+	}
+	for _, r := range s {
+		switch {
+		case unicode.IsDigit(r):
+			if !digit {
+				flush()
+			}
+			digit = true
+			cur.WriteRune(r)
+		case unicode.IsLetter(r):
+			if digit {
+				flush()
+			}
+			digit = false
+			cur.WriteRune(r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return out
+}
+
+// semVersion is a parsed semantic version. Missing minor or patch parts,
+// as in "1.29", parse as zero; wild records which parts were "x" or "*"
+// (or missing) so constraints can treat them as ranges.
+type semVersion struct {
+	major, minor, patch uint64
+	pre                 string
+	wild                int // number of trailing wildcard parts, 0-3
+}
+
+func parseSemver(s string) (semVersion, error) {
+	var v semVersion
+	orig := s
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		s, v.pre = s[:i], s[i+1:]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 || s == "" {
+		return v, fmt.Errorf("invalid semantic version %q", orig)
+	}
+	nums := []*uint64{&v.major, &v.minor, &v.patch}
+	for i := range nums {
+		if i >= len(parts) || parts[i] == "x" || parts[i] == "X" || parts[i] == "*" {
+			if v.wild == 0 {
+				v.wild = 3 - i
+			}
+			continue
+		}
+		if v.wild != 0 {
+			return v, fmt.Errorf("invalid semantic version %q", orig)
+		}
+		n, err := strconv.ParseUint(parts[i], 10, 64)
+		if err != nil {
+			return v, fmt.Errorf("invalid semantic version %q", orig)
+		}
+		*nums[i] = n
+	}
+	return v, nil
+}
+
+func (v semVersion) compare(o semVersion) int {
+	for _, p := range [][2]uint64{{v.major, o.major}, {v.minor, o.minor}, {v.patch, o.patch}} {
+		if p[0] != p[1] {
+			if p[0] < p[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case v.pre == o.pre:
+		return 0
+	case v.pre == "":
+		return 1
+	case o.pre == "":
+		return -1
+	}
+	return compareVersions(v.pre, o.pre)
+}
+
+// bump returns the smallest version above every version matched by the
+// first n parts of v, e.g. bump(1.2.3, 2) is 1.3.0. With n 0, as for
+// "*", it is above every version.
+func (v semVersion) bump(n int) semVersion {
+	switch n {
+	case 0:
+		return semVersion{major: math.MaxUint64}
+	case 1:
+		return semVersion{major: v.major + 1}
+	case 2:
+		return semVersion{major: v.major, minor: v.minor + 1}
+	}
+	return semVersion{major: v.major, minor: v.minor, patch: v.patch + 1}
+}
+
+// semverCompare reports whether version satisfies constraint, using the
+// constraint syntax Helm charts rely on: comparisons (=, !=, >, >=, <, <=),
+// tilde and caret ranges, x/* wildcards, comma- or space-separated AND and
+// "||" OR. As in Helm, a pre-release version only matches when the
+// constraint itself carries a pre-release (the common "-0" suffix).
+func semverCompare(constraint, version string) (bool, error) {
+	v, err := parseSemver(version)
+	if err != nil {
+		return false, err
+	}
+	for _, group := range strings.Split(constraint, "||") {
+		fields := strings.FieldsFunc(group, func(r rune) bool { return r == ',' || r == ' ' })
+		// Re-attach operators written with a space, as in ">= 1.19".
+		var terms []string
+		for i := 0; i < len(fields); i++ {
+			f := fields[i]
+			if strings.Trim(f, "=<>!~^") == "" && i+1 < len(fields) {
+				f += fields[i+1]
+				i++
+			}
+			terms = append(terms, f)
+		}
+		ok := len(terms) > 0
+		for _, t := range terms {
+			m, err := matchConstraint(t, v)
+			if err != nil {
+				return false, err
+			}
+			if !m {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func matchConstraint(term string, v semVersion) (bool, error) {
+	op := strings.TrimRight(term[:len(term)-len(strings.TrimLeft(term, "=<>!~^"))], " ")
+	c, err := parseSemver(term[len(op):])
+	if err != nil {
+		return false, err
+	}
+	if v.pre != "" && c.pre == "" {
+		return false, nil
+	}
+	fixed := 3 - c.wild
+	switch op {
+	case "", "=", "==":
+		if c.wild == 0 {
+			return v.compare(c) == 0, nil
+		}
+		return v.compare(c) >= 0 && v.compare(c.bump(fixed)) < 0, nil
+	case "!=":
+		if c.wild == 0 {
+			return v.compare(c) != 0, nil
+		}
+		return v.compare(c) < 0 || v.compare(c.bump(fixed)) >= 0, nil
+	case ">":
+		if c.wild != 0 {
+			return v.compare(c.bump(fixed)) >= 0, nil
+		}
+		return v.compare(c) > 0, nil
+	case ">=", "=>":
+		return v.compare(c) >= 0, nil
+	case "<":
+		return v.compare(c) < 0, nil
+	case "<=", "=<":
+		if c.wild != 0 {
+			return v.compare(c.bump(fixed)) < 0, nil
+		}
+		return v.compare(c) <= 0, nil
+	case "~", "~>":
+		n := 2
+		if fixed < 2 {
+			n = 1
+		}
+		return v.compare(c) >= 0 && v.compare(c.bump(n)) < 0, nil
+	case "^":
+		n := 1
+		if c.major == 0 && fixed >= 2 {
+			n = 2
+		}
+		return v.compare(c) >= 0 && v.compare(c.bump(n)) < 0, nil
+	}
+	return false, fmt.Errorf("unknown constraint operator %q", op)
+}
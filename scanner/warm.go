@@ -0,0 +1,134 @@
+package scanner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// warmRequest is the body of POST /cache/warm. Charts are scanned as with
+// /scan; images are resolved and inspected directly.
+type warmRequest struct {
+	Charts     []string `json:"charts"`
+	Images     []string `json:"images"`
+	Inspection string   `json:"inspection,omitempty"`
+	NoCache    bool     `json:"no_cache,omitempty"`
+}
+
+type warmResponse struct {
+	Charts []warmedChart `json:"charts"`
+	Images []warmedImage `json:"images"`
+	Cached int           `json:"cached"`
+	Failed int           `json:"failed"`
+	Dedup  *DedupStats   `json:"dedup"`
+}
+
+type warmedChart struct {
+	ChartURL string `json:"chart_url"`
+	Images   int    `json:"images"`
+	Error    string `json:"error,omitempty"`
+}
+
+type warmedImage struct {
+	Image  string `json:"image"`
+	Digest string `json:"digest,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (s *server) cacheWarmHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req warmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if len(req.Charts) == 0 && len(req.Images) == 0 {
+		jsonError(w, http.StatusBadRequest, "charts or images is required")
+		return
+	}
+	if s.cfg.CacheTTL <= 0 {
+		jsonError(w, http.StatusBadRequest, "the cache is disabled on this server")
+		return
+	}
+	opts, err := s.scanOptionsFor(scanRequest{Options: Options{Inspection: req.Inspection, NoCache: req.NoCache}}, cacheControl{})
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	opts.Share = newDigestShare()
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.ScanTimeout)
+	defer cancel()
+	resp := warmResponse{
+		Charts: make([]warmedChart, len(req.Charts)),
+		Images: s.warmImages(ctx, req.Images, opts),
+	}
+	var wg sync.WaitGroup
+	for i, chartURL := range req.Charts {
+		wg.Add(1)
+		go func(i int, chartURL string) {
+			defer wg.Done()
+			c := warmedChart{ChartURL: chartURL}
+			result, err := s.scanChartForImages(ctx, chartURL, opts)
+			if err != nil {
+				c.Error = err.Error()
+			} else {
+				c.Images = len(result.Images)
+			}
+			resp.Charts[i] = c
+		}(i, chartURL)
+	}
+	wg.Wait()
+
+	for _, c := range resp.Charts {
+		if c.Error != "" {
+			resp.Failed++
+		}
+		resp.Cached += c.Images
+	}
+	for _, img := range resp.Images {
+		if img.Error != "" {
+			resp.Failed++
+		} else {
+			resp.Cached++
+		}
+	}
+	resp.Dedup = opts.Share.result()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// warmImages inspects refs into the cache. Like a scan, it waits for a
+// scan slot so warming cannot crowd out interactive scans.
+func (s *server) warmImages(ctx context.Context, refs []string, opts scanOptions) []warmedImage {
+	out := make([]warmedImage, len(refs))
+	for i, ref := range refs {
+		out[i] = warmedImage{Image: ref}
+	}
+	if len(refs) == 0 {
+		return out
+	}
+	job, ctx, err := s.tracker.start(ctx, fmt.Sprintf("cache warm-up of %d images", len(refs)))
+	if err != nil {
+		for i := range out {
+			out[i].Error = fmt.Sprintf("waiting for a scan slot: %v", err)
+		}
+		return out
+	}
+	defer s.tracker.finish(job)
+	results := s.inspectAll(ctx, refs, opts, job, stageInspecting)
+	s.retryTransient(ctx, results, opts, job)
+	for i, r := range results {
+		if r.err != nil {
+			out[i].Error = r.err.Error()
+			continue
+		}
+		out[i].Digest = r.info.Digest
+	}
+	return out
+}
@@ -0,0 +1,246 @@
+package scanner
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Warning codes. Each is raised from one of the scan's reports, which
+// keeps the details; a warning only says what to look at.
+const (
+	warnMutableTag       = "MUTABLE_TAG"
+	warnStalePin         = "STALE_PIN"
+	warnRootUser         = "ROOT_USER"
+	warnLargeImage       = "LARGE_IMAGE"
+	warnNoPullSecret     = "NO_PULL_SECRET"
+	warnHardcodedImage   = "HARDCODED_IMAGE"
+	warnImageFailed      = "IMAGE_FAILED"
+	warnEgressBlocked    = "EGRESS_BLOCKED"
+	warnRenderFailed     = "RENDER_FAILED"
+	warnDeprecatedAPI    = "DEPRECATED_API"
+	warnMissingPlatform  = "MISSING_PLATFORM"
+	warnUndeclaredImage  = "UNDECLARED_IMAGE"
+	warnStaleDeclaration = "STALE_DECLARATION"
+	warnMirrorMissing    = "MIRROR_MISSING"
+	warnAppVersion       = "APP_VERSION_MISMATCH"
+	warnLibraryChart     = "LIBRARY_CHART"
+	warnEndOfLife        = "END_OF_LIFE"
+	warnBrokenLink       = "BROKEN_LINK"
+	warnImageLimit       = "IMAGE_LIMIT"
+)
+
+var warningCodes = []string{
+	warnMutableTag, warnStalePin, warnRootUser, warnLargeImage, warnNoPullSecret,
+	warnHardcodedImage, warnImageFailed, warnEgressBlocked, warnRenderFailed,
+	warnDeprecatedAPI, warnMissingPlatform, warnUndeclaredImage, warnStaleDeclaration,
+	warnMirrorMissing, warnAppVersion, warnLibraryChart, warnEndOfLife, warnBrokenLink,
+	warnImageLimit,
+}
+
+// defaultLargeImageBytes is the compressed size above which an image is
+// LARGE_IMAGE.
+const defaultLargeImageBytes = 1 << 30
+
+// ScanWarning is one finding of a scan worth a look, under a stable code
+// that suppression lists name.
+type ScanWarning struct {
+	Code string `json:"code"`
+	// Image or Registry is what the warning is about, when it is about
+	// one.
+	Image    string `json:"image,omitempty"`
+	Registry string `json:"registry,omitempty"`
+	Message  string `json:"message"`
+}
+
+// warningFilter suppresses the warnings of a code, optionally only those
+// about images under a registry or repository prefix.
+type warningFilter struct {
+	Code   string
+	Prefix string
+}
+
+// parseWarningFilters reads suppression entries, each a code or
+// CODE:<registry or repository prefix>, such as
+// MUTABLE_TAG:docker.io/library.
+func parseWarningFilters(list []string) ([]warningFilter, error) {
+	out := make([]warningFilter, 0, len(list))
+	for _, e := range list {
+		code, prefix, _ := strings.Cut(strings.TrimSpace(e), ":")
+		code = strings.ToUpper(code)
+		if !containsString(warningCodes, code) {
+			return nil, fmt.Errorf("unknown warning code %q, want one of %s", code, strings.Join(warningCodes, ", "))
+		}
+		f := warningFilter{Code: code}
+		if prefix = strings.TrimSuffix(prefix, "/"); prefix != "" {
+			f.Prefix = canonicalRegistry(prefix)
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+func (f warningFilter) matches(w ScanWarning) bool {
+	if f.Code != w.Code {
+		return false
+	}
+	switch {
+	case f.Prefix == "":
+		return true
+	case w.Image != "":
+		_, ok := matchRule(w.Image, []rewriteRule{{From: f.Prefix}})
+		return ok
+	default:
+		return w.Registry != "" && canonicalRegistry(w.Registry) == f.Prefix
+	}
+}
+
+// scanWarnings raises the warnings of a finished scan and drops those the
+// filters suppress, counting them per code. failed holds the inspection
+// error of every image that failed.
+func scanWarnings(result *ScanResult, failed map[string]error, opts scanOptions) ([]ScanWarning, map[string]int) {
+	var all []ScanWarning
+	add := func(code, image, format string, args ...interface{}) {
+		all = append(all, ScanWarning{Code: code, Image: image, Message: fmt.Sprintf(format, args...)})
+	}
+	if p := result.Pinning; p != nil {
+		for _, ref := range p.Tagged {
+			add(warnMutableTag, ref, "%s is referenced by a tag, which can be moved to other content", ref)
+		}
+		for _, ref := range p.Stale {
+			add(warnStalePin, ref, "the tag of %s no longer points at the pinned digest", ref)
+		}
+	}
+	for _, img := range result.Images {
+		if img.Kind != kindImage {
+			continue
+		}
+		if runsAsRoot(img.User) {
+			user := "no user"
+			if img.User != "" {
+				user = "user " + img.User
+			}
+			add(warnRootUser, img.Image, "%s sets %s and runs as root unless the pod sets runAsUser", img.Image, user)
+		}
+		if opts.LargeImageBytes > 0 && img.SizeBytes > opts.LargeImageBytes {
+			add(warnLargeImage, img.Image, "%s is %d bytes compressed, above %d", img.Image, img.SizeBytes, opts.LargeImageBytes)
+		}
+		if e := img.EOL; e != nil && e.Expired {
+			since := ""
+			if e.EOL != "true" {
+				since = " since " + e.EOL
+			}
+			add(warnEndOfLife, img.Image, "%s runs %s %s, out of support%s", img.Image, e.Product, e.Cycle, since)
+		}
+	}
+	refs := make([]string, 0, len(failed))
+	for ref := range failed {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	for _, ref := range refs {
+		add(warnImageFailed, ref, "%s could not be inspected: %v", ref, failed[ref])
+	}
+	for _, ref := range result.EgressBlocked {
+		add(warnEgressBlocked, ref, "%s is on a registry outside allowed_registries and was not inspected", ref)
+	}
+	if t := result.Truncation; t != nil {
+		for _, ref := range t.NotInspected {
+			add(warnImageLimit, ref, "%s was not inspected: %s", ref, t.Reason)
+		}
+	}
+	for _, h := range result.HardcodedImages {
+		where := strings.Join(h.Templates, ", ")
+		if len(h.Helpers) > 0 {
+			where += " by " + strings.Join(h.Helpers, ", ")
+		}
+		add(warnHardcodedImage, h.Image, "%s is written in %s and set by no value", h.Image, where)
+	}
+	if ps := result.PullSecrets; ps != nil {
+		for _, r := range ps.Registries {
+			if !r.Ready && len(r.WithoutSecret) > 0 {
+				all = append(all, ScanWarning{Code: warnNoPullSecret, Registry: r.Registry,
+					Message: fmt.Sprintf("%s name no pull secret for %s, which needed credentials", strings.Join(r.WithoutSecret, ", "), r.Registry)})
+			}
+		}
+	}
+	if result.RenderError != "" {
+		add(warnRenderFailed, "", "rendering failed, images were taken from the chart's files: %s", result.RenderError)
+	}
+	for _, d := range result.DeprecatedAPIs {
+		add(warnDeprecatedAPI, "", "%s %s in %s is deprecated in Kubernetes %s and removed in %s", d.APIVersion, d.Kind, d.Template, d.DeprecatedIn, d.RemovedIn)
+	}
+	if pr := result.Platforms; pr != nil {
+		for _, g := range pr.Missing {
+			add(warnMissingPlatform, g.Image, "%s has no build for %s", g.Image, strings.Join(g.Missing, ", "))
+		}
+	}
+	if d := result.DeclaredImages; d != nil {
+		for _, ref := range d.Undeclared {
+			add(warnUndeclaredImage, ref, "%s is missing from the artifacthub.io/images annotation", ref)
+		}
+		for _, s := range d.Stale {
+			add(warnStaleDeclaration, s.Image, "%s is declared in the artifacthub.io/images annotation but not used", s.Image)
+		}
+	}
+	if av := result.AppVersion; av != nil && !av.Matches {
+		add(warnAppVersion, av.Image, "%s is tagged %s but chart %s has appVersion %s", av.Image, av.Tag, av.Chart, av.AppVersion)
+	}
+	if l := result.Library; l != nil {
+		add(warnLibraryChart, "", "%s is a library chart, which installs nothing; its images are found by scanning a chart that uses it", l.Chart)
+	}
+	if lr := result.Links; lr != nil {
+		for _, l := range lr.Links {
+			if !l.Reachable {
+				add(warnBrokenLink, "", "the %s link %s of chart %s is not reachable: %s", l.Field, l.URL, lr.Chart, l.Error)
+			}
+		}
+	}
+	if rw := result.Rewrites; rw != nil {
+		for _, img := range rw.Images {
+			if !img.Exists {
+				add(warnMirrorMissing, img.Original, "the mirror does not serve %s as %s", img.Original, img.Rewritten)
+			}
+		}
+	}
+	rank := make(map[string]int, len(warningCodes))
+	for i, c := range warningCodes {
+		rank[c] = i
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].Code != all[j].Code {
+			return rank[all[i].Code] < rank[all[j].Code]
+		}
+		return all[i].Image < all[j].Image
+	})
+
+	warnings := make([]ScanWarning, 0, len(all))
+	var suppressed map[string]int
+	for _, w := range all {
+		if suppressedBy(w, opts.SuppressWarnings) {
+			if suppressed == nil {
+				suppressed = make(map[string]int)
+			}
+			suppressed[w.Code]++
+			continue
+		}
+		warnings = append(warnings, w)
+	}
+	return warnings, suppressed
+}
+
+func suppressedBy(w ScanWarning, filters []warningFilter) bool {
+	for _, f := range filters {
+		if f.matches(w) {
+			return true
+		}
+	}
+	return false
+}
+
+// runsAsRoot reports whether an image config's user is root, which an
+// unset user is.
+func runsAsRoot(user string) bool {
+	u, _, _ := strings.Cut(user, ":")
+	return u == "" || u == "0" || u == "root"
+}
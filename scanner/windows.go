@@ -0,0 +1,210 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scanWindow is a weekly time window in which bulk scans may run, at most
+// concurrency at a time.
+type scanWindow struct {
+	spec string
+	days [7]bool // by time.Weekday
+	// start and end are minutes of the day; an end at or before the start
+	// runs into the next day.
+	start, end  int
+	concurrency int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseScanWindows parses the -bulk-windows flag, a comma-separated list
+// of windows such as "Mon-Fri 22:00-06:00=4" or "Sat-Sun 00:00-24:00". The
+// days are a day, a range of days or *, and the concurrency after = is
+// optional and defaults to maxScans.
+func parseScanWindows(list []string, maxScans int) ([]scanWindow, error) {
+	var out []scanWindow
+	for _, spec := range list {
+		w := scanWindow{spec: spec, concurrency: maxScans}
+		rest, conc, ok := strings.Cut(spec, "=")
+		if ok {
+			n, err := strconv.Atoi(strings.TrimSpace(conc))
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid window %q: concurrency must be a positive number", spec)
+			}
+			w.concurrency = n
+		}
+		days, hours, ok := strings.Cut(strings.TrimSpace(rest), " ")
+		if !ok {
+			return nil, fmt.Errorf("invalid window %q, want <days> <HH:MM>-<HH:MM>[=concurrency]", spec)
+		}
+		if err := w.parseDays(days); err != nil {
+			return nil, fmt.Errorf("invalid window %q: %w", spec, err)
+		}
+		from, to, ok := strings.Cut(strings.TrimSpace(hours), "-")
+		var err error
+		if ok {
+			if w.start, err = parseClock(from); err == nil {
+				w.end, err = parseClock(to)
+			}
+		}
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid window %q: want hours as HH:MM-HH:MM", spec)
+		}
+		out = append(out, w)
+	}
+	return out, nil
+}
+
+func (w *scanWindow) parseDays(s string) error {
+	if s == "*" {
+		for d := range w.days {
+			w.days[d] = true
+		}
+		return nil
+	}
+	from, to, isRange := strings.Cut(s, "-")
+	first, ok := weekdays[strings.ToLower(from)]
+	if !ok {
+		return fmt.Errorf("unknown day %q", from)
+	}
+	last := first
+	if isRange {
+		if last, ok = weekdays[strings.ToLower(to)]; !ok {
+			return fmt.Errorf("unknown day %q", to)
+		}
+	}
+	for d := first; ; d = (d + 1) % 7 {
+		w.days[d] = true
+		if d == last {
+			return nil
+		}
+	}
+}
+
+// parseClock reads HH:MM as minutes of the day; 24:00 is the end of it.
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(strings.TrimSpace(s), ":")
+	hh, err1 := strconv.Atoi(h)
+	mm, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hh < 0 || mm < 0 || mm > 59 || hh > 24 || (hh == 24 && mm != 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return hh*60 + mm, nil
+}
+
+// contains reports whether t, in the calendar's time zone, lies in the
+// window. A window running past midnight belongs to the day it starts.
+func (w scanWindow) contains(t time.Time) bool {
+	now := t.Hour()*60 + t.Minute()
+	today, yesterday := t.Weekday(), (t.Weekday()+6)%7
+	if w.end > w.start {
+		return w.days[today] && now >= w.start && now < w.end
+	}
+	return (w.days[today] && now >= w.start) || (w.days[yesterday] && now < w.end)
+}
+
+// scanCalendar holds bulk scans, such as crawls, until one of its windows
+// is open, and runs no more of them at once than the open window allows.
+// Interactive scans are never held.
+type scanCalendar struct {
+	windows []scanWindow
+	loc     *time.Location
+
+	mu      sync.Mutex
+	running int
+	waiting int
+	changed chan struct{}
+}
+
+// BulkWindowStatus is the state of the bulk scan windows in /status.
+type BulkWindowStatus struct {
+	Open bool `json:"open"`
+	// Window is the open window and Concurrency the bulk scans it allows.
+	Window      string `json:"window,omitempty"`
+	Concurrency int    `json:"concurrency,omitempty"`
+	Running     int    `json:"running"`
+	Waiting     int    `json:"waiting"`
+}
+
+// newScanCalendar returns nil without windows, leaving bulk scans
+// unrestricted.
+func newScanCalendar(windows []scanWindow, loc *time.Location) *scanCalendar {
+	if len(windows) == 0 {
+		return nil
+	}
+	return &scanCalendar{windows: windows, loc: loc, changed: make(chan struct{})}
+}
+
+// open returns the open window at t allowing the most bulk scans.
+func (c *scanCalendar) open(t time.Time) (scanWindow, bool) {
+	t = t.In(c.loc)
+	var best scanWindow
+	found := false
+	for _, w := range c.windows {
+		if w.contains(t) && (!found || w.concurrency > best.concurrency) {
+			best, found = w, true
+		}
+	}
+	return best, found
+}
+
+// acquire waits until a window is open with room for another bulk scan
+// and returns the function that gives the room back. Windows are checked
+// again every minute and whenever a bulk scan finishes; a scan already
+// running when its window closes is left to finish.
+func (c *scanCalendar) acquire(ctx context.Context) (func(), error) {
+	if c == nil {
+		return func() {}, nil
+	}
+	c.mu.Lock()
+	c.waiting++
+	for {
+		if w, ok := c.open(time.Now()); ok && c.running < w.concurrency {
+			c.waiting--
+			c.running++
+			c.mu.Unlock()
+			return c.release, nil
+		}
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			c.mu.Lock()
+			c.waiting--
+			c.mu.Unlock()
+			return nil, ctx.Err()
+		case <-changed:
+		case <-time.After(time.Minute):
+		}
+		c.mu.Lock()
+	}
+}
+
+func (c *scanCalendar) release() {
+	c.mu.Lock()
+	c.running--
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.mu.Unlock()
+}
+
+func (c *scanCalendar) status() *BulkWindowStatus {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := &BulkWindowStatus{Running: c.running, Waiting: c.waiting}
+	if w, ok := c.open(time.Now()); ok {
+		st.Open, st.Window, st.Concurrency = true, w.spec, w.concurrency
+	}
+	return st
+}
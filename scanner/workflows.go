@@ -0,0 +1,271 @@
+package scanner
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Extraction rules of the workflow kinds.
+const (
+	// ruleWorkflowParameter is an image field whose parameter references
+	// were replaced with the values or defaults of the parameters.
+	ruleWorkflowParameter = "workflow-parameter"
+	// rulePodSpecPatch is an image of an Argo podSpecPatch, a pod spec
+	// written as a string.
+	rulePodSpecPatch = "pod-spec-patch"
+	// ruleTektonBundle is a Tekton bundle a taskRef or pipelineRef pulls
+	// from a registry.
+	ruleTektonBundle = "tekton-bundle"
+)
+
+var (
+	argoParamRe   = regexp.MustCompile(`\{\{\s*((?:workflow|inputs)\.parameters\.[\w.-]+)\s*\}\}`)
+	tektonParamRe = regexp.MustCompile(`\$\((?:params|inputs\.params)(?:\.([\w.-]+)|\[['"]([^'"]+)['"]\])\)`)
+)
+
+// documentExtractor returns the extractor for the kind of a manifest whose
+// images are written in shapes the generic extraction misreads, or nil:
+// the workflow kinds below and the custom resources of crdImageFields.
+// An extractor reports every image of the document.
+func documentExtractor(d map[string]interface{}) func(d map[string]interface{}, found func(img, path, rule string)) {
+	if f, ok := crdFieldsOf(d); ok {
+		return f.extract
+	}
+	group, _, _ := strings.Cut(valueString(d["apiVersion"]), "/")
+	switch kind := manifestKind(d); group {
+	case "argoproj.io":
+		switch kind {
+		case "Workflow", "WorkflowTemplate", "ClusterWorkflowTemplate", "CronWorkflow":
+			return argoImages
+		}
+	case "tekton.dev":
+		switch kind {
+		case "Task", "ClusterTask", "Pipeline", "TaskRun", "PipelineRun":
+			return tektonImages
+		}
+	}
+	return nil
+}
+
+// argoImages extracts the images of an Argo workflow. Parameter references
+// in images are replaced with the workflow's arguments and the inputs of
+// the template they appear in; an image whose parameters have neither a
+// value nor a default is left out, since it is only known when the
+// workflow is submitted.
+func argoImages(d map[string]interface{}, found func(img, path, rule string)) {
+	prefix := "spec"
+	spec, _ := d["spec"].(map[string]interface{})
+	if manifestKind(d) == "CronWorkflow" {
+		prefix += ".workflowSpec"
+		spec, _ = spec["workflowSpec"].(map[string]interface{})
+	}
+	if spec == nil {
+		walkImages(d, "", "", found)
+		return
+	}
+	global := make(map[string]string)
+	addParams(global, "workflow.parameters.", lookupValue(spec, "arguments.parameters"), nil)
+	resolve := func(params map[string]string) func(string) (string, bool) {
+		return func(s string) (string, bool) { return substitute(s, argoParamRe, params) }
+	}
+
+	templates := prefix + ".templates["
+	walkImages(d, "", "", func(img, path, rule string) {
+		if !strings.HasPrefix(path, templates) {
+			resolved(img, path, rule, resolve(global), found)
+		}
+	})
+	if p, ok := spec["podSpecPatch"].(string); ok {
+		patchImages(p, prefix+".podSpecPatch", resolve(global), found)
+	}
+	list, _ := spec["templates"].([]interface{})
+	for i, t := range list {
+		tmpl, _ := t.(map[string]interface{})
+		if tmpl == nil {
+			continue
+		}
+		params := make(map[string]string, len(global))
+		for k, v := range global {
+			params[k] = v
+		}
+		addParams(params, "inputs.parameters.", lookupValue(tmpl, "inputs.parameters"), resolve(global))
+		p := templates + strconv.Itoa(i) + "]"
+		walkImages(tmpl, "", p, func(img, path, rule string) {
+			resolved(img, path, rule, resolve(params), found)
+		})
+		if patch, ok := tmpl["podSpecPatch"].(string); ok {
+			patchImages(patch, p+".podSpecPatch", resolve(params), found)
+		}
+	}
+}
+
+// patchImages extracts the images of a podSpecPatch, which may be YAML or
+// JSON.
+func patchImages(patch, path string, resolve func(string) (string, bool), found func(img, path, rule string)) {
+	var node interface{}
+	if yaml.Unmarshal([]byte(patch), &node) != nil {
+		return
+	}
+	walkImages(node, "", path, func(img, p, _ string) {
+		if img, ok := resolve(img); ok {
+			found(img, p, rulePodSpecPatch)
+		}
+	})
+}
+
+// tektonImages extracts the images of a Tekton task, pipeline or run, and
+// the bundles its task and pipeline references pull. Parameter references
+// are replaced with the values the document passes, or the defaults it
+// declares.
+func tektonImages(d map[string]interface{}, found func(img, path, rule string)) {
+	values := make(map[string]string)
+	defaults := make(map[string]string)
+	visitMaps(d, "", func(m map[string]interface{}, _ string) {
+		list, _ := m["params"].([]interface{})
+		for _, e := range list {
+			p, _ := e.(map[string]interface{})
+			name := valueString(p["name"])
+			if name == "" {
+				continue
+			}
+			// A value passing on a parameter of its own is no value.
+			if v, ok := p["value"].(string); ok && !tektonParamRe.MatchString(v) {
+				if _, seen := values[name]; !seen {
+					values[name] = v
+				}
+			}
+			if v, ok := p["default"].(string); ok {
+				if _, seen := defaults[name]; !seen {
+					defaults[name] = v
+				}
+			}
+		}
+	})
+	for k, v := range defaults {
+		if _, ok := values[k]; !ok {
+			values[k] = v
+		}
+	}
+	resolve := func(s string) (string, bool) { return substitute(s, tektonParamRe, values) }
+
+	walkImages(d, "", "", func(img, path, rule string) {
+		resolved(img, path, rule, resolve, found)
+	})
+	visitMaps(d, "", func(m map[string]interface{}, path string) {
+		for _, field := range []string{"taskRef", "pipelineRef"} {
+			ref, _ := m[field].(map[string]interface{})
+			if ref == nil {
+				continue
+			}
+			p := joinPath(path, field)
+			if b, ok := ref["bundle"].(string); ok {
+				if b, ok := resolve(b); ok {
+					found(b, p+".bundle", ruleTektonBundle)
+				}
+			}
+			if valueString(ref["resolver"]) != "bundles" {
+				continue
+			}
+			list, _ := ref["params"].([]interface{})
+			for i, e := range list {
+				param, _ := e.(map[string]interface{})
+				if valueString(param["name"]) != "bundle" {
+					continue
+				}
+				if b, ok := resolve(valueString(param["value"])); ok && b != "" {
+					found(b, p+".params["+strconv.Itoa(i)+"].value", ruleTektonBundle)
+				}
+			}
+		}
+	})
+}
+
+// resolved reports img with its parameter references resolved, marking
+// the rule of an image that had any.
+func resolved(img, path, rule string, resolve func(string) (string, bool), found func(img, path, rule string)) {
+	out, ok := resolve(img)
+	if !ok {
+		return
+	}
+	if out != img {
+		rule = ruleWorkflowParameter
+	}
+	found(out, path, rule)
+}
+
+// substitute replaces the parameter references matched by re in s. It
+// fails when a parameter is unknown. The name is the first non-empty
+// group of the match. A string still holding template actions once
+// replaced is an unrendered chart template and is returned as it is.
+func substitute(s string, re *regexp.Regexp, params map[string]string) (string, bool) {
+	if !re.MatchString(s) {
+		return s, true
+	}
+	ok := true
+	out := re.ReplaceAllStringFunc(s, func(m string) string {
+		var name string
+		for _, g := range re.FindStringSubmatch(m)[1:] {
+			if g != "" {
+				name = g
+				break
+			}
+		}
+		v, known := params[name]
+		if !known {
+			ok = false
+		}
+		return v
+	})
+	if strings.Contains(out, "{{") {
+		return s, true
+	}
+	return out, ok
+}
+
+// addParams adds a list of Argo parameters to params under prefix, taking
+// the value of each or else its default, resolved with resolve when set.
+func addParams(params map[string]string, prefix string, list interface{}, resolve func(string) (string, bool)) {
+	entries, _ := list.([]interface{})
+	for _, e := range entries {
+		p, _ := e.(map[string]interface{})
+		name := valueString(p["name"])
+		v, ok := p["value"].(string)
+		if !ok {
+			v, ok = p["default"].(string)
+		}
+		if name == "" || !ok {
+			continue
+		}
+		if resolve != nil {
+			if v, ok = resolve(v); !ok {
+				continue
+			}
+		}
+		params[prefix+name] = v
+	}
+}
+
+// visitMaps calls fn for every map below node with its YAML path.
+func visitMaps(node interface{}, path string, fn func(m map[string]interface{}, path string)) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		fn(v, path)
+		for k, child := range v {
+			visitMaps(child, joinPath(path, k), fn)
+		}
+	case []interface{}:
+		for i, e := range v {
+			visitMaps(e, path+"["+strconv.Itoa(i)+"]", fn)
+		}
+	}
+}
+
+func joinPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
@@ -0,0 +1,154 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// workspaceCheckInterval is how often the disk use of a workspace is
+// measured against its quota.
+const workspaceCheckInterval = 200 * time.Millisecond
+
+var errWorkspaceQuota = errors.New("workspace quota exceeded")
+
+// workspaces hands out the directories scans write to disk in, such as
+// Git clones: one per scan below the work directory, at most max at a
+// time, each held to quota bytes and removed when the scan ends. They are
+// named after the process, so a restarted server sweeps what a crashed
+// one left behind.
+type workspaces struct {
+	root  string
+	quota int64
+	slots chan struct{}
+}
+
+func openWorkspaces(root string, quota int64, max int) (*workspaces, error) {
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, fmt.Errorf("creating work directory: %w", err)
+	}
+	return &workspaces{root: root, quota: quota, slots: make(chan struct{}, max)}, nil
+}
+
+// sweep removes the workspaces of processes that are gone, and any of this
+// process's id, which can only be left from an earlier process that had the
+// same id, such as PID 1 of a restarted container.
+func (w *workspaces) sweep() {
+	entries, err := os.ReadDir(w.root)
+	if err != nil {
+		log.Printf("warning: sweeping workspaces: %v", err)
+		return
+	}
+	removed := 0
+	for _, e := range entries {
+		pid, ok := workspacePID(e.Name())
+		if !ok || (pid != os.Getpid() && processAlive(pid)) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(w.root, e.Name())); err != nil {
+			log.Printf("warning: removing stale workspace %s: %v", e.Name(), err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("Removed %d workspaces left behind in %s", removed, w.root)
+	}
+}
+
+// workspacePID parses the process id out of a workspace's name.
+func workspacePID(name string) (int, bool) {
+	rest, ok := strings.CutPrefix(name, "ws-")
+	if !ok {
+		return 0, false
+	}
+	digits, _, ok := strings.Cut(rest, "-")
+	pid, err := strconv.Atoi(digits)
+	return pid, ok && err == nil && pid > 0
+}
+
+// workspace is the directory of one scan.
+type workspace struct {
+	dir    string
+	quota  int64
+	parent *workspaces
+}
+
+// create waits for a free slot and makes a workspace, which must be
+// closed.
+func (w *workspaces) create(ctx context.Context) (*workspace, error) {
+	select {
+	case w.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for a workspace: %w", ctx.Err())
+	}
+	dir, err := os.MkdirTemp(w.root, fmt.Sprintf("ws-%d-", os.Getpid()))
+	if err != nil {
+		<-w.slots
+		return nil, fmt.Errorf("creating workspace: %w", err)
+	}
+	return &workspace{dir: dir, quota: w.quota, parent: w}, nil
+}
+
+// Close removes the workspace and frees its slot.
+func (ws *workspace) Close() error {
+	err := os.RemoveAll(ws.dir)
+	<-ws.parent.slots
+	return err
+}
+
+// guard returns a context that is cancelled once the workspace holds more
+// than its quota, and a stop function that ends the measuring and returns
+// errWorkspaceQuota if the workspace outgrew its quota.
+func (ws *workspace) guard(ctx context.Context) (context.Context, func() error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(workspaceCheckInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if ws.used() > ws.quota {
+					cancel(errWorkspaceQuota)
+					return
+				}
+			}
+		}
+	}()
+	return ctx, func() error {
+		close(done)
+		err := context.Cause(ctx)
+		cancel(nil)
+		if errors.Is(err, errWorkspaceQuota) || ws.used() > ws.quota {
+			return fmt.Errorf("%w: more than %d bytes", errWorkspaceQuota, ws.quota)
+		}
+		return nil
+	}
+}
+
+// used sums the sizes of the files in the workspace.
+func (ws *workspace) used() int64 {
+	var n int64
+	filepath.WalkDir(ws.dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			n += info.Size()
+		}
+		return nil
+	})
+	return n
+}
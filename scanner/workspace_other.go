@@ -0,0 +1,7 @@
+//go:build !unix
+
+package scanner
+
+// processAlive cannot probe processes on this platform, so every workspace
+// left in the work directory is swept at startup.
+func processAlive(pid int) bool { return false }
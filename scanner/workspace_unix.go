@@ -0,0 +1,14 @@
+//go:build unix
+
+package scanner
+
+import (
+	"errors"
+	"syscall"
+)
+
+// processAlive reports whether a process with the id is running.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}